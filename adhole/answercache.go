@@ -0,0 +1,317 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"encoding/binary"
+	"expvar"
+	"log"
+	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Answer cache counters.
+var (
+	cntCacheHits   = expvar.NewInt("statsCacheHits")
+	cntCacheMisses = expvar.NewInt("statsCacheMisses")
+	cntPrefetched  = expvar.NewInt("statsPrefetched")
+	cntCacheFloor  = expvar.NewInt("statsCacheFloored")
+	cntSFHits      = expvar.NewInt("statsServfailHits")
+	// cntPrefetchJoined counts client queries that got the answer to a
+	// prefetch of the same question and id.
+	cntPrefetchJoined = expvar.NewInt("statsPrefetchJoined")
+)
+
+// evictSample is the number of entries evict looks at.
+const evictSample = 16
+
+// cacheEntry is a cached upstream answer.
+type cacheEntry struct {
+	answer  []byte    // the answer as received (after TTL clamping)
+	query   []byte    // the query that produced it, used for prefetching
+	stored  time.Time // when the answer was received
+	expires time.Time // when the record with the lowest TTL expires
+	hits    int64     // number of times the entry was served
+}
+
+// answerCache caches upstream answers keyed by cacheKey.
+type answerCache struct {
+	mu      sync.Mutex
+	entries map[string]*cacheEntry
+	size    int
+	top     int           // size of the current prefetch set
+	minTTL  time.Duration // floor for the lifetime of positive answers
+	sfTTL   time.Duration // lifetime of SERVFAIL answers, 0 - not cached
+}
+
+// cache is the answer cache, nil if disabled.
+var cache *answerCache
+
+// newAnswerCache returns an empty cache for up to size answers. Answers are
+// kept for at least minTTL, and SERVFAILs for sfTTL.
+func newAnswerCache(size int, minTTL, sfTTL time.Duration) *answerCache {
+	c := &answerCache{
+		entries: make(map[string]*cacheEntry, size),
+		size:    size,
+		minTTL:  minTTL,
+		sfTTL:   sfTTL,
+	}
+	expvar.Publish("cache", expvar.Func(func() interface{} {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return map[string]int{"entries": len(c.entries), "prefetchSet": c.top}
+	}))
+	return c
+}
+
+// cacheKey identifies the answers to a query: the lowercase name, type,
+// class, and the EDNS and DO state, as those change the answer's content.
+func cacheKey(host string, msg []byte, end int) string {
+	var b strings.Builder
+	b.WriteString(strings.ToLower(host))
+	b.WriteByte('/')
+	b.WriteString(strconv.Itoa(int(binary.BigEndian.Uint16(msg[end-4:]))))
+	b.WriteByte('/')
+	b.WriteString(strconv.Itoa(int(binary.BigEndian.Uint16(msg[end-2:]))))
+	if edns, do := queryEDNS(msg); edns {
+		b.WriteString("/edns")
+		if do {
+			b.WriteString("/do")
+		}
+	}
+	if msg[3]&flagCD != 0 {
+		b.WriteString("/cd")
+	}
+	return b.String()
+}
+
+// answerTTL returns the lowest TTL of the records in an answer, if it has
+// any.
+func answerTTL(answer []byte) (uint32, bool) {
+	min, found := uint32(0), false
+	err := walkRecords(answer, func(rrtype uint16, off int) {
+		if rrtype == typeOPT {
+			return
+		}
+		ttl := binary.BigEndian.Uint32(answer[off+4:])
+		if !found || ttl < min {
+			min, found = ttl, true
+		}
+	})
+	return min, err == nil && found
+}
+
+// store caches an answer for key. Successful and NXDOMAIN answers that carry
+// records are kept until the lowest TTL runs out, but at least minTTL.
+// SERVFAILs are kept for sfTTL.
+func (c *answerCache) store(key string, answer, query []byte) {
+	if len(answer) < headerLen || answer[2]&0x02 != 0 {
+		return // truncated
+	}
+	var life time.Duration
+	switch answer[3] & 0x0f {
+	case 0, rcodeNXDomain:
+		ttl, ok := answerTTL(answer)
+		if !ok {
+			return
+		}
+		life = time.Duration(ttl) * time.Second
+		if life < c.minTTL {
+			life = c.minTTL
+			cntCacheFloor.Add(1)
+		}
+	case rcodeServFail:
+		life = c.sfTTL
+	}
+	if life <= 0 {
+		return
+	}
+	now := time.Now()
+	entry := &cacheEntry{
+		answer:  append([]byte(nil), answer...),
+		query:   query,
+		stored:  now,
+		expires: now.Add(life),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if old, ok := c.entries[key]; ok {
+		entry.hits = old.hits // keep the popularity of refreshed entries
+	} else if len(c.entries) >= c.size {
+		c.evict(now)
+	}
+	c.entries[key] = entry
+}
+
+// evict makes room for one entry by looking at a few entries in random
+// order: the expired ones among them go, otherwise the least popular, the
+// one expiring first of equals. It must be called with c locked.
+func (c *answerCache) evict(now time.Time) {
+	victim, seen := "", 0
+	var worst *cacheEntry
+	for key, entry := range c.entries {
+		if seen++; seen > evictSample {
+			break
+		}
+		if !now.Before(entry.expires) {
+			delete(c.entries, key)
+			continue
+		}
+		if worst == nil || entry.hits < worst.hits ||
+			entry.hits == worst.hits && entry.expires.Before(worst.expires) {
+			victim, worst = key, entry
+		}
+	}
+	if len(c.entries) >= c.size && worst != nil {
+		delete(c.entries, victim)
+	}
+}
+
+// get returns the cached answer for key made into a reply to the query in
+// msg, with the TTLs reduced by the time spent in the cache (but not below
+// zero), or nil.
+func (c *answerCache) get(key string, msg []byte, end int) []byte {
+	now := time.Now()
+	c.mu.Lock()
+	entry, ok := c.entries[key]
+	if ok && !now.Before(entry.expires) {
+		delete(c.entries, key)
+		ok = false
+	}
+	if !ok {
+		c.mu.Unlock()
+		return nil
+	}
+	entry.hits++
+	reply := append([]byte(nil), entry.answer...)
+	age := uint32(now.Sub(entry.stored) / time.Second)
+	c.mu.Unlock()
+
+	// The question is copied from the query to preserve its ID and case.
+	copy(reply[:2], msg[:2])
+	copy(reply[headerLen:end], msg[headerLen:end])
+	// RD and CD are the query's, AD stays as the upstream set it.
+	setFlag(reply, flagRD, msg[2]&0x01 != 0)
+	setFlag(reply, flagCD, msg[3]&0x10 != 0)
+	walkRecords(reply, func(rrtype uint16, off int) {
+		if rrtype != typeOPT {
+			ttl := binary.BigEndian.Uint32(reply[off+4:])
+			if ttl > age {
+				ttl -= age
+			} else {
+				ttl = 0
+			}
+			binary.BigEndian.PutUint32(reply[off+4:], ttl)
+		}
+	})
+	if reply[3]&0x0f == rcodeServFail {
+		cntSFHits.Add(1)
+	}
+	return reply
+}
+
+// has tells if there is an unexpired answer for key. Unlike get it doesn't
+// count as a hit.
+func (c *answerCache) has(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	return ok && time.Now().Before(entry.expires)
+}
+
+// runPrefetch re-queries the most popular entries shortly before they
+// expire, so clients don't have to wait for the upstream.
+func (c *answerCache) runPrefetch(top int, minHits int64, margin time.Duration, rate int) {
+	interval := time.Second / time.Duration(rate)
+	for {
+		time.Sleep(time.Second)
+
+		type candidate struct {
+			key   string
+			entry *cacheEntry
+		}
+		var popular []candidate
+		now := time.Now()
+		c.mu.Lock()
+		for key, entry := range c.entries {
+			if entry.hits >= minHits {
+				popular = append(popular, candidate{key, entry})
+			}
+		}
+		sort.Slice(popular, func(i, j int) bool {
+			return popular[i].entry.hits > popular[j].entry.hits
+		})
+		if len(popular) > top {
+			popular = popular[:top]
+		}
+		c.top = len(popular)
+		var due [][]byte
+		for _, p := range popular {
+			if left := p.entry.expires.Sub(now); left > 0 && left <= margin {
+				due = append(due, p.entry.query)
+				// Popularity has to be earned again for the next round.
+				p.entry.hits = 0
+			}
+		}
+		c.mu.Unlock()
+
+		for _, msg := range due {
+			prefetch(msg)
+			time.Sleep(interval)
+		}
+	}
+}
+
+// prefetch sends a copy of a query upstream to refresh its cached answer.
+func prefetch(orig []byte) {
+	if cacheQuery(orig) {
+		if *flagVerbose {
+			host, _, _, _ := parseQuestion(orig)
+			log.Println("DNS: Prefetching", logHost(host, false))
+		}
+		cntPrefetched.Add(1)
+	}
+}
+
+// cacheQuery sends a copy of a query upstream with a fresh id, and tells if
+// it was sent. The answer only updates the cache.
+func cacheQuery(orig []byte) bool {
+	msg := append([]byte(nil), orig...)
+	host, _, end, err := parseQuestion(msg)
+	if err != nil {
+		return false
+	}
+	ctx, cancel := queryContext()
+	conn, stats, err := upstreamFor(ctx, host)
+	if err != nil {
+		cancel()
+		return false
+	}
+	q := &query{Host: host, Key: cacheKey(host, msg, end), Upstream: stats, Start: time.Now(), Ctx: ctx, Cancel: cancel, Msg: msg}
+	for tries := 0; ; tries++ {
+		id := rand.Intn(1 << 16)
+		if queries.addNew(id, q) {
+			binary.BigEndian.PutUint16(msg, uint16(id))
+			break
+		}
+		if tries == 10 {
+			cancel()
+			return false
+		}
+	}
+	id := int(binary.BigEndian.Uint16(msg))
+	if _, err := conn.Write(msg); err != nil {
+		logLimited("DNS ERROR (7): %s\n", err)
+		cntErrors.Add(1)
+		queries.remove(id, q)
+		return false
+	}
+	q.Upstream.sent()
+	queries.timeout(id, q)
+	return true
+}
@@ -0,0 +1,135 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"testing"
+	"time"
+)
+
+// testEntry returns a cache entry expiring after life with hits hits.
+func testEntry(now time.Time, life time.Duration, hits int64) *cacheEntry {
+	return &cacheEntry{stored: now, expires: now.Add(life), hits: hits}
+}
+
+func TestEvict(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name    string
+		entries map[string]*cacheEntry
+		left    []string
+	}{
+		{"expired first", map[string]*cacheEntry{
+			"old":     testEntry(now, -time.Second, 100),
+			"popular": testEntry(now, time.Hour, 50),
+			"unused":  testEntry(now, time.Hour, 0),
+		}, []string{"popular", "unused"}},
+		{"least popular", map[string]*cacheEntry{
+			"a": testEntry(now, time.Hour, 3),
+			"b": testEntry(now, time.Hour, 1),
+			"c": testEntry(now, time.Hour, 2),
+		}, []string{"a", "c"}},
+		{"expiring first of equals", map[string]*cacheEntry{
+			"soon":  testEntry(now, time.Minute, 1),
+			"later": testEntry(now, time.Hour, 1),
+		}, []string{"later"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := &answerCache{entries: tt.entries, size: len(tt.entries)}
+			c.evict(now)
+			if len(c.entries) != len(tt.left) {
+				t.Errorf("%d entries left, want %d", len(c.entries), len(tt.left))
+			}
+			for _, key := range tt.left {
+				if c.entries[key] == nil {
+					t.Errorf("%s evicted", key)
+				}
+			}
+		})
+	}
+}
+
+// TestEvictBounded checks that eviction looks at a few entries only, however
+// large the cache.
+func TestEvictBounded(t *testing.T) {
+	now := time.Now()
+	c := &answerCache{entries: make(map[string]*cacheEntry), size: 100000}
+	for i := 0; i < c.size; i++ {
+		// All expired: a full scan would empty the cache.
+		c.entries[fmt.Sprint(i)] = testEntry(now, -time.Second, 0)
+	}
+	c.evict(now)
+	if gone := c.size - len(c.entries); gone < 1 || gone > evictSample {
+		t.Errorf("%d entries evicted, want 1 to %d", gone, evictSample)
+	}
+}
+
+func BenchmarkCacheStoreFull(b *testing.B) {
+	c := &answerCache{entries: make(map[string]*cacheEntry), size: 100000}
+	answer := answerVector(b, "cname-chain")
+	query := testQuery("www.microsoft.com.", typeA)
+	for i := 0; i < c.size; i++ {
+		c.store(fmt.Sprint(i), answer, query)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.store(fmt.Sprint(c.size+i), answer, query)
+	}
+}
+
+// upstreamQueries counts the queries of n clients asking the same question
+// in a row that have to go upstream, each answered with answer.
+func upstreamQueries(c *answerCache, query, answer []byte, n int) int {
+	_, _, end, _ := parseQuestion(query)
+	key := cacheKey("www.microsoft.com.", query, end)
+	sent := 0
+	for i := 0; i < n; i++ {
+		if c.get(key, query, end) == nil {
+			sent++
+			c.store(key, answer, query)
+		}
+	}
+	return sent
+}
+
+func TestCacheFloorAndServfail(t *testing.T) {
+	query := testQuery("www.microsoft.com.", typeA)
+	_, _, end, _ := parseQuestion(query)
+	servfail := finishReply(newReply(query, end, rcodeServFail), query)
+	zeroTTL := answerVector(t, "cname-chain")
+	walkRecords(zeroTTL, func(rrtype uint16, off int) {
+		if rrtype != typeOPT {
+			binary.BigEndian.PutUint32(zeroTTL[off+4:], 0)
+		}
+	})
+
+	tests := []struct {
+		name          string
+		minTTL, sfTTL time.Duration
+		answer        []byte
+		sent          int
+		floored       int64
+	}{
+		{"TTL 0", 0, 0, zeroTTL, 100, 0},
+		{"TTL 0 floored", 30 * time.Second, 0, zeroTTL, 1, 1},
+		{"TTL 20", 0, 0, answerVector(t, "cname-chain"), 1, 0},
+		{"SERVFAIL", 0, 0, servfail, 100, 0},
+		{"SERVFAIL micro-cached", 0, 5 * time.Second, servfail, 1, 0},
+		// The floor is for answers with records only.
+		{"SERVFAIL not floored", 30 * time.Second, 0, servfail, 100, 0},
+	}
+	for _, tt := range tests {
+		floored := cntCacheFloor.Value()
+		c := testCache(10, tt.minTTL, tt.sfTTL)
+		if sent := upstreamQueries(c, query, tt.answer, 100); sent != tt.sent {
+			t.Errorf("%s: %d of 100 queries sent upstream, want %d", tt.name, sent, tt.sent)
+		}
+		if n := cntCacheFloor.Value() - floored; n != tt.floored {
+			t.Errorf("%s: %d answers floored, want %d", tt.name, n, tt.floored)
+		}
+	}
+}
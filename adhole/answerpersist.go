@@ -0,0 +1,164 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// The answer cache file keeps the cached answers across restarts.
+//
+// Layout (all integers big endian):
+// 4  - Magic    = "AHAC"
+// 2  - Version  = answerFileVersion
+// 4  - Count    - number of entries that follow
+// ?  - Entries  - key, answer and query as uvarint length and bytes each,
+// stored and expires time (UnixNano, 8 bytes each), and the hit count (uvarint)
+// 32 - Checksum - sha256 of everything above
+var (
+	answerFileMagic   = []byte("AHAC")
+	answerFileVersion = uint16(1)
+)
+
+// load fills the cache from the file at path, skipping expired
+// entries and those that don't fit. It returns the number of entries loaded.
+func (c *answerCache) load(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	if len(data) < len(answerFileMagic)+2+4+sha256.Size {
+		return 0, errors.New("cache file too short")
+	}
+	body, sum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	if check := sha256.Sum256(body); !bytes.Equal(check[:], sum) {
+		return 0, errors.New("cache file checksum mismatch")
+	}
+	if !bytes.Equal(body[:4], answerFileMagic) {
+		return 0, errors.New("not a cache file")
+	}
+	if v := binary.BigEndian.Uint16(body[4:]); v != answerFileVersion {
+		return 0, fmt.Errorf("cache file version %d not supported", v)
+	}
+	count := int(binary.BigEndian.Uint32(body[6:]))
+	body = body[10:]
+
+	bytesField := func() ([]byte, error) {
+		length, n := binary.Uvarint(body)
+		if n <= 0 || uint64(len(body)-n) < length {
+			return nil, errors.New("cache entry truncated")
+		}
+		field := body[n : n+int(length)]
+		body = body[n+int(length):]
+		return field, nil
+	}
+
+	now := time.Now()
+	loaded := 0
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := 0; i < count; i++ {
+		key, err := bytesField()
+		if err != nil {
+			return loaded, err
+		}
+		answer, err := bytesField()
+		if err != nil {
+			return loaded, err
+		}
+		query, err := bytesField()
+		if err != nil {
+			return loaded, err
+		}
+		if len(body) < 16 {
+			return loaded, errors.New("cache entry truncated")
+		}
+		stored := time.Unix(0, int64(binary.BigEndian.Uint64(body)))
+		expires := time.Unix(0, int64(binary.BigEndian.Uint64(body[8:])))
+		body = body[16:]
+		hits, n := binary.Uvarint(body)
+		if n <= 0 {
+			return loaded, errors.New("cache entry truncated")
+		}
+		body = body[n:]
+
+		if !now.Before(expires) || len(c.entries) >= c.size {
+			continue
+		}
+		c.entries[string(key)] = &cacheEntry{
+			answer:  append([]byte(nil), answer...),
+			query:   append([]byte(nil), query...),
+			stored:  stored,
+			expires: expires,
+			hits:    int64(hits),
+		}
+		loaded++
+	}
+	if len(body) != 0 {
+		return loaded, errors.New("cache file has trailing data")
+	}
+	return loaded, nil
+}
+
+// save writes the unexpired cache entries to the file at path. The file is
+// written to a temporary name first so a crash never leaves a partial file.
+func (c *answerCache) save(path string) (int, error) {
+	now := time.Now()
+	var body bytes.Buffer
+	buf := make([]byte, binary.MaxVarintLen64)
+	bytesField := func(field []byte) {
+		n := binary.PutUvarint(buf, uint64(len(field)))
+		body.Write(buf[:n])
+		body.Write(field)
+	}
+
+	count := 0
+	c.mu.Lock()
+	for key, entry := range c.entries {
+		if !now.Before(entry.expires) {
+			continue
+		}
+		bytesField([]byte(key))
+		bytesField(entry.answer)
+		bytesField(entry.query)
+		body.Write(binary.BigEndian.AppendUint64(nil, uint64(entry.stored.UnixNano())))
+		body.Write(binary.BigEndian.AppendUint64(nil, uint64(entry.expires.UnixNano())))
+		n := binary.PutUvarint(buf, uint64(entry.hits))
+		body.Write(buf[:n])
+		count++
+	}
+	c.mu.Unlock()
+
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return 0, err
+	}
+	hash := sha256.New()
+	w := bufio.NewWriter(io.MultiWriter(file, hash))
+	header := make([]byte, 0, 10)
+	header = append(header, answerFileMagic...)
+	header = binary.BigEndian.AppendUint16(header, answerFileVersion)
+	header = binary.BigEndian.AppendUint32(header, uint32(count))
+	w.Write(header)
+	w.Write(body.Bytes())
+	if err = w.Flush(); err == nil {
+		_, err = file.Write(hash.Sum(nil))
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return count, os.Rename(tmp, path)
+}
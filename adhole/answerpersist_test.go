@@ -0,0 +1,130 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testCache returns an empty cache for size answers.
+func testCache(size int, minTTL, sfTTL time.Duration) *answerCache {
+	return &answerCache{entries: make(map[string]*cacheEntry), size: size, minTTL: minTTL, sfTTL: sfTTL}
+}
+
+// fillCache stores an answer for each of the answerVectors and returns
+// the keys.
+func fillCache(tb testing.TB, c *answerCache) []string {
+	tb.Helper()
+	var keys []string
+	for name := range answerVectors {
+		answer := answerVector(tb, name)
+		_, _, end, err := parseQuestion(answer)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		key := cacheKey(name, answer, end)
+		c.store(key, answer, answer[:end])
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestAnswerCacheRoundTrip(t *testing.T) {
+	c := testCache(100, 0, 0)
+	keys := fillCache(t, c)
+	c.entries[keys[0]].hits = 42
+	// An expired entry isn't saved.
+	c.entries["expired"] = &cacheEntry{answer: []byte{0}, stored: time.Now().Add(-time.Hour), expires: time.Now().Add(-time.Minute)}
+
+	path := filepath.Join(t.TempDir(), "cache.bin")
+	saved, err := c.save(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved != len(keys) {
+		t.Errorf("saved %d entries, want %d", saved, len(keys))
+	}
+
+	loaded := testCache(100, 0, 0)
+	n, err := loaded.load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != len(keys) || len(loaded.entries) != len(keys) {
+		t.Errorf("loaded %d entries, %d in the cache, want %d", n, len(loaded.entries), len(keys))
+	}
+	for _, key := range keys {
+		want, got := c.entries[key], loaded.entries[key]
+		if got == nil {
+			t.Errorf("%s: not loaded", key)
+			continue
+		}
+		if !bytes.Equal(got.answer, want.answer) || !bytes.Equal(got.query, want.query) ||
+			!got.stored.Equal(want.stored) || !got.expires.Equal(want.expires) || got.hits != want.hits {
+			t.Errorf("%s: loaded %+v, want %+v", key, got, want)
+		}
+	}
+
+	// Loading into a smaller cache stops when it's full.
+	small := testCache(2, 0, 0)
+	if n, err := small.load(path); err != nil || n != 2 || len(small.entries) != 2 {
+		t.Errorf("loading into a cache for 2: %d loaded, %d in the cache, %v", n, len(small.entries), err)
+	}
+}
+
+// reseal replaces the checksum at the end of a cache file after changing
+// it, so the file passes the checksum.
+func reseal(data []byte) []byte {
+	body := data[:len(data)-sha256.Size]
+	sum := sha256.Sum256(body)
+	return append(append([]byte(nil), body...), sum[:]...)
+}
+
+func TestAnswerCacheDamaged(t *testing.T) {
+	c := testCache(100, 0, 0)
+	fillCache(t, c)
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.bin")
+	if _, err := c.save(good); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(good)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		damage func(data []byte) []byte
+	}{
+		{"empty", func(data []byte) []byte { return nil }},
+		{"cut short", func(data []byte) []byte { return data[:len(data)/2] }},
+		{"flipped bit", func(data []byte) []byte { data[20] ^= 1; return data }},
+		{"magic", func(data []byte) []byte { data[0] = 'X'; return reseal(data) }},
+		{"version", func(data []byte) []byte { data[5]++; return reseal(data) }},
+		{"count too high", func(data []byte) []byte {
+			binary.BigEndian.PutUint32(data[6:], 1000)
+			return reseal(data)
+		}},
+		{"trailing data", func(data []byte) []byte {
+			body := append(data[:len(data)-sha256.Size:len(data)-sha256.Size], 0)
+			return reseal(append(body, make([]byte, sha256.Size)...))
+		}},
+	}
+	for _, tt := range tests {
+		path := filepath.Join(dir, "damaged.bin")
+		damaged := tt.damage(append([]byte(nil), data...))
+		if err := os.WriteFile(path, damaged, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := testCache(100, 0, 0).load(path); err == nil {
+			t.Errorf("%s: no error", tt.name)
+		}
+	}
+}
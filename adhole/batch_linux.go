@@ -0,0 +1,161 @@
+// See LICENSE.txt for licensing information.
+//go:build linux && !386
+// +build linux,!386
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// batchSupported tells if readBatch and writeBatch use a single syscall.
+const batchSupported = true
+
+// mmsghdr mirrors struct mmsghdr used by recvmmsg(2) and sendmmsg(2).
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// batch holds the buffers and headers for batched socket operations, so
+// they can be reused between calls.
+type batch struct {
+	pkts  []packet
+	msgs  []mmsghdr
+	iovs  []syscall.Iovec
+	names []syscall.RawSockaddrInet4
+	oobs  [][]byte
+}
+
+// newBatch prepares a batch of size packets of bufSize bytes each.
+func newBatch(size, bufSize int) *batch {
+	b := &batch{
+		pkts:  make([]packet, size),
+		msgs:  make([]mmsghdr, size),
+		iovs:  make([]syscall.Iovec, size),
+		names: make([]syscall.RawSockaddrInet4, size),
+		oobs:  make([][]byte, size),
+	}
+	for i := range b.pkts {
+		b.pkts[i].buf = make([]byte, bufSize)
+		b.oobs[i] = make([]byte, pktinfoSpace)
+	}
+	return b
+}
+
+// prepare points the headers at the first count packets.
+func (b *batch) prepare(count int, read bool) {
+	for i := 0; i < count; i++ {
+		p := &b.pkts[i]
+		msg := &b.msgs[i]
+		*msg = mmsghdr{}
+		if read {
+			b.iovs[i].Base = &p.buf[0]
+			b.iovs[i].SetLen(len(p.buf))
+			msg.hdr.Control = &b.oobs[i][0]
+			msg.hdr.SetControllen(len(b.oobs[i]))
+		} else {
+			b.iovs[i].Base = &p.buf[0]
+			b.iovs[i].SetLen(p.n)
+			name := &b.names[i]
+			name.Family = syscall.AF_INET
+			port := (*[2]byte)(unsafe.Pointer(&name.Port))
+			port[0] = byte(p.addr.Port >> 8)
+			port[1] = byte(p.addr.Port)
+			copy(name.Addr[:], p.addr.IP.To4())
+			if p.dst != nil {
+				copy(b.oobs[i], pktinfoSource(p.dst))
+				msg.hdr.Control = &b.oobs[i][0]
+				msg.hdr.SetControllen(len(b.oobs[i]))
+			}
+		}
+		msg.hdr.Name = (*byte)(unsafe.Pointer(&b.names[i]))
+		msg.hdr.Namelen = syscall.SizeofSockaddrInet4
+		msg.hdr.Iov = &b.iovs[i]
+		msg.hdr.Iovlen = 1
+	}
+}
+
+// readBatch reads at least one and up to len(b.pkts) packets with a single
+// recvmmsg call and returns the number of packets read.
+func readBatch(conn *net.UDPConn, b *batch) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	b.prepare(len(b.pkts), true)
+
+	var count int
+	var errno syscall.Errno
+	err = raw.Read(func(fd uintptr) bool {
+		r, _, e := syscall.Syscall6(syscall.SYS_RECVMMSG, fd,
+			uintptr(unsafe.Pointer(&b.msgs[0])), uintptr(len(b.msgs)),
+			syscall.MSG_DONTWAIT, 0, 0)
+		if e == syscall.EAGAIN {
+			return false
+		}
+		count, errno = int(r), e
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, &net.OpError{Op: "recvmmsg", Net: "udp", Err: errno}
+	}
+
+	for i := 0; i < count; i++ {
+		p := &b.pkts[i]
+		name := &b.names[i]
+		p.n = int(b.msgs[i].len)
+		p.trunc = b.msgs[i].hdr.Flags&syscall.MSG_TRUNC != 0
+		port := (*[2]byte)(unsafe.Pointer(&name.Port))
+		p.addr = &net.UDPAddr{
+			IP:   net.IPv4(name.Addr[0], name.Addr[1], name.Addr[2], name.Addr[3]).To4(),
+			Port: int(port[0])<<8 | int(port[1]),
+		}
+		p.dst = nil
+		if oobn := int(b.msgs[i].hdr.Controllen); oobn > 0 {
+			p.dst = parsePktinfo(b.oobs[i][:oobn])
+		}
+	}
+	return count, nil
+}
+
+// writeBatch sends the first count packets with as few sendmmsg calls as
+// possible.
+func writeBatch(conn *net.UDPConn, b *batch, count int) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	b.prepare(count, false)
+
+	sent := 0
+	var errno syscall.Errno
+	err = raw.Write(func(fd uintptr) bool {
+		for sent < count {
+			r, _, e := syscall.Syscall6(sysSendmmsg, fd,
+				uintptr(unsafe.Pointer(&b.msgs[sent])), uintptr(count-sent),
+				syscall.MSG_DONTWAIT, 0, 0)
+			if e == syscall.EAGAIN {
+				return false
+			}
+			if e != 0 {
+				errno = e
+				return true
+			}
+			sent += int(r)
+		}
+		return true
+	})
+	if err != nil {
+		return sent, err
+	}
+	if errno != 0 {
+		return sent, &net.OpError{Op: "sendmmsg", Net: "udp", Err: errno}
+	}
+	return sent, nil
+}
@@ -0,0 +1,6 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+// sysSendmmsg is missing from the syscall package on amd64.
+const sysSendmmsg = 307
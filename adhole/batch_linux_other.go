@@ -0,0 +1,11 @@
+// See LICENSE.txt for licensing information.
+//go:build linux && !amd64 && !386
+// +build linux,!amd64,!386
+
+package main
+
+import (
+	"syscall"
+)
+
+const sysSendmmsg = syscall.SYS_SENDMMSG
@@ -0,0 +1,53 @@
+// See LICENSE.txt for licensing information.
+//go:build !linux || 386
+// +build !linux 386
+
+package main
+
+import (
+	"net"
+)
+
+// batchSupported tells if readBatch and writeBatch use a single syscall.
+const batchSupported = false
+
+// batch holds the buffers for batched socket operations.
+type batch struct {
+	pkts []packet
+}
+
+// newBatch prepares a batch of size packets of bufSize bytes each.
+func newBatch(size, bufSize int) *batch {
+	b := &batch{pkts: make([]packet, size)}
+	for i := range b.pkts {
+		b.pkts[i].buf = make([]byte, bufSize)
+	}
+	return b
+}
+
+// readBatch reads a single packet, as there is no batch API. A packet
+// filling its buffer counts as cut off, as not all systems tell.
+func readBatch(conn *net.UDPConn, b *batch) (int, error) {
+	p := &b.pkts[0]
+	n, addr, err := conn.ReadFromUDP(p.buf)
+	if err != nil {
+		return 0, err
+	}
+	p.n, p.addr, p.trunc = n, addr, n == len(p.buf)
+	return 1, nil
+}
+
+// writeBatch sends the first count packets one by one.
+func writeBatch(conn *net.UDPConn, b *batch, count int) (int, error) {
+	for i := 0; i < count; i++ {
+		p := &b.pkts[i]
+		var oob []byte
+		if p.dst != nil {
+			oob = pktinfoSource(p.dst)
+		}
+		if _, _, err := conn.WriteMsgUDP(p.buf[:p.n], oob, p.addr); err != nil {
+			return i, err
+		}
+	}
+	return count, nil
+}
@@ -0,0 +1,177 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"testing"
+)
+
+// udpPair returns a socket and a client connected to it.
+func udpPair(tb testing.TB) (server, client *net.UDPConn) {
+	tb.Helper()
+	server, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	client, err = net.DialUDP("udp4", nil, server.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	server.SetReadBuffer(1 << 20)
+	client.SetReadBuffer(1 << 20)
+	tb.Cleanup(func() {
+		server.Close()
+		client.Close()
+	})
+	return server, client
+}
+
+func TestBatchRoundTrip(t *testing.T) {
+	server, client := udpPair(t)
+	const count = 5
+	out := newBatch(count, 0)
+	for i := range out.pkts {
+		msg := testQuery(fmt.Sprintf("q%d.example.com.", i), typeA)
+		out.pkts[i] = packet{buf: msg, n: len(msg), addr: client.LocalAddr().(*net.UDPAddr)}
+	}
+	if sent, err := writeBatch(server, out, count); sent != count || err != nil {
+		t.Fatalf("sent %d of %d: %v", sent, count, err)
+	}
+
+	buf := make([]byte, 512)
+	for i := 0; i < count; i++ {
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf[:n], out.pkts[i].buf) {
+			t.Errorf("packet %d differs", i)
+		}
+		client.Write(buf[:n])
+	}
+
+	in := newBatch(count, 512)
+	for got := 0; got < count; {
+		n, err := readBatch(server, in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range in.pkts[:n] {
+			if !bytes.Equal(p.buf[:p.n], out.pkts[got].buf) {
+				t.Errorf("packet %d read back differs", got)
+			}
+			if !p.addr.IP.Equal(net.IPv4(127, 0, 0, 1)) || p.addr.Port != client.LocalAddr().(*net.UDPAddr).Port {
+				t.Errorf("packet %d from %s", got, p.addr)
+			}
+			got++
+		}
+	}
+}
+
+// BenchmarkRead compares reading queries one per system call with
+// ReadFromUDP, as before -batch, and with readBatch, which reads up to
+// -batch packets with one recvmmsg where supported. Both include sending
+// the queries, which costs the same for both.
+func BenchmarkRead(b *testing.B) {
+	msg := testQuery("www.example.com.", typeA)
+	const burst = 32
+	b.Run("ReadFromUDP", func(b *testing.B) {
+		server, client := udpPair(b)
+		buf := make([]byte, 512)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i += burst {
+			for j := 0; j < burst; j++ {
+				client.Write(msg)
+			}
+			for j := 0; j < burst; j++ {
+				if _, _, err := server.ReadFromUDP(buf); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run(fmt.Sprintf("readBatch=%d", burst), func(b *testing.B) {
+		server, client := udpPair(b)
+		in := newBatch(burst, 512)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i += burst {
+			for j := 0; j < burst; j++ {
+				client.Write(msg)
+			}
+			for got := 0; got < burst; {
+				n, err := readBatch(server, in)
+				if err != nil {
+					b.Fatal(err)
+				}
+				got += n
+			}
+		}
+	})
+}
+
+// BenchmarkWrite compares relaying answers one per system call and with
+// writeBatch, which sends them with as few sendmmsg calls as possible.
+func BenchmarkWrite(b *testing.B) {
+	msg := testQuery("www.example.com.", typeA)
+	const burst = 32
+	b.Run("WriteToUDP", func(b *testing.B) {
+		server, client := udpPair(b)
+		to := client.LocalAddr().(*net.UDPAddr)
+		buf := make([]byte, 512)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i += burst {
+			for j := 0; j < burst; j++ {
+				server.WriteToUDP(msg, to)
+			}
+			for j := 0; j < burst; j++ {
+				client.Read(buf)
+			}
+		}
+	})
+	b.Run(fmt.Sprintf("writeBatch=%d", burst), func(b *testing.B) {
+		server, client := udpPair(b)
+		out := newBatch(burst, 0)
+		for i := range out.pkts {
+			out.pkts[i] = packet{buf: msg, n: len(msg), addr: client.LocalAddr().(*net.UDPAddr)}
+		}
+		buf := make([]byte, 512)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i += burst {
+			if _, err := writeBatch(server, out, burst); err != nil {
+				b.Fatal(err)
+			}
+			for j := 0; j < burst; j++ {
+				client.Read(buf)
+			}
+		}
+	})
+}
+
+// TestBatchCutOff checks that packets larger than their buffer are marked.
+func TestBatchCutOff(t *testing.T) {
+	server, client := udpPair(t)
+	sizes := []int{100, 511, 600, 4000}
+	for _, size := range sizes {
+		client.Write(make([]byte, size))
+	}
+	in := newBatch(len(sizes), 512)
+	for got := 0; got < len(sizes); {
+		n, err := readBatch(server, in)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, p := range in.pkts[:n] {
+			size := sizes[got]
+			if want := size > 512; p.trunc != want {
+				t.Errorf("%d bytes: cut off %v, want %v", size, p.trunc, want)
+			}
+			if p.n != min(size, 512) {
+				t.Errorf("%d bytes: read %d", size, p.n)
+			}
+			got++
+		}
+	}
+}
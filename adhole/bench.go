@@ -0,0 +1,77 @@
+// See LICENSE.txt for licensing information.
+//go:build bench
+// +build bench
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"math/rand"
+	"os"
+	"testing"
+)
+
+// The bench subcommand is only built with -tags bench, so that the server
+// doesn't carry the testing package.
+func init() {
+	subcommands["bench"] = runBench
+}
+
+// runBench measures the operations on the query fast path against a list,
+// generated or given, and fails if any allocates more than it did when the
+// baseline in the README was taken.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ContinueOnError)
+	rules := fs.Int("rules", 100000, "number of names in the generated list")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s bench [options] [list.txt...]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	names := benchNames(rnd, *rules)
+	var rs *ruleSet
+	if fs.NArg() > 0 {
+		var err error
+		if rs, _, err = loadLists(fs.Args()); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			return 2
+		}
+		names = names[:0]
+		for name := range rs.blocked {
+			names = append(names, name)
+		}
+	} else {
+		rs = benchRules(names)
+	}
+	if len(names) == 0 {
+		fmt.Fprintln(os.Stderr, "ERROR: no blocked names to look up")
+		return 2
+	}
+
+	ops := hotPath(rnd, rs, names)
+
+	fmt.Printf("%d blocked names\n\n", len(rs.blocked))
+	fmt.Printf("%-14s %10s %10s %10s\n", "operation", "ns/op", "allocs/op", "allowed")
+	code := 0
+	for _, op := range ops {
+		res := testing.Benchmark(func(b *testing.B) {
+			for n := 0; n < b.N; n++ {
+				op.run()
+			}
+		})
+		allocs := testing.AllocsPerRun(1000, op.run)
+		fmt.Printf("%-14s %10d %10.0f %10.0f\n", op.name, res.NsPerOp(), allocs, op.max)
+		if allocs > op.max {
+			code = 1
+		}
+	}
+	if code != 0 {
+		fmt.Println("\nFAIL: more allocations than allowed")
+	}
+	return code
+}
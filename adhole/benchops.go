@@ -0,0 +1,95 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+)
+
+// benchOp is one of the operations done for every query.
+type benchOp struct {
+	name string
+	max  float64 // allocations allowed per run
+	run  func()
+}
+
+// hotPath returns the operations done for every query, run against rs on
+// queries for subdomains of its blocked names, and for names not blocked.
+// It resets the decision cache for rs.
+func hotPath(rnd *rand.Rand, rs *ruleSet, names []string) []benchOp {
+	hits := make([]string, 1024)
+	misses := make([]string, len(hits))
+	msgs := make([][]byte, len(hits))
+	ends := make([]int, len(hits))
+	for i := range hits {
+		hits[i] = "cdn" + fmt.Sprint(i) + "." + names[rnd.Intn(len(names))]
+		misses[i] = fmt.Sprintf("www.site%d.example.org.", rnd.Intn(1e6))
+		msgs[i] = benchQuery(hits[i])
+		_, _, ends[i], _ = parseQuestion(msgs[i])
+	}
+	sinkhole := net.IPv4(127, 0, 0, 1).To4()
+	// The same few names asked about all day all fit in the decision cache.
+	hot := hits[:decisionShardSize]
+	resetDecisions(rs)
+
+	var i int
+	next := func() int {
+		i = (i + 1) % len(hits)
+		return i
+	}
+	return []benchOp{
+		{"parse", 1, func() {
+			name, _, _, _ := parseQuestion(msgs[next()])
+			lowerName(name)
+		}},
+		{"lookup-hit", 0, func() { rs.matchBlocked(hits[next()]) }},
+		{"lookup-miss", 0, func() { rs.matchBlocked(misses[next()]) }},
+		{"lookup-cached", 0, func() { rs.matchCached(hot[next()%len(hot)]) }},
+		{"blocked-reply", 1, func() {
+			i := next()
+			blockedReply(msgs[i], ends[i], typeA, sinkhole, nil)
+		}},
+	}
+}
+
+// benchNames generates n names looking like those of block lists: ad and
+// tracking hosts two to four labels deep.
+func benchNames(rnd *rand.Rand, n int) []string {
+	words := []string{"ad", "ads", "track", "pixel", "stats", "metrics", "beacon", "cdn", "click", "banner", "tag", "sync"}
+	tlds := []string{"com", "net", "org", "io", "info", "co.uk"}
+	names := make([]string, n)
+	for i := range names {
+		name := fmt.Sprintf("%s%d.%s", words[rnd.Intn(len(words))], rnd.Intn(1e6), tlds[rnd.Intn(len(tlds))])
+		for d := rnd.Intn(3); d > 0; d-- {
+			name = words[rnd.Intn(len(words))] + "." + name
+		}
+		names[i] = name + "."
+	}
+	return names
+}
+
+// benchRules returns a rule set of one list blocking names.
+func benchRules(names []string) *ruleSet {
+	rs := newRuleSet()
+	rs.addList("generated")
+	for i, name := range names {
+		rs.add(listRule{Name: name}, newRuleSource(0, i+1))
+	}
+	return rs
+}
+
+// benchQuery returns an A query for name.
+func benchQuery(name string) []byte {
+	msg := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	start := 0
+	for i := 0; i < len(name); i++ {
+		if name[i] == '.' {
+			msg = append(msg, byte(i-start))
+			msg = append(msg, name[start:i]...)
+			start = i + 1
+		}
+	}
+	return append(msg, 0, 0, byte(typeA), 0, 1)
+}
@@ -0,0 +1,38 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"math/rand"
+	"testing"
+)
+
+// testHotPath returns the hot path operations against a generated list.
+func testHotPath(tb testing.TB) []benchOp {
+	tb.Helper()
+	rnd := rand.New(rand.NewSource(1))
+	names := benchNames(rnd, 10000)
+	rs := benchRules(names)
+	tb.Cleanup(func() { resetDecisions(currentRules()) })
+	return hotPath(rnd, rs, names)
+}
+
+// No operation of the hot path may allocate more than the baseline.
+func TestHotPathAllocs(t *testing.T) {
+	for _, op := range testHotPath(t) {
+		if allocs := testing.AllocsPerRun(1000, op.run); allocs > op.max {
+			t.Errorf("%s: %.0f allocations per run, want at most %.0f", op.name, allocs, op.max)
+		}
+	}
+}
+
+func BenchmarkHotPath(b *testing.B) {
+	for _, op := range testHotPath(b) {
+		b.Run(op.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for n := 0; n < b.N; n++ {
+				op.run()
+			}
+		})
+	}
+}
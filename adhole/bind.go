@@ -0,0 +1,40 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"syscall"
+	"time"
+)
+
+// bindRetryEvery is how often bindRetry tries again.
+var bindRetryEvery = time.Second
+
+// errWSAAddrInUse is how Windows tells an address is in use, which isn't
+// syscall.EADDRINUSE there.
+const errWSAAddrInUse = syscall.Errno(10048)
+
+// bindRetry calls bind until it succeeds, fails for another reason than the
+// address being in use, or -bind-retry has passed. proto is "udp" or "tcp",
+// what is the log prefix.
+func bindRetry(what, proto string, port int, bind func() error) error {
+	deadline := time.Now().Add(*flagBindWait)
+	for {
+		err := bind()
+		if err == nil || !errors.Is(err, syscall.EADDRINUSE) && !errors.Is(err, errWSAAddrInUse) {
+			return err
+		}
+		by := ""
+		if owner := portOwner(proto, port); owner != "" {
+			by = " by " + owner
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("%s port %d is already in use%s; stop that or choose another address or port", proto, port, by)
+		}
+		log.Printf("%s WARN: %s port %d is in use%s, retrying\n", what, proto, port, by)
+		time.Sleep(bindRetryEvery)
+	}
+}
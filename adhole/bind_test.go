@@ -0,0 +1,116 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// occupy binds a proto ("udp" or "tcp") socket to a free loopback port and
+// returns the port and the socket, closed after the test.
+func occupy(tb testing.TB, proto string) (int, io.Closer) {
+	tb.Helper()
+	var sock io.Closer
+	var addr net.Addr
+	if proto == "udp" {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			tb.Fatal(err)
+		}
+		sock, addr = conn, conn.LocalAddr()
+	} else {
+		ln, err := net.Listen("tcp4", "127.0.0.1:0")
+		if err != nil {
+			tb.Fatal(err)
+		}
+		sock, addr = ln, ln.Addr()
+	}
+	tb.Cleanup(func() { sock.Close() })
+	_, port, _ := net.SplitHostPort(addr.String())
+	p, _ := strconv.Atoi(port)
+	return p, sock
+}
+
+// thisProcess returns how portOwner names the test process, "" where it
+// can't.
+func thisProcess() string {
+	if runtime.GOOS != "linux" {
+		return ""
+	}
+	comm, _ := os.ReadFile("/proc/self/comm")
+	return fmt.Sprintf("%s (pid %d)", strings.TrimSpace(string(comm)), os.Getpid())
+}
+
+// A DNS or HTTP port in use stops AdHole at once, naming the process holding
+// it, unless it is freed within -bind-retry.
+func TestBindInUse(t *testing.T) {
+	withFlag(t, &bindRetryEvery, 20*time.Millisecond)
+	list := writeTemp(t, "list.txt", "ads.example.com\n")
+	tests := []struct {
+		name  string
+		proto string
+		retry time.Duration
+		free  time.Duration // after which the port is freed, 0 - never
+		err   bool
+	}{
+		{"DNS port in use", "udp", 0, 0, true},
+		{"DNS port freed while retrying", "udp", 2 * time.Second, 100 * time.Millisecond, false},
+		{"DNS port not freed in time", "udp", 100 * time.Millisecond, 0, true},
+		{"HTTP port in use", "tcp", 0, 0, true},
+		{"HTTP port freed while retrying", "tcp", 2 * time.Second, 100 * time.Millisecond, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := withLogBuffer(t, 0)
+			port, sock := occupy(t, tt.proto)
+			if tt.free > 0 {
+				time.AfterFunc(tt.free, func() { sock.Close() })
+			}
+			what, args := "DNS", []string{"-no-http", "-dport", strconv.Itoa(port)}
+			if tt.proto == "tcp" {
+				what, args = "HTTP", []string{"-no-dns", "-hport", strconv.Itoa(port)}
+			}
+			args = append(args, "-bind-retry", tt.retry.String(), "secret", "127.0.0.2", "127.0.0.1", list)
+			_, err := startServer(t, args...)
+
+			by := ""
+			if owner := thisProcess(); owner != "" {
+				by = " by " + owner
+			}
+			if tt.err {
+				want := fmt.Sprintf("%s port %d is already in use%s;", tt.proto, port, by)
+				if err == nil || !strings.Contains(err.Error(), want) {
+					t.Errorf("returned %v, want %q", err, want)
+				}
+			} else if err != nil {
+				t.Error(err)
+			}
+			warning := fmt.Sprintf("%s WARN: %s port %d is in use%s, retrying", what, tt.proto, port, by)
+			retried := strings.Contains(strings.Join(lb.lines(), "\n"), warning)
+			if retried != (tt.retry > 0) {
+				t.Errorf("retried %v, want %v: %q", retried, tt.retry > 0, lb.lines())
+			}
+		})
+	}
+}
+
+// Errors other than the address being in use aren't retried.
+func TestBindRetryOtherError(t *testing.T) {
+	withFlag(t, flagBindWait, time.Minute)
+	calls := 0
+	err := bindRetry("DNS", "udp", 53, func() error {
+		calls++
+		return os.ErrPermission
+	})
+	if err != os.ErrPermission || calls != 1 {
+		t.Errorf("returned %v after %d calls", err, calls)
+	}
+}
@@ -0,0 +1,64 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"hash/maphash"
+	"math"
+)
+
+// bloom is a Bloom filter over names: has never misses a name that was
+// added, and wrongly reports others with about the probability it was built
+// for.
+type bloom struct {
+	bits []uint64
+	m    uint64 // number of bits
+	k    int    // number of probes
+	seed maphash.Seed
+}
+
+// newBloom returns a filter sized for n names at false positive rate fp.
+func newBloom(n int, fp float64) *bloom {
+	if n < 1 {
+		n = 1
+	}
+	m := math.Ceil(-float64(n) * math.Log(fp) / (math.Ln2 * math.Ln2))
+	k := int(math.Round(m / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	words := (uint64(m) + 63) / 64
+	return &bloom{bits: make([]uint64, words), m: words * 64, k: k, seed: maphash.MakeSeed()}
+}
+
+// probes returns the two hashes the probe positions are derived from.
+func (b *bloom) probes(name string) (uint64, uint64) {
+	h := maphash.String(b.seed, name)
+	return h, h>>32 | 1
+}
+
+// add adds a name.
+func (b *bloom) add(name string) {
+	h1, h2 := b.probes(name)
+	for i := 0; i < b.k; i++ {
+		bit := (h1 + uint64(i)*h2) % b.m
+		b.bits[bit/64] |= 1 << (bit % 64)
+	}
+}
+
+// has reports whether name may have been added.
+func (b *bloom) has(name string) bool {
+	h1, h2 := b.probes(name)
+	for i := 0; i < b.k; i++ {
+		bit := (h1 + uint64(i)*h2) % b.m
+		if b.bits[bit/64]&(1<<(bit%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// size returns the memory used by the filter in bytes.
+func (b *bloom) size() int {
+	return len(b.bits) * 8
+}
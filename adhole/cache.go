@@ -0,0 +1,160 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// The compiled list cache is a binary dump of the blocked map, written next to
+// the source list after a successful parse.
+//
+// Layout (all integers big endian):
+// 4  - Magic        = "AHLC"
+// 2  - Version      = cacheVersion
+// 8  - Source size  - size of the list file the cache was built from
+// 8  - Source mtime - modification time (UnixNano) of the same
+// 4  - Count        - number of entries that follow
+// ?  - Entries      - uvarint length, the domain bytes, uvarint line number
+// 32 - Checksum     - sha256 of everything above
+//
+// With -cache-gzip all of it is gzip compressed.
+var (
+	cacheMagic   = []byte("AHLC")
+	cacheVersion = uint16(2)
+	gzipMagic    = []byte{0x1f, 0x8b}
+)
+
+// cachePath returns the path of the compiled cache for a list file.
+func cachePath(path string) string {
+	return path + ".cache"
+}
+
+// loadCache tries to load the compiled cache for the list at path, which
+// has the given list index.
+// It returns an error if the cache is missing, stale or corrupt, in which case
+// the caller should fall back to parsing the list.
+func loadCache(path string, index int) (map[string]ruleSource, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := os.ReadFile(cachePath(path))
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(data, gzipMagic) {
+		zr, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if data, err = io.ReadAll(zr); err != nil {
+			return nil, fmt.Errorf("cache corrupt: %s", err)
+		}
+	}
+	if len(data) < len(cacheMagic)+2+8+8+4+sha256.Size {
+		return nil, errors.New("cache too short")
+	}
+
+	body, sum := data[:len(data)-sha256.Size], data[len(data)-sha256.Size:]
+	if check := sha256.Sum256(body); !bytes.Equal(check[:], sum) {
+		return nil, errors.New("cache checksum mismatch")
+	}
+	if !bytes.Equal(body[:4], cacheMagic) {
+		return nil, errors.New("not a cache file")
+	}
+	body = body[4:]
+	if v := binary.BigEndian.Uint16(body); v != cacheVersion {
+		return nil, fmt.Errorf("cache version %d not supported", v)
+	}
+	body = body[2:]
+	size := int64(binary.BigEndian.Uint64(body))
+	mtime := int64(binary.BigEndian.Uint64(body[8:]))
+	if size != info.Size() || mtime != info.ModTime().UnixNano() {
+		return nil, errors.New("cache is stale")
+	}
+	count := int(binary.BigEndian.Uint32(body[16:]))
+	body = body[20:]
+
+	entries := make(map[string]ruleSource, count)
+	for i := 0; i < count; i++ {
+		length, n := binary.Uvarint(body)
+		if n <= 0 || uint64(len(body)-n) < length {
+			return nil, errors.New("cache entry truncated")
+		}
+		body = body[n:]
+		name := string(body[:length])
+		body = body[length:]
+		line, n := binary.Uvarint(body)
+		if n <= 0 {
+			return nil, errors.New("cache entry truncated")
+		}
+		body = body[n:]
+		entries[name] = newRuleSource(index, int(line))
+	}
+	if len(body) != 0 {
+		return nil, errors.New("cache has trailing data")
+	}
+	return entries, nil
+}
+
+// saveCache writes the compiled cache for the list at path. The file is
+// written to a temporary name first so a crash never leaves a partial cache.
+func saveCache(path string, entries map[string]ruleSource) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	tmp := cachePath(path) + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+
+	var out io.Writer = file
+	var zw *gzip.Writer
+	if *flagCacheGz {
+		zw = gzip.NewWriter(file)
+		out = zw
+	}
+	hash := sha256.New()
+	w := bufio.NewWriter(io.MultiWriter(out, hash))
+	header := make([]byte, 0, 26)
+	header = append(header, cacheMagic...)
+	header = binary.BigEndian.AppendUint16(header, cacheVersion)
+	header = binary.BigEndian.AppendUint64(header, uint64(info.Size()))
+	header = binary.BigEndian.AppendUint64(header, uint64(info.ModTime().UnixNano()))
+	header = binary.BigEndian.AppendUint32(header, uint32(len(entries)))
+	w.Write(header)
+
+	buf := make([]byte, binary.MaxVarintLen64)
+	for domain, src := range entries {
+		n := binary.PutUvarint(buf, uint64(len(domain)))
+		w.Write(buf[:n])
+		w.WriteString(domain)
+		n = binary.PutUvarint(buf, uint64(src.line()))
+		w.Write(buf[:n])
+	}
+	if err = w.Flush(); err == nil {
+		_, err = out.Write(hash.Sum(nil))
+	}
+	if zw != nil && err == nil {
+		err = zw.Close()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, cachePath(path))
+}
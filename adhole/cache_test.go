@@ -0,0 +1,196 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeList writes a plain list of names, one per line, and returns its
+// path and the entries a parse of it yields.
+func writeList(tb testing.TB, names []string) (string, map[string]ruleSource) {
+	tb.Helper()
+	var b strings.Builder
+	entries := make(map[string]ruleSource, len(names))
+	for i, name := range names {
+		b.WriteString(strings.TrimSuffix(name, ".") + "\n")
+		entries[name] = newRuleSource(0, i+1)
+	}
+	return writeTemp(tb, "list.txt", b.String()), entries
+}
+
+func TestCacheRoundTrip(t *testing.T) {
+	for _, gz := range []bool{false, true} {
+		withFlag(t, flagCacheGz, gz)
+		path, entries := writeList(t, testNames(1000))
+		if err := saveCache(path, entries); err != nil {
+			t.Fatalf("gzip %v: saveCache: %s", gz, err)
+		}
+		data, err := os.ReadFile(cachePath(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := bytes.HasPrefix(data, gzipMagic); got != gz {
+			t.Errorf("gzip %v: cache gzipped is %v", gz, got)
+		}
+		loaded, err := loadCache(path, 0)
+		if err != nil {
+			t.Fatalf("gzip %v: loadCache: %s", gz, err)
+		}
+		if len(loaded) != len(entries) {
+			t.Fatalf("gzip %v: loaded %d entries, want %d", gz, len(loaded), len(entries))
+		}
+		for name, src := range entries {
+			if loaded[name] != src {
+				t.Errorf("gzip %v: %s has source %d, want %d", gz, name, loaded[name], src)
+			}
+		}
+	}
+}
+
+// A cache that doesn't match its list or is damaged in any way must be
+// rejected as a whole, never yield part of the rules.
+func TestCacheRejected(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		damage func(t *testing.T, list, cache string, data []byte) []byte
+		gzip   bool
+	}{
+		{"list changed", func(t *testing.T, list, cache string, data []byte) []byte {
+			os.WriteFile(list, []byte("other.example.com\n"), 0644)
+			return data
+		}, false},
+		{"list touched", func(t *testing.T, list, cache string, data []byte) []byte {
+			later := time.Now().Add(time.Hour)
+			os.Chtimes(list, later, later)
+			return data
+		}, false},
+		{"flipped byte", func(t *testing.T, list, cache string, data []byte) []byte {
+			data[len(data)/2] ^= 0x40
+			return data
+		}, false},
+		{"truncated", func(t *testing.T, list, cache string, data []byte) []byte {
+			return data[:len(data)-100]
+		}, false},
+		{"too short", func(t *testing.T, list, cache string, data []byte) []byte {
+			return data[:10]
+		}, false},
+		{"trailing data", func(t *testing.T, list, cache string, data []byte) []byte {
+			return append(data, 0)
+		}, false},
+		{"truncated gzip", func(t *testing.T, list, cache string, data []byte) []byte {
+			return data[:len(data)-20]
+		}, true},
+		{"not gzip inside", func(t *testing.T, list, cache string, data []byte) []byte {
+			var b bytes.Buffer
+			zw := gzip.NewWriter(&b)
+			io.WriteString(zw, "hello")
+			zw.Close()
+			return b.Bytes()
+		}, true},
+	} {
+		withFlag(t, flagCacheGz, tc.gzip)
+		path, entries := writeList(t, testNames(100))
+		if err := saveCache(path, entries); err != nil {
+			t.Fatal(err)
+		}
+		data, err := os.ReadFile(cachePath(path))
+		if err != nil {
+			t.Fatal(err)
+		}
+		data = tc.damage(t, path, cachePath(path), data)
+		if err := os.WriteFile(cachePath(path), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+		if loaded, err := loadCache(path, 0); err == nil || loaded != nil {
+			t.Errorf("%s: loaded %d entries, error %v", tc.name, len(loaded), err)
+		}
+	}
+}
+
+func TestCacheMissing(t *testing.T) {
+	path, _ := writeList(t, testNames(10))
+	if _, err := loadCache(path, 0); !os.IsNotExist(err) {
+		t.Errorf("got %v, want a not exist error", err)
+	}
+}
+
+// BenchmarkListParse and BenchmarkListCache show what the compiled cache
+// saves at startup: the time to load the same 100000 names parsing the list,
+// and from the cache.
+func BenchmarkListParse(b *testing.B) {
+	path, _ := writeList(b, testNames(100000))
+	withFlag(b, flagCache, false)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := loadLists([]string{path}); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkListCache(b *testing.B) {
+	path, entries := writeList(b, testNames(100000))
+	if err := saveCache(path, entries); err != nil {
+		b.Fatal(err)
+	}
+	withFlag(b, flagCache, true)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, files, err := loadLists([]string{path})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if !files[0].FromCache {
+			b.Fatal("not loaded from the cache")
+		}
+	}
+}
+
+// benchLookup loads a list of 100000 names like those of block lists, with
+// or without -bloom, and looks up names in it, or others under the same
+// top level domains, as hit says.
+func benchLookup(b *testing.B, bloom, hit bool) {
+	rnd := rand.New(rand.NewSource(1))
+	names := benchNames(rnd, 100000)
+	path, _ := writeList(b, names)
+	withFlag(b, flagCache, false)
+	withFlag(b, flagBloom, bloom)
+	rs, _, err := loadLists([]string{path})
+	if err != nil {
+		b.Fatal(err)
+	}
+	queries := make([]string, 4096)
+	for i := range queries {
+		if hit {
+			queries[i] = names[rnd.Intn(len(names))]
+		} else {
+			queries[i] = fmt.Sprintf("static.www.site%d.example.%s.", rnd.Intn(1e6), []string{"com", "net", "org"}[i%3])
+		}
+		if _, _, block := rs.matchBlocked(queries[i]); block != hit {
+			b.Fatalf("%s blocked %v", queries[i], block)
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rs.matchBlocked(queries[i%len(queries)])
+	}
+}
+
+// BenchmarkLookupHit, BenchmarkLookupMiss and their Bloom variants show what
+// -bloom costs for names on the list, and saves for the rest.
+func BenchmarkLookupHit(b *testing.B)       { benchLookup(b, false, true) }
+func BenchmarkLookupHitBloom(b *testing.B)  { benchLookup(b, true, true) }
+func BenchmarkLookupMiss(b *testing.B)      { benchLookup(b, false, false) }
+func BenchmarkLookupMissBloom(b *testing.B) { benchLookup(b, true, false) }
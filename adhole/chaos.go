@@ -0,0 +1,41 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import "os"
+
+// identNames are the CHAOS class names that diagnostic tools ask resolvers
+// to identify themselves with, and whether they ask for the version (or
+// else the host name). The .server ones are from RFC 4892.
+var identNames = map[string]bool{
+	"version.bind.":   true,
+	"version.server.": true,
+	"hostname.bind.":  false,
+	"id.server.":      false,
+}
+
+// isIdent tells if a question of class and name asks AdHole to identify
+// itself.
+func isIdent(class uint16, name string) bool {
+	_, ok := identNames[name]
+	return ok && class == classCH
+}
+
+// identReply answers a CHAOS query for one of identNames with a TXT record
+// of the version or the host name, or with REFUSED under -no-ident. Other
+// types get an empty answer.
+func identReply(msg []byte, end int, qtype uint16, name string) []byte {
+	if *flagNoIdent {
+		return finishReply(newReply(msg, end, rcodeRefused), msg)
+	}
+	reply := newReply(msg, end, 0)
+	if qtype == typeTXT || qtype == typeANY {
+		txt := "adhole " + version
+		if !identNames[name] {
+			txt, _ = os.Hostname()
+		}
+		reply = appendTXT(reply, classCH, 0, txt)
+	}
+	setFlag(reply, flagAA, true)
+	return finishReply(reply, msg)
+}
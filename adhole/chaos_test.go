@@ -0,0 +1,98 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"testing"
+)
+
+// chaosQuery returns a CHAOS class query for name of qtype.
+func chaosQuery(name string, qtype uint16) []byte {
+	msg := testQuery(name, qtype)
+	binary.BigEndian.PutUint16(msg[len(msg)-2:], classCH)
+	return msg
+}
+
+// answerTXT returns the first string of each TXT record in msg, and the
+// class of the last.
+func answerTXT(msg []byte) (txts []string, class uint16) {
+	walkRecords(msg, func(rrtype uint16, off int) {
+		if rrtype == typeTXT {
+			class = binary.BigEndian.Uint16(msg[off+2:])
+			n := int(msg[off+10])
+			txts = append(txts, string(msg[off+11:off+11+n]))
+		}
+	})
+	return
+}
+
+// Diagnostic tools asking AdHole to identify itself get the version or the
+// host name, unless it's told not to.
+func TestIdentReply(t *testing.T) {
+	host, _ := os.Hostname()
+	tests := []struct {
+		name    string
+		qtype   uint16
+		noIdent bool
+		rcode   byte
+		txt     string // "" for no records
+	}{
+		{"version.bind.", typeTXT, false, 0, "adhole " + version},
+		{"version.server.", typeANY, false, 0, "adhole " + version},
+		{"hostname.bind.", typeTXT, false, 0, host},
+		{"id.server.", typeTXT, false, 0, host},
+		{"version.bind.", typeA, false, 0, ""},
+		{"version.bind.", typeTXT, true, rcodeRefused, ""},
+		{"id.server.", typeTXT, true, rcodeRefused, ""},
+	}
+	for _, tt := range tests {
+		withFlag(t, flagNoIdent, tt.noIdent)
+		msg := chaosQuery(tt.name, tt.qtype)
+		_, _, end, _ := parseQuestion(msg)
+		reply := identReply(msg, end, tt.qtype, tt.name)
+		if rcode := reply[3] & 0x0f; rcode != tt.rcode {
+			t.Errorf("%s type %d: rcode %d, want %d", tt.name, tt.qtype, rcode, tt.rcode)
+		}
+		txts, class := answerTXT(reply)
+		if tt.txt == "" && len(txts) != 0 || tt.txt != "" && (len(txts) != 1 || txts[0] != tt.txt || class != classCH) {
+			t.Errorf("%s type %d: answered %q in class %d, want %q", tt.name, tt.qtype, txts, class, tt.txt)
+		}
+	}
+}
+
+func TestIsIdent(t *testing.T) {
+	tests := []struct {
+		class uint16
+		name  string
+		want  bool
+	}{
+		{classCH, "version.bind.", true},
+		{classCH, "hostname.bind.", true},
+		{classCH, "version.server.", true},
+		{classCH, "id.server.", true},
+		{classIN, "version.bind.", false},
+		{classCH, "other.bind.", false},
+		{classCH, "www.version.bind.", false},
+	}
+	for _, tt := range tests {
+		if got := isIdent(tt.class, tt.name); got != tt.want {
+			t.Errorf("class %d %s: %v, want %v", tt.class, tt.name, got, tt.want)
+		}
+	}
+}
+
+// The CHAOS queries are answered by the listener, in any case, and never
+// relayed.
+func TestIdentListener(t *testing.T) {
+	up := withUpstream(t)
+	l := startListener(t, false)
+	reply := ask(t, l, chaosQuery("VERSION.Bind.", typeTXT))
+	if txts, _ := answerTXT(reply); len(txts) != 1 || txts[0] != "adhole "+version {
+		t.Errorf("answered % x", reply)
+	}
+	if relayed(up) != nil {
+		t.Error("relayed upstream")
+	}
+}
@@ -0,0 +1,231 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var cntClientQs = expvar.NewMap("statsClientQueries")
+
+// lease is a DHCP lease from the -dhcp-leases file.
+type lease struct {
+	mac    string
+	name   string    // the host name the client sent, if any
+	expiry time.Time // zero for an infinite lease
+}
+
+// clientNameTable maps client addresses to friendly names.
+type clientNameTable struct {
+	static map[string]string // IPs and MACs, in lower case, from -clients
+	leases map[string]lease  // IPs to their leases
+	// The modification times of the files when they were read.
+	staticMod, leasesMod time.Time
+}
+
+// clientNames is the table in use, nil if clients aren't named.
+var clientNames atomic.Pointer[clientNameTable]
+
+func init() {
+	expvar.Publish("clientNames", expvar.Func(func() interface{} {
+		t := clientNames.Load()
+		if t == nil {
+			return nil
+		}
+		active := 0
+		now := time.Now()
+		for _, l := range t.leases {
+			if l.active(now) {
+				active++
+			}
+		}
+		return map[string]int{"static": len(t.static), "leases": active}
+	}))
+}
+
+// active reports whether the lease hasn't expired at now.
+func (l lease) active(now time.Time) bool {
+	return l.expiry.IsZero() || now.Before(l.expiry)
+}
+
+// clientName returns the friendly name of the client at ip: the one given
+// for its IP in -clients, or else the one given for the MAC of its current
+// lease, or else the host name in the lease. It returns "" for unknown
+// clients, and for all of them with -privacy.
+func clientName(ip net.IP) string {
+	t := clientNames.Load()
+	if t == nil || *flagPrivacy != "" {
+		return ""
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	key := ip.String()
+	if name, ok := t.static[key]; ok {
+		return name
+	}
+	l, ok := t.leases[key]
+	if !ok || !l.active(time.Now()) {
+		return ""
+	}
+	if name, ok := t.static[l.mac]; ok {
+		return name
+	}
+	return l.name
+}
+
+// countClient counts a query from the client at ip under its name, or as
+// "unknown", if clients are named.
+func countClient(ip net.IP) {
+	if clientNames.Load() == nil || *flagPrivacy != "" {
+		return
+	}
+	name := clientName(ip)
+	if name == "" {
+		name = "unknown"
+	}
+	cntClientQs.Add(name, 1)
+}
+
+// loadClientNames reads -clients and -dhcp-leases again if they changed
+// since they were last read. The names in use stay if a file can't be read.
+func loadClientNames() error {
+	old := clientNames.Load()
+	t := &clientNameTable{}
+	if old != nil {
+		*t = *old
+	}
+	changed := false
+	if *flagClients != "" {
+		mod, err := modTime(*flagClients)
+		if err != nil {
+			return err
+		}
+		if old == nil || !mod.Equal(old.staticMod) {
+			if t.static, err = readClients(*flagClients); err != nil {
+				return err
+			}
+			t.staticMod, changed = mod, true
+		}
+	}
+	if *flagLeases != "" {
+		mod, err := modTime(*flagLeases)
+		if err != nil {
+			return err
+		}
+		if old == nil || !mod.Equal(old.leasesMod) {
+			if t.leases, err = readLeases(*flagLeases); err != nil {
+				return err
+			}
+			t.leasesMod, changed = mod, true
+		}
+	}
+	if changed {
+		clientNames.Store(t)
+	}
+	return nil
+}
+
+// modTime returns the modification time of the file at path.
+func modTime(path string) (time.Time, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// runClientNames reads the client name files again when they change,
+// checking every so often.
+func runClientNames(every time.Duration) {
+	for range time.Tick(every) {
+		if err := loadClientNames(); err != nil {
+			log.Println("DNS ERROR: Can't reload client names, keeping the old ones:", err)
+			cntErrors.Add(1)
+		}
+	}
+}
+
+// readClients reads a -clients file: an IP or MAC address and a name per
+// line, with empty lines and those starting with # skipped.
+func readClients(path string) (map[string]string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	m := make(map[string]string)
+	scn := bufio.NewScanner(file)
+	for n := 1; scn.Scan(); n++ {
+		line := strings.TrimSpace(scn.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s line %d: want an address and a name", path, n)
+		}
+		var key string
+		if ip := net.ParseIP(fields[0]); ip != nil {
+			if ip4 := ip.To4(); ip4 != nil {
+				ip = ip4
+			}
+			key = ip.String()
+		} else if mac, err := net.ParseMAC(fields[0]); err == nil {
+			key = mac.String()
+		} else {
+			return nil, fmt.Errorf("%s line %d: bad IP or MAC address %q", path, n, fields[0])
+		}
+		m[key] = fields[1]
+	}
+	return m, scn.Err()
+}
+
+// readLeases reads a dnsmasq leases file. Its lines have the expiry time in
+// seconds since the epoch (0 for infinite), the MAC address, the IP address,
+// the host name or * and the client ID. IPv6 leases have the IAID instead
+// of the MAC, after a line with the server's DUID.
+func readLeases(path string) (map[string]lease, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	m := make(map[string]lease)
+	scn := bufio.NewScanner(file)
+	for n := 1; scn.Scan(); n++ {
+		fields := strings.Fields(scn.Text())
+		if len(fields) == 0 || fields[0] == "duid" {
+			continue
+		}
+		if len(fields) < 4 {
+			return nil, fmt.Errorf("%s line %d: too few fields", path, n)
+		}
+		secs, err := strconv.ParseInt(fields[0], 10, 64)
+		ip := net.ParseIP(fields[2])
+		if err != nil || ip == nil {
+			return nil, fmt.Errorf("%s line %d: not a lease", path, n)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		l := lease{mac: strings.ToLower(fields[1])}
+		if fields[3] != "*" {
+			l.name = fields[3]
+		}
+		if secs != 0 {
+			l.expiry = time.Unix(secs, 0)
+		}
+		m[ip.String()] = l
+	}
+	return m, scn.Err()
+}
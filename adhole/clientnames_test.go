@@ -0,0 +1,111 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
+// withClientNames names clients from the given -clients and -dhcp-leases
+// files for the rest of the test.
+func withClientNames(tb testing.TB, clients, leases string) {
+	tb.Helper()
+	withFlag(tb, flagClients, writeTemp(tb, "clients.txt", clients))
+	withFlag(tb, flagLeases, writeTemp(tb, "dnsmasq.leases", leases))
+	clientNames.Store(nil)
+	tb.Cleanup(func() { clientNames.Store(nil) })
+	if err := loadClientNames(); err != nil {
+		tb.Fatal(err)
+	}
+}
+
+// Clients are named by IP from -clients, else by the MAC of their lease,
+// else by the host name they sent.
+func TestClientName(t *testing.T) {
+	now := time.Now().Unix()
+	withClientNames(t, `# the family
+192.168.1.10 laptop
+fd00::10     laptop6
+AA:BB:CC:DD:EE:01 phone
+`, fmt.Sprintf(`%d aa:bb:cc:dd:ee:01 192.168.1.20 android-1234 01:aa:bb:cc:dd:ee:01
+%d aa:bb:cc:dd:ee:02 192.168.1.21 * 01:aa:bb:cc:dd:ee:02
+0 aa:bb:cc:dd:ee:03 192.168.1.22 printer *
+%d aa:bb:cc:dd:ee:04 192.168.1.23 gone *
+%d aa:bb:cc:dd:ee:05 192.168.1.10 laptop-dhcp *
+duid 00:01:00:01:2c:5f:1a:2b:aa:bb:cc:dd:ee:ff
+%d 12345678 fd00::30 desktop 00:01:00:01
+`, now+3600, now+3600, now-60, now+3600, now+3600))
+
+	tests := []struct {
+		ip   string
+		name string
+	}{
+		{"192.168.1.10", "laptop"},
+		{"::ffff:192.168.1.10", "laptop"},
+		{"fd00::10", "laptop6"},
+		{"192.168.1.20", "phone"},
+		{"192.168.1.21", ""},
+		{"192.168.1.22", "printer"},
+		{"192.168.1.23", ""},
+		{"fd00::30", "desktop"},
+		{"192.168.1.99", ""},
+	}
+	for _, tt := range tests {
+		if name := clientName(net.ParseIP(tt.ip)); name != tt.name {
+			t.Errorf("%s: named %q, want %q", tt.ip, name, tt.name)
+		}
+	}
+	count := func(name string) int64 {
+		n, _ := cntClientQs.Get(name).(*expvar.Int)
+		if n == nil {
+			return 0
+		}
+		return n.Value()
+	}
+	laptop, unknown := count("laptop"), count("unknown")
+	countClient(net.ParseIP("192.168.1.10"))
+	countClient(net.ParseIP("192.168.1.99"))
+	if count("laptop") != laptop+1 || count("unknown") != unknown+1 {
+		t.Error("queries not counted by client name")
+	}
+
+	withFlag(t, flagPrivacy, "hmac")
+	if name := clientName(net.ParseIP("192.168.1.10")); name != "" {
+		t.Errorf("named %q with -privacy", name)
+	}
+}
+
+// Changed files are read again, and files that can't be read keep the names
+// in use.
+func TestReloadClientNames(t *testing.T) {
+	withClientNames(t, "192.168.1.10 laptop\n", "")
+	ip := net.ParseIP("192.168.1.10")
+	for _, tt := range []struct {
+		clients string
+		err     bool
+		name    string
+	}{
+		{"192.168.1.10 notebook\n", false, "notebook"},
+		{"192.168.1.10\n", true, "notebook"},
+		{"not-an-address laptop\n", true, "notebook"},
+		{"# nobody\n", false, ""},
+	} {
+		// Make sure the modification time changes.
+		later := time.Now().Add(time.Duration(len(tt.clients)) * time.Second)
+		if err := os.WriteFile(*flagClients, []byte(tt.clients), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(*flagClients, later, later)
+		if err := loadClientNames(); (err != nil) != tt.err {
+			t.Errorf("%q: error %v, want %v", tt.clients, err, tt.err)
+		}
+		if name := clientName(ip); name != tt.name {
+			t.Errorf("%q: named %q, want %q", tt.clients, name, tt.name)
+		}
+	}
+}
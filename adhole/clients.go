@@ -0,0 +1,91 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"expvar"
+	"hash/maphash"
+	"math"
+	"math/bits"
+	"net"
+	"sync"
+	"time"
+)
+
+// hllBits is the HyperLogLog precision: 2^hllBits one byte registers, for
+// a standard error of about 1.6%.
+const hllBits = 12
+
+// hll is a HyperLogLog sketch counting distinct values in fixed memory.
+type hll [1 << hllBits]uint8
+
+// add adds a hashed value.
+func (h *hll) add(x uint64) {
+	i := x >> (64 - hllBits)
+	rank := uint8(bits.LeadingZeros64(x<<hllBits|1<<(hllBits-1)) + 1)
+	if rank > h[i] {
+		h[i] = rank
+	}
+}
+
+// count returns the estimated number of distinct values added.
+func (h *hll) count() int64 {
+	m := float64(len(h))
+	sum, zeros := 0.0, 0
+	for _, r := range h {
+		sum += math.Ldexp(1, -int(r))
+		if r == 0 {
+			zeros++
+		}
+	}
+	est := 0.7213 / (1 + 1.079/m) * m * m / sum
+	if est <= 2.5*m && zeros > 0 {
+		// Linear counting is much more accurate for small counts.
+		est = m * math.Log(m/float64(zeros))
+	}
+	return int64(est + 0.5)
+}
+
+// clients counts the distinct client addresses seen today and since start.
+var clients = struct {
+	sync.Mutex
+	seed  maphash.Seed
+	day   time.Time // local midnight starting today
+	today hll
+	total hll
+}{seed: maphash.MakeSeed()}
+
+func init() {
+	expvar.Publish("clients", expvar.Func(func() interface{} {
+		clients.Lock()
+		defer clients.Unlock()
+		clientsRollover(time.Now())
+		return map[string]int64{
+			"today": clients.today.count(),
+			"total": clients.total.count(),
+		}
+	}))
+}
+
+// clientsRollover starts a new day's count after local midnight. It must be
+// called with clients locked.
+func clientsRollover(now time.Time) {
+	y, m, d := now.Date()
+	if day := time.Date(y, m, d, 0, 0, 0, 0, time.Local); !day.Equal(clients.day) {
+		clients.day = day
+		clients.today = hll{}
+	}
+}
+
+// clientSeen counts a query from ip.
+func clientSeen(ip net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		ip = ip4
+	}
+	x := maphash.Bytes(clients.seed, ip)
+	clients.Lock()
+	defer clients.Unlock()
+	clientsRollover(time.Now())
+	clients.today.add(x)
+	clients.total.add(x)
+}
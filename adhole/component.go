@@ -0,0 +1,129 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var cntCompFails = expvar.NewMap("statsComponentFailures")
+
+// component is a part of the server, e.g. a local DNS listener or the HTTP
+// server, run and supervised on its own. What happens when it fails is up to
+// -on-failure.
+type component struct {
+	name string
+	run  func() error // serves until it fails or is stopped
+	stop func()       // makes run return, e.g. by closing its socket
+
+	done chan struct{} // closed once it's no longer run
+}
+
+var (
+	// components are the started components, in the order started,
+	// guarded by componentsMu.
+	components   []*component
+	componentsMu sync.Mutex
+	// stopping is set once the components are being stopped, so that
+	// them returning isn't taken as a failure.
+	stopping atomic.Bool
+)
+
+// stopWait is how long stopComponents waits for the components to return.
+const stopWait = 5 * time.Second
+
+// Restart backoff with -on-failure restart. The delay doubles with each
+// failure, unless the component ran for maxRestartDelay before failing.
+var (
+	minRestartDelay = time.Second
+	maxRestartDelay = time.Minute
+)
+
+// parseOnFailure checks an -on-failure policy.
+func parseOnFailure(policy string) error {
+	if policy != "exit" && policy != "restart" {
+		return fmt.Errorf("bad -on-failure policy '%s', want exit or restart", policy)
+	}
+	return nil
+}
+
+// startComponent runs c in the background.
+func startComponent(c *component) {
+	c.done = make(chan struct{})
+	componentsMu.Lock()
+	components = append(components, c)
+	componentsMu.Unlock()
+	go c.supervise()
+}
+
+// supervise runs c until it is stopped. A failure stops the process with
+// -on-failure exit, or has c run again after a backoff with restart. A
+// component whose socket was closed can't be restarted.
+func (c *component) supervise() {
+	defer close(c.done)
+	delay := minRestartDelay
+	for !stopping.Load() {
+		start := time.Now()
+		err := c.runSafe()
+		if stopping.Load() {
+			return
+		}
+		if err == nil {
+			err = errors.New("stopped")
+		}
+		cntCompFails.Add(c.name, 1)
+		if *flagOnFail != "restart" || errors.Is(err, net.ErrClosed) {
+			fail(fmt.Errorf("%s: %w", c.name, err))
+			return
+		}
+		if time.Since(start) >= maxRestartDelay {
+			delay = minRestartDelay
+		}
+		log.Printf("ERROR: %s failed, restarting in %s: %s\n", c.name, delay, err)
+		time.Sleep(delay)
+		if delay *= 2; delay > maxRestartDelay {
+			delay = maxRestartDelay
+		}
+	}
+}
+
+// runSafe runs c, turning a panic into an error.
+func (c *component) runSafe() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("ERROR: %s panicked: %v\n%s", c.name, r, debug.Stack())
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return c.run()
+}
+
+// stopComponents stops the components, the last started first, and waits
+// up to stopWait for them to return.
+func stopComponents() {
+	stopping.Store(true)
+	componentsMu.Lock()
+	defer componentsMu.Unlock()
+	for i := len(components) - 1; i >= 0; i-- {
+		if c := components[i]; c.stop != nil {
+			c.stop()
+		}
+	}
+	timeout := time.After(stopWait)
+	for _, c := range components {
+		select {
+		case <-c.done:
+		case <-timeout:
+			log.Printf("ERROR: %s still running after %s\n", c.name, stopWait)
+			return
+		}
+	}
+}
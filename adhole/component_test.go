@@ -0,0 +1,341 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"errors"
+	"expvar"
+	"flag"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// A component failing with -on-failure exit must stop the server with an
+// exit status telling so, after stopping the components.
+func TestFailureExitStatus(t *testing.T) {
+	withFlag(t, flagOnFail, "exit")
+	tests := []struct {
+		name  string
+		run   func() error // of a component, if any
+		fail  error        // reported otherwise
+		code  int
+		cause string
+	}{
+		{"component error", func() error { return errors.New("crashed") }, nil, exitFailed, "test: crashed"},
+		{"component panic", func() error { panic("oops") }, nil, exitFailed, "test: panic: oops"},
+		{"component returning", func() error { return nil }, nil, exitFailed, "test: stopped"},
+		{"watchdog", nil, &exitError{exitWatchdog, errors.New("listener wedged")}, exitWatchdog, "listener wedged"},
+	}
+	for _, tt := range tests {
+		stopped := make(chan struct{})
+		if tt.run != nil {
+			startComponent(&component{name: "test", run: tt.run, stop: func() { close(stopped) }})
+		} else {
+			close(stopped)
+			fail(tt.fail)
+		}
+
+		done := make(chan error, 1)
+		go func() { done <- serve() }()
+		var err error
+		select {
+		case err = <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatalf("%s: still serving", tt.name)
+		}
+		var ee *exitError
+		if !errors.As(err, &ee) || ee.Code != tt.code || !strings.Contains(err.Error(), tt.cause) {
+			t.Errorf("%s: returned %v, want exit status %d for %q", tt.name, err, tt.code, tt.cause)
+		}
+		select {
+		case <-stopped:
+		default:
+			t.Errorf("%s: components not stopped", tt.name)
+		}
+
+		stopping.Store(false)
+		componentsMu.Lock()
+		components = nil
+		componentsMu.Unlock()
+		atomic.StoreInt32(&ready, 0)
+	}
+}
+
+// withComponents has the test start with no components, and stops and
+// forgets the ones it started after.
+func withComponents(tb testing.TB) {
+	tb.Cleanup(func() {
+		if !stopping.Load() {
+			stopComponents()
+		}
+		stopping.Store(false)
+		componentsMu.Lock()
+		components = nil
+		componentsMu.Unlock()
+	})
+}
+
+// failCount returns the failures counted for the component named name.
+func failCount(name string) int64 {
+	if n, ok := cntCompFails.Get(name).(*expvar.Int); ok {
+		return n.Value()
+	}
+	return 0
+}
+
+// With -on-failure restart a failing component is run again after a delay
+// doubling up to the maximum, back to the minimum after a long enough run,
+// and each failure is counted.
+func TestRestartBackoff(t *testing.T) {
+	withFlag(t, flagOnFail, "restart")
+	withFlag(t, &minRestartDelay, 10*time.Millisecond)
+	withFlag(t, &maxRestartDelay, 40*time.Millisecond)
+	withComponents(t)
+	lb := withLogBuffer(t, 0)
+	attempts := []func() error{
+		func() error { return errors.New("crashed") },
+		func() error { return errors.New("crashed") },
+		func() error { time.Sleep(40 * time.Millisecond); return errors.New("crashed") },
+		func() error { panic("oops") },
+		func() error { return nil },
+		func() error { return errors.New("crashed") },
+	}
+	want := []string{"10ms: crashed", "20ms: crashed", "10ms: crashed", "20ms: panic: oops", "40ms: stopped", "40ms: crashed"}
+	fails := failCount("restarting")
+	running, stop := make(chan struct{}), make(chan struct{})
+	n := 0
+	startComponent(&component{
+		name: "restarting",
+		run: func() error {
+			if n < len(attempts) {
+				n++
+				return attempts[n-1]()
+			}
+			close(running)
+			<-stop
+			return nil
+		},
+		stop: func() { close(stop) },
+	})
+	select {
+	case <-running:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("not running again after %d attempts", n)
+	}
+	var got []string
+	for _, line := range lb.lines() {
+		if delay, ok := strings.CutPrefix(line, "ERROR: restarting failed, restarting in "); ok {
+			got = append(got, delay)
+		}
+	}
+	if strings.Join(got, "|") != strings.Join(want, "|") {
+		t.Errorf("restarted after %q, want %q", got, want)
+	}
+	if n := failCount("restarting") - fails; n != int64(len(attempts)) {
+		t.Errorf("%d failures counted, want %d", n, len(attempts))
+	}
+	select {
+	case err := <-failed:
+		t.Errorf("failed with %v", err)
+	default:
+	}
+}
+
+// A component whose socket was closed can't be restarted, so it stops the
+// server even with -on-failure restart.
+func TestRestartClosed(t *testing.T) {
+	withFlag(t, flagOnFail, "restart")
+	withComponents(t)
+	startComponent(&component{name: "closed", run: func() error {
+		return &net.OpError{Op: "read", Net: "udp", Err: net.ErrClosed}
+	}})
+	select {
+	case err := <-failed:
+		if !errors.Is(err, net.ErrClosed) || !strings.HasPrefix(err.Error(), "closed: ") {
+			t.Errorf("failed with %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("not failed")
+	}
+}
+
+// Shutting down stops the components, the last started first, and waits for
+// them to return, which is no failure then.
+func TestStopComponents(t *testing.T) {
+	withFlag(t, flagOnFail, "exit")
+	withComponents(t)
+	var (
+		mu      sync.Mutex
+		stopped []string
+	)
+	var started sync.WaitGroup
+	var returned atomic.Int32
+	for _, name := range []string{"upstream", "dns", "http"} {
+		stop := make(chan struct{})
+		started.Add(1)
+		startComponent(&component{
+			name: name,
+			run: func() error {
+				defer returned.Add(1)
+				started.Done()
+				<-stop
+				return errors.New("socket closed")
+			},
+			stop: func() {
+				mu.Lock()
+				stopped = append(stopped, name)
+				mu.Unlock()
+				close(stop)
+			},
+		})
+	}
+	fails := failCount("dns")
+	started.Wait()
+	stopComponents()
+	if n := returned.Load(); n != 3 {
+		t.Errorf("%d components returned when stopped, want 3", n)
+	}
+	if got := strings.Join(stopped, " "); got != "http dns upstream" {
+		t.Errorf("stopped in order %s, want http dns upstream", got)
+	}
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case err := <-failed:
+		t.Errorf("failed with %v", err)
+	default:
+	}
+	if failCount("dns") != fails {
+		t.Error("stopping counted as a failure")
+	}
+}
+
+// startServer runs AdHole with args until the test ends or calls the stop
+// it returns, which returns what run did. The flags and what run sets up are
+// put back after. startServer returns once the server is ready, or with
+// the error if it didn't start.
+func startServer(tb testing.TB, args ...string) (stop func() error, err error) {
+	tb.Helper()
+	flags := make(map[string]string)
+	flag.CommandLine.VisitAll(func(f *flag.Flag) { flags[f.Name] = f.Value.String() })
+	oldKey, oldLists, oldUp := key, lists, upstream.Load()
+	listMu.RLock()
+	oldRules, oldFiles := rules, ruleFiles
+	listMu.RUnlock()
+
+	done := make(chan error, 1)
+	go func() { done <- run(args) }()
+	var result error
+	returned := false
+	stop = func() error {
+		if !returned {
+			fail(errors.New("test done"))
+			result, returned = <-done, true
+		}
+		return result
+	}
+	tb.Cleanup(func() {
+		stop()
+		flag.CommandLine.VisitAll(func(f *flag.Flag) {
+			if f.Value.String() != flags[f.Name] {
+				f.Value.Set(flags[f.Name])
+			}
+		})
+		key, lists = oldKey, oldLists
+		upstream.Store(oldUp)
+		listMu.Lock()
+		rules, ruleFiles = oldRules, oldFiles
+		listMu.Unlock()
+		updateDisabled()
+		listeners, httpBound, httpConns, upStats = nil, nil, nil, nil
+		queries.max, queries.maxClient = 0, 0
+		atomic.StoreInt32(&ready, 0)
+		stopping.Store(false)
+		componentsMu.Lock()
+		components = nil
+		componentsMu.Unlock()
+	})
+	for deadline := time.Now().Add(5 * time.Second); atomic.LoadInt32(&ready) == 0; {
+		select {
+		case result = <-done:
+			returned = true
+			return stop, result
+		default:
+		}
+		if time.Now().After(deadline) {
+			tb.Fatal("server not ready")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	return stop, nil
+}
+
+// -no-dns and -no-http leave out the DNS or the HTTP servers, but not both,
+// and what runs is stopped on shutdown.
+func TestServeOnly(t *testing.T) {
+	list := writeTemp(t, "list.txt", "ads.example.com\n")
+	withLogBuffer(t, 0)
+	tests := []struct {
+		name string
+		flag string
+		dns  bool
+		http bool
+		err  string
+	}{
+		{"DNS only", "-no-http", true, false, ""},
+		{"HTTP only", "-no-dns", false, true, ""},
+		{"nothing", "-no-dns=1 -no-http", false, false, "leave nothing to serve"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := append(strings.Fields(tt.flag), "-dport", "0", "-hport", "0", "secret", "127.0.0.2", "127.0.0.1", list)
+			stop, err := startServer(t, args...)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("returned %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			dnsAddrs, httpAddrs := listeners, httpBound
+			if (len(dnsAddrs) > 0) != tt.dns || (len(httpAddrs) > 0) != tt.http {
+				t.Errorf("%d DNS and %d HTTP listeners", len(dnsAddrs), len(httpAddrs))
+			}
+			for _, l := range dnsAddrs {
+				if reply := ask(t, l, testQuery("ads.example.com.", typeA)); len(answerAddrs(reply)) != 1 {
+					t.Errorf("blocked name answered % x", reply)
+				}
+			}
+			for _, addr := range httpAddrs {
+				resp, err := http.Get("http://" + addr.String() + "/ad.gif")
+				if err != nil {
+					t.Error(err)
+					continue
+				}
+				resp.Body.Close()
+				if resp.StatusCode != http.StatusOK {
+					t.Errorf("pixel status %d", resp.StatusCode)
+				}
+			}
+
+			if err := stop(); err == nil || !strings.Contains(err.Error(), "test done") {
+				t.Errorf("stopped with %v", err)
+			}
+			if n := atomic.LoadInt64(&listening); n != 0 {
+				t.Errorf("%d DNS servers still running", n)
+			}
+			for _, addr := range httpAddrs {
+				if conn, err := net.Dial("tcp", addr.String()); err == nil {
+					conn.Close()
+					t.Errorf("HTTP server at %s still running", addr)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// secretFlags are the flags whose values aren't shown by /api/config, e.g.
+// webhook URLs, which often carry a token.
+var secretFlags = map[string]bool{"webhook": true}
+
+// configView is the configuration AdHole runs with, as /api/config shows
+// it: the addresses it resolved and bound, the lists it loaded and the
+// effective value of every flag, from the command line, the environment or
+// the default.
+type configView struct {
+	Version    string            `json:"version"`
+	Upstream   string            `json:"upstream"`
+	DNSListen  []string          `json:"dnsListen"`
+	HTTPListen []string          `json:"httpListen"`
+	Sinkhole   string            `json:"sinkhole,omitempty"`
+	Sinkhole6  string            `json:"sinkhole6,omitempty"`
+	Lists      []listFile        `json:"lists"`
+	Disabled   []string          `json:"disabledLists,omitempty"`
+	Features   map[string]bool   `json:"features"`
+	Flags      map[string]string `json:"flags"`
+}
+
+// currentConfig returns the configuration AdHole runs with.
+func currentConfig() *configView {
+	cv := &configView{
+		Version:    versionString(),
+		DNSListen:  []string{},
+		HTTPListen: []string{},
+		Flags:      make(map[string]string),
+	}
+	if conn := upstream.Load(); conn != nil {
+		cv.Upstream = conn.RemoteAddr().String()
+	}
+	for _, l := range listeners {
+		cv.DNSListen = append(cv.DNSListen, l.String())
+	}
+	if unixListener != nil {
+		cv.DNSListen = append(cv.DNSListen, unixListener.String())
+	}
+	componentsMu.Lock()
+	for _, c := range components {
+		if addr, ok := strings.CutPrefix(c.name, "http "); ok {
+			cv.HTTPListen = append(cv.HTTPListen, addr)
+		}
+	}
+	componentsMu.Unlock()
+	sv := currentSinkholes().view()
+	cv.Sinkhole, cv.Sinkhole6 = sv.IPv4, sv.IPv6
+	listMu.RLock()
+	cv.Lists = make([]listFile, len(ruleFiles))
+	for i, info := range ruleFiles {
+		info.Path = redactList(info.Path)
+		info.Included = make([]string, len(info.Included))
+		for j, path := range ruleFiles[i].Included {
+			info.Included[j] = redactList(path)
+		}
+		cv.Lists[i] = info
+	}
+	listMu.RUnlock()
+	for name := range disabledLists() {
+		cv.Disabled = append(cv.Disabled, name)
+	}
+	sort.Strings(cv.Disabled)
+	cv.Features = map[string]bool{
+		"answerCache":    cache != nil,
+		"bloom":          *flagBloom,
+		"dnssecNXDomain": *flagDNSSECNX,
+		"listCache":      *flagCache,
+		"pac":            *flagPAC,
+		"prefetch":       cache != nil && *flagPrefetch > 0 && *flagPFRate > 0,
+		"privacy":        *flagPrivacy != "",
+		"queryLog":       queryLog != nil,
+		"record":         recordings != nil,
+		"statsd":         *flagStatsd != "",
+		"tarpit":         *flagTarpit > 0,
+		"tunnel":         *flagTunnel,
+		"upstreamTCP":    upPool != nil,
+		"webhook":        *flagWebhook != "",
+	}
+	flag.VisitAll(func(f *flag.Flag) {
+		cv.Flags[f.Name] = redactFlag(f.Name, f.Value.String())
+	})
+	return cv
+}
+
+// redactFlag returns the value of the flag called name as /api/config shows
+// it: secret flags as xxxxx if set, and URLs redacted by redactURL.
+func redactFlag(name, value string) string {
+	if value == "" {
+		return value
+	}
+	if secretFlags[name] {
+		return "xxxxx"
+	}
+	if !strings.Contains(value, "://") {
+		return value
+	}
+	parts := strings.Split(value, ",")
+	for i, part := range parts {
+		prefix, raw, ok := strings.Cut(part, "=")
+		if !ok || strings.Contains(prefix, "://") {
+			prefix, raw = "", part
+		} else {
+			prefix += "="
+		}
+		if u, err := url.Parse(raw); err == nil {
+			parts[i] = prefix + redactURL(u)
+		}
+	}
+	return strings.Join(parts, ",")
+}
+
+// redactList returns the path of a list file as /api/config shows it: list
+// URLs redacted by redactURL, or xxxxx if they can't be parsed.
+func redactList(path string) string {
+	if !isRemote(path) {
+		return path
+	}
+	u, err := url.Parse(path)
+	if err != nil {
+		return "xxxxx"
+	}
+	return redactURL(u)
+}
+
+// redactURL returns u with xxxxx for its user info and its query, either of
+// which may carry a token or a password.
+func redactURL(u *url.URL) string {
+	r := *u
+	if r.User != nil {
+		r.User = url.User("xxxxx")
+	}
+	if r.RawQuery != "" {
+		r.RawQuery = "xxxxx"
+	}
+	return r.String()
+}
+
+// handleAPIConfig serves GET /api/config, the configuration AdHole runs
+// with. The key is never shown, nor are the secretFlags.
+func handleAPIConfig(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !authHTTP(req) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad key"})
+		return
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(currentConfig())
+}
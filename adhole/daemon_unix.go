@@ -0,0 +1,52 @@
+// See LICENSE.txt for licensing information.
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// daemonEnv marks the re-executed background process.
+const daemonEnv = "ADHOLE_DAEMON"
+
+// daemonize re-executes adhole in the background, in a new session and with
+// its output going to logfile (or nowhere if empty). It returns in the
+// background process, and exits in the foreground one once that is started.
+func daemonize(logfile string) error {
+	if os.Getenv(daemonEnv) != "" {
+		os.Unsetenv(daemonEnv)
+		return nil
+	}
+	if logfile == "" {
+		logfile = os.DevNull
+	}
+	out, err := os.OpenFile(logfile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, os.Args[1:]...)
+	cmd.Env = append(os.Environ(), daemonEnv+"=1")
+	cmd.Stdout = out
+	cmd.Stderr = out
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	os.Exit(0)
+	return nil
+}
+
+// processAlive tells if a process with the given PID exists.
+func processAlive(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
@@ -0,0 +1,25 @@
+// See LICENSE.txt for licensing information.
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+	"os"
+)
+
+// daemonize is not supported on Windows, run adhole as a service instead.
+func daemonize(logfile string) error {
+	return errors.New("-daemon is not supported on Windows, use a service")
+}
+
+// processAlive tells if a process with the given PID exists.
+func processAlive(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
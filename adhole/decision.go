@@ -0,0 +1,102 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"expvar"
+	"hash/maphash"
+	"sync"
+	"sync/atomic"
+)
+
+// The decision cache has decisionShards shards of up to decisionShardSize
+// names each. A full shard is emptied, which is cheaper than tracking which
+// names are used least, and hot names are back after one lookup.
+const (
+	decisionShards    = 16
+	decisionShardSize = 256
+)
+
+// decision is the outcome of matchBlocked for a name.
+type decision struct {
+	zone  string
+	src   ruleSource
+	block bool
+}
+
+// decisionShard is a part of the cache, with its own lock.
+type decisionShard struct {
+	mu sync.RWMutex
+	m  map[string]decision
+}
+
+// decisionCache remembers the decisions of matchBlocked for the names asked
+// about most, for one rule set with the lists enabled at the time.
+type decisionCache struct {
+	rs     *ruleSet
+	seed   maphash.Seed
+	shards [decisionShards]decisionShard
+}
+
+var (
+	// decisions is the cache for the current rule set, replaced by an empty
+	// one whenever the rules change or lists are enabled or disabled.
+	decisions atomic.Pointer[decisionCache]
+	// Lookups answered from the cache, and not.
+	decisionHits, decisionMisses atomic.Int64
+)
+
+func init() {
+	expvar.Publish("decisionCache", expvar.Func(func() interface{} {
+		hits, misses := decisionHits.Load(), decisionMisses.Load()
+		rate := 0.0
+		if hits+misses > 0 {
+			rate = float64(hits) / float64(hits+misses)
+		}
+		size := 0
+		if c := decisions.Load(); c != nil {
+			for i := range c.shards {
+				s := &c.shards[i]
+				s.mu.RLock()
+				size += len(s.m)
+				s.mu.RUnlock()
+			}
+		}
+		return map[string]interface{}{"hits": hits, "misses": misses, "hitRate": rate, "size": size}
+	}))
+}
+
+// resetDecisions starts an empty decision cache for rs.
+func resetDecisions(rs *ruleSet) {
+	c := &decisionCache{rs: rs, seed: maphash.MakeSeed()}
+	for i := range c.shards {
+		c.shards[i].m = make(map[string]decision, decisionShardSize)
+	}
+	decisions.Store(c)
+}
+
+// matchCached is matchBlocked, answered from the decision cache if name was
+// looked up since the rules or the enabled lists last changed.
+func (rs *ruleSet) matchCached(name string) (string, ruleSource, bool) {
+	c := decisions.Load()
+	if c == nil || c.rs != rs {
+		return rs.matchBlocked(name)
+	}
+	s := &c.shards[maphash.String(c.seed, name)%decisionShards]
+	s.mu.RLock()
+	d, ok := s.m[name]
+	s.mu.RUnlock()
+	if ok {
+		decisionHits.Add(1)
+		return d.zone, d.src, d.block
+	}
+	decisionMisses.Add(1)
+	d.zone, d.src, d.block = rs.matchBlocked(name)
+	s.mu.Lock()
+	if len(s.m) >= decisionShardSize {
+		clear(s.m)
+	}
+	s.m[name] = d
+	s.mu.Unlock()
+	return d.zone, d.src, d.block
+}
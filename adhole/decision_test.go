@@ -0,0 +1,55 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+)
+
+// BenchmarkDecisionCache looks up names asked about as often as in real
+// traffic, where a few are most of the queries, with the decision cache
+// and without it.
+func BenchmarkDecisionCache(b *testing.B) {
+	rnd := rand.New(rand.NewSource(1))
+	names := benchNames(rnd, 100000)
+	rs := benchRules(names)
+	asked := make([]string, 20000)
+	for i := range asked {
+		if i%2 == 0 {
+			asked[i] = "cdn." + names[rnd.Intn(len(names))]
+		} else {
+			asked[i] = fmt.Sprintf("www.site%d.example.org.", i)
+		}
+	}
+	rnd.Shuffle(len(asked), func(i, j int) { asked[i], asked[j] = asked[j], asked[i] })
+	b.Cleanup(func() { resetDecisions(currentRules()) })
+
+	for _, cached := range []bool{true, false} {
+		name := "uncached"
+		if cached {
+			name = "cached"
+		}
+		b.Run(name, func(b *testing.B) {
+			resetDecisions(rs)
+			lookup := rs.matchBlocked
+			if cached {
+				lookup = rs.matchCached
+			}
+			hits, misses := decisionHits.Load(), decisionMisses.Load()
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				zipf := rand.NewZipf(rand.New(rand.NewSource(rand.Int63())), 1.1, 1, uint64(len(asked)-1))
+				for pb.Next() {
+					lookup(asked[zipf.Uint64()])
+				}
+			})
+			if cached {
+				hits, misses = decisionHits.Load()-hits, decisionMisses.Load()-misses
+				b.ReportMetric(float64(hits)/float64(hits+misses), "hit-rate")
+			}
+		})
+	}
+}
@@ -0,0 +1,143 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// dhcpFormats write the DNS server option for a DHCP server, and for those
+// that are also DNS servers the self name, given as "" if there is none.
+var dhcpFormats = map[string]func(servers []net.IP, self string, self6 net.IP){
+	"dnsmasq": dhcpDnsmasq,
+	"kea":     dhcpKea,
+	"udhcpd":  dhcpUdhcpd,
+}
+
+// runDHCPConfig runs the dhcp-config subcommand: it prints the DHCP server
+// options that point the network at AdHole's DNS listen addresses, resolved
+// from the same options, environment and arguments as the server. It
+// returns the exit code.
+func runDHCPConfig(args []string) int {
+	fs := flag.NewFlagSet("dhcp-config", flag.ContinueOnError)
+	format := fs.String("format", "dnsmasq", "DHCP server to write options for: dnsmasq, kea or udhcpd")
+	advertise := fs.String("advertise", "", "comma separated addresses to give clients instead of the DNS listen addresses")
+	flag.CommandLine.VisitAll(func(f *flag.Flag) { fs.Var(f.Value, f.Name, f.Usage) })
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s dhcp-config [-format dnsmasq|kea|udhcpd] [-advertise ip,...] [server options] KEY UPSTREAM PROXY [lists]\n\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "  -advertise string\n    \t%s\n", fs.Lookup("advertise").Usage)
+		fmt.Fprintf(os.Stderr, "  -format string\n    \t%s (default \"dnsmasq\")\n", fs.Lookup("format").Usage)
+	}
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if err := applyEnv(fs, os.Getenv); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return 1
+	}
+	write, ok := dhcpFormats[*format]
+	args = envPositional(fs.Args(), os.Getenv)
+	if !ok || len(args) < 3 {
+		fs.Usage()
+		return 1
+	}
+
+	servers, err := dhcpServers(args[2], *advertise)
+	var self string
+	if err == nil {
+		self, err = parseSelfName(*flagSelfName)
+	}
+	var self6 net.IP
+	if err == nil && *flagSink6 != "" {
+		if self6 = net.ParseIP(*flagSink6); self6 == nil || self6.To4() != nil {
+			err = fmt.Errorf("Can't parse sinkhole6 IPv6 '%s'", *flagSink6)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return 2
+	}
+	write(servers, strings.TrimSuffix(self, "."), self6)
+	return 0
+}
+
+// dhcpServers returns the addresses DHCP clients should use for DNS: the
+// advertised ones if given, or else the DNS listen addresses, which must
+// then be specific addresses on port 53, the only one DHCP can tell about.
+func dhcpServers(proxy, advertise string) ([]net.IP, error) {
+	var servers []net.IP
+	if advertise != "" {
+		for _, item := range strings.Split(advertise, ",") {
+			ip, err := parseIPv4(strings.TrimSpace(item), "advertise")
+			if err != nil {
+				return nil, err
+			}
+			servers = append(servers, ip)
+		}
+		return servers, nil
+	}
+	proxyIP, err := parseIPv4(proxy, "proxy")
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := dnsListenAddrs(proxyIP)
+	if err != nil {
+		return nil, err
+	}
+	for _, addr := range addrs {
+		if addr.IP.IsUnspecified() {
+			return nil, fmt.Errorf("listening on %s, give the address clients should use with -advertise", addr)
+		}
+		if addr.Port != 53 {
+			return nil, fmt.Errorf("listening on %s, but DHCP clients can only use port 53; forward it and give the address with -advertise", addr)
+		}
+		servers = append(servers, addr.IP)
+	}
+	if len(servers) == 0 {
+		return nil, errors.New("no DNS listen addresses")
+	}
+	return servers, nil
+}
+
+// joinIPs joins addresses with sep.
+func joinIPs(ips []net.IP, sep string) string {
+	s := make([]string, len(ips))
+	for i, ip := range ips {
+		s[i] = ip.String()
+	}
+	return strings.Join(s, sep)
+}
+
+// dhcpDnsmasq writes dnsmasq.conf lines, with the self name answered by
+// dnsmasq too, as its clients may ask it rather than AdHole.
+func dhcpDnsmasq(servers []net.IP, self string, self6 net.IP) {
+	fmt.Println("# DNS servers for DHCP clients: AdHole")
+	fmt.Printf("dhcp-option=option:dns-server,%s\n", joinIPs(servers, ","))
+	if self == "" {
+		return
+	}
+	for _, ip := range servers {
+		fmt.Printf("address=/%s/%s\n", self, ip)
+	}
+	if self6 != nil {
+		fmt.Printf("address=/%s/%s\n", self, self6)
+	}
+}
+
+// dhcpKea writes the option-data of a Dhcp4 subnet or the global scope.
+func dhcpKea(servers []net.IP, self string, self6 net.IP) {
+	fmt.Printf(`"option-data": [
+    { "name": "domain-name-servers", "data": "%s" }
+]
+`, joinIPs(servers, ", "))
+}
+
+// dhcpUdhcpd writes udhcpd.conf lines.
+func dhcpUdhcpd(servers []net.IP, self string, self6 net.IP) {
+	fmt.Printf("option dns %s\n", joinIPs(servers, " "))
+}
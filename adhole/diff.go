@@ -0,0 +1,152 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"expvar"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ruleDiff tells how the rules changed with a reload.
+type ruleDiff struct {
+	Time      time.Time `json:"time"`
+	Added     int       `json:"added"`
+	Removed   int       `json:"removed"`
+	Unchanged int       `json:"unchanged"`
+	// Some of the added and removed rules, for spot checks.
+	AddedSample   []string `json:"addedSample,omitempty"`
+	RemovedSample []string `json:"removedSample,omitempty"`
+}
+
+// lastDiff is the diff of the last reload, guarded by lastDiffMu.
+var (
+	lastDiff   *ruleDiff
+	lastDiffMu sync.Mutex
+)
+
+func init() {
+	expvar.Publish("lastReload", expvar.Func(func() interface{} {
+		lastDiffMu.Lock()
+		defer lastDiffMu.Unlock()
+		return lastDiff
+	}))
+}
+
+// ruleKind is one of the kinds of rules in a rule set, keyed by name.
+type ruleKind struct {
+	prefix string // to tell the kinds apart in samples
+	len    int
+	has    func(name string) bool
+	each   func(fn func(name string) bool) // until fn returns false
+}
+
+// kinds returns the kinds of rules in rs.
+func (rs *ruleSet) kinds() []ruleKind {
+	return []ruleKind{
+		sourceKind("", rs.blocked),
+		sourceKind("*.", rs.tlds),
+		sourceKind("contains:", rs.substrs),
+		{
+			prefix: "local:",
+			len:    len(rs.local),
+			has:    func(name string) bool { return rs.local[name] != nil },
+			each: func(fn func(string) bool) {
+				for name := range rs.local {
+					if !fn(name) {
+						return
+					}
+				}
+			},
+		},
+		{
+			prefix: "server:",
+			len:    len(rs.forward),
+			has:    func(name string) bool { return rs.forward[name] != nil },
+			each: func(fn func(string) bool) {
+				for name := range rs.forward {
+					if !fn(name) {
+						return
+					}
+				}
+			},
+		},
+	}
+}
+
+// sourceKind returns the kind of rules in m.
+func sourceKind(prefix string, m map[string]ruleSource) ruleKind {
+	return ruleKind{
+		prefix: prefix,
+		len:    len(m),
+		has: func(name string) bool {
+			_, ok := m[name]
+			return ok
+		},
+		each: func(fn func(string) bool) {
+			for name := range m {
+				if !fn(name) {
+					return
+				}
+			}
+		},
+	}
+}
+
+// diffRules compares the rules of two rule sets, with up to samples added
+// and removed rules. Only the smaller set of each kind is walked to count
+// the unchanged rules, the sets are walked again only for samples.
+func diffRules(old, cur *ruleSet, samples int) *ruleDiff {
+	diff := &ruleDiff{Time: time.Now()}
+	oldKinds, curKinds := old.kinds(), cur.kinds()
+	for i := range curKinds {
+		o, c := oldKinds[i], curKinds[i]
+		small, large := o, c
+		if c.len < o.len {
+			small, large = c, o
+		}
+		same := 0
+		small.each(func(name string) bool {
+			if large.has(name) {
+				same++
+			}
+			return true
+		})
+		diff.Unchanged += same
+		diff.Added += c.len - same
+		diff.Removed += o.len - same
+		if c.len > same {
+			diff.AddedSample = sampleMissing(diff.AddedSample, c, o, samples)
+		}
+		if o.len > same {
+			diff.RemovedSample = sampleMissing(diff.RemovedSample, o, c, samples)
+		}
+	}
+	sort.Strings(diff.AddedSample)
+	sort.Strings(diff.RemovedSample)
+	return diff
+}
+
+// sampleMissing appends rules of from that aren't in to, until sample holds
+// max of them.
+func sampleMissing(sample []string, from, to ruleKind, max int) []string {
+	from.each(func(name string) bool {
+		if len(sample) >= max {
+			return false
+		}
+		if !to.has(name) {
+			sample = append(sample, from.prefix+strings.TrimSuffix(name, "."))
+		}
+		return true
+	})
+	return sample
+}
+
+// setLastDiff records the diff of the last reload.
+func setLastDiff(diff *ruleDiff) {
+	lastDiffMu.Lock()
+	lastDiff = diff
+	lastDiffMu.Unlock()
+}
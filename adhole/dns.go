@@ -0,0 +1,397 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// DNS wire format constants.
+const (
+	headerLen = 12
+
+	typeA     = 1
+	typeNS    = 2
+	typeCNAME = 5
+	typeSOA   = 6
+	typePTR   = 12
+	typeMX    = 15
+	typeTXT   = 16
+	typeAAAA  = 28
+	typeSRV   = 33
+	typeOPT   = 41
+	typeSVCB  = 64
+	typeHTTPS = 65
+	typeANY   = 255
+
+	classIN = 1
+	classCH = 3 // CHAOS, used for server identification
+
+	rcodeFormErr  = 1
+	rcodeServFail = 2
+	rcodeNXDomain = 3
+	rcodeNotImp   = 4
+	rcodeRefused  = 5
+)
+
+// typeNames maps the query types we keep statistics for to their mnemonics.
+var typeNames = map[uint16]string{
+	typeA:     "A",
+	typeNS:    "NS",
+	typeCNAME: "CNAME",
+	typeSOA:   "SOA",
+	typePTR:   "PTR",
+	typeMX:    "MX",
+	typeTXT:   "TXT",
+	typeAAAA:  "AAAA",
+	typeSRV:   "SRV",
+	typeSVCB:  "SVCB",
+	typeHTTPS: "HTTPS",
+	typeANY:   "ANY",
+}
+
+// typeName returns the mnemonic of a query type, or "other".
+func typeName(qtype uint16) string {
+	if name, ok := typeNames[qtype]; ok {
+		return name
+	}
+	return "other"
+}
+
+// parseTypes parses a comma separated list of type mnemonics.
+func parseTypes(arg string) (map[uint16]bool, error) {
+	types := make(map[uint16]bool)
+outer:
+	for _, item := range strings.Split(arg, ",") {
+		item = strings.ToUpper(strings.TrimSpace(item))
+		if item == "" {
+			continue
+		}
+		for qtype, name := range typeNames {
+			if name == item {
+				types[qtype] = true
+				continue outer
+			}
+		}
+		return nil, errors.New("unknown query type " + item)
+	}
+	return types, nil
+}
+
+// rcodeNames maps response codes to their mnemonics.
+var rcodeNames = map[int]string{
+	0:  "NOERROR",
+	1:  "FORMERR",
+	2:  "SERVFAIL",
+	3:  "NXDOMAIN",
+	4:  "NOTIMP",
+	5:  "REFUSED",
+	6:  "YXDOMAIN",
+	7:  "YXRRSET",
+	8:  "NXRRSET",
+	9:  "NOTAUTH",
+	10: "NOTZONE",
+}
+
+// rcodeName returns the mnemonic of a response code.
+func rcodeName(rcode int) string {
+	if name, ok := rcodeNames[rcode]; ok {
+		return name
+	}
+	return "RCODE" + strconv.Itoa(rcode)
+}
+
+// errMalformed is returned when a message can't be walked.
+var errMalformed = errors.New("malformed DNS message")
+
+// parseQuestion parses the first question of a query. It returns the name
+// in dotted form, with exactly one trailing dot ("." for the root), the query
+// type and the offset just past the question. Dots and backslashes inside
+// labels are escaped as \046 and \092, so that every other dot ends a label.
+func parseQuestion(msg []byte) (name string, qtype uint16, end int, err error) {
+	if len(msg) < headerLen {
+		return "", 0, 0, errMalformed
+	}
+	// Names are at most 255 bytes, so the buffer stays on the stack and only
+	// the string is allocated.
+	domain := make([]byte, 0, 256)
+	off := headerLen
+	for {
+		if off >= len(msg) {
+			return "", 0, 0, errMalformed
+		}
+		length := int(msg[off])
+		if length == 0 {
+			off++
+			break
+		}
+		if length > 63 || off+1+length > len(msg) {
+			return "", 0, 0, errMalformed
+		}
+		domain = appendLabel(domain, msg[off+1:off+1+length])
+		off += 1 + length
+	}
+	if off+4 > len(msg) {
+		return "", 0, 0, errMalformed
+	}
+	if len(domain) == 0 {
+		domain = append(domain, '.')
+	}
+	return string(domain), binary.BigEndian.Uint16(msg[off:]), off + 4, nil
+}
+
+// questionClass returns the class of the question ending at end, as
+// returned by parseQuestion.
+func questionClass(msg []byte, end int) uint16 {
+	return binary.BigEndian.Uint16(msg[end-2:])
+}
+
+// appendLabel appends a label and the dot ending it to a dotted name, with
+// dots and backslashes in it escaped.
+func appendLabel(name, label []byte) []byte {
+	for _, c := range label {
+		switch c {
+		case '.':
+			name = append(name, `\046`...)
+		case '\\':
+			name = append(name, `\092`...)
+		default:
+			name = append(name, c)
+		}
+	}
+	return append(name, '.')
+}
+
+// escapeName returns name, as returned by parseQuestion, with bytes other
+// than printable ASCII written as RFC 1035 \DDD escapes, so that binary
+// labels can't mess up the logs. Backslashes are escapes already.
+func escapeName(name string) string {
+	i := 0
+	for i < len(name) && name[i] > ' ' && name[i] < 0x7f {
+		i++
+	}
+	if i == len(name) {
+		return name
+	}
+	b := []byte(name[:i])
+	for ; i < len(name); i++ {
+		if c := name[i]; c > ' ' && c < 0x7f {
+			b = append(b, c)
+		} else {
+			b = append(b, '\\', '0'+c/100, '0'+c/10%10, '0'+c%10)
+		}
+	}
+	return string(b)
+}
+
+// lowerName returns name with ASCII letters lowercased. Other bytes are
+// left alone, unlike strings.ToLower which replaces invalid UTF-8.
+func lowerName(name string) string {
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; c >= 'A' && c <= 'Z' {
+			b := []byte(name)
+			for j := i; j < len(b); j++ {
+				if c := b[j]; c >= 'A' && c <= 'Z' {
+					b[j] = c + 'a' - 'A'
+				}
+			}
+			return string(b)
+		}
+	}
+	return name
+}
+
+// restoreQuestion copies the question of query, as the client sent it, over
+// the question of answer if the two only differ in the case of the name.
+// Resolvers using dns0x20 compare the question of the answer with theirs
+// byte for byte, and an upstream may answer in another case. It reports
+// whether answer was changed.
+func restoreQuestion(answer, query []byte) bool {
+	if len(answer) < headerLen || len(query) < headerLen ||
+		binary.BigEndian.Uint16(answer[4:]) != 1 || binary.BigEndian.Uint16(query[4:]) != 1 {
+		return false
+	}
+	end, err := skipName(query, headerLen)
+	if err != nil || end+4 > len(query) || end+4 > len(answer) {
+		return false
+	}
+	if !bytes.Equal(answer[end:end+4], query[end:end+4]) {
+		return false // type, class
+	}
+	a, q := answer[headerLen:end], query[headerLen:end]
+	changed := false
+	for i := range q {
+		if a[i] == q[i] {
+			continue
+		}
+		if a[i]|0x20 != q[i]|0x20 || a[i]|0x20 < 'a' || a[i]|0x20 > 'z' {
+			return false
+		}
+		changed = true
+	}
+	if changed {
+		copy(a, q)
+	}
+	return changed
+}
+
+// queryEDNS tells if a query carries an OPT record, and if so whether it has
+// the DO (DNSSEC OK) bit set.
+func queryEDNS(msg []byte) (edns, do bool) {
+	walkRecords(msg, func(rrtype uint16, off int) {
+		if rrtype == typeOPT {
+			edns = true
+			do = msg[off+6]&0x80 != 0
+		}
+	})
+	return
+}
+
+// queryPadded reports whether the query's OPT record has a padding option,
+// which asks for the reply to be padded too.
+func queryPadded(msg []byte) (padded bool) {
+	walkRecords(msg, func(rrtype uint16, off int) {
+		if rrtype != typeOPT {
+			return
+		}
+		opts := msg[off+10 : off+10+int(binary.BigEndian.Uint16(msg[off+8:]))]
+		for len(opts) >= 4 {
+			code := binary.BigEndian.Uint16(opts)
+			n := 4 + int(binary.BigEndian.Uint16(opts[2:]))
+			if n > len(opts) {
+				return
+			}
+			if code == optPadding {
+				padded = true
+			}
+			opts = opts[n:]
+		}
+	})
+	return
+}
+
+// ednsSize returns the UDP payload size advertised in the query's OPT record,
+// or 0 if it has none.
+func ednsSize(msg []byte) (size int) {
+	walkRecords(msg, func(rrtype uint16, off int) {
+		if rrtype == typeOPT {
+			size = int(binary.BigEndian.Uint16(msg[off+2:]))
+		}
+	})
+	return
+}
+
+// skipName returns the offset just past the (possibly compressed) name
+// starting at off.
+func skipName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errMalformed
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			return off + 1, nil
+		case length&0xc0 == 0xc0:
+			// A compression pointer always ends the name.
+			if off+2 > len(msg) {
+				return 0, errMalformed
+			}
+			return off + 2, nil
+		case length&0xc0 != 0:
+			return 0, errMalformed
+		}
+		off += 1 + length
+	}
+}
+
+// skipRecord returns the offset just past the resource record starting at
+// off.
+func skipRecord(msg []byte, off int) (int, error) {
+	off, err := skipName(msg, off)
+	if err != nil {
+		return 0, err
+	}
+	if off+10 > len(msg) {
+		return 0, errMalformed
+	}
+	end := off + 10 + int(binary.BigEndian.Uint16(msg[off+8:]))
+	if end > len(msg) {
+		return 0, errMalformed
+	}
+	return end, nil
+}
+
+// walkRecords calls fn for every resource record in the answer, authority
+// and additional sections of msg. The offset passed to fn points at the
+// record's type, just after its name.
+func walkRecords(msg []byte, fn func(rrtype uint16, off int)) error {
+	if len(msg) < headerLen {
+		return errMalformed
+	}
+	qdcount := int(binary.BigEndian.Uint16(msg[4:]))
+	rrcount := int(binary.BigEndian.Uint16(msg[6:])) +
+		int(binary.BigEndian.Uint16(msg[8:])) +
+		int(binary.BigEndian.Uint16(msg[10:]))
+
+	off := headerLen
+	var err error
+	for i := 0; i < qdcount; i++ {
+		if off, err = skipName(msg, off); err != nil {
+			return err
+		}
+		off += 4 // type, class
+	}
+	for i := 0; i < rrcount; i++ {
+		if off, err = skipName(msg, off); err != nil {
+			return err
+		}
+		if off+10 > len(msg) {
+			return errMalformed
+		}
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		if off+10+rdlen > len(msg) {
+			return errMalformed
+		}
+		fn(binary.BigEndian.Uint16(msg[off:]), off)
+		off += 10 + rdlen
+	}
+	return nil
+}
+
+// clampTTLs rewrites, in place, the TTLs of all records in msg so they fall
+// between min and max seconds; a zero max means no upper limit. The OPT
+// pseudo-record is left alone as its TTL field holds flags. The message is
+// only modified if it can be walked completely.
+func clampTTLs(msg []byte, min, max uint32) (int, error) {
+	var offsets []int
+	err := walkRecords(msg, func(rrtype uint16, off int) {
+		if rrtype != typeOPT {
+			offsets = append(offsets, off+4)
+		}
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	for _, off := range offsets {
+		ttl := binary.BigEndian.Uint32(msg[off:])
+		clamped := ttl
+		if clamped < min {
+			clamped = min
+		}
+		if max > 0 && clamped > max {
+			clamped = max
+		}
+		if clamped != ttl {
+			binary.BigEndian.PutUint32(msg[off:], clamped)
+			changed++
+		}
+	}
+	return changed, nil
+}
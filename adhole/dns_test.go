@@ -0,0 +1,289 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// answerVectors are upstream answers laid out the way recursive resolvers
+// send them: compressed owner names, names compressed inside record data,
+// an OPT record, DNSSEC signatures and an authority section.
+var answerVectors = map[string]string{
+	"cname-chain": "" +
+		"a1b28180000100040000000103777777096d6963726f736f667403636f6d0000" +
+		"010001c00c0005000100000e10002303777777096d6963726f736f667407636f" +
+		"6d2d632d3307656467656b6579036e657400c02f000500010000038400370377" +
+		"7777096d6963726f736f667407636f6d2d632d3307656467656b6579036e6574" +
+		"0b676c6f62616c726564697206616b61646e73c04dc05e000500010000038400" +
+		"190665313336373804647363620a616b616d616965646765c04dc0a100010001" +
+		"00000014000417377c9700002904d0000000000000",
+	"dnssec": "" +
+		"0c0181a00001000200000001076578616d706c6503636f6d0000010001c00c00" +
+		"01000100000d1900045db8d70ec00c002e000100000d19005f00010d0200000e" +
+		"10671db48066ff30000172076578616d706c6503636f6d000001020304050607" +
+		"08090a0b0c0d0e0f101112131415161718191a1b1c1d1e1f2021222324252627" +
+		"28292a2b2c2d2e2f303132333435363738393a3b3c3d3e3f00002904d0000080" +
+		"000000",
+	"nxdomain": "" +
+		"5d2e818300010000000100010a6e6f737563686e616d65076578616d706c6503" +
+		"636f6d0000010001c0170006000100000e10002c026e73056963616e6e036f72" +
+		"6700036e6f6303646e73c03778a507c100001c2000000e100012750000000e10" +
+		"00002904d0000000000000",
+	"mx": "" +
+		"777781800001000200000002076578616d706c65036f726700000f0001c00c00" +
+		"0f0001000151800009000a046d61696cc00cc00c000f00010000000500080014" +
+		"036d7832c00cc02b0001000100093a800004c0000219c040001c000100093a80" +
+		"001000000000000000000000000000000000",
+}
+
+func answerVector(tb testing.TB, name string) []byte {
+	tb.Helper()
+	msg, err := hex.DecodeString(answerVectors[name])
+	if err != nil || len(msg) == 0 {
+		tb.Fatalf("vector %s: %v", name, err)
+	}
+	return msg
+}
+
+// recordTTLs returns the TTL of every record but OPT, in message order.
+func recordTTLs(tb testing.TB, msg []byte) []uint32 {
+	tb.Helper()
+	var ttls []uint32
+	err := walkRecords(msg, func(rrtype uint16, off int) {
+		if rrtype != typeOPT {
+			ttls = append(ttls, binary.BigEndian.Uint32(msg[off+4:]))
+		}
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return ttls
+}
+
+func TestWalkRecords(t *testing.T) {
+	tests := []struct {
+		vector string
+		types  []uint16
+	}{
+		{"cname-chain", []uint16{typeCNAME, typeCNAME, typeCNAME, typeA, typeOPT}},
+		{"dnssec", []uint16{typeA, 46, typeOPT}}, // RRSIG,
+		{"nxdomain", []uint16{typeSOA, typeOPT}},
+		{"mx", []uint16{typeMX, typeMX, typeA, typeAAAA}},
+	}
+	for _, tt := range tests {
+		msg := answerVector(t, tt.vector)
+		var types []uint16
+		if err := walkRecords(msg, func(rrtype uint16, off int) {
+			types = append(types, rrtype)
+		}); err != nil {
+			t.Errorf("%s: %v", tt.vector, err)
+			continue
+		}
+		if !reflect.DeepEqual(types, tt.types) {
+			t.Errorf("%s: types %v, want %v", tt.vector, types, tt.types)
+		}
+	}
+}
+
+func TestClampTTLs(t *testing.T) {
+	tests := []struct {
+		vector   string
+		min, max uint32
+		changed  int
+		ttls     []uint32
+	}{
+		{"cname-chain", 0, 0, 0, []uint32{3600, 900, 900, 20}},
+		{"cname-chain", 60, 0, 1, []uint32{3600, 900, 900, 60}},
+		{"cname-chain", 0, 300, 3, []uint32{300, 300, 300, 20}},
+		{"cname-chain", 60, 300, 4, []uint32{300, 300, 300, 60}},
+		{"dnssec", 0, 3600, 0, []uint32{3353, 3353}},
+		{"dnssec", 0, 600, 2, []uint32{600, 600}},
+		{"nxdomain", 0, 900, 1, []uint32{900}},
+		{"nxdomain", 7200, 0, 1, []uint32{7200}},
+		{"mx", 30, 86400, 3, []uint32{86400, 30, 86400, 86400}},
+		{"mx", 900, 900, 4, []uint32{900, 900, 900, 900}},
+	}
+	for _, tt := range tests {
+		msg := answerVector(t, tt.vector)
+		orig := append([]byte(nil), msg...)
+		changed, err := clampTTLs(msg, tt.min, tt.max)
+		if err != nil {
+			t.Errorf("%s %d-%d: %v", tt.vector, tt.min, tt.max, err)
+			continue
+		}
+		if changed != tt.changed {
+			t.Errorf("%s %d-%d: changed %d, want %d", tt.vector, tt.min, tt.max, changed, tt.changed)
+		}
+		if ttls := recordTTLs(t, msg); !reflect.DeepEqual(ttls, tt.ttls) {
+			t.Errorf("%s %d-%d: TTLs %v, want %v", tt.vector, tt.min, tt.max, ttls, tt.ttls)
+		}
+		// Only TTL fields may change: names, record data and the
+		// OPT pseudo-record (whose TTL carries the DO bit) stay put.
+		ttlBytes := map[int]bool{}
+		walkRecords(orig, func(rrtype uint16, off int) {
+			if rrtype != typeOPT {
+				for i := 0; i < 4; i++ {
+					ttlBytes[off+4+i] = true
+				}
+			}
+		})
+		for i := range msg {
+			if msg[i] != orig[i] && !ttlBytes[i] {
+				t.Errorf("%s %d-%d: byte %d changed outside a TTL", tt.vector, tt.min, tt.max, i)
+				break
+			}
+		}
+	}
+}
+
+// TestClampTTLsMalformed checks that a cut-off or corrupted answer is
+// refused as a whole rather than clamped up to the damage.
+func TestClampTTLsMalformed(t *testing.T) {
+	for name := range answerVectors {
+		full := answerVector(t, name)
+		for n := 0; n < len(full); n++ {
+			msg := append([]byte(nil), full[:n]...)
+			if _, err := clampTTLs(msg, 60, 300); err == nil {
+				// A cut can only stay valid at a record boundary,
+				// and the header counts always claim more records.
+				t.Errorf("%s cut to %d bytes: no error", name, n)
+			}
+			if !bytes.Equal(msg, full[:n]) {
+				t.Errorf("%s cut to %d bytes: modified", name, n)
+			}
+		}
+	}
+
+	msg := answerVector(t, "cname-chain")
+	// Turn the first answer's compression pointer into a reserved
+	// label type.
+	i := strings.Index(hex.EncodeToString(msg), "c00c0005") / 2
+	msg[i] = 0x80
+	orig := append([]byte(nil), msg...)
+	if _, err := clampTTLs(msg, 60, 300); err == nil {
+		t.Error("reserved label type: no error")
+	}
+	if !bytes.Equal(msg, orig) {
+		t.Error("reserved label type: modified")
+	}
+}
+
+// Names are parsed with one trailing dot, the root as ".", and dots and
+// backslashes inside labels escaped so they can't pass for label ends.
+func TestParseQuestionNames(t *testing.T) {
+	const header = "1234 0100 0001 0000 0000 0000 "
+	tests := []struct {
+		question string
+		name     string
+		escaped  string // as logged
+		err      bool
+	}{
+		{"07 6578616d706c65 03 636f6d 00 0001 0001", "example.com.", "example.com.", false},
+		{"00 0002 0001", ".", ".", false},
+		{"0b 6164732e6578616d706c65 03 636f6d 00 0001 0001", `ads\046example.com.`, `ads\046example.com.`, false},
+		{"03 615c62 00 0001 0001", `a\092b.`, `a\092b.`, false},
+		{"03 610a62 00 0001 0001", "a\nb.", `a\010b.`, false},
+		{"03 61206200 0001 0001", "a b.", `a\032b.`, false},
+		{"07 6578616d706c65 03 636f6d", "", "", true},
+		{"07 6578616d706c65 03 636f6d 00 0001", "", "", true},
+		{"40 " + strings.Repeat("61", 64) + " 00 0001 0001", "", "", true},
+	}
+	for _, tt := range tests {
+		name, _, _, err := parseQuestion(wire(t, header+tt.question))
+		if (err != nil) != tt.err || name != tt.name {
+			t.Errorf("%s: %q, %v, want %q, error %v", tt.question, name, err, tt.name, tt.err)
+			continue
+		}
+		if escaped := escapeName(name); escaped != tt.escaped {
+			t.Errorf("%s: logged as %q, want %q", tt.question, escaped, tt.escaped)
+		}
+	}
+}
+
+// The root is never blocked, and names with dots inside labels only match
+// rules for their real parents.
+func TestMatchOddNames(t *testing.T) {
+	rs, _, err := loadLists([]string{writeTemp(t, "odd.txt", "example.com\n*.zip\ncontains:.\n")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every name but the root has a dot for the substring rule, which is
+	// only tried when no name rule matches.
+	tests := []struct {
+		name string
+		zone string // "" if not blocked
+	}{
+		{".", ""},
+		{"example.com.", "example.com."},
+		{`ads\046example.com.`, "contains:."},
+		{`example\046com.`, "contains:."},
+		{"files.zip.", "*.zip."},
+	}
+	for _, tt := range tests {
+		zone, _, block := rs.matchBlocked(tt.name)
+		if block != (tt.zone != "") || zone != tt.zone {
+			t.Errorf("%q: matched %q, blocked %v, want %q", tt.name, zone, block, tt.zone)
+		}
+	}
+}
+
+// Answers get the question back in the case the client asked in, unless
+// they are to another question.
+func TestRestoreQuestion(t *testing.T) {
+	query := testQuery("wWw.ExAmPlE.cOm.", typeA)
+	tests := []struct {
+		name    string
+		answer  []byte
+		changed bool
+	}{
+		{"same case", testQuery("wWw.ExAmPlE.cOm.", typeA), false},
+		{"lower case", testQuery("www.example.com.", typeA), true},
+		{"upper case", testQuery("WWW.EXAMPLE.COM.", typeA), true},
+		{"other name", testQuery("www.example.org.", typeA), false},
+		{"other type", testQuery("www.example.com.", typeAAAA), false},
+		{"other label lengths", testQuery("www.exampl.ecom.", typeA), false},
+		{"no question", wire(t, "1234 8180 0000 0000 0000 0000"), false},
+		{"cut off", testQuery("www.example.com.", typeA)[:20], false},
+	}
+	for _, tt := range tests {
+		answer := append([]byte(nil), tt.answer...)
+		answer[2] |= 0x80
+		before := append([]byte(nil), answer...)
+		if changed := restoreQuestion(answer, query); changed != tt.changed {
+			t.Errorf("%s: changed %v, want %v", tt.name, changed, tt.changed)
+		}
+		want := before
+		if tt.changed {
+			want = append(append([]byte(nil), before[:headerLen]...), query[headerLen:]...)
+			want[2] = before[2]
+		}
+		if !bytes.Equal(answer, want) {
+			t.Errorf("%s: answer % x, want % x", tt.name, answer, want)
+		}
+	}
+}
+
+// Relayed answers are restored before being cached and sent, and counted.
+func TestTakeAnswerRestoresCase(t *testing.T) {
+	msg := testQuery("Ads.Example.COM.", typeA)
+	const id = 0x2468
+	msg[0], msg[1] = id>>8, id&0xff
+	ctx, cancel := queryContext()
+	queries.addNew(id, &query{Host: "Ads.Example.COM.", Start: time.Now(), Ctx: ctx, Cancel: cancel, Msg: msg})
+	answer := testQuery("ads.example.com.", typeA)
+	answer[0], answer[1], answer[2] = id>>8, id&0xff, 0x81
+	fixed := cntCaseFix.Value()
+	if q, _ := takeAnswer(answer); q == nil {
+		t.Fatal("query not found")
+	}
+	if !bytes.Equal(answer[headerLen:], msg[headerLen:]) || cntCaseFix.Value() != fixed+1 {
+		t.Errorf("answer % x, want the question % x", answer, msg)
+	}
+}
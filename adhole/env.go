@@ -0,0 +1,88 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// envPrefix starts the names of all environment variables used for
+// configuration. Options map to e.g. ADHOLE_DPORT or ADHOLE_STATE_EVERY.
+const envPrefix = "ADHOLE_"
+
+// envArgs are the environment variables standing in for the arguments.
+var envArgs = []string{"ADHOLE_KEY", "ADHOLE_UPSTREAM", "ADHOLE_PROXY", "ADHOLE_LIST"}
+
+// envAliases name the variables for options whose names are too short to
+// be self-explanatory.
+var envAliases = map[string]string{
+	"t": "ADHOLE_TIMEOUT",
+	"v": "ADHOLE_VERBOSE",
+}
+
+// envName returns the environment variable for an option.
+func envName(name string) string {
+	if alias, ok := envAliases[name]; ok {
+		return alias
+	}
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(name, "-", "_"))
+}
+
+// applyEnv sets the options that were not given on the command line from
+// the environment, so that flags take precedence over the environment,
+// which takes precedence over the defaults.
+func applyEnv(fs *flag.FlagSet, getenv func(string) string) error {
+	given := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || err != nil {
+			return
+		}
+		name := envName(f.Name)
+		if value := getenv(name); value != "" {
+			if serr := fs.Set(f.Name, value); serr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %s", value, name, serr)
+			}
+		}
+	})
+	return err
+}
+
+// envPositional returns the arguments from the environment if none were
+// given on the command line and the variables for the key, upstream and
+// proxy are set. ADHOLE_LIST is optional, as the lists are with -preset,
+// and can hold several lists, separated like in PATH.
+func envPositional(args []string, getenv func(string) string) []string {
+	if len(args) != 0 {
+		return args
+	}
+	var env []string
+	for _, name := range envArgs {
+		value := getenv(name)
+		switch {
+		case name == "ADHOLE_LIST":
+			env = append(env, filepath.SplitList(value)...)
+		case value == "":
+			return args
+		default:
+			env = append(env, value)
+		}
+	}
+	return env
+}
+
+// envUsage describes the environment variables for the usage message.
+func envUsage() {
+	fmt.Fprintf(os.Stderr, "\nOptions not given on the command line are taken from the environment,\n"+
+		"e.g. -dport from %s and -state-every from %s\n"+
+		"(-t and -v from %s and %s). The arguments can be given as\n"+
+		"%s.\n",
+		envName("dport"), envName("state-every"), envName("t"), envName("v"),
+		strings.Join(envArgs, ", "))
+}
@@ -0,0 +1,103 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"flag"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testEnv returns a getenv looking up env.
+func testEnv(env map[string]string) func(string) string {
+	return func(name string) string { return env[name] }
+}
+
+func TestEnvName(t *testing.T) {
+	for name, want := range map[string]string{
+		"dport":       "ADHOLE_DPORT",
+		"state-every": "ADHOLE_STATE_EVERY",
+		"t":           "ADHOLE_TIMEOUT",
+		"v":           "ADHOLE_VERBOSE",
+	} {
+		if got := envName(name); got != want {
+			t.Errorf("envName(%q) = %s, want %s", name, got, want)
+		}
+	}
+}
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string
+		env     map[string]string
+		dport   int
+		timeout time.Duration
+		verbose bool
+		err     string
+	}{
+		{"defaults", nil, nil, 53, time.Second, false, ""},
+		{"environment", nil, map[string]string{"ADHOLE_DPORT": "5353", "ADHOLE_TIMEOUT": "3s", "ADHOLE_VERBOSE": "true"}, 5353, 3 * time.Second, true, ""},
+		{"flags", []string{"-dport", "54", "-t", "2s", "-v"}, nil, 54, 2 * time.Second, true, ""},
+		{"flags over environment", []string{"-dport", "54"}, map[string]string{"ADHOLE_DPORT": "5353", "ADHOLE_TIMEOUT": "3s"}, 54, 3 * time.Second, false, ""},
+		{"flag set to its default", []string{"-dport", "53"}, map[string]string{"ADHOLE_DPORT": "5353"}, 53, time.Second, false, ""},
+		{"empty variable", nil, map[string]string{"ADHOLE_DPORT": ""}, 53, time.Second, false, ""},
+		{"invalid variable", nil, map[string]string{"ADHOLE_DPORT": "dns"}, 53, time.Second, false, "ADHOLE_DPORT"},
+		{"invalid unused variable", []string{"-dport", "54"}, map[string]string{"ADHOLE_DPORT": "dns"}, 54, time.Second, false, ""},
+	}
+	for _, tt := range tests {
+		fs := flag.NewFlagSet("adhole", flag.ContinueOnError)
+		fs.SetOutput(io.Discard)
+		dport := fs.Int("dport", 53, "")
+		timeout := fs.Duration("t", time.Second, "")
+		verbose := fs.Bool("v", false, "")
+		if err := fs.Parse(tt.args); err != nil {
+			t.Fatal(err)
+		}
+		err := applyEnv(fs, testEnv(tt.env))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want one about %s", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if *dport != tt.dport || *timeout != tt.timeout || *verbose != tt.verbose {
+			t.Errorf("%s: dport %d, t %s, v %v, want %d, %s, %v", tt.name, *dport, *timeout, *verbose, tt.dport, tt.timeout, tt.verbose)
+		}
+	}
+}
+
+func TestEnvPositional(t *testing.T) {
+	all := map[string]string{
+		"ADHOLE_KEY":      "secret",
+		"ADHOLE_UPSTREAM": "9.9.9.9",
+		"ADHOLE_PROXY":    "192.168.1.2",
+		"ADHOLE_LIST":     "/etc/adhole/ads.txt:/etc/adhole/trackers.txt",
+	}
+	noList := map[string]string{"ADHOLE_KEY": "secret", "ADHOLE_UPSTREAM": "9.9.9.9", "ADHOLE_PROXY": "192.168.1.2"}
+	partial := map[string]string{"ADHOLE_KEY": "secret", "ADHOLE_UPSTREAM": "9.9.9.9", "ADHOLE_LIST": "ads.txt"}
+	tests := []struct {
+		name string
+		args []string
+		env  map[string]string
+		want []string
+	}{
+		{"environment", nil, all, []string{"secret", "9.9.9.9", "192.168.1.2", "/etc/adhole/ads.txt", "/etc/adhole/trackers.txt"}},
+		{"arguments over environment", []string{"key", "1.1.1.1", "10.0.0.1", "list.txt"}, all, []string{"key", "1.1.1.1", "10.0.0.1", "list.txt"}},
+		{"no lists, for -preset", nil, noList, []string{"secret", "9.9.9.9", "192.168.1.2"}},
+		{"incomplete environment", nil, partial, nil},
+		{"nothing", nil, nil, nil},
+	}
+	for _, tt := range tests {
+		if got := envPositional(tt.args, testEnv(tt.env)); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
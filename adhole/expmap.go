@@ -0,0 +1,186 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"expvar"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// expiringMap is a map of at most max entries, each dropped once it hasn't
+// been used for ttl. A full map makes room by dropping an arbitrary entry,
+// which is much cheaper than finding the least recently used one and about
+// as good for what these maps hold: per client or per domain state that an
+// attacker could otherwise grow without end. It is safe for concurrent use.
+type expiringMap[K comparable, V any] struct {
+	max int
+	ttl time.Duration
+
+	mu    sync.Mutex
+	m     map[K]*expiringEntry[V]
+	swept time.Time
+
+	evicted, expired atomic.Int64
+}
+
+// expiringEntry is a value of an expiringMap and when it was last used.
+type expiringEntry[V any] struct {
+	v    V
+	used time.Time
+}
+
+// mapGauges are the size and drop counters of every expiringMap, shown in
+// the internalMaps expvar by name.
+var (
+	mapGauges   = make(map[string]func() map[string]int64)
+	mapGaugesMu sync.Mutex
+)
+
+func init() {
+	expvar.Publish("internalMaps", expvar.Func(func() interface{} {
+		mapGaugesMu.Lock()
+		defer mapGaugesMu.Unlock()
+		gauges := make(map[string]map[string]int64, len(mapGauges))
+		for name, fn := range mapGauges {
+			gauges[name] = fn()
+		}
+		return gauges
+	}))
+}
+
+// newExpiringMap returns an empty map of at most max entries, each kept for
+// ttl after it was last used, shown as name in internalMaps.
+func newExpiringMap[K comparable, V any](name string, max int, ttl time.Duration) *expiringMap[K, V] {
+	m := &expiringMap[K, V]{max: max, ttl: ttl, m: make(map[K]*expiringEntry[V])}
+	mapGaugesMu.Lock()
+	mapGauges[name] = func() map[string]int64 {
+		return map[string]int64{"size": int64(m.Len()), "max": int64(m.max),
+			"evicted": m.evicted.Load(), "expired": m.expired.Load()}
+	}
+	mapGaugesMu.Unlock()
+	return m
+}
+
+// Get returns the value for key, if it is there and hasn't expired.
+func (m *expiringMap[K, V]) Get(key K) (V, bool) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	e, ok := m.m[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	if now.Sub(e.used) >= m.ttl {
+		delete(m.m, key)
+		m.expired.Add(1)
+		var zero V
+		return zero, false
+	}
+	e.used = now
+	return e.v, true
+}
+
+// GetOrPut returns the value for key, putting the one made by fn there
+// first if there is none or it has expired.
+func (m *expiringMap[K, V]) GetOrPut(key K, fn func() V) V {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.m[key]; ok && now.Sub(e.used) < m.ttl {
+		e.used = now
+		return e.v
+	}
+	v := fn()
+	m.put(key, v, now)
+	return v
+}
+
+// Put sets the value for key. Expired entries are dropped at most once per
+// ttl, and if the map is still full an arbitrary entry is dropped too.
+func (m *expiringMap[K, V]) Put(key K, v V) {
+	m.mu.Lock()
+	m.put(key, v, time.Now())
+	m.mu.Unlock()
+}
+
+// put is Put with m.mu held.
+func (m *expiringMap[K, V]) put(key K, v V, now time.Time) {
+	if e, ok := m.m[key]; ok {
+		e.v, e.used = v, now
+		return
+	}
+	if now.Sub(m.swept) >= m.ttl {
+		m.swept = now
+		for k, e := range m.m {
+			if now.Sub(e.used) >= m.ttl {
+				delete(m.m, k)
+				m.expired.Add(1)
+			}
+		}
+	}
+	if len(m.m) >= m.max {
+		for k := range m.m {
+			delete(m.m, k)
+			m.evicted.Add(1)
+			break
+		}
+	}
+	m.m[key] = &expiringEntry[V]{v: v, used: now}
+}
+
+// Delete drops the entry for key.
+func (m *expiringMap[K, V]) Delete(key K) {
+	m.mu.Lock()
+	delete(m.m, key)
+	m.mu.Unlock()
+}
+
+// Len returns the number of entries, expired ones included until they are
+// dropped.
+func (m *expiringMap[K, V]) Len() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.m)
+}
+
+// Range calls fn for each entry that hasn't expired, until fn returns false.
+// fn must not use m.
+func (m *expiringMap[K, V]) Range(fn func(K, V) bool) {
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, e := range m.m {
+		if now.Sub(e.used) < m.ttl && !fn(k, e.v) {
+			return
+		}
+	}
+}
+
+// expiringCounters is an expvar map of counters kept in an expiringMap, for
+// counters by client that would otherwise grow without end.
+type expiringCounters struct {
+	m *expiringMap[string, *atomic.Int64]
+}
+
+// newExpiringCounters publishes counters as name, for at most max keys, each
+// dropped when it hasn't been counted for ttl.
+func newExpiringCounters(name string, max int, ttl time.Duration) *expiringCounters {
+	c := &expiringCounters{m: newExpiringMap[string, *atomic.Int64](name, max, ttl)}
+	expvar.Publish(name, expvar.Func(func() interface{} {
+		counts := make(map[string]int64)
+		c.m.Range(func(key string, n *atomic.Int64) bool {
+			counts[key] = n.Load()
+			return true
+		})
+		return counts
+	}))
+	return c
+}
+
+// Add adds delta to the counter for key.
+func (c *expiringCounters) Add(key string, delta int64) {
+	c.m.GetOrPut(key, func() *atomic.Int64 { return new(atomic.Int64) }).Add(delta)
+}
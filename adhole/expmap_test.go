@@ -0,0 +1,190 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"sort"
+	"testing"
+	"time"
+)
+
+// age makes the entry for key, and the last sweep of m, d older.
+func age[K comparable, V any](m *expiringMap[K, V], key K, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.m[key]; ok {
+		e.used = e.used.Add(-d)
+	}
+	m.swept = m.swept.Add(-d)
+}
+
+// mapGauge returns the internalMaps gauges of the map named name.
+func mapGauge(tb testing.TB, name string) map[string]int64 {
+	tb.Helper()
+	var gauges map[string]map[string]int64
+	if err := json.Unmarshal([]byte(expvar.Get("internalMaps").String()), &gauges); err != nil {
+		tb.Fatal(err)
+	}
+	return gauges[name]
+}
+
+// keys returns the keys of the live entries of m, sorted.
+func keys(m *expiringMap[string, int]) []string {
+	var ks []string
+	m.Range(func(k string, _ int) bool {
+		ks = append(ks, k)
+		return true
+	})
+	sort.Strings(ks)
+	return ks
+}
+
+// Entries unused for the TTL are gone for Get, GetOrPut and Range, and
+// dropped by the next Put after a TTL since the last sweep.
+func TestExpiringMapExpiry(t *testing.T) {
+	const ttl = time.Minute
+	tests := []struct {
+		name    string
+		aged    time.Duration // of "a"
+		get     bool          // "a" still there
+		expired int64         // after Get and a Put
+	}{
+		{"fresh", 0, true, 0},
+		{"used just now", ttl / 2, true, 0},
+		{"at the TTL", ttl, false, 1},
+		{"long expired", 10 * ttl, false, 1},
+	}
+	for _, tt := range tests {
+		m := newExpiringMap[string, int]("testExpiry", 10, ttl)
+		m.Put("a", 1)
+		m.Put("b", 2)
+		age(m, "a", tt.aged)
+		if got := keys(m); (len(got) == 2) != tt.get {
+			t.Errorf("%s: Range saw %v", tt.name, got)
+		}
+		if v, ok := m.Get("a"); ok != tt.get || ok && v != 1 {
+			t.Errorf("%s: Get %d, %v, want %v", tt.name, v, ok, tt.get)
+		}
+		made := false
+		m.GetOrPut("a", func() int { made = true; return 3 })
+		if made == tt.get {
+			t.Errorf("%s: GetOrPut made a new value %v", tt.name, made)
+		}
+		if v, _ := m.Get("b"); v != 2 {
+			t.Errorf("%s: b is %d", tt.name, v)
+		}
+		if n := m.expired.Load(); n != tt.expired {
+			t.Errorf("%s: %d expired, want %d", tt.name, n, tt.expired)
+		}
+	}
+
+	// A sweep drops every expired entry, not just the ones asked for.
+	m := newExpiringMap[string, int]("testExpiry", 10, ttl)
+	for _, k := range []string{"a", "b", "c"} {
+		m.Put(k, 1)
+	}
+	age(m, "a", ttl)
+	age(m, "b", ttl)
+	m.Put("d", 1)
+	if n := m.Len(); n != 2 || m.expired.Load() != 2 {
+		t.Errorf("after a sweep %d entries, %d expired, want 2 and 2", n, m.expired.Load())
+	}
+}
+
+// A full map drops an entry for each new key, but only after the expired
+// ones, and never for a key it already has.
+func TestExpiringMapEviction(t *testing.T) {
+	const max, ttl = 3, time.Minute
+	tests := []struct {
+		name    string
+		put     []string
+		aged    string // aged past the TTL before the last Put, if any
+		keys    int
+		evicted int64
+		expired int64
+	}{
+		{"below max", []string{"a", "b"}, "", 2, 0, 0},
+		{"at max", []string{"a", "b", "c"}, "", 3, 0, 0},
+		{"over max", []string{"a", "b", "c", "d", "e"}, "", 3, 2, 0},
+		{"same keys", []string{"a", "b", "c", "a", "b", "c"}, "", 3, 0, 0},
+		{"expired first", []string{"a", "b", "c", "d"}, "b", 3, 0, 1},
+	}
+	for _, tt := range tests {
+		m := newExpiringMap[string, int]("testEviction", max, ttl)
+		for i, k := range tt.put {
+			if i == len(tt.put)-1 && tt.aged != "" {
+				age(m, tt.aged, ttl)
+			}
+			m.Put(k, i)
+		}
+		if n := m.Len(); n != tt.keys {
+			t.Errorf("%s: %d entries, want %d", tt.name, n, tt.keys)
+		}
+		if _, ok := m.Get(tt.put[len(tt.put)-1]); !ok {
+			t.Errorf("%s: last key put dropped", tt.name)
+		}
+		if tt.aged != "" {
+			if _, ok := m.Get(tt.aged); ok {
+				t.Errorf("%s: expired %s kept", tt.name, tt.aged)
+			}
+		}
+		if n := m.evicted.Load(); n != tt.evicted {
+			t.Errorf("%s: %d evicted, want %d", tt.name, n, tt.evicted)
+		}
+		if n := m.expired.Load(); n != tt.expired {
+			t.Errorf("%s: %d expired, want %d", tt.name, n, tt.expired)
+		}
+	}
+}
+
+// The size and drop counts of each map are shown in internalMaps by name.
+func TestExpiringMapGauges(t *testing.T) {
+	m := newExpiringMap[string, int]("testGauges", 2, time.Minute)
+	if g := mapGauge(t, "testGauges"); g["size"] != 0 || g["max"] != 2 {
+		t.Errorf("empty map shown as %v", g)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		m.Put(k, 1)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		age(m, k, time.Minute)
+	}
+	m.Put("d", 1)
+	want := map[string]int64{"size": 1, "max": 2, "evicted": 1, "expired": 2}
+	if g := mapGauge(t, "testGauges"); len(g) != len(want) {
+		t.Errorf("shown as %v, want %v", g, want)
+	} else {
+		for k, v := range want {
+			if g[k] != v {
+				t.Errorf("%s shown as %d, want %d", k, g[k], v)
+			}
+		}
+	}
+}
+
+// testCounters are published once, as expvar can't take the name again.
+var testCounters = newExpiringCounters("testCounters", 10, time.Minute)
+
+// Counters by key are published as a map, without the expired ones.
+func TestExpiringCounters(t *testing.T) {
+	c := testCounters
+	c.m.Delete("a")
+	c.m.Delete("b")
+	c.Add("a", 1)
+	c.Add("a", 2)
+	c.Add("b", 1)
+	age(c.m, "b", time.Minute)
+	var counts map[string]int64
+	if err := json.Unmarshal([]byte(expvar.Get("testCounters").String()), &counts); err != nil {
+		t.Fatal(err)
+	}
+	if len(counts) != 1 || counts["a"] != 3 {
+		t.Errorf("published %v, want a: 3", counts)
+	}
+	c.Add("b", 1)
+	if n, _ := c.m.Get("b"); n.Load() != 1 {
+		t.Errorf("expired counter restarted at %d, want 1", n.Load())
+	}
+}
@@ -0,0 +1,197 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// exportVersion is the version of the export document format. Version 1
+// documents, without disabled lists, are still accepted.
+const exportVersion = 2
+
+// exportEntry is a whitelisted name or a disabled list; Expires is omitted
+// for permanent ones.
+type exportEntry struct {
+	Name    string     `json:"name"`
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// exportDoc is the runtime configuration made through the API, as exported
+// by /api/export and accepted by /api/import. Block rules and local answers
+// only come from lists, which are moved as files, and the sinkholes are
+// addresses of this host, so neither is part of it.
+type exportDoc struct {
+	Version   int           `json:"version"`
+	Blocking  bool          `json:"blocking"`
+	Whitelist []exportEntry `json:"whitelist"`
+	Disabled  []exportEntry `json:"disabledLists,omitempty"`
+}
+
+// export returns the current runtime configuration.
+func (wl *whitelist) export() []exportEntry {
+	now := time.Now()
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	entries := make([]exportEntry, 0, len(wl.entries))
+	for name, expires := range wl.entries {
+		entry := exportEntry{Name: strings.TrimSuffix(name, ".")}
+		if !expires.IsZero() {
+			if !now.Before(expires) {
+				continue
+			}
+			expires := expires
+			entry.Expires = &expires
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// exportDisabled returns the disabled lists.
+func exportDisabled() []exportEntry {
+	var entries []exportEntry
+	for name, until := range disabledLists() {
+		entry := exportEntry{Name: name}
+		if !until.IsZero() {
+			until := until
+			entry.Expires = &until
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+// replace makes entries the whole whitelist. The permanent ones are saved
+// first, and if that fails the whitelist is left as it was.
+func (wl *whitelist) replace(entries map[string]time.Time) error {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	if *flagOverride != "" {
+		if err := saveOverrides(*flagOverride, entries); err != nil {
+			return err
+		}
+	}
+	wl.entries = entries
+	return nil
+}
+
+// importState is the runtime configuration of an export document, checked
+// and ready to be applied.
+type importState struct {
+	blocking  bool
+	whitelist map[string]time.Time
+	disabled  map[string]time.Time
+}
+
+// parseExport checks an export document and returns what it configures.
+func parseExport(doc *exportDoc) (*importState, error) {
+	if doc.Version < 1 || doc.Version > exportVersion {
+		return nil, fmt.Errorf("version %d not supported", doc.Version)
+	}
+	st := &importState{
+		blocking:  doc.Blocking,
+		whitelist: make(map[string]time.Time, len(doc.Whitelist)),
+		disabled:  make(map[string]time.Time, len(doc.Disabled)),
+	}
+	for _, entry := range doc.Whitelist {
+		name := strings.ToLower(strings.TrimSuffix(entry.Name, "."))
+		if name == "" || strings.ContainsAny(name, " /") {
+			return nil, fmt.Errorf("bad name %q", entry.Name)
+		}
+		var expires time.Time
+		if entry.Expires != nil {
+			expires = *entry.Expires
+		}
+		st.whitelist[name+"."] = expires
+	}
+	for _, entry := range doc.Disabled {
+		if entry.Name == "" || strings.Contains(entry.Name, "/") {
+			return nil, fmt.Errorf("bad list name %q", entry.Name)
+		}
+		var until time.Time
+		if entry.Expires != nil {
+			until = *entry.Expires
+		}
+		st.disabled[entry.Name] = until
+	}
+	return st, nil
+}
+
+// apply makes st the runtime configuration. The whitelist goes first, as
+// saving it is all that can fail, and then nothing else is changed.
+func (st *importState) apply() error {
+	if err := allowed.replace(st.whitelist); err != nil {
+		return err
+	}
+	replaceDisabled(st.disabled)
+	blocking.Set(st.blocking)
+	return nil
+}
+
+// handleAPIExport returns the runtime configuration as JSON.
+func handleAPIExport(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !authHTTP(req) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad key"})
+		return
+	}
+	w.Header().Set("Content-Disposition", `attachment; filename="adhole.json"`)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(exportDoc{
+		Version:   exportVersion,
+		Blocking:  blocking.Value(),
+		Whitelist: allowed.export(),
+		Disabled:  exportDisabled(),
+	})
+}
+
+// handleAPIImport replaces the runtime configuration with the JSON document
+// in the request body. Nothing is changed unless the whole document is valid.
+func handleAPIImport(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	reply := func(status int, msg string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+	}
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		reply(http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	// The body is the document, so the key has to be in the URL.
+	if !authHTTP(req) {
+		reply(http.StatusForbidden, "bad key")
+		return
+	}
+
+	var doc exportDoc
+	dec := json.NewDecoder(http.MaxBytesReader(w, req.Body, 16<<20))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&doc); err != nil {
+		reply(http.StatusBadRequest, err.Error())
+		return
+	}
+	st, err := parseExport(&doc)
+	if err != nil {
+		reply(http.StatusBadRequest, err.Error())
+		return
+	}
+	if err := st.apply(); err != nil {
+		log.Println("HTTP ERROR: Can't save overrides, nothing imported:", err)
+		reply(http.StatusInternalServerError, err.Error())
+		return
+	}
+	log.Printf("HTTP: Imported %d whitelist entries, %d disabled lists, blocking %v\n",
+		len(st.whitelist), len(st.disabled), st.blocking)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"whitelist": len(st.whitelist), "disabledLists": len(st.disabled), "blocking": st.blocking,
+	})
+}
@@ -0,0 +1,131 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withRuntimeState has the test start with blocking on, an empty whitelist
+// and all lists enabled, and restores that after.
+func withRuntimeState(tb testing.TB) {
+	withWhitelist(tb)
+	withFlag(tb, &key, "secret")
+	blocking.Set(true)
+	replaceDisabled(nil)
+	tb.Cleanup(func() {
+		blocking.Set(true)
+		replaceDisabled(nil)
+	})
+}
+
+// exportState returns the document /api/export serves, sorted.
+func exportState(tb testing.TB) exportDoc {
+	tb.Helper()
+	w := httptest.NewRecorder()
+	handleAPIExport(w, httptest.NewRequest(http.MethodGet, "/api/export?key="+key, nil))
+	var doc exportDoc
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		tb.Fatalf("%s: %s", err, w.Body)
+	}
+	for _, entries := range [][]exportEntry{doc.Whitelist, doc.Disabled} {
+		sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+	}
+	return doc
+}
+
+// importDoc posts doc to /api/import and returns the status.
+func importDoc(tb testing.TB, doc string) int {
+	tb.Helper()
+	w := httptest.NewRecorder()
+	handleAPIImport(w, httptest.NewRequest(http.MethodPost, "/api/import?key="+key, strings.NewReader(doc)))
+	return w.Code
+}
+
+// An export imported into a fresh instance must give it the same state.
+func TestExportRoundTrip(t *testing.T) {
+	withRuntimeState(t)
+	withFlag(t, flagOverride, filepath.Join(t.TempDir(), "overrides.txt"))
+	withLists(t, [2]string{"strict.txt", "ads.example.com\n"}, [2]string{"default.txt", "tracker.net\n"})
+	allowed.add("shop.example.com", 0)
+	allowed.add("ads.example.com", time.Hour)
+	setListEnabled("strict", false, 0)
+	setListEnabled("default", false, time.Hour)
+	blocking.Set(false)
+	want := exportState(t)
+	data, err := json.Marshal(want)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(want.Whitelist) != 2 || len(want.Disabled) != 2 || want.Blocking {
+		t.Fatalf("exported %s", data)
+	}
+
+	withRuntimeState(t)
+	if code := importDoc(t, string(data)); code != http.StatusOK {
+		t.Fatalf("import: status %d", code)
+	}
+	got := exportState(t)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("after import %+v, want %+v", got, want)
+	}
+	if _, _, block := currentRules().matchBlocked("ads.example.com."); block {
+		t.Error("rule of the disabled list still matches")
+	}
+	saved, err := os.ReadFile(*flagOverride)
+	if err != nil || string(saved) != "shop.example.com\n" {
+		t.Errorf("overrides file %q, %v", saved, err)
+	}
+}
+
+// An import that can't be saved must change nothing at all.
+func TestImportAllOrNothing(t *testing.T) {
+	withRuntimeState(t)
+	withFlag(t, flagOverride, filepath.Join(t.TempDir(), "missing", "overrides.txt"))
+	withLists(t, [2]string{"strict.txt", "ads.example.com\n"})
+	allowed.add("ads.example.com", time.Hour)
+	before := exportState(t)
+
+	doc := `{"version": 2, "blocking": false, "whitelist": [{"name": "shop.example.com"}],
+		"disabledLists": [{"name": "strict"}]}`
+	if code := importDoc(t, doc); code != http.StatusInternalServerError {
+		t.Errorf("status %d, want %d", code, http.StatusInternalServerError)
+	}
+	if after := exportState(t); !reflect.DeepEqual(after, before) {
+		t.Errorf("state changed to %+v from %+v", after, before)
+	}
+	for _, doc := range []string{
+		`{"version": 3, "blocking": false, "whitelist": []}`,
+		`{"version": 2, "blocking": false, "whitelist": [{"name": "a b"}]}`,
+		`{"version": 2, "blocking": false, "whitelist": [], "disabledLists": [{"name": ""}]}`,
+		`{"version": 2, "blocking": false, "whitelist": [], "rules": []}`,
+	} {
+		if code := importDoc(t, doc); code != http.StatusBadRequest {
+			t.Errorf("%s: status %d, want %d", doc, code, http.StatusBadRequest)
+		}
+	}
+	if after := exportState(t); !reflect.DeepEqual(after, before) {
+		t.Errorf("state changed to %+v from %+v by bad documents", after, before)
+	}
+}
+
+// Documents exported before disabled lists were must still import.
+func TestImportVersion1(t *testing.T) {
+	withRuntimeState(t)
+	withFlag(t, flagOverride, "")
+	if code := importDoc(t, `{"version": 1, "blocking": false, "whitelist": [{"name": "shop.example.com"}]}`); code != http.StatusOK {
+		t.Fatalf("status %d", code)
+	}
+	if blocking.Value() || !allowed.contains("www.shop.example.com.") {
+		t.Error("version 1 document not applied")
+	}
+}
@@ -0,0 +1,67 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"context"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// forwarder is the connection to a server zones are relayed to.
+type forwarder struct {
+	conn  atomic.Pointer[net.UDPConn]
+	stats *serverStats
+}
+
+// forwarders holds the forwarders by server address. They are opened when
+// first used and stay open, also if a reload drops their zones.
+var forwarders = struct {
+	sync.Mutex
+	m map[string]*forwarder
+}{m: make(map[string]*forwarder)}
+
+// forwarderFor returns the forwarder for the server at addr, opening it and
+// starting to read its answers if needed, unless ctx ends first.
+func forwarderFor(ctx context.Context, addr *net.UDPAddr) (*forwarder, error) {
+	forwarders.Lock()
+	defer forwarders.Unlock()
+	if f, ok := forwarders.m[addr.String()]; ok {
+		return f, nil
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "udp4", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	f := &forwarder{stats: serverStatsFor(addr.String())}
+	f.conn.Store(conn.(*net.UDPConn))
+	forwarders.m[addr.String()] = f
+	log.Println("DNS: Forwarding to", addr)
+	startComponent(&component{
+		name: "forward " + addr.String(),
+		run:  func() error { return runServerUpstreamDNS(&f.conn) },
+		stop: func() { f.conn.Load().Close() },
+	})
+	return f, nil
+}
+
+// upstreamFor returns the connection to relay the query about host with the
+// context ctx to, and the statistics of its server: a forwarder if host is in
+// a forwarded zone, the upstream otherwise.
+func upstreamFor(ctx context.Context, host string) (*net.UDPConn, *serverStats, error) {
+	rs := currentRules()
+	if len(rs.forward) > 0 {
+		zone := findZone(lowerName(host), func(name string) bool { return rs.forward[name] != nil })
+		if zone != "" {
+			f, err := forwarderFor(ctx, rs.forward[zone])
+			if err != nil {
+				return nil, nil, err
+			}
+			return f.conn.Load(), f.stats, nil
+		}
+	}
+	return upstream.Load(), upStats, nil
+}
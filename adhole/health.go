@@ -0,0 +1,148 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// healthWindow is how recent the last upstream answer has to be for the
+// upstream to be considered healthy without probing.
+const healthWindow = time.Minute
+
+var (
+	// lastUpstream is the time (UnixNano) of the last answer from upstream.
+	lastUpstream int64
+	// listening is the number of running local DNS servers.
+	listening int64
+	// ready is set once the list is loaded and the servers are started.
+	ready int32
+)
+
+// healthCheck is the result of one check, reported as JSON.
+type healthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// probe sends a query for the root NS records to the first listener and waits
+// for an answer, which checks both the listener and the upstream.
+func probe(timeout time.Duration) error {
+	if len(listeners) == 0 {
+		return errors.New("no listeners")
+	}
+	reply, err := exchange(listeners[0], ".", typeNS, timeout)
+	if err != nil {
+		return err
+	}
+	if rcode := int(reply[3] & 0x0f); rcode == rcodeServFail {
+		return fmt.Errorf("probe answered with %s", rcodeName(rcode))
+	}
+	return nil
+}
+
+// exchange sends a query for name to the listener l and returns the answer.
+func exchange(l *listener, name string, qtype uint16, timeout time.Duration) ([]byte, error) {
+	addr := *l.conn.LocalAddr().(*net.UDPAddr)
+	if addr.IP.IsUnspecified() {
+		addr.IP = net.IPv4(127, 0, 0, 1)
+	}
+	conn, err := net.DialUDP("udp4", nil, &addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	id := uint16(time.Now().UnixNano())
+	msg := []byte{0, 0, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(msg, id)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label != "" {
+			msg = append(msg, byte(len(label)))
+			msg = append(msg, label...)
+		}
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), 0, 1)
+	if _, err = conn.Write(msg); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, 512)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n >= headerLen && binary.BigEndian.Uint16(buf) == id && buf[2]&0x80 != 0 {
+			return buf[:n], nil
+		}
+	}
+}
+
+// handleHealth reports if the DNS server works: the listeners are running
+// and the upstream answered recently (or answers a probe now). With -no-dns
+// there is nothing to check.
+func handleHealth(w http.ResponseWriter, req *http.Request) {
+	if *flagNoDNS {
+		writeHealth(w, []healthCheck{})
+		return
+	}
+	checks := []healthCheck{{Name: "listener", OK: atomic.LoadInt64(&listening) > 0}}
+	if !checks[0].OK {
+		checks[0].Error = "no DNS listener running"
+	}
+
+	up := healthCheck{Name: "upstream", OK: true}
+	last := time.Unix(0, atomic.LoadInt64(&lastUpstream))
+	if time.Since(last) > healthWindow {
+		if err := probe(*flagTimeout); err != nil {
+			up.OK, up.Error = false, err.Error()
+		}
+	}
+	checks = append(checks, up)
+	writeHealth(w, checks)
+}
+
+// handleReady reports if the list is loaded and the servers are started,
+// and with -warmup-ready if the cache is warmed up.
+func handleReady(w http.ResponseWriter, req *http.Request) {
+	check := healthCheck{Name: "list", OK: atomic.LoadInt32(&ready) != 0}
+	if !check.OK {
+		check.Error = "block list not loaded yet"
+	}
+	checks := []healthCheck{check}
+	if *flagWarmRdy && *flagWarmup != "" {
+		warm := healthCheck{Name: "warmup", OK: atomic.LoadInt32(&warmedUp) != 0}
+		if !warm.OK {
+			warm.Error = "cache warm-up not done yet"
+		}
+		checks = append(checks, warm)
+	}
+	writeHealth(w, checks)
+}
+
+// writeHealth writes the results of checks, with status 503 if any failed.
+func writeHealth(w http.ResponseWriter, checks []healthCheck) {
+	status := http.StatusOK
+	for _, check := range checks {
+		if !check.OK {
+			status = http.StatusServiceUnavailable
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"ok":     status == http.StatusOK,
+		"checks": checks,
+	})
+}
@@ -0,0 +1,152 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	// The code under test logs like the server does, which is just noise
+	// here.
+	if !testing.Verbose() {
+		log.SetOutput(io.Discard)
+	}
+	// Servers started by tests need a rule set, even if it's empty.
+	rules = newRuleSet()
+	os.Exit(m.Run())
+}
+
+// writeTemp writes content to a file called name in a temporary directory
+// removed after the test, and returns its path.
+func writeTemp(tb testing.TB, name, content string) string {
+	tb.Helper()
+	path := filepath.Join(tb.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		tb.Fatal(err)
+	}
+	return path
+}
+
+// withFlag sets a flag's value for the rest of the test, and restores it
+// after.
+func withFlag[T any](tb testing.TB, flag *T, value T) {
+	old := *flag
+	*flag = value
+	tb.Cleanup(func() { *flag = old })
+}
+
+// testNames generates n names looking like those of block lists, with a
+// trailing dot: ad and tracking hosts two to four labels deep. The same n
+// always gives the same names.
+func testNames(n int) []string {
+	rnd := rand.New(rand.NewSource(1))
+	words := []string{"ad", "ads", "track", "pixel", "stats", "metrics", "beacon", "cdn", "click", "banner", "tag", "sync"}
+	tlds := []string{"com", "net", "org", "io", "info", "co.uk"}
+	names := make([]string, n)
+	for i := range names {
+		name := fmt.Sprintf("%s%d.%s", words[rnd.Intn(len(words))], i, tlds[rnd.Intn(len(tlds))])
+		for d := rnd.Intn(3); d > 0; d-- {
+			name = words[rnd.Intn(len(words))] + "." + name
+		}
+		names[i] = name + "."
+	}
+	return names
+}
+
+// testQuery returns a query for name, with a trailing dot, of qtype.
+func testQuery(name string, qtype uint16) []byte {
+	msg := []byte{0x12, 0x34, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	start := 0
+	for i := 0; i < len(name); i++ {
+		if name[i] == '.' {
+			msg = append(msg, byte(i-start))
+			msg = append(msg, name[start:i]...)
+			start = i + 1
+		}
+	}
+	return append(msg, 0, byte(qtype>>8), byte(qtype), 0, 1)
+}
+
+// withBlocked makes the rule set block names, with a trailing dot, for the
+// rest of the test.
+func withBlocked(tb testing.TB, names ...string) *ruleSet {
+	rs := newRuleSet()
+	for _, name := range names {
+		rs.blocked[name] = flagSource
+	}
+	listMu.Lock()
+	old := rules
+	rules = rs
+	listMu.Unlock()
+	tb.Cleanup(func() {
+		listMu.Lock()
+		rules = old
+		listMu.Unlock()
+	})
+	return rs
+}
+
+// ask sends msg to the listener l and returns the answer.
+func ask(tb testing.TB, l *listener, msg []byte) []byte {
+	tb.Helper()
+	conn, err := net.DialUDP("udp4", nil, l.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer conn.Close()
+	if _, err := conn.Write(msg); err != nil {
+		tb.Fatal(err)
+	}
+	conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, answerBufSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return buf[:n]
+}
+
+// withUpstream makes a socket that never answers the upstream for the rest
+// of the test, and returns it to read the queries relayed from.
+func withUpstream(tb testing.TB) *net.UDPConn {
+	tb.Helper()
+	up, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	conn, err := net.DialUDP("udp4", nil, up.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	old := upstream.Swap(conn)
+	tb.Cleanup(func() {
+		upstream.Store(old)
+		conn.Close()
+		up.Close()
+	})
+	return up
+}
+
+// relayed returns the next query read from up, or nil if none comes. The
+// query is no longer outstanding after, as if it timed out.
+func relayed(up *net.UDPConn) []byte {
+	up.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+	buf := make([]byte, answerBufSize)
+	n, err := up.Read(buf)
+	if err != nil || n < headerLen {
+		return nil
+	}
+	queries.take(int(buf[0])<<8 | int(buf[1]))
+	return buf[:n]
+}
@@ -0,0 +1,162 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"expvar"
+	"sync"
+	"time"
+)
+
+// Number of buckets kept.
+const (
+	historyHours = 24
+	historyDays  = 30
+)
+
+// bucket holds the counts for one hour or day.
+type bucket struct {
+	Start   time.Time `json:"start"`
+	Queries int64     `json:"queries"`
+	Blocked int64     `json:"blocked"`
+	Relayed int64     `json:"relayed"`
+}
+
+// add adds the counts of b to a.
+func (a *bucket) add(b bucket) {
+	a.Queries += b.Queries
+	a.Blocked += b.Blocked
+	a.Relayed += b.Relayed
+}
+
+// historyData holds the closed buckets, newest first.
+type historyData struct {
+	Hourly []bucket `json:"hourly"`
+	Daily  []bucket `json:"daily"`
+}
+
+// history holds the closed buckets and the counter values at the start of
+// the current hour, from which the current hour's counts are computed.
+var history = struct {
+	sync.Mutex
+	historyData
+	hour  bucket // counter values at the start of the current hour
+	today bucket // counts of the closed hours of today
+}{}
+
+func init() {
+	expvar.Publish("history", expvar.Func(func() interface{} {
+		return currentHistory()
+	}))
+}
+
+// counterBucket returns the current values of the counters.
+func counterBucket() bucket {
+	return bucket{
+		Queries: cntMsgs.Value(),
+		Blocked: cntBlocked.Value(),
+		Relayed: cntRelayed.Value(),
+	}
+}
+
+// hourBucket returns the counts of the current hour. It must be called with
+// history locked.
+func hourBucket() bucket {
+	now := counterBucket()
+	return bucket{
+		Start:   history.hour.Start,
+		Queries: now.Queries - history.hour.Queries,
+		Blocked: now.Blocked - history.hour.Blocked,
+		Relayed: now.Relayed - history.hour.Relayed,
+	}
+}
+
+// currentHistory returns all buckets, including the current hour and day.
+func currentHistory() *historyData {
+	history.Lock()
+	defer history.Unlock()
+
+	hour := hourBucket()
+	day := history.today
+	day.add(hour)
+	return &historyData{
+		Hourly: append([]bucket{hour}, history.Hourly...),
+		Daily:  append([]bucket{day}, history.Daily...),
+	}
+}
+
+// restoreHistory takes over the buckets from a saved state, whose first
+// hourly and daily buckets are the then current ones. If those are still
+// current they are merged into the running counts.
+func restoreHistory(data *historyData) {
+	history.Lock()
+	defer history.Unlock()
+	hourly, daily := data.Hourly, data.Daily
+	if len(hourly) > 0 && hourly[0].Start.Equal(history.hour.Start) {
+		history.hour.Queries -= hourly[0].Queries
+		history.hour.Blocked -= hourly[0].Blocked
+		history.hour.Relayed -= hourly[0].Relayed
+		hourly = hourly[1:]
+	}
+	if len(daily) > 0 && daily[0].Start.Equal(history.today.Start) {
+		// The saved day included the saved hour, which is now accounted
+		// for in the hour's counts.
+		day := daily[0]
+		if len(data.Hourly) > len(hourly) {
+			day.Queries -= data.Hourly[0].Queries
+			day.Blocked -= data.Hourly[0].Blocked
+			day.Relayed -= data.Hourly[0].Relayed
+		}
+		history.today.add(day)
+		daily = daily[1:]
+	}
+	history.Hourly = trimBuckets(hourly, historyHours-1)
+	history.Daily = trimBuckets(daily, historyDays-1)
+}
+
+// trimBuckets limits buckets to max entries.
+func trimBuckets(buckets []bucket, max int) []bucket {
+	if len(buckets) > max {
+		return buckets[:max]
+	}
+	return buckets
+}
+
+// startOfHour returns the start of the wall-clock hour t is in.
+func startOfHour(t time.Time) time.Time {
+	return time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), 0, 0, 0, t.Location())
+}
+
+// startHistory starts the current hour and day buckets. It must be called
+// before restoreHistory.
+func startHistory() {
+	history.Lock()
+	defer history.Unlock()
+	history.hour = counterBucket()
+	history.hour.Start = startOfHour(time.Now())
+	y, m, d := history.hour.Start.Date()
+	history.today = bucket{Start: time.Date(y, m, d, 0, 0, 0, 0, time.Local)}
+}
+
+// runHistory rotates the buckets at every full hour of local time.
+func runHistory() {
+	for {
+		next := startOfHour(time.Now()).Add(time.Hour)
+		// Add is not wall-clock aware, so go through startOfHour again to
+		// handle DST changes.
+		next = startOfHour(next.Add(time.Minute))
+		time.Sleep(time.Until(next))
+
+		history.Lock()
+		hour := hourBucket()
+		history.Hourly = trimBuckets(append([]bucket{hour}, history.Hourly...), historyHours-1)
+		history.today.add(hour)
+		history.hour = counterBucket()
+		history.hour.Start = startOfHour(time.Now())
+		if y, m, d := history.hour.Start.Date(); d != history.today.Start.Day() {
+			history.Daily = trimBuckets(append([]bucket{history.today}, history.Daily...), historyDays-1)
+			history.today = bucket{Start: time.Date(y, m, d, 0, 0, 0, 0, time.Local)}
+		}
+		history.Unlock()
+	}
+}
@@ -0,0 +1,85 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+)
+
+var (
+	cntAvoided   = expvar.NewInt("statsBytesAvoided")
+	cntConnsDrop = expvar.NewInt("statsConnsRefused")
+)
+
+// limitBody keeps the pixel server from reading request bodies, e.g. of
+// blocked analytics beacons, beyond -http-max-body bytes. Larger bodies are
+// left unread and the connection is closed after the response, rather than
+// drained. The bytes not uploaded are counted when the size is known.
+func limitBody(w http.ResponseWriter, req *http.Request) {
+	if req.ContentLength == 0 || req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+	max := *flagHTTPBody
+	if req.ContentLength < 0 || req.ContentLength > max {
+		w.Header().Set("Connection", "close")
+		if req.ContentLength > max {
+			cntAvoided.Add(req.ContentLength - max)
+		}
+	}
+	req.Body = http.MaxBytesReader(w, req.Body, max)
+}
+
+// connLimiter closes the HTTP connections of clients that already have
+// max connections open. Its maps only hold open connections, which leave
+// them when closed, so they can't grow beyond what the server has open.
+type connLimiter struct {
+	mu    sync.Mutex
+	max   int
+	open  map[string]int      // client IPs to their open connections
+	conns map[net.Conn]string // counted connections to their client IPs
+}
+
+// httpConns limits the connections per client to all the HTTP listeners,
+// nil if there's no limit.
+var httpConns *connLimiter
+
+// newConnLimiter returns a limiter of max connections per client IP.
+func newConnLimiter(max int) *connLimiter {
+	return &connLimiter{max: max, open: make(map[string]int), conns: make(map[net.Conn]string)}
+}
+
+// connState is an http.Server ConnState hook.
+func (l *connLimiter) connState(c net.Conn, state http.ConnState) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	switch state {
+	case http.StateNew:
+		ip, _, err := net.SplitHostPort(c.RemoteAddr().String())
+		if err != nil {
+			return
+		}
+		if l.open[ip] >= l.max {
+			c.Close()
+			if *flagVerbose {
+				log.Printf("HTTP: Too many connections from %s, closing\n", clientHTTP(c.RemoteAddr().String()))
+			}
+			cntConnsDrop.Add(1)
+			return
+		}
+		l.open[ip]++
+		l.conns[c] = ip
+	case http.StateClosed, http.StateHijacked:
+		ip, ok := l.conns[c]
+		if !ok {
+			return
+		}
+		delete(l.conns, c)
+		if l.open[ip]--; l.open[ip] <= 0 {
+			delete(l.open, ip)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// serveHTTP runs the HTTP server on a loopback port with at most max
+// connections per client, stopped after the test, and returns its address.
+func serveHTTP(tb testing.TB, max int) string {
+	tb.Helper()
+	withLogBuffer(tb, 0)
+	httpRoutes.Do(registerHTTP)
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	httpConns = newConnLimiter(max)
+	done := make(chan error, 1)
+	go func() { done <- runServerHTTP(ln) }()
+	tb.Cleanup(func() {
+		ln.Close()
+		<-done
+		httpConns = nil
+	})
+	return ln.Addr().String()
+}
+
+// dialHTTP connects to addr, closing the connection after the test.
+func dialHTTP(tb testing.TB, addr string) (net.Conn, *bufio.Reader) {
+	tb.Helper()
+	c, err := net.Dial("tcp4", addr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { c.Close() })
+	c.SetDeadline(time.Now().Add(5 * time.Second))
+	return c, bufio.NewReader(c)
+}
+
+// get asks for the pixel on c, returning the response status.
+func get(c net.Conn, r *bufio.Reader) (int, error) {
+	if _, err := io.WriteString(c, "GET /ad.gif HTTP/1.1\r\nHost: ads.example\r\n\r\n"); err != nil {
+		return 0, err
+	}
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		return 0, err
+	}
+	io.Copy(io.Discard, res.Body)
+	res.Body.Close()
+	return res.StatusCode, nil
+}
+
+// A large beacon upload is answered before its body is sent, the connection
+// is closed rather than drained and the bytes not uploaded are counted.
+func TestLargeUpload(t *testing.T) {
+	addr := serveHTTP(t, 2)
+	const size = 1 << 20
+	avoided := cntAvoided.Value()
+	c, r := dialHTTP(t, addr)
+	fmt.Fprintf(c, "POST /beacon HTTP/1.1\r\nHost: ads.example\r\nContent-Length: %d\r\n\r\n", size)
+	io.WriteString(c, strings.Repeat("x", 100))
+
+	res, err := http.ReadResponse(r, nil)
+	if err != nil {
+		t.Fatal("no response before the body is sent:", err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusNoContent {
+		t.Errorf("status %d, want %d", res.StatusCode, http.StatusNoContent)
+	}
+	if !res.Close {
+		t.Error("connection not to be closed")
+	}
+	if n := cntAvoided.Value() - avoided; n != size-*flagHTTPBody {
+		t.Errorf("%d bytes avoided, want %d", n, size-*flagHTTPBody)
+	}
+	if _, err := r.ReadByte(); err != io.EOF {
+		t.Errorf("connection left open for the body: %v", err)
+	}
+}
+
+// A client is refused connections beyond -http-max-conns, and can connect
+// again once it has closed one.
+func TestConnLimit(t *testing.T) {
+	addr := serveHTTP(t, 2)
+	refused := cntConnsDrop.Value()
+	c1, r1 := dialHTTP(t, addr)
+	c2, r2 := dialHTTP(t, addr)
+	for _, c := range []struct {
+		net.Conn
+		*bufio.Reader
+	}{{c1, r1}, {c2, r2}} {
+		if code, err := get(c.Conn, c.Reader); code != http.StatusOK {
+			t.Fatalf("below the limit: %d %v", code, err)
+		}
+	}
+
+	c3, r3 := dialHTTP(t, addr)
+	if code, err := get(c3, r3); err == nil {
+		t.Errorf("over the limit: %d, want the connection closed", code)
+	}
+	if n := cntConnsDrop.Value() - refused; n != 1 {
+		t.Errorf("%d connections refused, want 1", n)
+	}
+	if code, err := get(c1, r1); code != http.StatusOK {
+		t.Errorf("open connection after a refusal: %d %v", code, err)
+	}
+
+	// The server sees c2 closed a little later.
+	c2.Close()
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		c, r := dialHTTP(t, addr)
+		if code, _ := get(c, r); code == http.StatusOK {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("refused after closing a connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,129 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// httpBound are the addresses the HTTP server listens on, none with
+// -no-http.
+var httpBound []*net.TCPAddr
+
+// parseHTTPListen parses a comma separated list of IPv4 or IPv6 addresses
+// with optional ports, IPv6 ones with a port in brackets, e.g.
+// "192.168.1.1,[fd00::1]:8080,fd00::2". Addresses without a port use port.
+func parseHTTPListen(arg string, port int) ([]*net.TCPAddr, error) {
+	var addrs []*net.TCPAddr
+	for _, item := range strings.Split(arg, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		host, portStr := item, strconv.Itoa(port)
+		if ip := net.ParseIP(strings.Trim(item, "[]")); ip != nil {
+			host = strings.Trim(item, "[]")
+		} else {
+			var err error
+			if host, portStr, err = net.SplitHostPort(item); err != nil {
+				return nil, fmt.Errorf("can't parse HTTP listen address '%s'", item)
+			}
+		}
+		ip := net.ParseIP(host)
+		if ip == nil {
+			return nil, fmt.Errorf("can't parse HTTP listen address '%s'", item)
+		}
+		p, err := strconv.Atoi(portStr)
+		if err != nil || p < 1 || p > 65535 {
+			return nil, fmt.Errorf("bad port in HTTP listen address '%s'", item)
+		}
+		addrs = append(addrs, &net.TCPAddr{IP: ip, Port: p})
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no HTTP listen addresses in '%s'", arg)
+	}
+	return addrs, nil
+}
+
+// httpSinkholes returns the addresses blocked names are answered with: the
+// listeners' (the proxy address for those on 0.0.0.0) and -sinkhole6, each
+// once.
+func httpSinkholes(proxyIP net.IP) []net.IP {
+	ips := []net.IP{proxyIP}
+	for _, l := range listeners {
+		ips = append(ips, l.sinkhole)
+	}
+	if sinkhole6 != nil {
+		ips = append(ips, sinkhole6)
+	}
+	var uniq []net.IP
+	for _, ip := range ips {
+		if !containsIP(uniq, ip) {
+			uniq = append(uniq, ip)
+		}
+	}
+	return uniq
+}
+
+// containsIP reports whether ips has ip.
+func containsIP(ips []net.IP, ip net.IP) bool {
+	for _, i := range ips {
+		if i.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultHTTPListen returns the HTTP listen addresses without -http-listen:
+// all the sinkhole addresses, so that blocked clients always reach the pixel.
+func defaultHTTPListen(proxyIP net.IP, port int) []*net.TCPAddr {
+	var addrs []*net.TCPAddr
+	for _, ip := range httpSinkholes(proxyIP) {
+		if !ip.IsUnspecified() {
+			addrs = append(addrs, &net.TCPAddr{IP: ip, Port: port})
+		}
+	}
+	return addrs
+}
+
+// checkHTTPListen makes sure the HTTP server listens, on -hport, on every
+// address blocked names are answered with, either on the address itself or
+// on the unspecified address of its family.
+func checkHTTPListen(addrs []*net.TCPAddr, proxyIP net.IP, port int) error {
+	for _, ip := range httpSinkholes(proxyIP) {
+		if ip.IsUnspecified() {
+			continue
+		}
+		if !servesHTTP(addrs, ip, port) {
+			return fmt.Errorf("blocked names are answered with %s, but -http-listen doesn't include %s",
+				ip, net.JoinHostPort(ip.String(), strconv.Itoa(port)))
+		}
+	}
+	return nil
+}
+
+// servesHTTP reports whether listening on addrs takes connections to ip on
+// port, either on the address itself or on the unspecified address of its
+// family.
+func servesHTTP(addrs []*net.TCPAddr, ip net.IP, port int) bool {
+	for _, addr := range addrs {
+		if addr.Port == port && (addr.IP.Equal(ip) ||
+			addr.IP.IsUnspecified() && (addr.IP.To4() == nil) == (ip.To4() == nil)) {
+			return true
+		}
+	}
+	return false
+}
+
+// httpNetwork returns the network to listen on addr with: tcp6 for IPv6
+// addresses, so that :: doesn't take IPv4 too.
+func httpNetwork(addr *net.TCPAddr) string {
+	if addr.IP.To4() == nil {
+		return "tcp6"
+	}
+	return "tcp4"
+}
@@ -0,0 +1,70 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+var cntProxied = expvar.NewMap("statsHTTPProxied")
+
+// httpProxies are the -http-proxy reverse proxies, keyed by the lower case
+// host name they serve, without a port.
+var httpProxies map[string]*httputil.ReverseProxy
+
+// parseHTTPProxies parses comma separated host=url mappings, e.g.
+// "grafana.home=http://192.168.1.20:3000", into reverse proxies.
+func parseHTTPProxies(s string) (map[string]*httputil.ReverseProxy, error) {
+	proxies := make(map[string]*httputil.ReverseProxy)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		host, target, ok := strings.Cut(item, "=")
+		host = strings.ToLower(strings.TrimSpace(host))
+		if !ok || !validName(host) {
+			return nil, fmt.Errorf("bad -http-proxy mapping '%s', want host=url", item)
+		}
+		u, err := url.Parse(strings.TrimSpace(target))
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, fmt.Errorf("bad -http-proxy backend '%s' for %s", target, host)
+		}
+		proxy := httputil.NewSingleHostReverseProxy(u)
+		proxy.ErrorHandler = func(w http.ResponseWriter, req *http.Request, err error) {
+			log.Printf("HTTP ERROR: Proxying %s to %s: %s\n", host, u.Host, err)
+			cntErrors.Add(1)
+			w.WriteHeader(http.StatusBadGateway)
+		}
+		proxies[host] = proxy
+	}
+	return proxies, nil
+}
+
+// proxyHosts passes requests for the -http-proxy hosts to their backends,
+// with all their paths, and all others to next.
+func proxyHosts(next http.Handler) http.Handler {
+	if len(httpProxies) == 0 {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		host := req.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		host = strings.ToLower(strings.TrimSuffix(host, "."))
+		if proxy := httpProxies[host]; proxy != nil {
+			cntProxied.Add(host, 1)
+			proxy.ServeHTTP(w, req)
+			return
+		}
+		next.ServeHTTP(w, req)
+	})
+}
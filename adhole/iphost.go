@@ -0,0 +1,64 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+)
+
+var cntIPHost = expvar.NewInt("statsHTTPIPHost")
+
+// parseIPHosts checks an -ip-hosts policy.
+func parseIPHosts(policy string) error {
+	if policy != "pixel" && policy != "log" && policy != "refuse" {
+		return fmt.Errorf("bad -ip-hosts policy '%s', want pixel, log or refuse", policy)
+	}
+	return nil
+}
+
+// hostIP returns the address in a Host header that is an IP literal, with or
+// without a port, IPv6 ones in brackets, or nil for a name.
+func hostIP(host string) net.IP {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	} else if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		host = host[1 : len(host)-1]
+	}
+	return net.ParseIP(host)
+}
+
+// ipHostRequest tells if req asks for an IP address rather than a name, other
+// than the one it arrived at: most likely software connecting by address
+// without DNS, such as malware calling home, redirected to the pixel server
+// by the firewall. Such requests are counted, and logged or refused as
+// -ip-hosts says. It returns true if req has been answered.
+func ipHostRequest(w http.ResponseWriter, req *http.Request) bool {
+	ip := hostIP(req.Host)
+	if ip == nil {
+		return false
+	}
+	if local, ok := req.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok && local.IP.Equal(ip) {
+		return false
+	}
+	cntIPHost.Add(1)
+	if *flagIPHosts == "pixel" {
+		return false
+	}
+	client := clientHTTP(req.RemoteAddr)
+	if host, _, err := net.SplitHostPort(req.RemoteAddr); err == nil {
+		if name := clientName(net.ParseIP(host)); name != "" {
+			client += " (" + name + ")"
+		}
+	}
+	log.Printf("HTTP WARN: Request for address %s from %s: %s %s\n", ip, client, req.Method, req.RequestURI)
+	if *flagIPHosts != "refuse" {
+		return false
+	}
+	http.Error(w, "Forbidden", http.StatusForbidden)
+	return true
+}
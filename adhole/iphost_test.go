@@ -0,0 +1,84 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHostIP(t *testing.T) {
+	tests := []struct {
+		host string
+		want string // "" for a name
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"192.0.2.1:8080", "192.0.2.1"},
+		{"[2001:db8::1]", "2001:db8::1"},
+		{"[2001:db8::1]:443", "2001:db8::1"},
+		{"2001:db8::1", "2001:db8::1"},
+		{"ads.example.com", ""},
+		{"ads.example.com:80", ""},
+		{"[ads.example.com]", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		got := hostIP(tt.host)
+		if tt.want == "" && got != nil || tt.want != "" && !got.Equal(net.ParseIP(tt.want)) {
+			t.Errorf("%q: %v, want %q", tt.host, got, tt.want)
+		}
+	}
+}
+
+// Pixel requests for IP addresses are counted under any policy, logged
+// unless pixel and refused only with refuse, while those for names or for
+// the address they arrived at go on to the pixel.
+func TestIPHostRequest(t *testing.T) {
+	local := &net.TCPAddr{IP: net.IPv4(192, 0, 2, 53), Port: 80}
+	tests := []struct {
+		policy  string
+		host    string
+		counted bool
+		logged  bool
+		status  int
+	}{
+		{"pixel", "192.0.2.1", true, false, http.StatusOK},
+		{"log", "192.0.2.1", true, true, http.StatusOK},
+		{"refuse", "192.0.2.1", true, true, http.StatusForbidden},
+		{"refuse", "[2001:db8::1]:80", true, true, http.StatusForbidden},
+		{"refuse", "192.0.2.53", false, false, http.StatusOK},
+		{"refuse", "ads.example.com", false, false, http.StatusOK},
+		{"log", "ads.example.com:80", false, false, http.StatusOK},
+	}
+	for _, tt := range tests {
+		withFlag(t, flagIPHosts, tt.policy)
+		lb := withLogBuffer(t, 0)
+		count := cntIPHost.Value()
+		req := httptest.NewRequest(http.MethodGet, "/ad.gif", nil)
+		req.Host = tt.host
+		req = req.WithContext(context.WithValue(req.Context(), http.LocalAddrContextKey, local))
+		w := httptest.NewRecorder()
+		handleHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%s %s: status %d, want %d", tt.policy, tt.host, w.Code, tt.status)
+		}
+		if counted := cntIPHost.Value() > count; counted != tt.counted {
+			t.Errorf("%s %s: counted %v, want %v", tt.policy, tt.host, counted, tt.counted)
+		}
+		if logged := strings.Contains(strings.Join(lb.lines(), "\n"), "Request for address"); logged != tt.logged {
+			t.Errorf("%s %s: logged %v, want %v", tt.policy, tt.host, logged, tt.logged)
+		}
+	}
+}
+
+func TestParseIPHosts(t *testing.T) {
+	for policy, ok := range map[string]bool{"pixel": true, "log": true, "refuse": true, "": false, "block": false} {
+		if err := parseIPHosts(policy); (err == nil) != ok {
+			t.Errorf("%q: %v", policy, err)
+		}
+	}
+}
@@ -0,0 +1,649 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxWarnings limits the parse warnings kept per list file.
+const maxWarnings = 10
+
+var (
+	// rules is the current rule set, guarded by listMu. It is only ever
+	// replaced as a whole, never modified.
+	rules  *ruleSet
+	listMu sync.RWMutex
+	// ruleFiles describes the list files rules was loaded from, guarded
+	// by listMu.
+	ruleFiles []listFile
+	// reloadMu serializes reloads.
+	reloadMu sync.Mutex
+)
+
+// ruleSource packs where a blocking rule came from: the index of the list
+// file in ruleSet.names in the top 8 bits, and the line number in the rest.
+type ruleSource uint32
+
+// newRuleSource returns the source for line of the list file with index
+// list. Line numbers too large to pack are kept as the largest possible.
+func newRuleSource(list, line int) ruleSource {
+	if line > 1<<24-1 {
+		line = 1<<24 - 1
+	}
+	return ruleSource(list<<24 | line)
+}
+
+// flagSource is the source of rules given as options rather than in a list.
+// List lines are numbered from 1, so it can't be mistaken for one.
+const flagSource ruleSource = 0
+
+// list returns the list index.
+func (src ruleSource) list() int {
+	return int(src >> 24)
+}
+
+// active reports whether the rule from src applies, i.e. isn't from a
+// disabled list.
+func (src ruleSource) active() bool {
+	return src == flagSource || !listDisabled(src.list())
+}
+
+// owner returns the list index, or -1 for flagSource.
+func (src ruleSource) owner() int {
+	if src == flagSource {
+		return -1
+	}
+	return src.list()
+}
+
+// line returns the line number.
+func (src ruleSource) line() int {
+	return int(src & (1<<24 - 1))
+}
+
+// ruleSet holds the rules of the lists by name, with a trailing dot. Each
+// applies to the name and all its subdomains.
+type ruleSet struct {
+	names   []string     // list names, indexed by ruleSource
+	paths   []string     // list paths
+	rules   []int        // number of rules per list
+	usage   []*listUsage // which rules matched, per list
+	blocked map[string]ruleSource
+	filter  *bloom                  // of blocked, if -bloom
+	tlds    map[string]ruleSource   // top level domains blocked as a whole
+	substrs map[string]ruleSource   // blocking substrings of names
+	matcher *substrings             // of substrs, if there are any
+	local   map[string]*localRule   // names answered locally
+	forward map[string]*net.UDPAddr // zones relayed to other servers
+	// also has the sources of rules held by more than one list but the
+	// first, which is in blocked, tlds or substrs. It is keyed by zone as
+	// matchBlocked returns it, e.g. "*.zip." for a top level domain.
+	also map[string][]ruleSource
+}
+
+// localRule is how a name is answered locally: with its addresses, no
+// records (NODATA) if there are none, or NXDOMAIN.
+type localRule struct {
+	addrs    []net.IP
+	nxdomain bool
+}
+
+// newRuleSet returns an empty rule set.
+func newRuleSet() *ruleSet {
+	return &ruleSet{
+		blocked: make(map[string]ruleSource),
+		tlds:    make(map[string]ruleSource),
+		substrs: make(map[string]ruleSource),
+		local:   make(map[string]*localRule),
+		forward: make(map[string]*net.UDPAddr),
+		also:    make(map[string][]ruleSource),
+	}
+}
+
+// addList adds the list file at path and returns its index.
+func (rs *ruleSet) addList(path string) (int, error) {
+	if len(rs.names) == maxLists {
+		return 0, fmt.Errorf("at most %d lists are supported", maxLists)
+	}
+	rs.names = append(rs.names, listName(path, rs.names))
+	rs.paths = append(rs.paths, path)
+	rs.rules = append(rs.rules, 0)
+	return len(rs.names) - 1, nil
+}
+
+// merge adds the blocked names of the list with the given index, which has
+// rules rules in all.
+func (rs *ruleSet) merge(blocked map[string]ruleSource, index, rules int) {
+	rs.rules[index] = rules
+	if len(rs.blocked) == 0 {
+		rs.blocked = blocked
+		return
+	}
+	for name, src := range blocked {
+		rs.addSource(rs.blocked, "", name, src)
+	}
+}
+
+// addSource records that the rule key of m, one of blocked, tlds or substrs
+// with zones starting with prefix, comes from src. The first source is kept
+// in m, those of other lists with the same rule in also.
+func (rs *ruleSet) addSource(m map[string]ruleSource, prefix, key string, src ruleSource) {
+	first, ok := m[key]
+	if !ok {
+		m[key] = src
+		return
+	}
+	zone := prefix + key
+	if first.owner() == src.owner() {
+		return
+	}
+	for _, s := range rs.also[zone] {
+		if s.owner() == src.owner() {
+			return
+		}
+	}
+	rs.also[zone] = append(rs.also[zone], src)
+}
+
+// activeSource returns src, the first source of the rule key with zones
+// starting with prefix, if it is active, or else the first active one of
+// the others. It reports false if all are from disabled lists.
+func (rs *ruleSet) activeSource(prefix, key string, src ruleSource) (ruleSource, bool) {
+	if src.active() {
+		return src, true
+	}
+	if len(rs.also) == 0 {
+		return 0, false
+	}
+	for _, src := range rs.also[prefix+key] {
+		if src.active() {
+			return src, true
+		}
+	}
+	return 0, false
+}
+
+// add adds a rule from src.
+func (rs *ruleSet) add(rule listRule, src ruleSource) {
+	name := strings.TrimSuffix(rule.Name, ".") + "."
+	switch {
+	case rule.Substring:
+		rs.addSource(rs.substrs, "contains:", rule.Name, src)
+	case rule.TLD:
+		rs.addSource(rs.tlds, "*.", name, src)
+	case rule.Server != nil:
+		rs.forward[name] = rule.Server
+	case rule.Addrs != nil || rule.NXDomain || rule.NoData:
+		lr := rs.local[name]
+		if lr == nil {
+			lr = &localRule{}
+			rs.local[name] = lr
+		}
+		lr.addrs = append(lr.addrs, rule.Addrs...)
+		lr.nxdomain = rule.NXDomain
+	default:
+		rs.addSource(rs.blocked, "", name, src)
+	}
+}
+
+// isBlocked reports whether name itself is blocked, and by which rule: the
+// first of the enabled lists holding it. With
+// -bloom most names that aren't are ruled out by the filter, without a map
+// lookup.
+func (rs *ruleSet) isBlocked(name string) (ruleSource, bool) {
+	if rs.filter != nil && !rs.filter.has(name) {
+		return 0, false
+	}
+	src, ok := rs.blocked[name]
+	if !ok {
+		return 0, false
+	}
+	return rs.activeSource("", name, src)
+}
+
+// matchBlocked finds the blocking rule for name: for name itself or one of
+// its parents, except top level domains, which only TLD rules block. Their
+// zone is returned as e.g. "*.zip.". Failing that, substring rules are
+// tried, with the zone e.g. "contains:adserver". The root is never blocked.
+func (rs *ruleSet) matchBlocked(name string) (string, ruleSource, bool) {
+	if name == "." {
+		return "", 0, false
+	}
+	full := name
+	// The parents are walked as substrings of name, without allocating.
+	for {
+		if src, ok := rs.isBlocked(name); ok {
+			return name, src, true
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i == len(name)-1 {
+			name = "" // a single label has no parent
+			break
+		}
+		name = name[i+1:]
+		if j := strings.IndexByte(name, '.'); j < 0 || j == len(name)-1 {
+			break // a top level domain
+		}
+	}
+	if strings.HasSuffix(name, ".") {
+		if src, ok := rs.tlds[name]; ok {
+			if src, ok := rs.activeSource("*.", name, src); ok {
+				return "*." + name, src, true
+			}
+		}
+	}
+	if rs.matcher != nil {
+		var src ruleSource
+		p := rs.matcher.find(full, func(p int) bool {
+			pattern := rs.matcher.patterns[p]
+			var ok bool
+			src, ok = rs.activeSource("contains:", pattern, rs.substrs[pattern])
+			return ok
+		})
+		if p >= 0 {
+			return "contains:" + rs.matcher.patterns[p], src, true
+		}
+	}
+	return "", 0, false
+}
+
+// isTLDZone reports whether zone, as returned by matchBlocked, is a top level
+// domain blocked as a whole.
+func isTLDZone(zone string) bool {
+	return strings.HasPrefix(zone, "*.")
+}
+
+// describe tells where the rule for name from src came from, e.g.
+// "doubleclick.net from hosts.txt line 48211".
+func (rs *ruleSet) describe(name string, src ruleSource) string {
+	name = strings.TrimSuffix(name, ".")
+	if src == flagSource {
+		return name + " from the options"
+	}
+	list := "?"
+	if i := src.list(); i < len(rs.names) {
+		list = rs.names[i]
+	}
+	return fmt.Sprintf("%s from %s line %d", name, list, src.line())
+}
+
+// buildFilter builds the Bloom filter of the blocked names if -bloom is on.
+func (rs *ruleSet) buildFilter() {
+	if !*flagBloom {
+		return
+	}
+	rs.filter = newBloom(len(rs.blocked), *flagBloomFP)
+	for name := range rs.blocked {
+		rs.filter.add(name)
+	}
+	log.Printf("DNS: Bloom filter uses %d KiB with %d hashes\n", rs.filter.size()/1024, rs.filter.k)
+}
+
+// buildMatcher builds the automaton for the substring rules, if there are
+// any, so that names are only scanned for substrings if they have to be.
+func (rs *ruleSet) buildMatcher() {
+	if len(rs.substrs) == 0 {
+		return
+	}
+	patterns := make([]string, 0, len(rs.substrs))
+	for pattern := range rs.substrs {
+		patterns = append(patterns, pattern)
+	}
+	sort.Strings(patterns)
+	rs.matcher = newSubstrings(patterns)
+	log.Printf("DNS: Substring automaton has %d states for %d patterns\n", rs.matcher.len(), len(patterns))
+}
+
+// len returns the number of names with rules.
+func (rs *ruleSet) len() int {
+	return len(rs.blocked) + len(rs.tlds) + len(rs.substrs) + len(rs.local) + len(rs.forward)
+}
+
+// findZone returns name or the closest of its parents for which has returns
+// true, or "" if there is none.
+func findZone(name string, has func(string) bool) string {
+	for {
+		if has(name) {
+			return name
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 || i == len(name)-1 {
+			return ""
+		}
+		name = name[i+1:]
+	}
+}
+
+// listFile describes one loaded list file.
+type listFile struct {
+	Name      string         `json:"name"`
+	Path      string         `json:"path"`
+	Included  []string       `json:"includedFrom,omitempty"` // the including files, outermost first
+	Rules     int            `json:"rules"`
+	Hash      string         `json:"hash"`
+	FromCache bool           `json:"fromCache"`
+	Formats   map[string]int `json:"formats,omitempty"` // rules per format
+	Skipped   int            `json:"skipped,omitempty"` // lines with warnings
+	Warnings  []string       `json:"warnings,omitempty"`
+	lines     int            // the last line with rules, for usage
+}
+
+// listResult describes the outcome of a reload.
+type listResult struct {
+	Files    []listFile `json:"files"`
+	Rules    int        `json:"rules"`
+	Duration float64    `json:"duration"` // in seconds
+	Swapped  bool       `json:"swapped"`
+	Diff     *ruleDiff  `json:"diff,omitempty"` // from the previous rules
+	Error    string     `json:"error,omitempty"`
+}
+
+// currentRules returns the current rule set.
+func currentRules() *ruleSet {
+	listMu.RLock()
+	defer listMu.RUnlock()
+	return rules
+}
+
+// maxLists is the number of list files a ruleSource can tell apart.
+const maxLists = 256
+
+// maxIncludeDepth limits how deeply @include directives may nest.
+const maxIncludeDepth = 8
+
+// loadLists loads the list files at paths, and the files they include, into
+// one rule set. A name blocked by several lists counts as blocked by the
+// first loaded of them that is enabled. Lists that can't be loaded don't stop the others from being
+// tried, so that the errors of all of them are returned together.
+func loadLists(paths []string) (*ruleSet, []listFile, error) {
+	ld := &listLoader{rs: newRuleSet()}
+	for _, tld := range blockTLDs {
+		ld.rs.tlds[tld+"."] = flagSource
+	}
+	var errs []error
+	for _, path := range paths {
+		if err := ld.load(path, nil); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) > 0 {
+		return nil, ld.files, errors.Join(errs...)
+	}
+	ld.rs.buildFilter()
+	ld.rs.buildMatcher()
+	return ld.rs, ld.files, nil
+}
+
+// listLoader loads list files into a rule set. Each included file becomes a
+// list of its own, so that its rules are reported with its name and lines.
+type listLoader struct {
+	rs    *ruleSet
+	files []listFile
+}
+
+// load loads the list file at path, which was included by the files in
+// chain, outermost first. The file has one name or rule per line in any of
+// the listFormats, and may be gzip or zstd compressed. Empty lines and comments
+// starting with # are skipped, as are lines in no known format, with a
+// warning. "@include other.txt" loads another file, relative to this one.
+//
+// If enabled, the compiled cache is tried first and refreshed after a parse.
+// The cache only holds blocked names, so it isn't written for lists with
+// other rules or includes. Remote lists are downloaded every time and never
+// cached, nor is the -pihole-db database, read every time.
+func (ld *listLoader) load(path string, chain []string) error {
+	for i, p := range chain {
+		if p == path {
+			return fmt.Errorf("include cycle: %s", strings.Join(append(chain[i:], path), " -> "))
+		}
+	}
+	if len(chain) > maxIncludeDepth {
+		return fmt.Errorf("includes nested more than %d deep", maxIncludeDepth)
+	}
+	rs := ld.rs
+	index, err := rs.addList(path)
+	if err != nil {
+		return err
+	}
+	pos := len(ld.files)
+	ld.files = append(ld.files, listFile{Name: rs.names[index], Path: path, Included: chain})
+	info := &ld.files[pos]
+	remote := isRemote(path)
+	pihole := *flagPiholeDB != "" && path == *flagPiholeDB
+	if *flagCache && !remote && !pihole {
+		entries, err := loadCache(path, index)
+		if err == nil {
+			info.Rules, info.FromCache = len(entries), true
+			for _, src := range entries {
+				info.lines = max(info.lines, src.line())
+			}
+			info.Hash, _ = hashFile(path)
+			log.Printf("DNS: Loaded %d entries from cache\n", len(entries))
+			rs.merge(entries, index, info.Rules)
+			return nil
+		}
+		log.Println("DNS: Not using cache:", err)
+	}
+
+	local := path
+	if remote {
+		if local, err = fetchList(path); err != nil {
+			return err
+		}
+		defer os.Remove(local)
+	} else if pihole {
+		if local, err = piholeList(path); err != nil {
+			return err
+		}
+		defer os.Remove(local)
+	}
+	file, err := os.Open(local)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	// The hash is of the file as it is, compressed or not.
+	hash := sha256.New()
+	r, err := decompress(listPath(path), io.TeeReader(file, hash))
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	defer r.Close()
+
+	// Blocked names go to a map of their own first, for the cache.
+	blocked := make(map[string]ruleSource, 4096)
+	other, includes := 0, 0
+	formats := make(map[string]int)
+	var skipped int
+	var warnings []string
+	var st listState
+	scn := bufio.NewScanner(r)
+	for line := 1; scn.Scan(); line++ {
+		text := strings.TrimSpace(scn.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		if target, ok := strings.CutPrefix(text, "@include "); ok {
+			inner := append(chain[:len(chain):len(chain)], path)
+			if err := ld.load(resolveInclude(path, strings.TrimSpace(target)), inner); err != nil {
+				return fmt.Errorf("%s line %d: %w", path, line, err)
+			}
+			includes++
+			continue
+		}
+		lineRules, format, err := parseListLine(&st, text)
+		if err != nil {
+			skipped++
+			if len(warnings) < maxWarnings {
+				warnings = append(warnings, fmt.Sprintf("line %d: %s: %q", line, err, text))
+			}
+			continue
+		}
+		src := newRuleSource(index, line)
+		info.lines = line
+		for _, rule := range lineRules {
+			if rule.Addrs != nil || rule.NXDomain || rule.NoData || rule.Server != nil || rule.TLD || rule.Substring {
+				rs.add(rule, src)
+				other++
+				continue
+			}
+			name := strings.TrimSuffix(rule.Name, ".") + "."
+			if _, ok := blocked[name]; !ok {
+				blocked[name] = src
+			}
+		}
+		formats[format] += len(lineRules)
+	}
+	if err := scn.Err(); err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	// Included files were appended to ld.files since, which may have moved.
+	info = &ld.files[pos]
+	info.Formats, info.Skipped, info.Warnings = formats, skipped, warnings
+	info.Rules = len(blocked) + other
+	info.Hash = hex.EncodeToString(hash.Sum(nil))
+	log.Printf("DNS: Parsed %d entries from %s %v\n", info.Rules, path, info.Formats)
+	for _, warning := range info.Warnings {
+		log.Printf("DNS WARN: %s: %s\n", path, warning)
+	}
+
+	if *flagCache && !remote && other == 0 && includes == 0 {
+		if err := saveCache(path, blocked); err != nil {
+			log.Println("DNS ERROR: Can't write cache:", err)
+		}
+	}
+	rs.merge(blocked, index, info.Rules)
+	return nil
+}
+
+// resolveInclude returns the path of the file included as target by the
+// list at from. Relative paths are relative to the including file. Remote
+// lists can only include other remote lists, never local files.
+func resolveInclude(from, target string) string {
+	if isRemote(target) {
+		return target
+	}
+	if isRemote(from) {
+		base, err := url.Parse(from)
+		if err != nil {
+			return target
+		}
+		ref, err := url.Parse(target)
+		if err != nil {
+			return target
+		}
+		base.Fragment = ""
+		return base.ResolveReference(ref).String()
+	}
+	if filepath.IsAbs(target) {
+		return target
+	}
+	return filepath.Join(filepath.Dir(from), target)
+}
+
+// decompress returns a reader decompressing r if the list file at path is
+// compressed, going by its extension, or r as it is.
+func decompress(path string, r io.Reader) (io.ReadCloser, error) {
+	switch filepath.Ext(path) {
+	case ".gz":
+		return gzip.NewReader(r)
+	case ".zst":
+		return io.NopCloser(newZstdReader(r)), nil
+	}
+	return io.NopCloser(r), nil
+}
+
+// hashFile returns the hex sha256 of a file's contents.
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// swapList makes rs the current rule set.
+func swapList(rs *ruleSet, files []listFile) {
+	trackUsage(rs, files)
+	listMu.Lock()
+	rules, ruleFiles = rs, files
+	listMu.Unlock()
+	updateDisabled()
+	hashes := make([]string, len(files))
+	for i, info := range files {
+		hashes[i] = info.Hash
+	}
+	cntRules.Set(int64(rs.len()))
+	infoList.Set(strings.Join(hashes, ","))
+}
+
+// reloadList loads the list and, if that worked, replaces the current one.
+// The current list stays in use if the new one can't be loaded. It must be
+// called with reloadMu held.
+func reloadList() listResult {
+	start := time.Now()
+	rs, files, err := loadLists(lists)
+	res := listResult{Files: files}
+	if err != nil {
+		res.Error = err.Error()
+		log.Println("DNS ERROR: Can't reload list, keeping the old one:", err)
+		cntErrors.Add(1)
+	} else {
+		res.Diff = diffRules(currentRules(), rs, *flagDiffN)
+		swapList(rs, files)
+		setLastDiff(res.Diff)
+		res.Rules, res.Swapped = rs.len(), true
+		log.Printf("Rules reloaded: %d (%d added, %d removed, %d unchanged)\n",
+			res.Rules, res.Diff.Added, res.Diff.Removed, res.Diff.Unchanged)
+		if len(res.Diff.AddedSample) > 0 || len(res.Diff.RemovedSample) > 0 {
+			log.Printf("Rules added e.g. %v, removed e.g. %v\n", res.Diff.AddedSample, res.Diff.RemovedSample)
+		}
+	}
+	if err := loadLogIgnore(); err != nil {
+		log.Println("DNS ERROR: Can't reload -log-ignore-file, keeping the old names:", err)
+		cntErrors.Add(1)
+	}
+	if err := loadClientNames(); err != nil {
+		log.Println("DNS ERROR: Can't reload client names, keeping the old ones:", err)
+		cntErrors.Add(1)
+	}
+	res.Duration = time.Since(start).Seconds()
+	return res
+}
+
+// reload reloads the list, waiting for any reload in progress to finish.
+func reload() listResult {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	return reloadList()
+}
+
+// tryReload reloads the list unless a reload is in progress already.
+func tryReload() (listResult, bool) {
+	if !reloadMu.TryLock() {
+		return listResult{}, false
+	}
+	defer reloadMu.Unlock()
+	return reloadList(), true
+}
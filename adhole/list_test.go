@@ -0,0 +1,222 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// withLists loads list files with the given names and contents as the
+// current rules for the rest of the test, all enabled.
+func withLists(tb testing.TB, files ...[2]string) *ruleSet {
+	tb.Helper()
+	paths := make([]string, len(files))
+	for i, f := range files {
+		paths[i] = writeTemp(tb, f[0], f[1])
+	}
+	rs, infos, err := loadLists(paths)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	listMu.RLock()
+	oldRules, oldFiles := rules, ruleFiles
+	listMu.RUnlock()
+	swapList(rs, infos)
+	tb.Cleanup(func() {
+		for _, name := range rs.names {
+			setListEnabled(name, true, 0)
+		}
+		listMu.Lock()
+		rules, ruleFiles = oldRules, oldFiles
+		listMu.Unlock()
+		updateDisabled()
+	})
+	return rs
+}
+
+// A name held by several lists must stay blocked as long as any of them is
+// enabled, whichever was loaded first.
+func TestDisabledListSharingName(t *testing.T) {
+	rs := withLists(t,
+		[2]string{"strict.txt", "ads.example.com\nonly-strict.com\n*.zip\ncontains:adserv\n"},
+		[2]string{"default.txt", "tracker.net\nads.example.com\n*.zip\ncontains:adserv\n"})
+	for _, tc := range []struct {
+		disable []string
+		name    string
+		zone    string // "" if not blocked
+		list    string
+	}{
+		{nil, "ads.example.com.", "ads.example.com.", "strict"},
+		{[]string{"strict"}, "ads.example.com.", "ads.example.com.", "default"},
+		{[]string{"strict"}, "www.ads.example.com.", "ads.example.com.", "default"},
+		{[]string{"strict"}, "only-strict.com.", "", ""},
+		{[]string{"strict"}, "files.zip.", "*.zip.", "default"},
+		{[]string{"strict"}, "myadserver.com.", "contains:adserv", "default"},
+		{[]string{"default"}, "ads.example.com.", "ads.example.com.", "strict"},
+		{[]string{"strict", "default"}, "ads.example.com.", "", ""},
+		{[]string{"strict", "default"}, "files.zip.", "", ""},
+	} {
+		for _, name := range rs.names {
+			setListEnabled(name, !contains(tc.disable, name), 0)
+		}
+		zone, src, block := rs.matchCached(tc.name)
+		if tc.zone == "" {
+			if block {
+				t.Errorf("%v disabled: %s blocked by %s", tc.disable, tc.name, rs.describe(zone, src))
+			}
+			continue
+		}
+		if !block || zone != tc.zone || rs.names[src.list()] != tc.list {
+			t.Errorf("%v disabled: %s matched %q in list %d, blocked %v, want %q in %s",
+				tc.disable, tc.name, zone, src.list(), block, tc.zone, tc.list)
+		}
+	}
+}
+
+// A rule held by several lists is used in all of them when it matches, so
+// that pruning doesn't remove it from any.
+func TestUsageCreditsEveryList(t *testing.T) {
+	rs := withLists(t,
+		[2]string{"strict.txt", "ads.example.com\nunused.com\n"},
+		[2]string{"default.txt", "tracker.net\nads.example.com\n"})
+	zone, src, block := rs.matchBlocked("ads.example.com.")
+	if !block {
+		t.Fatal("not blocked")
+	}
+	rs.markUsed(zone, src)
+
+	unused := make(map[string][]unusedRule)
+	for _, ul := range rs.unused(0) {
+		unused[ul.Name] = ul.Unused
+	}
+	for list, want := range map[string]unusedRule{
+		"strict":  {Line: 2, Rule: "unused.com"},
+		"default": {Line: 1, Rule: "tracker.net"},
+	} {
+		if got := unused[list]; len(got) != 1 || got[0] != want {
+			t.Errorf("%s: unused %v, want only %v", list, got, want)
+		}
+	}
+	if u := rs.usage[indexOf(rs.names, "default")]; !u.used(2) {
+		t.Error("default: matched line 2 not marked used")
+	}
+}
+
+// compressedList is the list in the compressed fixtures.
+func compressedList() string {
+	var b strings.Builder
+	for i := 0; i < 300; i++ {
+		fmt.Fprintf(&b, "ads%d.example.com\n", i)
+	}
+	b.WriteString("||tracker.net^\n0.0.0.0 telemetry.example.org\n")
+	return b.String()
+}
+
+// compressedZstd is compressedList compressed with zstd -19.
+const compressedZstd = "" +
+	"28b52ffd640315a50c00e6a24c1aa029cb010062246fb64cd6b71dfdc32ba594" +
+	"32a5946cafb88a0747003d003c0093c53eafe336168dc45dae8a46e22e474523" +
+	"71979ba291b8cb49d148dce5a26824ee722f1a89bb9c8b46e22ed7a291b84b16" +
+	"8dc45d1e242010603818489080b0e06098820108012313f3f174389b12921191" +
+	"908ba5429954504c48443c1c0dc6a24e9fcbe3bfdff37b993c16876fbba6e72a" +
+	"752a8dbe6ecbae45e250183ccd921c6bb409f2f8eff7fc5e268fc5e1dbaee9b9" +
+	"4a9d4aa3afdbb26b913814064fb324c71a6d268b7d5ec76dada29a928a7ab95a" +
+	"ac5511d19050d0c954228d6a68260704141030505838241c0c1c1600ccb08300" +
+	"0b87030685430101080a0b0d1a54514d4945bd5c2dd6aa88684828e8642a9146" +
+	"35343332311f4f87b32921191109b9582a944905c58444c4c3d1602ceaf47981" +
+	"2ea81140f1f6d80cd18742632108c1088142a8f00750b5d4ad65fffdeffffef7" +
+	"7ffffbbffffde2854800000000000000000000296ee3639c588b63fa709cea70" +
+	"4c1f8b531d87e9e358aae3287d1ce3f59f5cc57d8efb38eea35c6c02fe2ae1dd" +
+	"0835"
+
+// compressed returns compressedList compressed with enc, gzip or zstd.
+func compressed(tb testing.TB, enc string) []byte {
+	tb.Helper()
+	if enc == "zstd" {
+		data, err := hex.DecodeString(compressedZstd)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		return data
+	}
+	var b bytes.Buffer
+	zw := gzip.NewWriter(&b)
+	zw.Write([]byte(compressedList()))
+	zw.Close()
+	return b.Bytes()
+}
+
+// Lists ending in .gz or .zst are read decompressed, whether files or
+// downloads, as are downloads with a Content-Encoding.
+func TestCompressedLists(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/list.txt.gz":
+			w.Write(compressed(t, "gzip"))
+		case "/list.txt.zst":
+			w.Write(compressed(t, "zstd"))
+		case "/gzip/list.txt", "/zstd/list.txt":
+			enc := strings.Split(req.URL.Path, "/")[1]
+			if !strings.Contains(req.Header.Get("Accept-Encoding"), enc) {
+				t.Errorf("%s not accepted: %q", enc, req.Header.Get("Accept-Encoding"))
+			}
+			w.Header().Set("Content-Encoding", enc)
+			w.Write(compressed(t, enc))
+		case "/br/list.txt":
+			w.Header().Set("Content-Encoding", "br")
+			w.Write([]byte(compressedList()))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer srv.Close()
+	gz, zst := string(compressed(t, "gzip")), string(compressed(t, "zstd"))
+
+	tests := []struct {
+		name string
+		path string
+		err  string // "" if loaded
+	}{
+		{"gzip file", writeTemp(t, "list.txt.gz", gz), ""},
+		{"zstd file", writeTemp(t, "list.txt.zst", zst), ""},
+		{"gzip download", srv.URL + "/list.txt.gz", ""},
+		{"zstd download", srv.URL + "/list.txt.zst", ""},
+		{"gzip encoded download", srv.URL + "/gzip/list.txt", ""},
+		{"zstd encoded download", srv.URL + "/zstd/list.txt", ""},
+		{"corrupt gzip file", writeTemp(t, "list.txt.gz", gz[:len(gz)/2]), "unexpected EOF"},
+		{"corrupt zstd file", writeTemp(t, "list.txt.zst", zst[:len(zst)/2]), "zstd"},
+		{"not gzip", writeTemp(t, "list.txt.gz", compressedList()), "gzip"},
+		{"unknown encoding", srv.URL + "/br/list.txt", "Content-Encoding"},
+	}
+	for _, tt := range tests {
+		rs, files, err := loadLists([]string{tt.path})
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if files[0].Name != "list" {
+			t.Errorf("%s: list named %q", tt.name, files[0].Name)
+		}
+		for _, name := range []string{"ads0.example.com.", "ads299.example.com.", "tracker.net.", "telemetry.example.org."} {
+			if _, _, block := rs.matchBlocked(name); !block {
+				t.Errorf("%s: %s not blocked", tt.name, name)
+			}
+		}
+		if n := rs.len(); n != 302 {
+			t.Errorf("%s: %d rules, want 302", tt.name, n)
+		}
+	}
+}
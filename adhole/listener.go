@@ -0,0 +1,154 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// listener is a local DNS server socket. Each listener has its own sinkhole
+// address, so blocked queries are answered with the address they arrived on.
+type listener struct {
+	conn     *net.UDPConn
+	unix     *unixSocket // instead of conn for Unix domain sockets
+	sinkhole net.IP
+	stats    *expvar.Map
+}
+
+// packet is a datagram read from, or to be written to, a UDP socket. The
+// destination address of read packets is known only on wildcard listeners
+// where IP_PKTINFO is supported, for written ones it's the source address.
+type packet struct {
+	buf   []byte
+	n     int
+	addr  *net.UDPAddr
+	dst   net.IP
+	trunc bool // the datagram was larger than buf, and cut off
+}
+
+// statsListeners holds the per-listener counters, keyed by address.
+var statsListeners = expvar.NewMap("statsListeners")
+
+// newListener wraps a bound socket. If it is bound to the unspecified
+// address the sinkhole IP is used for answers instead. Sockets sharing an
+// address also share their counters.
+func newListener(conn *net.UDPConn, sinkhole net.IP) *listener {
+	addr := conn.LocalAddr().(*net.UDPAddr)
+	ip := addr.IP.To4()
+	if ip == nil || ip.IsUnspecified() {
+		ip = sinkhole
+		if pktinfoSupported {
+			if err := enablePktinfo(conn); err != nil {
+				log.Printf("DNS WARN: Can't learn query addresses at %s: %s\n", addr, err)
+			}
+		}
+	}
+
+	l := &listener{conn: conn, sinkhole: ip}
+	if stats, ok := statsListeners.Get(addr.String()).(*expvar.Map); ok {
+		l.stats = stats
+	} else {
+		l.stats = new(expvar.Map).Init()
+		statsListeners.Set(addr.String(), l.stats)
+	}
+	return l
+}
+
+// send writes a reply to a client. If src is known the reply goes out from
+// that address, so wildcard listeners answer from the address they were
+// asked at.
+func (l *listener) send(b []byte, to *net.UDPAddr, src net.IP) error {
+	if l.unix != nil {
+		return l.unix.send(b, to)
+	}
+	var oob []byte
+	if src != nil {
+		oob = pktinfoSource(src)
+	}
+	_, _, err := l.conn.WriteMsgUDP(b, oob, to)
+	return err
+}
+
+// sendBatch writes the first n packets of b, and returns how many were
+// written.
+func (l *listener) sendBatch(b *batch, n int) (int, error) {
+	if l.unix == nil {
+		return writeBatch(l.conn, b, n)
+	}
+	for i, p := range b.pkts[:n] {
+		if err := l.send(p.buf[:p.n], p.addr, nil); err != nil {
+			return i, err
+		}
+	}
+	return n, nil
+}
+
+// String returns the listener's address.
+func (l *listener) String() string {
+	if l.unix != nil {
+		return "unix:" + l.unix.path
+	}
+	return l.conn.LocalAddr().String()
+}
+
+// listenUDP binds a UDP socket, optionally with SO_REUSEPORT so that several
+// sockets, each with its own reader, can share the address.
+func listenUDP(addr *net.UDPAddr, shared bool) (*net.UDPConn, error) {
+	if !shared {
+		return net.ListenUDP("udp4", addr)
+	}
+	lc := net.ListenConfig{Control: reusePort}
+	pc, err := lc.ListenPacket(context.Background(), "udp4", addr.String())
+	if err != nil {
+		return nil, err
+	}
+	return pc.(*net.UDPConn), nil
+}
+
+// dnsListenAddrs returns the DNS listen addresses: -listen, or the proxy
+// address.
+func dnsListenAddrs(proxyIP net.IP) ([]*net.UDPAddr, error) {
+	if *flagListen == "" {
+		return []*net.UDPAddr{{IP: proxyIP, Port: *flagDNSPort}}, nil
+	}
+	return parseListen(*flagListen, *flagDNSPort)
+}
+
+// parseListen parses a comma separated list of IPv4 addresses with optional
+// ports. Addresses without a port use port. A list without any address is
+// an error.
+func parseListen(arg string, port int) ([]*net.UDPAddr, error) {
+	var addrs []*net.UDPAddr
+	for _, item := range strings.Split(arg, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		host, portStr := item, strconv.Itoa(port)
+		if strings.Contains(item, ":") {
+			var err error
+			if host, portStr, err = net.SplitHostPort(item); err != nil {
+				return nil, err
+			}
+		}
+		ip := net.ParseIP(host).To4()
+		if ip == nil {
+			return nil, fmt.Errorf("can't parse listen address '%s'", item)
+		}
+		p, err := strconv.Atoi(portStr)
+		if err != nil || p < 1 || p > 65535 {
+			return nil, fmt.Errorf("bad port in listen address '%s'", item)
+		}
+		addrs = append(addrs, &net.UDPAddr{IP: ip, Port: p})
+	}
+	if len(addrs) == 0 {
+		return nil, fmt.Errorf("no listen address in '%s'", arg)
+	}
+	return addrs, nil
+}
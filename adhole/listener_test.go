@@ -0,0 +1,188 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestListenUDPShared(t *testing.T) {
+	if !reusePortSupported {
+		t.Skip("no SO_REUSEPORT")
+	}
+	first, err := listenUDP(&net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	addr := first.LocalAddr().(*net.UDPAddr)
+	second, err := listenUDP(addr, true)
+	if err != nil {
+		t.Fatalf("second shared socket: %s", err)
+	}
+	second.Close()
+	if third, err := listenUDP(addr, false); err == nil {
+		third.Close()
+		t.Error("an unshared socket could bind the shared address")
+	}
+}
+
+func TestParseListen(t *testing.T) {
+	for _, tt := range []struct {
+		arg  string
+		want string // addresses, or "error"
+	}{
+		{"127.0.0.1", "[127.0.0.1:53]"},
+		{"127.0.0.1:5353, 10.0.0.1", "[127.0.0.1:5353 10.0.0.1:53]"},
+		{"127.0.0.1,", "[127.0.0.1:53]"},
+		{",", "error"},
+		{" , ", "error"},
+		{"::1", "error"},
+		{"127.0.0.1:0", "error"},
+	} {
+		addrs, err := parseListen(tt.arg, 53)
+		got := fmt.Sprint(addrs)
+		if err != nil {
+			got = "error"
+		}
+		if got != tt.want {
+			t.Errorf("parseListen(%q) = %s, want %s", tt.arg, got, tt.want)
+		}
+	}
+}
+
+// BenchmarkReusePort shows how the query rate scales with the number of
+// -sockets on one address, each with its own reader parsing what it reads,
+// with as many clients as CPUs. It reports the packets read per second and
+// the share lost to full socket buffers.
+func BenchmarkReusePort(b *testing.B) {
+	if !reusePortSupported {
+		b.Skip("no SO_REUSEPORT")
+	}
+	for _, sockets := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("sockets=%d", sockets), func(b *testing.B) {
+			benchSockets(b, sockets)
+		})
+	}
+}
+
+func benchSockets(b *testing.B, sockets int) {
+	conns := make([]*net.UDPConn, sockets)
+	addr := &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}
+	for i := range conns {
+		conn, err := listenUDP(addr, true)
+		if err != nil {
+			b.Fatal(err)
+		}
+		addr = conn.LocalAddr().(*net.UDPAddr)
+		conns[i] = conn
+	}
+	var read, lastRead atomic.Int64
+	var readers sync.WaitGroup
+	for _, conn := range conns {
+		readers.Add(1)
+		go func(conn *net.UDPConn) {
+			defer readers.Done()
+			buf := make([]byte, 512)
+			for {
+				n, _, err := conn.ReadFromUDP(buf)
+				if err != nil {
+					return
+				}
+				if name, _, _, err := parseQuestion(buf[:n]); err == nil {
+					lowerName(name)
+				}
+				read.Add(1)
+				lastRead.Store(time.Now().UnixNano())
+			}
+		}(conn)
+	}
+
+	clients := runtime.GOMAXPROCS(0)
+	msgs := make([][]byte, 64)
+	for i, name := range testNames(len(msgs)) {
+		msgs[i] = testQuery(name, typeA)
+	}
+	b.ResetTimer()
+	start := time.Now()
+	var senders sync.WaitGroup
+	for c := 0; c < clients; c++ {
+		senders.Add(1)
+		go func(c int) {
+			defer senders.Done()
+			// A socket per client, so that the kernel spreads them.
+			conn, err := net.DialUDP("udp4", nil, addr)
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			defer conn.Close()
+			for i := c; i < b.N; i += clients {
+				conn.Write(msgs[i%len(msgs)])
+			}
+		}(c)
+	}
+	senders.Wait()
+	// Wait for the readers to drain the buffers.
+	for last := int64(-1); read.Load() != last && read.Load() < int64(b.N); {
+		last = read.Load()
+		time.Sleep(20 * time.Millisecond)
+	}
+	elapsed := time.Unix(0, lastRead.Load()).Sub(start)
+	b.StopTimer()
+	for _, conn := range conns {
+		conn.Close()
+	}
+	readers.Wait()
+	n := read.Load()
+	b.ReportMetric(float64(n)/elapsed.Seconds(), "pkts/s")
+	b.ReportMetric(100*float64(int64(b.N)-n)/float64(b.N), "%lost")
+}
+
+// TestWildcardAnswerAddress asks a listener bound to the unspecified address
+// at several loopback addresses, and checks that the sinkhole answers come
+// from and carry the address asked at.
+func TestWildcardAnswerAddress(t *testing.T) {
+	if !pktinfoSupported {
+		t.Skip("query addresses not known on this platform")
+	}
+	withBlocked(t, "ads.example.com.")
+	for _, batch := range []int{1, 32} {
+		withFlag(t, flagBatch, batch)
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4zero})
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := newListener(conn, net.IPv4(192, 0, 2, 9).To4())
+		go runServerLocalDNS(l)
+		port := conn.LocalAddr().(*net.UDPAddr).Port
+
+		for _, ip := range []net.IP{net.IPv4(127, 0, 0, 1), net.IPv4(127, 0, 0, 2), net.IPv4(127, 3, 2, 1)} {
+			// A connected socket only gets replies from the address
+			// it's connected to.
+			client, err := net.DialUDP("udp4", nil, &net.UDPAddr{IP: ip, Port: port})
+			if err != nil {
+				t.Fatal(err)
+			}
+			client.Write(testQuery("ads.example.com.", typeA))
+			client.SetReadDeadline(time.Now().Add(2 * time.Second))
+			buf := make([]byte, 512)
+			n, err := client.Read(buf)
+			client.Close()
+			if err != nil {
+				t.Errorf("batch %d, %s: %v", batch, ip, err)
+				continue
+			}
+			if got := net.IP(buf[n-4 : n]); !got.Equal(ip) {
+				t.Errorf("batch %d, %s: answered with %s", batch, ip, got)
+			}
+		}
+		conn.Close()
+	}
+}
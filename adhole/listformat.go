@@ -0,0 +1,256 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// listRule is what a list line says about a name and its subdomains: it's
+// blocked, unless one of the other fields is set.
+type listRule struct {
+	Name      string
+	Addrs     []net.IP     // answer with these addresses
+	NXDomain  bool         // answer that the name doesn't exist
+	NoData    bool         // answer that the name has no records
+	Server    *net.UDPAddr // relay to this server instead of the upstream
+	TLD       bool         // block all names in this top level domain
+	Substring bool         // block all names containing Name
+}
+
+// blockRules returns rules blocking names.
+func blockRules(names []string) []listRule {
+	rules := make([]listRule, len(names))
+	for i, name := range names {
+		rules[i].Name = name
+	}
+	return rules
+}
+
+// listState is what earlier lines of a list file tell about later ones.
+type listState struct {
+	origin string // zone file origin, with a trailing dot
+	paren  bool   // in a zone file record continued over several lines
+}
+
+// A listFormat recognizes the lines of one kind of block list. parse returns
+// the rules in a line, with ok false if the line isn't in the format. A line
+// in the format that can't be used gives an error.
+type listFormat struct {
+	name  string
+	parse func(st *listState, line string) (rules []listRule, ok bool, err error)
+}
+
+// listFormats are tried in order on every line, so that lists concatenated
+// from different sources load without saying which format they're in. The
+// plain format accepts anything left that looks like a name.
+var listFormats = []listFormat{
+	{"hosts", parseHostsLine},
+	{"adblock", parseAdblockLine},
+	{"dnsmasq", parseDnsmasqLine},
+	{"rpz", parseRPZLine},
+	{"tld", parseTLDLine},
+	{"contains", parseContainsLine},
+	{"plain", parsePlainLine},
+}
+
+// hostsLocal are the names hosts files map to the loopback address, which
+// must not be blocked.
+var hostsLocal = map[string]bool{
+	"localhost":             true,
+	"localhost.localdomain": true,
+	"local":                 true,
+	"broadcasthost":         true,
+	"ip6-localhost":         true,
+	"ip6-loopback":          true,
+	"ip6-localnet":          true,
+	"ip6-mcastprefix":       true,
+	"ip6-allnodes":          true,
+	"ip6-allrouters":        true,
+	"ip6-allhosts":          true,
+	"0.0.0.0":               true,
+}
+
+// parseHostsLine parses hosts file entries: "0.0.0.0 ads.example.com".
+func parseHostsLine(st *listState, line string) ([]listRule, bool, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+		return nil, false, nil
+	}
+	var names []string
+	for _, field := range fields[1:] {
+		if strings.HasPrefix(field, "#") {
+			break
+		}
+		if !hostsLocal[strings.ToLower(field)] {
+			names = append(names, field)
+		}
+	}
+	return blockRules(names), true, nil
+}
+
+// parseAdblockLine parses AdGuard and Adblock Plus domain rules:
+// "||ads.example.com^", optionally followed by $options. Other rules, such as
+// exceptions and cosmetic filters, apply to web pages and are skipped.
+func parseAdblockLine(st *listState, line string) ([]listRule, bool, error) {
+	switch {
+	case strings.HasPrefix(line, "!"), strings.HasPrefix(line, "[Adblock"):
+		return nil, true, nil // comments and headers
+	case strings.HasPrefix(line, "@@"), strings.Contains(line, "##"), strings.Contains(line, "#@#"):
+		return nil, true, errors.New("unsupported adblock rule")
+	case !strings.HasPrefix(line, "||"):
+		return nil, false, nil
+	}
+	name, rest, found := strings.Cut(line[2:], "^")
+	if !found || rest != "" && !strings.HasPrefix(rest, "$") || !validName(name) {
+		return nil, true, errors.New("unsupported adblock rule")
+	}
+	return blockRules([]string{name}), true, nil
+}
+
+// parseDnsmasqLine parses dnsmasq address and server directives, which may
+// give several names between slashes:
+//
+//	address=/ads.example.com/0.0.0.0 - blocked, as with :: or # or nothing
+//	address=/nas.example.com/10.0.0.2 - answered with the address
+//	server=/corp.example/10.0.0.53 - relayed to the server, #port optional
+func parseDnsmasqLine(st *listState, line string) ([]listRule, bool, error) {
+	directive, arg, _ := strings.Cut(line, "=")
+	if directive != "address" && directive != "server" {
+		return nil, false, nil
+	}
+	parts := strings.Split(arg, "/")
+	if len(parts) < 3 || parts[0] != "" {
+		return nil, true, errors.New(directive + " directive without names is not supported")
+	}
+	names, target := parts[1:len(parts)-1], parts[len(parts)-1]
+	for _, name := range names {
+		if !validName(name) {
+			return nil, true, errors.New("bad " + directive + " directive")
+		}
+	}
+	rules := blockRules(names)
+
+	if directive == "server" {
+		host, port, found := strings.Cut(target, "#")
+		ip := net.ParseIP(host)
+		n, err := strconv.Atoi(port)
+		if !found {
+			n, err = 53, nil
+		}
+		if ip == nil || ip.To4() == nil || err != nil || n < 1 || n > 65535 {
+			return nil, true, errors.New("server directive without an IPv4 server is not supported")
+		}
+		for i := range rules {
+			rules[i].Server = &net.UDPAddr{IP: ip, Port: n}
+		}
+		return rules, true, nil
+	}
+
+	if target == "" || target == "#" {
+		return rules, true, nil
+	}
+	ip := net.ParseIP(target)
+	if ip == nil {
+		return nil, true, errors.New("bad address directive")
+	}
+	if !ip.IsUnspecified() {
+		for i := range rules {
+			rules[i].Addrs = []net.IP{ip}
+		}
+	}
+	return rules, true, nil
+}
+
+// parseTLDLine parses top level domain rules: "*.zip" or "tld:zip".
+func parseTLDLine(st *listState, line string) ([]listRule, bool, error) {
+	var tld string
+	switch {
+	case strings.HasPrefix(line, "*."):
+		tld = line[2:]
+	case strings.HasPrefix(line, "tld:"):
+		tld = line[4:]
+	default:
+		return nil, false, nil
+	}
+	if !validTLD(tld) {
+		return nil, strings.HasPrefix(line, "tld:"), errors.New("bad top level domain")
+	}
+	return []listRule{{Name: strings.ToLower(tld), TLD: true}}, true, nil
+}
+
+// validTLD reports whether tld looks like a top level domain: a name with a
+// single label.
+func validTLD(tld string) bool {
+	return validName(tld) && !strings.Contains(tld, ".")
+}
+
+// parseTLDs parses a comma separated list of top level domains, with or
+// without a leading dot, e.g. "zip,.mov".
+func parseTLDs(s string) ([]string, error) {
+	var tlds []string
+	for _, tld := range strings.Split(s, ",") {
+		tld = strings.TrimPrefix(strings.TrimSpace(tld), ".")
+		if tld == "" {
+			continue
+		}
+		if !validTLD(tld) {
+			return nil, fmt.Errorf("bad top level domain %q", tld)
+		}
+		tlds = append(tlds, strings.ToLower(tld))
+	}
+	return tlds, nil
+}
+
+// parseContainsLine parses substring rules: "contains:adserver" blocks all
+// names with "adserver" anywhere in them.
+func parseContainsLine(st *listState, line string) ([]listRule, bool, error) {
+	if !strings.HasPrefix(line, "contains:") {
+		return nil, false, nil
+	}
+	substr := line[len("contains:"):]
+	// Unlike names, substrings may start with a dot.
+	if substr == "" || !validName("x"+substr) {
+		return nil, true, errors.New("bad substring")
+	}
+	return []listRule{{Name: strings.ToLower(substr), Substring: true}}, true, nil
+}
+
+// parsePlainLine parses a line with just a name.
+func parsePlainLine(st *listState, line string) ([]listRule, bool, error) {
+	if !validName(line) {
+		return nil, false, nil
+	}
+	return blockRules([]string{line}), true, nil
+}
+
+// validName reports whether name looks like a domain name: letters, digits,
+// hyphens, underscores and dots, not starting with a dot.
+func validName(name string) bool {
+	if name == "" || name[0] == '.' {
+		return false
+	}
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+// parseListLine finds the format of a list line and returns its rules and
+// the format's name.
+func parseListLine(st *listState, line string) ([]listRule, string, error) {
+	for _, format := range listFormats {
+		rules, ok, err := format.parse(st, line)
+		if ok {
+			return rules, format.name, err
+		}
+	}
+	return nil, "", errors.New("not a name or rule")
+}
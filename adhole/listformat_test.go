@@ -0,0 +1,312 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"reflect"
+	"testing"
+)
+
+// Each line is recognized in its own format, so that concatenated lists of
+// different formats load.
+func TestListLineFormats(t *testing.T) {
+	tests := []struct {
+		line   string
+		format string
+		names  []string
+		err    bool
+	}{
+		{"0.0.0.0 ads.example.com", "hosts", []string{"ads.example.com"}, false},
+		{"127.0.0.1 ads.example.com tracker.net # trackers", "hosts", []string{"ads.example.com", "tracker.net"}, false},
+		{"::1 ip6-localhost ip6-loopback", "hosts", nil, false},
+		{"127.0.0.1 localhost", "hosts", nil, false},
+		{"0.0.0.0 0.0.0.0", "hosts", nil, false},
+		{"||ads.example.com^", "adblock", []string{"ads.example.com"}, false},
+		{"||ads.example.com^$third-party", "adblock", []string{"ads.example.com"}, false},
+		{"! Title: EasyList", "adblock", nil, false},
+		{"[Adblock Plus 2.0]", "adblock", nil, false},
+		{"@@||ads.example.com^", "adblock", nil, true},
+		{"example.com##.banner", "adblock", nil, true},
+		{"||ads.example.com/banner.gif", "adblock", nil, true},
+		{"address=/ads.example.com/", "dnsmasq", []string{"ads.example.com"}, false},
+		{"address=/ads.example.com/tracker.net/0.0.0.0", "dnsmasq", []string{"ads.example.com", "tracker.net"}, false},
+		{"address=ads.example.com", "dnsmasq", nil, true},
+		{"ads.example.com", "plain", []string{"ads.example.com"}, false},
+		{"ADS.Example.COM", "plain", []string{"ADS.Example.COM"}, false},
+		{"ads example com", "", nil, true},
+		{"https://example.com/ads", "", nil, true},
+	}
+	for _, tt := range tests {
+		rules, format, err := parseListLine(&listState{}, tt.line)
+		if format != tt.format || (err != nil) != tt.err {
+			t.Errorf("%q: format %q, error %v, want %q, error %v", tt.line, format, err, tt.format, tt.err)
+			continue
+		}
+		var names []string
+		for _, rule := range rules {
+			if !reflect.DeepEqual(rule, listRule{Name: rule.Name}) {
+				t.Errorf("%q: rule %+v, want a plain block", tt.line, rule)
+			}
+			names = append(names, rule.Name)
+		}
+		if !reflect.DeepEqual(names, tt.names) {
+			t.Errorf("%q: names %q, want %q", tt.line, names, tt.names)
+		}
+	}
+}
+
+// A list concatenated from lists of different formats loads as a whole.
+func TestMixedFormatList(t *testing.T) {
+	path := writeTemp(t, "mixed.txt", `# from a hosts file
+0.0.0.0 hosts.example.com
+! from an adblock list
+||adblock.example.com^
+address=/dnsmasq.example.com/
+plain.example.com
+this line is nothing
+`)
+	rs, _, err := loadLists([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name  string
+		block bool
+	}{
+		{"hosts.example.com.", true},
+		{"www.adblock.example.com.", true},
+		{"dnsmasq.example.com.", true},
+		{"plain.example.com.", true},
+		{"example.com.", false},
+		{"line.", false},
+	} {
+		if _, _, block := rs.matchBlocked(tt.name); block != tt.block {
+			t.Errorf("%s: blocked %v, want %v", tt.name, block, tt.block)
+		}
+	}
+}
+
+// dnsmasq address directives answer with their addresses or block, and
+// server directives relay to their server.
+func TestDnsmasqDirectives(t *testing.T) {
+	server := func(ip string, port int) *net.UDPAddr { return &net.UDPAddr{IP: net.ParseIP(ip), Port: port} }
+	tests := []struct {
+		line  string
+		rules []listRule
+		err   bool
+	}{
+		{"address=/nas.example.com/10.0.0.2", []listRule{{Name: "nas.example.com", Addrs: []net.IP{net.ParseIP("10.0.0.2")}}}, false},
+		{"address=/nas.example.com/fd00::2", []listRule{{Name: "nas.example.com", Addrs: []net.IP{net.ParseIP("fd00::2")}}}, false},
+		{"address=/a.example/b.example/10.0.0.2", []listRule{
+			{Name: "a.example", Addrs: []net.IP{net.ParseIP("10.0.0.2")}},
+			{Name: "b.example", Addrs: []net.IP{net.ParseIP("10.0.0.2")}},
+		}, false},
+		{"address=/ads.example.com/::", []listRule{{Name: "ads.example.com"}}, false},
+		{"address=/ads.example.com/#", []listRule{{Name: "ads.example.com"}}, false},
+		{"address=/nas.example.com/nas", nil, true},
+		{"address=/bad name/10.0.0.2", nil, true},
+		{"server=/corp.example/10.0.0.53", []listRule{{Name: "corp.example", Server: server("10.0.0.53", 53)}}, false},
+		{"server=/corp.example/10.0.0.53#5353", []listRule{{Name: "corp.example", Server: server("10.0.0.53", 5353)}}, false},
+		{"server=/corp.example/10.0.0.53#0", nil, true},
+		{"server=/corp.example/fd00::53", nil, true},
+		{"server=10.0.0.53", nil, true},
+	}
+	for _, tt := range tests {
+		rules, format, err := parseListLine(&listState{}, tt.line)
+		if format != "dnsmasq" || (err != nil) != tt.err {
+			t.Errorf("%q: format %q, error %v, want error %v", tt.line, format, err, tt.err)
+			continue
+		}
+		if !tt.err && !reflect.DeepEqual(rules, tt.rules) {
+			t.Errorf("%q: rules %+v, want %+v", tt.line, rules, tt.rules)
+		}
+	}
+}
+
+// answerAddrs returns the addresses in the A and AAAA records of msg.
+func answerAddrs(msg []byte) []string {
+	var addrs []string
+	walkRecords(msg, func(rrtype uint16, off int) {
+		if rrtype == typeA || rrtype == typeAAAA {
+			n := int(binary.BigEndian.Uint16(msg[off+8:]))
+			addrs = append(addrs, net.IP(msg[off+10:off+10+n]).String())
+		}
+	})
+	return addrs
+}
+
+// localTest is a query for a name with a local rule, and its answer.
+type localTest struct {
+	name  string
+	qtype uint16
+	rcode byte
+	addrs []string
+}
+
+// askLocal asks l the queries of tests and checks the answers.
+func askLocal(t *testing.T, l *listener, tests []localTest) {
+	t.Helper()
+	for _, tt := range tests {
+		reply := ask(t, l, testQuery(tt.name, tt.qtype))
+		if rcode := reply[3] & 0x0f; rcode != tt.rcode {
+			t.Errorf("%s type %d: rcode %d, want %d", tt.name, tt.qtype, rcode, tt.rcode)
+		}
+		if addrs := answerAddrs(reply); !reflect.DeepEqual(addrs, tt.addrs) {
+			t.Errorf("%s type %d: answered %q, want %q", tt.name, tt.qtype, addrs, tt.addrs)
+		}
+	}
+}
+
+func TestDnsmasqAddressAnswers(t *testing.T) {
+	withLists(t, [2]string{"dnsmasq.conf", "address=/nas.example.com/10.0.0.2\naddress=/nas.example.com/fd00::2\n"})
+	l := startListener(t, false)
+	askLocal(t, l, []localTest{
+		{"nas.example.com.", typeA, 0, []string{"10.0.0.2"}},
+		{"www.nas.example.com.", typeA, 0, []string{"10.0.0.2"}},
+		{"nas.example.com.", typeAAAA, 0, []string{"fd00::2"}},
+		{"nas.example.com.", typeANY, 0, []string{"10.0.0.2", "fd00::2"}},
+		{"nas.example.com.", typeMX, 0, nil},
+	})
+}
+
+func TestDnsmasqServer(t *testing.T) {
+	up := withUpstream(t)
+	corp, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer corp.Close()
+	addr := corp.LocalAddr().(*net.UDPAddr)
+	withLists(t, [2]string{"dnsmasq.conf", fmt.Sprintf("server=/corp.example/127.0.0.1#%d\n", addr.Port)})
+
+	// The forwarder is set up here rather than started as a component.
+	conn, err := net.DialUDP("udp4", nil, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &forwarder{stats: serverStatsFor(addr.String())}
+	f.conn.Store(conn)
+	forwarders.Lock()
+	forwarders.m[addr.String()] = f
+	forwarders.Unlock()
+	go runServerUpstreamDNS(&f.conn)
+	t.Cleanup(func() {
+		forwarders.Lock()
+		delete(forwarders.m, addr.String())
+		forwarders.Unlock()
+		conn.Close()
+	})
+	go func() {
+		buf := make([]byte, 512)
+		n, from, err := corp.ReadFromUDP(buf)
+		if err != nil {
+			return
+		}
+		_, _, end, _ := parseQuestion(buf[:n])
+		corp.WriteToUDP(appendA(newReply(buf[:n], end, 0), net.IPv4(10, 1, 1, 1), 60), from)
+	}()
+
+	l := startListener(t, false)
+	askLocal(t, l, []localTest{{"intranet.corp.example.", typeA, 0, []string{"10.1.1.1"}}})
+
+	client, err := net.DialUDP("udp4", nil, l.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.Write(testQuery("example.com.", typeA))
+	if relayed(up) == nil {
+		t.Error("name outside the zone not relayed to the upstream")
+	}
+}
+
+// RPZ QNAME policies load as local answers, and other policies and triggers
+// are skipped.
+func TestRPZ(t *testing.T) {
+	const zone = `$TTL 300
+@ IN SOA localhost. admin.localhost. (
+	1 3600 600 86400 300 )
+	IN NS localhost.
+; threats
+$ORIGIN rpz.example.
+malware.example.com CNAME .
+*.malware.example.com CNAME .
+nodata.example.com 300 IN CNAME *.
+walled.example.com A 10.0.0.80
+walled.example.com AAAA fd00::80
+absolute.example.net.rpz.example. CNAME .
+32.1.2.0.192.rpz-ip CNAME .
+redirect.example.com CNAME walled.example.com.
+`
+	rs := withLists(t, [2]string{"threats.rpz", zone})
+	for _, tt := range []struct {
+		name     string
+		nxdomain bool
+		addrs    int
+	}{
+		{"malware.example.com.", true, 0},
+		{"nodata.example.com.", false, 0},
+		{"walled.example.com.", false, 2},
+		{"absolute.example.net.", true, 0},
+	} {
+		lr := rs.local[tt.name]
+		if lr == nil {
+			t.Errorf("%s: no local rule", tt.name)
+			continue
+		}
+		if lr.nxdomain != tt.nxdomain || len(lr.addrs) != tt.addrs {
+			t.Errorf("%s: NXDOMAIN %v with %d addresses, want %v with %d", tt.name, lr.nxdomain, len(lr.addrs), tt.nxdomain, tt.addrs)
+		}
+	}
+	if len(rs.local) != 4 || len(rs.blocked) != 0 {
+		t.Errorf("%d local rules and %d blocked names, want 4 and none", len(rs.local), len(rs.blocked))
+	}
+
+	l := startListener(t, false)
+	askLocal(t, l, []localTest{
+		{"malware.example.com.", typeA, rcodeNXDomain, nil},
+		{"cdn.malware.example.com.", typeA, rcodeNXDomain, nil},
+		{"nodata.example.com.", typeA, 0, nil},
+		{"walled.example.com.", typeA, 0, []string{"10.0.0.80"}},
+		{"walled.example.com.", typeAAAA, 0, []string{"fd00::80"}},
+		{"absolute.example.net.", typeTXT, rcodeNXDomain, nil},
+	})
+}
+
+func TestRPZLines(t *testing.T) {
+	tests := []struct {
+		line string
+		rule *listRule // nil if the line has none
+		err  bool
+	}{
+		{"ads.example.com CNAME .", &listRule{Name: "ads.example.com", NXDomain: true}, false},
+		{"ads.example.com 60 IN CNAME *.", &listRule{Name: "ads.example.com", NoData: true}, false},
+		{"*.ads.example.com CNAME .", &listRule{Name: "ads.example.com", NXDomain: true}, false},
+		{"ads.example.com A 10.0.0.1", &listRule{Name: "ads.example.com", Addrs: []net.IP{net.ParseIP("10.0.0.1")}}, false},
+		{"ads.example.com A fd00::1", nil, true},
+		{"ads.example.com AAAA 10.0.0.1", nil, true},
+		{"ads.example.com CNAME walled.example.com.", nil, true},
+		{"24.0.2.0.192.rpz-ip CNAME .", nil, true},
+		{"ns.example.rpz-nsdname CNAME .", nil, true},
+		{"@ IN NS localhost.", nil, false},
+		{"ads.example.com TXT \"why\"", nil, false},
+		{"; comment", nil, false},
+	}
+	for _, tt := range tests {
+		rules, ok, err := parseRPZLine(&listState{origin: "rpz.example."}, tt.line)
+		if !ok || (err != nil) != tt.err {
+			t.Errorf("%q: recognized %v, error %v, want error %v", tt.line, ok, err, tt.err)
+			continue
+		}
+		var want []listRule
+		if tt.rule != nil {
+			want = []listRule{*tt.rule}
+		}
+		if !reflect.DeepEqual(rules, want) {
+			t.Errorf("%q: rules %+v, want %+v", tt.line, rules, want)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// cntListHits counts the blocked queries per list name.
+var cntListHits = expvar.NewMap("statsListHits")
+
+var (
+	// disabled maps the names of the disabled lists to the time they are
+	// enabled again, or the zero time if they stay disabled.
+	disabled   = make(map[string]time.Time)
+	disabledMu sync.Mutex
+	// disabledBits has the bits of the list indexes in the current rule
+	// set that are disabled. It is read without a lock when matching.
+	disabledBits [maxLists / 64]atomic.Uint64
+)
+
+func init() {
+	expvar.Publish("lists", expvar.Func(func() interface{} {
+		return listStatus()
+	}))
+}
+
+// listName returns the name of the list file at path: its base name without
+// extension (and without .gz or .zst), or the preset's name for a preset, with a
+// number appended if it is one of taken.
+func listName(path string, taken []string) string {
+	base, ok := presetNames[path]
+	if !ok {
+		base = filepath.Base(listPath(path))
+		if ext := filepath.Ext(base); ext == ".gz" || ext == ".zst" {
+			base = strings.TrimSuffix(base, ext)
+		}
+		base = strings.TrimSuffix(base, filepath.Ext(base))
+	}
+	name := base
+	for n := 2; contains(taken, name); n++ {
+		name = base + "-" + strconv.Itoa(n)
+	}
+	return name
+}
+
+// contains reports whether names has name.
+func contains(names []string, name string) bool {
+	for _, n := range names {
+		if n == name {
+			return true
+		}
+	}
+	return false
+}
+
+// listDisabled reports whether the list with the given index is disabled.
+func listDisabled(index int) bool {
+	return disabledBits[index/64].Load()&(1<<(index%64)) != 0
+}
+
+// updateDisabled recomputes disabledBits for the current rule set.
+func updateDisabled() {
+	rs := currentRules()
+	disabledMu.Lock()
+	defer disabledMu.Unlock()
+	var bits [len(disabledBits)]uint64
+	for i, name := range rs.names {
+		if _, ok := disabled[name]; ok {
+			bits[i/64] |= 1 << (i % 64)
+		}
+	}
+	for i := range bits {
+		disabledBits[i].Store(bits[i])
+	}
+	resetDecisions(rs)
+}
+
+// setListEnabled enables or disables the list called name. A disabled list
+// is enabled again after d, unless d is 0.
+func setListEnabled(name string, enable bool, d time.Duration) {
+	disabledMu.Lock()
+	if enable {
+		delete(disabled, name)
+	} else {
+		var until time.Time
+		if d > 0 {
+			until = time.Now().Add(d)
+			time.AfterFunc(d, func() { expireDisabled(name, until) })
+		}
+		disabled[name] = until
+	}
+	disabledMu.Unlock()
+	updateDisabled()
+}
+
+// expireDisabled enables the list called name again if it is still
+// disabled until the given time.
+func expireDisabled(name string, until time.Time) {
+	disabledMu.Lock()
+	current, ok := disabled[name]
+	disabledMu.Unlock()
+	if ok && current.Equal(until) {
+		setListEnabled(name, true, 0)
+		log.Printf("Enabled list %s again\n", name)
+	}
+}
+
+// disabledLists returns a copy of the disabled lists.
+func disabledLists() map[string]time.Time {
+	disabledMu.Lock()
+	defer disabledMu.Unlock()
+	m := make(map[string]time.Time, len(disabled))
+	for name, until := range disabled {
+		m[name] = until
+	}
+	return m
+}
+
+// restoreDisabled disables the lists in m, as saved by disabledLists. Lists
+// whose time has passed stay enabled.
+func restoreDisabled(m map[string]time.Time) {
+	for name, until := range m {
+		if until.IsZero() {
+			setListEnabled(name, false, 0)
+		} else if d := time.Until(until); d > 0 {
+			setListEnabled(name, false, d)
+		}
+	}
+}
+
+// replaceDisabled makes the lists in m, as returned by disabledLists, the
+// disabled ones, and enables all others. Lists whose time has passed are
+// enabled too.
+func replaceDisabled(m map[string]time.Time) {
+	disabledMu.Lock()
+	disabled = make(map[string]time.Time, len(m))
+	for name, until := range m {
+		if until.IsZero() {
+			disabled[name] = until
+		} else if d := time.Until(until); d > 0 {
+			disabled[name] = until
+			name, until := name, until
+			time.AfterFunc(d, func() { expireDisabled(name, until) })
+		}
+	}
+	disabledMu.Unlock()
+	updateDisabled()
+}
+
+// listInfo describes a list in /api/lists.
+type listInfo struct {
+	Name          string     `json:"name"`
+	Rules         int        `json:"rules"`
+	Enabled       bool       `json:"enabled"`
+	DisabledUntil *time.Time `json:"disabledUntil,omitempty"`
+	Hits          int64      `json:"hits"`
+}
+
+// listStatus describes the lists of the current rule set.
+func listStatus() []listInfo {
+	rs := currentRules()
+	if rs == nil {
+		return nil
+	}
+	off := disabledLists()
+	infos := make([]listInfo, len(rs.names))
+	for i, name := range rs.names {
+		info := listInfo{Name: name, Rules: rs.rules[i], Enabled: true}
+		if until, ok := off[name]; ok {
+			info.Enabled = false
+			if !until.IsZero() {
+				info.DisabledUntil = &until
+			}
+		}
+		if v, ok := cntListHits.Get(name).(*expvar.Int); ok {
+			info.Hits = v.Value()
+		}
+		infos[i] = info
+	}
+	return infos
+}
+
+// handleAPILists serves GET /api/lists, the state of all lists, and
+// POST /api/lists/{name}/enable or /disable, which changes it. Disabling
+// takes an optional for=duration.
+func handleAPILists(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	reply := func(status int, msg string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+	}
+	if !authHTTP(req) {
+		reply(http.StatusForbidden, "bad key")
+		return
+	}
+	path := strings.Trim(strings.TrimPrefix(req.URL.Path, "/api/lists"), "/")
+	if path == "" {
+		json.NewEncoder(w).Encode(listStatus())
+		return
+	}
+
+	name, action, _ := strings.Cut(path, "/")
+	if action != "enable" && action != "disable" {
+		reply(http.StatusNotFound, "unknown action")
+		return
+	}
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		reply(http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+	if !contains(currentRules().names, name) {
+		reply(http.StatusNotFound, "unknown list")
+		return
+	}
+	var d time.Duration
+	if s := req.FormValue("for"); s != "" && action == "disable" {
+		var err error
+		if d, err = time.ParseDuration(s); err != nil || d <= 0 {
+			reply(http.StatusBadRequest, "bad duration")
+			return
+		}
+	}
+	setListEnabled(name, action == "enable", d)
+	log.Printf("HTTP: List %s: %s\n", name, action)
+	json.NewEncoder(w).Encode(listStatus())
+}
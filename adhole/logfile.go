@@ -0,0 +1,145 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"os"
+	"sync"
+)
+
+var cntLogDrops = expvar.NewInt("statsLogDropped")
+
+// logFile is an io.Writer for the log package that appends to a file from a
+// goroutine of its own, so that a stalled disk never blocks the servers.
+// Lines that don't fit in the buffer are dropped and counted. The file is
+// rotated when it grows over maxSize, keeping keep old files.
+type logFile struct {
+	path    string
+	maxSize int64
+	keep    int
+	lines   chan []byte
+	reopen  chan struct{}
+	quit    chan struct{}
+	done    sync.WaitGroup
+	file    *os.File
+	size    int64
+}
+
+// logger is the log file in use, nil if logging to stderr.
+var logger *logFile
+
+// openLogFile opens the log file at path and starts its writer.
+func openLogFile(path string, maxSize int64, keep int) (*logFile, error) {
+	l := &logFile{
+		path:    path,
+		maxSize: maxSize,
+		keep:    keep,
+		lines:   make(chan []byte, 1024),
+		reopen:  make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+	}
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	l.done.Add(1)
+	go l.run()
+	return l, nil
+}
+
+// open (re)opens the file for appending.
+func (l *logFile) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// Write queues a copy of p, or drops it if the writer is behind.
+func (l *logFile) Write(p []byte) (int, error) {
+	select {
+	case l.lines <- append([]byte(nil), p...):
+	default:
+		cntLogDrops.Add(1)
+	}
+	return len(p), nil
+}
+
+// Reopen makes the writer reopen the file, e.g. after logrotate moved it.
+func (l *logFile) Reopen() {
+	select {
+	case l.reopen <- struct{}{}:
+	default:
+	}
+}
+
+// Close writes out the queued lines and closes the file. Lines written
+// afterwards are dropped.
+func (l *logFile) Close() {
+	close(l.quit)
+	l.done.Wait()
+	l.file.Close()
+}
+
+// run writes the queued lines until the log file is closed.
+func (l *logFile) run() {
+	defer l.done.Done()
+	for {
+		select {
+		case line := <-l.lines:
+			l.write(line)
+		case <-l.quit:
+			for {
+				select {
+				case line := <-l.lines:
+					l.write(line)
+				default:
+					return
+				}
+			}
+		case <-l.reopen:
+			if err := l.open(); err != nil {
+				fmt.Fprintf(os.Stderr, "ERROR: Can't reopen log file: %s\n", err)
+			}
+		}
+	}
+}
+
+// write writes a line, rotating the file first if it would get too big.
+func (l *logFile) write(line []byte) {
+	if l.maxSize > 0 && l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		l.rotate()
+	}
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		cntLogDrops.Add(1)
+	}
+}
+
+// rotate renames path to path.1, path.1 to path.2 and so on, dropping the
+// oldest, and opens a fresh file.
+func (l *logFile) rotate() {
+	if l.keep > 0 {
+		for i := l.keep - 1; i > 0; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", l.path, i), fmt.Sprintf("%s.%d", l.path, i+1))
+		}
+		os.Rename(l.path, l.path+".1")
+	} else {
+		os.Remove(l.path)
+	}
+	if err := l.open(); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Can't rotate log file: %s\n", err)
+	}
+}
@@ -0,0 +1,83 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bufio"
+	"expvar"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync/atomic"
+)
+
+var cntIgnored = expvar.NewInt("statsLogIgnored")
+
+// logIgnore holds the names, with a trailing dot, whose queries are left out
+// of the query log and the stream, along with their subdomains.
+var logIgnore atomic.Pointer[map[string]bool]
+
+func init() {
+	expvar.Publish("logIgnore", expvar.Func(func() interface{} {
+		m := logIgnore.Load()
+		if m == nil {
+			return []string{}
+		}
+		names := make([]string, 0, len(*m))
+		for name := range *m {
+			names = append(names, strings.TrimSuffix(name, "."))
+		}
+		sort.Strings(names)
+		return names
+	}))
+}
+
+// loadLogIgnore sets the ignored names from -log-ignore and the file
+// -log-ignore-file, if given. The names in use stay if the file can't be
+// read.
+func loadLogIgnore() error {
+	m := make(map[string]bool)
+	for _, name := range strings.Split(*flagLogIgn, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			m[strings.ToLower(strings.TrimSuffix(name, "."))+"."] = true
+		}
+	}
+	if *flagLogIgnF != "" {
+		file, err := os.Open(*flagLogIgnF)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		scn := bufio.NewScanner(file)
+		for line := 1; scn.Scan(); line++ {
+			name := strings.TrimSpace(scn.Text())
+			if name == "" || strings.HasPrefix(name, "#") {
+				continue
+			}
+			if !validName(name) {
+				return fmt.Errorf("%s line %d: bad name %q", *flagLogIgnF, line, name)
+			}
+			m[strings.ToLower(strings.TrimSuffix(name, "."))+"."] = true
+		}
+		if err := scn.Err(); err != nil {
+			return err
+		}
+	}
+	logIgnore.Store(&m)
+	return nil
+}
+
+// ignoredName reports whether queries for host are left out of the query
+// log and the stream. The -self-name never is.
+func ignoredName(host string) bool {
+	m := logIgnore.Load()
+	if m == nil || len(*m) == 0 {
+		return false
+	}
+	host = lowerName(host)
+	if host == selfName {
+		return false
+	}
+	return findZone(host, func(name string) bool { return (*m)[name] }) != ""
+}
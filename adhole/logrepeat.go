@@ -0,0 +1,104 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logRepeatKeys bounds the messages repeats are counted for. Beyond it,
+// messages are only told apart by their format strings, of which there are
+// only as many as call sites.
+const logRepeatKeys = 256
+
+var cntLogSupp = expvar.NewInt("statsLogSuppressed")
+
+// logRepeat is a message logged in the current window, and the repeats of
+// it held back since.
+type logRepeat struct {
+	start time.Time
+	n     int    // repeats held back
+	last  string // the last of them
+}
+
+var logRepeats = struct {
+	sync.Mutex
+	m map[string]*logRepeat
+}{m: make(map[string]*logRepeat)}
+
+// logKey returns what tells a message apart from others for logLimited: its
+// format and the errors in args. Other args, such as query IDs, names and
+// clients, don't, so that e.g. all timeouts are one message.
+func logKey(format string, args []interface{}) string {
+	key := format
+	for _, arg := range args {
+		if err, ok := arg.(error); ok {
+			key += "\x00" + err.Error()
+		}
+	}
+	return key
+}
+
+// logLimited logs a warning or error like log.Printf, unless the same
+// message, see logKey, was logged within -log-repeats. Those are counted
+// instead, and once the window is over the last of them is logged with the
+// count, so a dead upstream logs a line or two a window rather than one per
+// query.
+func logLimited(format string, args ...interface{}) {
+	window := *flagLogRep
+	if window <= 0 {
+		log.Printf(format, args...)
+		return
+	}
+	now := time.Now()
+	key := logKey(format, args)
+	logRepeats.Lock()
+	r, ok := logRepeats.m[key]
+	if !ok && len(logRepeats.m) >= logRepeatKeys {
+		// Messages with repeats held back are forgotten once those are
+		// logged, the others only here.
+		for k, r := range logRepeats.m {
+			if r.n == 0 && now.Sub(r.start) >= window {
+				delete(logRepeats.m, k)
+			}
+		}
+		if len(logRepeats.m) >= logRepeatKeys {
+			key = format
+			r, ok = logRepeats.m[key]
+		}
+	}
+	if !ok || now.Sub(r.start) >= window {
+		logRepeats.m[key] = &logRepeat{start: now}
+		logRepeats.Unlock()
+		log.Printf(format, args...)
+		return
+	}
+	r.n++
+	r.last = fmt.Sprintf(format, args...)
+	if r.n == 1 {
+		time.AfterFunc(r.start.Add(window).Sub(now), func() { flushRepeats(key, r) })
+	}
+	logRepeats.Unlock()
+	cntLogSupp.Add(1)
+}
+
+// flushRepeats logs the last repeat held back in r, with the count, and
+// forgets r unless a new window has started.
+func flushRepeats(key string, r *logRepeat) {
+	logRepeats.Lock()
+	if logRepeats.m[key] == r {
+		delete(logRepeats.m, key)
+	}
+	n, last := r.n, strings.TrimSuffix(r.last, "\n")
+	logRepeats.Unlock()
+	if n == 1 {
+		log.Println(last)
+		return
+	}
+	log.Printf("%s (previous message repeated %d times in %s)\n", last, n, *flagLogRep)
+}
@@ -0,0 +1,152 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// logBuffer collects log lines, written from any goroutine.
+type logBuffer struct {
+	mu sync.Mutex
+	b  strings.Builder
+}
+
+func (lb *logBuffer) Write(p []byte) (int, error) {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return lb.b.Write(p)
+}
+
+// lines returns the lines logged so far.
+func (lb *logBuffer) lines() []string {
+	lb.mu.Lock()
+	defer lb.mu.Unlock()
+	return strings.Split(strings.TrimSuffix(lb.b.String(), "\n"), "\n")
+}
+
+// withLogBuffer has the log written, without timestamps, to a buffer for
+// the rest of the test, with repeats limited in window and none pending.
+func withLogBuffer(tb testing.TB, window time.Duration) *logBuffer {
+	lb := &logBuffer{}
+	out, flags := log.Writer(), log.Flags()
+	log.SetOutput(lb)
+	log.SetFlags(0)
+	withFlag(tb, flagLogRep, window)
+	resetRepeats := func() {
+		logRepeats.Lock()
+		logRepeats.m = make(map[string]*logRepeat)
+		logRepeats.Unlock()
+	}
+	resetRepeats()
+	tb.Cleanup(func() {
+		resetRepeats()
+		log.SetOutput(out)
+		log.SetFlags(flags)
+	})
+	return lb
+}
+
+func TestLogLimited(t *testing.T) {
+	const window = 100 * time.Millisecond
+	refused := errors.New("connection refused")
+	unreachable := errors.New("network unreachable")
+	tests := []struct {
+		name  string
+		log   func()
+		now   []string // logged right away
+		later []string // logged once the window is over
+		held  int      // counted in statsLogSuppressed
+	}{
+		{"collapsed", func() {
+			for i := 0; i < 5; i++ {
+				logLimited("DNS ERROR (4): %s\n", refused)
+			}
+		}, []string{"DNS ERROR (4): connection refused"},
+			[]string{"DNS ERROR (4): connection refused (previous message repeated 4 times in 100ms)"}, 4},
+		{"one repeat", func() {
+			logLimited("DNS ERROR (4): %s\n", refused)
+			logLimited("DNS ERROR (4): %s\n", refused)
+		}, []string{"DNS ERROR (4): connection refused"},
+			[]string{"DNS ERROR (4): connection refused"}, 1},
+		{"different errors", func() {
+			logLimited("DNS ERROR (4): %s\n", refused)
+			logLimited("DNS ERROR (4): %s\n", unreachable)
+			logLimited("DNS ERROR (4): %s\n", refused)
+		}, []string{"DNS ERROR (4): connection refused", "DNS ERROR (4): network unreachable"},
+			[]string{"DNS ERROR (4): connection refused"}, 1},
+		{"different queries", func() {
+			for id := 1; id <= 3; id++ {
+				logLimited("DNS WARN: Query id %d %s timed out\n", id, fmt.Sprintf("q%d.example.com.", id))
+			}
+		}, []string{"DNS WARN: Query id 1 q1.example.com. timed out"},
+			[]string{"DNS WARN: Query id 3 q3.example.com. timed out (previous message repeated 2 times in 100ms)"}, 2},
+		{"different formats", func() {
+			logLimited("DNS ERROR (3): %s\n", refused)
+			logLimited("DNS ERROR (4): %s\n", refused)
+		}, []string{"DNS ERROR (3): connection refused", "DNS ERROR (4): connection refused"}, nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			lb := withLogBuffer(t, window)
+			held := cntLogSupp.Value()
+			tt.log()
+			if got := lb.lines(); strings.Join(got, "\n") != strings.Join(tt.now, "\n") {
+				t.Errorf("logged %q, want %q", got, tt.now)
+			}
+			time.Sleep(window + 50*time.Millisecond)
+			want := append(tt.now, tt.later...)
+			if got := lb.lines(); strings.Join(got, "\n") != strings.Join(want, "\n") {
+				t.Errorf("after the window logged %q, want %q", got, want)
+			}
+			if n := cntLogSupp.Value() - held; n != int64(tt.held) {
+				t.Errorf("%d held back, want %d", n, tt.held)
+			}
+
+			// A new window starts afresh.
+			lb.mu.Lock()
+			lb.b.Reset()
+			lb.mu.Unlock()
+			tt.log()
+			if got := lb.lines(); strings.Join(got, "\n") != strings.Join(tt.now, "\n") {
+				t.Errorf("in the next window logged %q, want %q", got, tt.now)
+			}
+			time.Sleep(window + 50*time.Millisecond)
+		})
+	}
+}
+
+// With -log-repeats 0 every message is logged.
+func TestLogLimitedOff(t *testing.T) {
+	lb := withLogBuffer(t, 0)
+	for i := 0; i < 3; i++ {
+		logLimited("DNS ERROR (4): %s\n", errors.New("connection refused"))
+	}
+	if got := lb.lines(); len(got) != 3 {
+		t.Errorf("logged %q, want 3 lines", got)
+	}
+}
+
+// Past logRepeatKeys messages, those with the same format are one message,
+// so memory stays bounded however many different errors there are.
+func TestLogLimitedBounded(t *testing.T) {
+	lb := withLogBuffer(t, time.Minute)
+	for i := 0; i < logRepeatKeys+100; i++ {
+		logLimited("DNS ERROR (4): %s\n", fmt.Errorf("error %d", i))
+	}
+	logRepeats.Lock()
+	n := len(logRepeats.m)
+	logRepeats.Unlock()
+	if n != logRepeatKeys+1 {
+		t.Errorf("%d messages tracked, want %d", n, logRepeatKeys+1)
+	}
+	if got := lb.lines(); len(got) != logRepeatKeys+1 {
+		t.Errorf("logged %d lines, want %d", len(got), logRepeatKeys+1)
+	}
+}
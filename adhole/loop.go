@@ -0,0 +1,58 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+)
+
+var cntLoop = expvar.NewInt("statsLoopDetected")
+
+// checkUpstreamLoop returns an error if the upstream server is one of our
+// own listeners, which would make every forwarded query come back to us.
+func checkUpstreamLoop(up *net.UDPAddr, ls []*listener) error {
+	for _, l := range ls {
+		addr, ok := l.conn.LocalAddr().(*net.UDPAddr)
+		if !ok || addr.Port != up.Port {
+			continue
+		}
+		if addr.IP.Equal(up.IP) || addr.IP.IsUnspecified() && isLocalIP(up.IP) {
+			return fmt.Errorf("upstream %s is our own listener %s", up, l)
+		}
+	}
+	return nil
+}
+
+// isLocalIP reports whether ip is an address of this host.
+func isLocalIP(ip net.IP) bool {
+	if ip.IsLoopback() {
+		return true
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// looped reports whether q, which came with id, is most likely one of our
+// own forwarded queries coming back through the upstream: an outstanding
+// query sent with that id, for the same name, from a different client. Client retransmissions come from the
+// same address and port, and a client that happens to pick the id of one
+// of our prefetches is no loop either.
+func (t *queryTable) looped(id int, q *query) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	old, ok := t.m[id]
+	if !ok || old.Host != q.Host || old.From == nil {
+		return false
+	}
+	return !old.From.IP.Equal(q.From.IP) || old.From.Port != q.From.Port
+}
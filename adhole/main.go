@@ -3,8 +3,9 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"expvar"
 	"flag"
 	"fmt"
@@ -13,20 +14,42 @@ import (
 	"net"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-// query wraps Host name and clients UDPAddr.
+// query wraps Host name, clients UDPAddr, the address it was sent to (if
+// known), the listener it came through, the time it was received at and its
+// context, which ends at its deadline.
+// Msg is the query as the client sent it. Key is set if the answer is to be
+// cached, Record if the exchange is to be recorded. Prefetch queries have no
+// client and no Msg.
 type query struct {
-	Host string
-	From *net.UDPAddr
+	ID       int // the client sent the query with, not the one sent upstream
+	Host     string
+	Type     uint16
+	Upstream *serverStats
+	From     *net.UDPAddr
+	Dst      net.IP
+	Via      *listener
+	Start    time.Time
+	Ctx      context.Context // ends at the deadline, or once answered
+	Cancel   context.CancelFunc
+	Key      string
+	Msg      []byte
+	Record   bool
+	Trace    *tracer // nil unless the query is traced
 }
 
 // String prints human-readable representation of a query.
 func (q *query) String() string {
-	return fmt.Sprintf("from %s about %s", q.From, q.Host)
+	if q.From == nil {
+		return fmt.Sprintf("prefetch about %s", logHost(q.Host, false))
+	}
+	return fmt.Sprintf("from %s about %s", clientAddr(q.From), logHost(q.Host, false))
 }
 
 // toggle is a synced bool wrapper for expvar.
@@ -52,6 +75,13 @@ func (t *toggle) Value() bool {
 	return t.b
 }
 
+// Set sets a toggle value.
+func (t *toggle) Set(b bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.b = b
+}
+
 // Toggle toggles a toggle.
 func (t *toggle) Toggle() bool {
 	t.mu.Lock()
@@ -63,9 +93,110 @@ func (t *toggle) Toggle() bool {
 // Flags.
 var (
 	flagVerbose  = flag.Bool("v", false, "be verbose")
+	flagLogRep   = flag.Duration("log-repeats", time.Minute, "log repeated warnings and errors once in this, with a count (0 - log all)")
 	flagHTTPPort = flag.Int("hport", 80, "HTTP server port")
 	flagDNSPort  = flag.Int("dport", 53, "DNS server port")
 	flagTimeout  = flag.Duration("t", 5*time.Second, "upstream query timeout")
+	flagListen   = flag.String("listen", "", "comma separated DNS listen addresses (default: proxy)")
+	flagHTTPLsn  = flag.String("http-listen", "", "comma separated HTTP listen addresses, IPv6 ones in brackets with a port (default: the sinkhole addresses)")
+	flagUnix     = flag.String("listen-unix", "", "also answer DNS on this datagram Unix domain socket (not on Windows)")
+	flagUnixMode = flag.String("listen-unix-mode", "0660", "file mode of the -listen-unix socket")
+	flagSockets  = flag.Int("sockets", 1, "number of SO_REUSEPORT sockets per listen address")
+	flagBatch    = flag.Int("batch", 32, "max packets per read or write syscall (Linux only)")
+	flagRcvBuf   = flag.Int("rcvbuf", 0, "UDP socket receive buffer size (default: OS default)")
+	flagSndBuf   = flag.Int("sndbuf", 0, "UDP socket send buffer size (default: OS default)")
+	flagMinTTL   = flag.Duration("min-ttl", 0, "raise TTLs of relayed records to at least this")
+	flagMaxTTL   = flag.Duration("max-ttl", 0, "lower TTLs of relayed records to at most this (0 - no limit)")
+	flagBlockQT  = flag.String("block-qtypes", "", "comma separated query types to refuse with NOTIMP, e.g. ANY,TXT")
+	flagBlockTLD = flag.String("block-tlds", "", "comma separated top level domains to block as a whole, e.g. zip,mov")
+	flagTunnel   = flag.Bool("tunnel", false, "detect DNS tunneling attempts")
+	flagTunLen   = flag.Int("tunnel-len", 120, "suspicious query name length")
+	flagTunEnt   = flag.Float64("tunnel-entropy", 4.0, "suspicious label entropy in bits per character")
+	flagTunUniq  = flag.Int("tunnel-unique", 200, "suspicious number of distinct subdomains per client and domain")
+	flagTunWin   = flag.Duration("tunnel-window", time.Minute, "window for counting distinct subdomains")
+	flagTunRef   = flag.Duration("tunnel-refuse", 0, "refuse suspicious domains for the client for this long (0 - only log)")
+	flagState    = flag.String("statefile", "", "file to keep counters in across restarts")
+	flagStateInt = flag.Duration("state-every", 5*time.Minute, "how often to save the state file")
+	flagHistory  = flag.Bool("state-history", true, "keep the hourly and daily history in the state file")
+	flagStatsd   = flag.String("statsd", "", "send metrics to statsd, e.g. udp://192.168.1.10:8125")
+	flagSDPrefix = flag.String("statsd-prefix", "adhole.", "prefix for statsd metric names")
+	flagSDEvery  = flag.Duration("statsd-every", 10*time.Second, "how often to send metrics to statsd")
+	flagClients  = flag.String("clients", "", "file naming clients, one 'ip-or-mac name' per line")
+	flagLeases   = flag.String("dhcp-leases", "", "dnsmasq leases file to name clients by their host names")
+	flagClientEv = flag.Duration("clients-every", 30*time.Second, "how often to check -clients and -dhcp-leases for changes")
+	flagPrivacy  = flag.String("privacy", "", "hide clients in logs: hmac or truncate (also hides allowed names)")
+	flagCacheSz  = flag.Int("cache-size", 0, "number of upstream answers to cache (0 - no caching)")
+	flagCacheMin = flag.Duration("cache-min-ttl", 0, "keep cached answers for at least this")
+	flagCacheSF  = flag.Duration("cache-servfail", 5*time.Second, "keep SERVFAIL answers cached for this (0 - don't)")
+	flagCachePer = flag.String("cache-persist", "", "file to keep the answer cache in across restarts")
+	flagWarmup   = flag.String("warmup", "", "file of names to ask the upstream about at startup to warm up the cache, one per line")
+	flagWarmRate = flag.Int("warmup-rate", 20, "max -warmup queries per second")
+	flagWarmRdy  = flag.Bool("warmup-ready", false, "report not ready on /readyz until the -warmup queries are answered")
+	flagPrefetch = flag.Int("prefetch", 50, "refresh up to this many popular cache entries before they expire")
+	flagPFHits   = flag.Int64("prefetch-hits", 10, "hits needed for an entry to be prefetched")
+	flagPFMargin = flag.Duration("prefetch-margin", 10*time.Second, "prefetch entries expiring within this")
+	flagPFRate   = flag.Int("prefetch-rate", 10, "max prefetch queries per second")
+	flagCache    = flag.Bool("cache", false, "use a compiled list cache next to list.txt")
+	flagCacheGz  = flag.Bool("cache-gzip", false, "gzip the compiled list cache")
+	flagDiffN    = flag.Int("diff-samples", 5, "number of added and removed rules to show after a reload")
+	flagReqSums  = flag.Bool("require-checksums", false, "refuse remote lists without a sha256 digest to check")
+	flagPreset   = flag.String("preset", "", "comma separated names of well-known lists to block too, see 'adhole presets'")
+	flagPresetsF = flag.String("presets-file", "", "file with more presets, one 'name url [format] [description]' per line")
+	flagBloom    = flag.Bool("bloom", false, "check a Bloom filter before the list, for very large lists")
+	flagBloomFP  = flag.Float64("bloom-fp", 0.001, "false positive rate of the Bloom filter")
+	flagPidFile  = flag.String("pidfile", "", "write the PID to this file")
+	flagDaemon   = flag.Bool("daemon", false, "run in the background (not on Windows)")
+	flagLogFile  = flag.String("logfile", "", "append the log to this file instead of stderr")
+	flagLogSize  = flag.Int64("log-size", 0, "rotate the log file at this many bytes (0 - never)")
+	flagLogKeep  = flag.Int("log-keep", 5, "number of rotated log files to keep")
+	flagQueryLog = flag.String("querylog", "", "log every query as a line of JSON to this file")
+	flagLogIgn   = flag.String("log-ignore", "", "comma separated names to leave out of the query log and stream, e.g. ntp.org")
+	flagLogIgnF  = flag.String("log-ignore-file", "", "file with more names for -log-ignore, read again on reload")
+	flagQLSample = flag.Float64("querylog-sample", 1, "log only this fraction of relayed, cached and local queries")
+	flagNoDNS    = flag.Bool("no-dns", false, "don't serve DNS, only HTTP")
+	flagNoHTTP   = flag.Bool("no-http", false, "don't serve HTTP, only DNS")
+	flagOnFail   = flag.String("on-failure", "exit", "when a server fails: exit, or restart it with a backoff")
+	flagWatchdog = flag.Duration("watchdog", 0, "check that queries are answered this often (0 - only under systemd's watchdog)")
+	flagWDFails  = flag.Int("watchdog-fails", 3, "failed watchdog checks in a row before acting")
+	flagWDExit   = flag.Bool("watchdog-exit", false, "exit with status 3 instead of reopening the upstream socket")
+	flagDNSSECNX = flag.Bool("dnssec-nxdomain", false, "answer blocked queries with the DO bit with NXDOMAIN (fails validation)")
+	flagSink6    = flag.String("sinkhole6", "", "answer blocked AAAA queries with this address (default: no records)")
+	flagSelfName = flag.String("self-name", "", "answer this name with AdHole's own addresses, e.g. adhole.home")
+	flagStatsNm  = flag.String("stats-name", "stats.adhole", "answer TXT queries for this name with statistics (empty - don't)")
+	flagStatsNet = flag.String("stats-clients", "127.0.0.0/8,::1/128", "comma separated networks allowed to query -stats-name")
+	flagNoIdent  = flag.Bool("no-ident", false, "refuse CHAOS version.bind and hostname.bind queries instead of answering them")
+	flagSinkAA   = flag.Bool("sinkhole-aa", false, "mark sinkhole answers as authoritative")
+	flagPadResp  = flag.Bool("pad-responses", false, "pad local answers to queries with EDNS padding to 468 byte blocks")
+	flagTarpit   = flag.Duration("tarpit", 0, "delay answers for blocked names and pixel requests by this")
+	flagTarpitMx = flag.Int("tarpit-max", 10000, "max number of answers delayed at once")
+	flagHTTPBody = flag.Int64("http-max-body", 1024, "max bytes of request bodies the pixel server reads")
+	flagHTTPConn = flag.Int("http-max-conns", 32, "max open HTTP connections per client IP (0 - no limit)")
+	flagPAC      = flag.Bool("pac", false, "serve /proxy.pac and /wpad.dat, and answer wpad names with the proxy address")
+	flagPACSize  = flag.Int("pac-max-size", 1<<20, "max bytes of blocked names in the proxy.pac")
+	flagIPHosts  = flag.String("ip-hosts", "pixel", "requests for IP addresses instead of names: pixel, log, or refuse with 403")
+	flagHTTPPrx  = flag.String("http-proxy", "", "comma separated host=url pairs to reverse proxy instead of serving the pixel")
+	flagWebhook  = flag.String("webhook", "", "POST an alert as JSON to this URL when a rule of -alert-lists or -alert-rules blocks")
+	flagAlertLst = flag.String("alert-lists", "", "comma separated names of lists whose blocks alert, e.g. malware")
+	flagAlertRul = flag.String("alert-rules", "", "comma separated blocked names whose blocks alert")
+	flagHookRate = flag.Int("webhook-rate", 10, "max alerts posted per minute")
+	flagRecord   = flag.String("record", "", "record the raw upstream queries and answers to this file, for 'adhole replay'")
+	flagRecSize  = flag.Int64("record-size", 100<<20, "stop recording once the -record file holds this many bytes")
+	flagRecSampl = flag.Float64("record-sample", 1, "record only this fraction of the upstream exchanges")
+	flagOverride = flag.String("overrides", "", "file to keep permanently whitelisted names in")
+	flagPiholeDB = flag.String("pihole-db", "", "Pi-hole gravity.db to block its adlists and blacklist and allow its whitelist from")
+	flagSelfServ = flag.Bool("allow-self-service", false, "let anyone whitelist names for an hour from the block page")
+	flagMaxOut   = flag.Int("max-outstanding", 0, "answer SERVFAIL instead of relaying with this many queries waiting upstream (0 - no limit)")
+	flagUpTCP    = flag.Bool("upstream-tcp", false, "send queries to the upstream over a pool of persistent TCP connections")
+	flagTCPConns = flag.Int("tcp-conns", 2, "max TCP connections to the upstream with -upstream-tcp")
+	flagTCPIdle  = flag.Duration("tcp-idle", 30*time.Second, "close upstream TCP connections idle for this long, or sooner if the upstream asks")
+	flagTCPInfl  = flag.Int("tcp-inflight", 64, "max queries waiting for answers on one upstream TCP connection")
+	flagMaxOutCl = flag.Int("max-outstanding-client", 100, "answer SERVFAIL instead of relaying with this many queries from one client waiting upstream (0 - no limit)")
+	flagBindWait = flag.Duration("bind-retry", 0, "keep trying to bind addresses in use for this long")
+	flagUser     = flag.String("user", "", "drop privileges to this user after binding")
+	flagGroup    = flag.String("group", "", "drop privileges to this group (default: user's group)")
+	flagVersion  = flag.Bool("version", false, "print version information and exit")
+	flagServer   = flag.Bool("server-header", false, "send a Server header with the version")
+	flagCORS     = flag.String("cors-origin", "*", "comma separated origins allowed to read sinkhole responses, * for any (empty - no CORS headers)")
 )
 
 // Expvar exported statistics counters.
@@ -75,27 +206,31 @@ var (
 	cntBlocked  = expvar.NewInt("statsBlocked")
 	cntTimedout = expvar.NewInt("statsTimedout")
 	cntServed   = expvar.NewInt("statsServed")
+	cntMethods  = expvar.NewMap("statsHTTPMethods")
 	cntErrors   = expvar.NewInt("statsErrors")
 	cntRules    = expvar.NewInt("statsRules")
+	cntRetrans  = expvar.NewInt("statsRetransmits")
+	cntNodata   = expvar.NewInt("statsNodata")
+	cntRcodes   = expvar.NewMap("statsRcodes")
+	cntQtypes   = expvar.NewMap("statsQtypes")
+	cntQTBlock  = expvar.NewInt("statsQtypeBlocked")
+	cntTunnel   = expvar.NewInt("statsTunnelSuspect")
+	cntFormErr  = expvar.NewInt("statsFormErr")
+	cntFull     = expvar.NewInt("statsQueriesFull")
+	cntClFull   = newExpiringCounters("statsClientQueriesFull", 1024, 24*time.Hour)
+	cntLocal    = expvar.NewInt("statsLocal")
+	cntTLDBlock = expvar.NewInt("statsTLDBlocked")
+	cntCaseFix  = expvar.NewInt("statsCaseRestored")
+	cntDropped  = expvar.NewMap("statsDropped")
+	cntCutOff   = expvar.NewInt("statsAnswersCutOff")
 )
 
+// answerBufSize is the size of the buffers upstream answers are read into,
+// enough for the largest UDP datagram.
+const answerBufSize = 64 << 10
+
 // 'Static' variables.
-// answer will become static once the proxy address bytes have been added.
 var (
-	// answer is the header of a DNS query response without the domain name and
-	// the resource data.
-	//
-	// Good sources of information on the DNS protocol can be found at:
-	// http://www.firewall.cx/networking-topics/protocols/domain-name-system-dns
-	// http://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml
-	//
-	// Bytes described:
-	// 2 - Type        = 0x0001     - A
-	// 2 - Class       = 0x0001     - IN
-	// 4 - TTL         = 0xffffffff - if anyone respects it, this should reduce hits
-	// 2 - Data Length = 0x0004     - number of resource bytes, which for IN A IPv4 address is exactly 4
-	answer = []byte("\x00\x01\x00\x01\xff\xff\xff\xff\x00\x04")
-
 	// pixel is a hex representation of an 'empty' 1x1 GIF image.
 	pixel = "\x47\x49\x46\x38\x39\x61\x01\x00\x01\x00\x80\x00\x00\xff\xff" +
 		"\xff\x00\x00\x00\x21\xf9\x04\x01\x00\x00\x00\x00\x2c\x00\x00" +
@@ -103,279 +238,1321 @@ var (
 )
 
 var (
-	proxy    *net.UDPConn
-	upstream *net.UDPConn
-	queries  map[int]*query
-	blocked  map[string]bool
-	blocking = &toggle{b: true}
-	key      string
-	list     string
+	listeners []*listener
+	upstream  atomic.Pointer[net.UDPConn]
+	queries   = newQueryTable()
+	blockedQT map[uint16]bool
+	blockTLDs []string
+	sinkhole6 net.IP
+	selfName  string
+	blocking  = &toggle{b: true}
+	failed    = make(chan error, 1)
+	key       string
+	lists     []string
 )
 
+// subcommands are run instead of the server with e.g. "adhole prune".
+var subcommands = map[string]func(args []string) int{
+	"dhcp-config":   runDHCPConfig,
+	"import-pihole": runImportPihole,
+	"prune":         runPrune,
+	"presets":       runPresets,
+	"replay":        runReplay,
+}
+
 func init() {
 	expvar.Publish("stateIsRunning", blocking)
 }
 
 func main() {
 	flag.Usage = func() {
-		fmt.Fprintf(os.Stderr, "Usage: %s [options] key upstream proxy list.txt\n\n"+
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] key upstream proxy [list.txt...]\n\n"+
 			"key      - password used for /debug actions protection\n"+
 			"upstream - real upstream DNS address, e.g. 8.8.8.8\n"+
 			"proxy    - servers' bind address, e.g. 127.0.0.1\n"+
-			"list.txt - text file with domains to block\n\n",
+			"list.txt - text files or URLs with domains to block, optional with -preset\n\n",
 			os.Args[0],
 		)
 		flag.PrintDefaults()
+		envUsage()
 		return
 	}
-	flag.Parse()
+	if len(os.Args) > 1 {
+		if run, ok := subcommands[os.Args[1]]; ok {
+			os.Exit(run(os.Args[2:]))
+		}
+	}
+	code := 0
+	if err := run(os.Args[1:]); err != nil {
+		code = reportError(err)
+	}
+	exitService(code)
+	os.Exit(code)
+}
+
+// run starts AdHole with the command line args and serves until it is
+// stopped. The flags and arguments are all checked before anything is
+// started, and all their problems are returned together, as an *exitError
+// like any startup error.
+func run(args []string) error {
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	if err := flag.CommandLine.Parse(args); err == flag.ErrHelp {
+		return nil
+	} else if err != nil {
+		return configError(nil)
+	}
+	if err := applyEnv(flag.CommandLine, os.Getenv); err != nil {
+		return configError(err)
+	}
+	if *flagVersion {
+		fmt.Println(versionString())
+		return nil
+	}
 
-	if len(flag.Args()) < 4 {
+	args = envPositional(flag.Args(), os.Getenv)
+	if len(args) < 3 || len(args) == 3 && *flagPreset == "" {
 		flag.Usage()
-		os.Exit(1)
+		return configError(nil)
+	}
+
+	var problems []error
+	check := func(err error) {
+		if err != nil {
+			problems = append(problems, err)
+		}
+	}
+	key = args[0]
+	upIP, err := parseIPv4(args[1], "upstream")
+	check(err)
+	proxyIP, err := parseIPv4(args[2], "proxy")
+	check(err)
+	lists = args[3:]
+	if *flagPresetsF != "" {
+		check(loadPresets(*flagPresetsF))
+	}
+	if *flagPreset != "" {
+		urls, err := resolvePresets(*flagPreset)
+		check(err)
+		lists = append(lists, urls...)
+	}
+	var pihole *piholeImport
+	if *flagPiholeDB != "" {
+		pihole, err = loadPihole(*flagPiholeDB)
+		check(err)
+	}
+	queries.max = *flagMaxOut
+	queries.maxClient = *flagMaxOutCl
+	if *flagBloomFP <= 0 || *flagBloomFP >= 1 {
+		check(errors.New("-bloom-fp must be between 0 and 1"))
+	}
+	blockedQT, err = parseTypes(*flagBlockQT)
+	check(err)
+	blockTLDs, err = parseTLDs(*flagBlockTLD)
+	check(err)
+	httpProxies, err = parseHTTPProxies(*flagHTTPPrx)
+	check(err)
+	if *flagWebhook != "" {
+		check(setupAlerts(*flagWebhook, *flagAlertLst, *flagAlertRul))
+		if *flagHookRate < 1 {
+			check(errors.New("-webhook-rate must be at least 1"))
+		}
+	}
+	if *flagNoDNS && *flagNoHTTP {
+		check(errors.New("-no-dns and -no-http leave nothing to serve"))
+	}
+	check(parseOnFailure(*flagOnFail))
+	check(parseIPHosts(*flagIPHosts))
+	if *flagSink6 != "" {
+		if sinkhole6 = net.ParseIP(*flagSink6); sinkhole6 == nil || sinkhole6.To4() != nil {
+			check(fmt.Errorf("Can't parse sinkhole6 IPv6 '%s'", *flagSink6))
+		}
+	}
+	selfName, err = parseSelfName(*flagSelfName)
+	check(err)
+	check(setupStatsName(*flagStatsNm, *flagStatsNet))
+	check(setupPrivacy(*flagPrivacy))
+	var statsd string
+	if *flagStatsd != "" {
+		statsd, err = statsdAddr(*flagStatsd)
+		check(err)
+	}
+	if *flagQueryLog != "" && (*flagQLSample <= 0 || *flagQLSample > 1) {
+		check(errors.New("-querylog-sample must be over 0 and at most 1"))
+	}
+	if *flagRecord != "" && (*flagRecSampl <= 0 || *flagRecSampl > 1) {
+		check(errors.New("-record-sample must be over 0 and at most 1"))
+	}
+	dnsAddrs, err := dnsListenAddrs(proxyIP)
+	check(err)
+	var unixMode os.FileMode
+	if *flagUnix != "" {
+		unixMode, err = parseMode(*flagUnixMode)
+		check(err)
+	}
+	var httpAddrs []*net.TCPAddr
+	if *flagHTTPLsn != "" {
+		httpAddrs, err = parseHTTPListen(*flagHTTPLsn, *flagHTTPPort)
+		check(err)
+	}
+	if *flagGroup != "" && *flagUser == "" {
+		check(errors.New("-group requires -user"))
+	}
+	if *flagUpTCP && (*flagTCPConns < 1 || *flagTCPInfl < 1) {
+		check(errors.New("-tcp-conns and -tcp-inflight must be at least 1"))
+	}
+	if *flagWarmup != "" && (*flagCacheSz <= 0 || *flagWarmRate < 1) {
+		check(errors.New("-warmup requires -cache-size, and -warmup-rate must be at least 1"))
+	}
+	if len(problems) > 0 {
+		return configError(errors.Join(problems...))
+	}
+
+	if *flagPidFile != "" {
+		if err = checkPidFile(*flagPidFile); err != nil {
+			return configError(err)
+		}
+	}
+	if *flagDaemon {
+		if err = daemonize(*flagLogFile); err != nil {
+			return configError(fmt.Errorf("Can't daemonize: %w", err))
+		}
+	}
+	if *flagLogFile != "" {
+		if logger, err = openLogFile(*flagLogFile, *flagLogSize, *flagLogKeep); err != nil {
+			return configError(fmt.Errorf("Can't open log file: %w", err))
+		}
+		log.SetOutput(logger)
+		defer logger.Close()
+	}
+	if *flagQueryLog != "" {
+		if queryLog, err = openLogFile(*flagQueryLog, *flagLogSize, *flagLogKeep); err != nil {
+			return configError(fmt.Errorf("Can't open query log: %w", err))
+		}
+		defer queryLog.Close()
+	}
+	if *flagRecord != "" {
+		if err = openRecording(*flagRecord, *flagRecSize); err != nil {
+			return configError(fmt.Errorf("Can't open recording: %w", err))
+		}
 	}
 
-	key = flag.Arg(0)
-	upIP := parseIPv4(flag.Arg(1), "upstream")
-	proxyIP := parseIPv4(flag.Arg(2), "proxy")
-	answer = append(answer, proxyIP...)
-	list = flag.Arg(3)
-	parseList(list)
+	rs, files, err := loadLists(lists)
+	check(err)
+	check(loadLogIgnore())
+	if *flagClients != "" || *flagLeases != "" {
+		check(loadClientNames())
+	}
+	if *flagOverride != "" {
+		check(allowed.load(*flagOverride))
+	}
+	if pihole != nil {
+		for _, s := range pihole.skipped {
+			log.Printf("DNS WARN: Pi-hole %s\n", s)
+		}
+		allowed.allowFixed(pihole.allow)
+	}
+	var warmNames []string
+	if *flagWarmup != "" {
+		warmNames, err = loadWarmup(*flagWarmup)
+		check(err)
+	}
+	if len(problems) > 0 {
+		return listError(errors.Join(problems...))
+	}
+	swapList(rs, files)
+	if *flagClients != "" || *flagLeases != "" {
+		go runClientNames(*flagClientEv)
+	}
 
-	var err error
 	upAddr := &net.UDPAddr{IP: upIP, Port: 53}
-	upstream, err = net.DialUDP("udp4", nil, upAddr)
+	upConn, err := net.DialUDP("udp4", nil, upAddr)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
-		os.Exit(2)
+		return bindError(err)
+	}
+	upstream.Store(upConn)
+	defer func() { upstream.Load().Close() }()
+	infoUp.Set(upAddr.String())
+	upStats = serverStatsFor(upAddr.String())
+	if *flagUpTCP {
+		upPool = newTCPPool(upAddr.String(), *flagTCPConns, *flagTCPInfl, *flagTCPIdle, *flagTimeout)
+	}
+	if *flagTunnel {
+		setupTunnel()
 	}
-	defer upstream.Close()
 
-	proxyAddr := &net.UDPAddr{IP: proxyIP, Port: *flagDNSPort}
-	proxy, err = net.ListenUDP("udp4", proxyAddr)
+	activated, err := activatedSockets()
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
-		os.Exit(2)
+		return bindError(err)
+	}
+	if files := activated["dns"]; len(files) > 0 && *flagNoDNS {
+		log.Printf("DNS WARN: Closing %d activated dns sockets, not used with -no-dns\n", len(files))
+		closeFiles(files)
+	}
+	if files := activated["http"]; len(files) > 0 && *flagNoHTTP {
+		log.Printf("HTTP WARN: Closing %d activated http sockets, not used with -no-http\n", len(files))
+		closeFiles(files)
 	}
-	defer proxy.Close()
 
-	queries = make(map[int]*query, 4096)
+	if files, ok := activated["dns"]; ok && !*flagNoDNS {
+		for _, file := range files {
+			conn, err := activatedUDP(file)
+			if err != nil {
+				return bindError(err)
+			}
+			listeners = append(listeners, newListener(conn, proxyIP))
+		}
+	} else if !*flagNoDNS {
+		sockets := *flagSockets
+		if sockets > 1 && !reusePortSupported {
+			log.Println("DNS WARN: SO_REUSEPORT not supported, using one socket per address")
+			sockets = 1
+		}
+		for _, addr := range dnsAddrs {
+			for i := 0; i < sockets; i++ {
+				var conn *net.UDPConn
+				err := bindRetry("DNS", "udp", addr.Port, func() (err error) {
+					conn, err = listenUDP(addr, sockets > 1)
+					return err
+				})
+				if err != nil {
+					return bindError(err)
+				}
+				listeners = append(listeners, newListener(conn, proxyIP))
+			}
+		}
+	}
+	conns := []*net.UDPConn{upConn}
+	for _, l := range listeners {
+		defer l.conn.Close()
+		conns = append(conns, l.conn)
+	}
+	if err := checkUpstreamLoop(upAddr, listeners); err != nil {
+		return configError(err)
+	}
+	setSocketBuffers(conns)
+	if *flagUnix != "" && !*flagNoDNS {
+		conn, err := listenUnix(*flagUnix, unixMode)
+		if err != nil {
+			return bindError(err)
+		}
+		unixListener = newUnixListener(conn, proxyIP)
+		defer unixListener.unix.close()
+	}
+
+	var httpListeners []net.Listener
+	defer func() {
+		for _, ln := range httpListeners {
+			ln.Close()
+		}
+	}()
+	if files, ok := activated["http"]; ok && !*flagNoHTTP {
+		for _, file := range files {
+			ln, err := activatedListener(file)
+			if err != nil {
+				return bindError(err)
+			}
+			httpListeners = append(httpListeners, ln)
+		}
+	} else if !*flagNoHTTP {
+		if httpAddrs == nil {
+			httpAddrs = defaultHTTPListen(proxyIP, *flagHTTPPort)
+		} else if err := checkHTTPListen(httpAddrs, proxyIP, *flagHTTPPort); err != nil {
+			return configError(err)
+		}
+		for _, addr := range httpAddrs {
+			var ln net.Listener
+			err := bindRetry("HTTP", "tcp", addr.Port, func() (err error) {
+				ln, err = net.Listen(httpNetwork(addr), addr.String())
+				return err
+			})
+			if err != nil {
+				if sinkhole6 != nil && addr.IP.Equal(sinkhole6) {
+					err = fmt.Errorf("%w\nThe pixel server must listen on -sinkhole6, which must be a local address", err)
+				}
+				return bindError(err)
+			}
+			httpListeners = append(httpListeners, ln)
+		}
+	}
 
-	go runServerHTTP(proxyIP.String())
-	go runServerUpstreamDNS()
-	go runServerLocalDNS()
+	httpBound = nil
+	for _, ln := range httpListeners {
+		if addr, ok := ln.Addr().(*net.TCPAddr); ok {
+			httpBound = append(httpBound, addr)
+		}
+	}
 
-	sigwait()
+	if *flagPidFile != "" {
+		if err := writePidFile(*flagPidFile); err != nil {
+			return bindError(fmt.Errorf("Can't write PID file: %w", err))
+		}
+		defer removePidFile(*flagPidFile)
+	}
+
+	// Everything that needs privileges (binding low ports, reading the list)
+	// has to happen before this point.
+	if *flagUser != "" {
+		if err := dropPrivileges(*flagUser, *flagGroup); err != nil {
+			return bindError(fmt.Errorf("Can't drop privileges: %w", err))
+		}
+	}
+
+	startHistory()
+	if *flagState != "" {
+		loadState(*flagState)
+		go runStateSaver(*flagState, *flagStateInt)
+	}
+
+	go runHistory()
+	if *flagCacheSz > 0 {
+		cache = newAnswerCache(*flagCacheSz, *flagCacheMin, *flagCacheSF)
+		if *flagCachePer != "" {
+			n, err := cache.load(*flagCachePer)
+			if err != nil && !os.IsNotExist(err) {
+				log.Println("DNS WARN: Ignoring cache file:", err)
+			}
+			log.Printf("DNS: Loaded %d cached answers\n", n)
+		}
+		if *flagPrefetch > 0 && *flagPFRate > 0 {
+			go cache.runPrefetch(*flagPrefetch, *flagPFHits, *flagPFMargin, *flagPFRate)
+		}
+	}
+	if len(warmNames) > 0 {
+		go runWarmup(warmNames, *flagWarmRate)
+	} else {
+		atomic.StoreInt32(&warmedUp, 1)
+	}
+	if statsd != "" {
+		go runStatsd(statsd, *flagSDPrefix, *flagSDEvery)
+	}
+	if every := watchdogInterval(*flagWatchdog); every > 0 && !*flagNoDNS {
+		go runWatchdog(every, *flagWDFails, *flagWDExit)
+	}
+	go watchSocketDrops(conns, 10*time.Second)
+	if *flagWebhook != "" {
+		go runWebhook(*flagWebhook, *flagHookRate)
+	}
+	startComponent(&component{
+		name: "upstream",
+		run:  func() error { return runServerUpstreamDNS(&upstream) },
+		stop: func() { upstream.Load().Close() },
+	})
+	for _, l := range listeners {
+		l := l
+		startComponent(&component{
+			name: "dns " + l.String(),
+			run:  func() error { return runServerLocalDNS(l) },
+			stop: func() { l.conn.Close() },
+		})
+	}
+	if unixListener != nil {
+		startComponent(&component{
+			name: "dns " + unixListener.String(),
+			run:  func() error { return runServerUnixDNS(unixListener) },
+			stop: unixListener.unix.close,
+		})
+	}
+	if len(httpListeners) > 0 {
+		setupHTTP()
+	}
+	for _, ln := range httpListeners {
+		ln := ln
+		startComponent(&component{
+			name: "http " + ln.Addr().String(),
+			run:  func() error { return runServerHTTP(ln) },
+			stop: func() { ln.Close() },
+		})
+	}
+
+	return serve()
 }
 
-// parseIPv4 parses a string to an IPv4 address or dies.
-func parseIPv4(arg string, msg string) (ip net.IP) {
-	ip = net.ParseIP(arg)
-	if ip == nil {
-		fmt.Fprintf(os.Stderr, "ERROR: Can't parse %s IP '%s'\n", msg, arg)
-		os.Exit(2)
+// serve reports the server ready and serves until it is stopped by a signal
+// or a failure, then stops the components and saves what is to be kept. A
+// failure is returned with its exit status.
+func serve() error {
+	atomic.StoreInt32(&ready, 1)
+	if err := sdNotify("READY=1"); err != nil {
+		log.Println("Can't notify systemd:", err)
 	}
-	ip = ip.To4()
+	err := sigwait()
+	sdNotify("STOPPING=1")
+	stopComponents()
+	if *flagState != "" {
+		if err := saveState(*flagState); err != nil {
+			log.Println("ERROR: Can't save state:", err)
+		}
+	}
+	if cache != nil && *flagCachePer != "" {
+		if n, err := cache.save(*flagCachePer); err != nil {
+			log.Println("ERROR: Can't save cache:", err)
+		} else {
+			log.Printf("DNS: Saved %d cached answers\n", n)
+		}
+	}
+	if err != nil {
+		return failureError(err)
+	}
+	return nil
+}
+
+// parseIPv4 parses a string to an IPv4 address.
+func parseIPv4(arg string, msg string) (net.IP, error) {
+	ip := net.ParseIP(arg)
 	if ip == nil {
-		fmt.Fprintln(os.Stderr, "ERROR: IPv6 is not supported, sorry")
-		os.Exit(3)
+		return nil, fmt.Errorf("Can't parse %s IP '%s'", msg, arg)
 	}
-	return
+	if ip = ip.To4(); ip == nil {
+		return nil, fmt.Errorf("IPv6 is not supported for the %s address, sorry", msg)
+	}
+	return ip, nil
 }
 
-// parseList loads a block list file into blocked and updates rules counter.
-func parseList(path string) {
-	file, err := os.Open(path)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, "ERROR:", err)
-		os.Exit(2)
+// parseSelfName checks a -self-name and returns it lowercased with a
+// trailing dot, or "" for none.
+func parseSelfName(arg string) (string, error) {
+	if arg == "" {
+		return "", nil
 	}
-	defer file.Close()
+	name := strings.TrimSuffix(arg, ".")
+	if !validName(name) || strings.Contains(name, "..") {
+		return "", fmt.Errorf("bad -self-name '%s'", arg)
+	}
+	return lowerName(name) + ".", nil
+}
 
-	blocked = make(map[string]bool, 4096)
-	counter := 0
-	scn := bufio.NewScanner(file)
-	for scn.Scan() {
-		counter++
-		blocked[scn.Text()+"."] = true
+// setSocketBuffers applies the requested buffer sizes and logs the effective
+// ones, as the kernel may clamp them.
+func setSocketBuffers(conns []*net.UDPConn) {
+	if *flagRcvBuf <= 0 && *flagSndBuf <= 0 {
+		return
+	}
+	for _, conn := range conns {
+		if *flagRcvBuf > 0 {
+			if err := conn.SetReadBuffer(*flagRcvBuf); err != nil {
+				log.Println("DNS ERROR: Can't set receive buffer:", err)
+			}
+		}
+		if *flagSndBuf > 0 {
+			if err := conn.SetWriteBuffer(*flagSndBuf); err != nil {
+				log.Println("DNS ERROR: Can't set send buffer:", err)
+			}
+		}
+		if rcv, snd := socketBuffers(conn); rcv >= 0 {
+			log.Printf("DNS: Socket %s buffers: receive %d, send %d\n", conn.LocalAddr(), rcv, snd)
+		}
 	}
-	log.Printf("DNS: Parsed %d entries from list\n", counter)
-	cntRules.Set(int64(counter))
-	return
+}
+
+// fail reports a server loop ending to the main goroutine.
+func fail(err error) {
+	select {
+	case failed <- err:
+	default:
+	}
+}
+
+// readBackoff decides what a server loop should do after a read error.
+// It returns false if the socket has been closed and the loop should end,
+// otherwise it sleeps for a delay that doubles with consecutive errors so a
+// persistent error can't spin the CPU.
+func readBackoff(err error, delay *time.Duration) bool {
+	if errors.Is(err, net.ErrClosed) {
+		return false
+	}
+	switch {
+	case *delay == 0:
+		*delay = 5 * time.Millisecond
+	case *delay < time.Second:
+		*delay *= 2
+	}
+	time.Sleep(*delay)
+	return true
 }
 
 // runServerLocalDNS listens for incoming DNS queries and dispatches them for processing.
-func runServerLocalDNS() {
-	log.Println("DNS: Started local server at", proxy.LocalAddr())
+func runServerLocalDNS(l *listener) error {
+	log.Println("DNS: Started local server at", l)
+	atomic.AddInt64(&listening, 1)
+	defer atomic.AddInt64(&listening, -1)
 
-	buf := make([]byte, 512)
+	var delay time.Duration
+	b := newBatch(batchSize(), answerBufSize)
 	for {
-		n, addr, err := proxy.ReadFromUDP(buf)
+		count, err := readBatch(l.conn, b)
 		if err != nil {
-			log.Println("DNS ERROR (1):", err)
+			if !readBackoff(err, &delay) {
+				return err
+			}
+			logLimited("DNS ERROR (1): %s\n", err)
 			cntErrors.Add(1)
 			continue
 		}
+		delay = 0
 
-		msg := make([]byte, n)
-		copy(msg, buf[:n])
-		cntMsgs.Add(1)
-		go handleDNS(msg, addr)
+		for _, p := range b.pkts[:count] {
+			if p.trunc {
+				cutOffQuery(l, p)
+				continue
+			}
+			msg := make([]byte, p.n)
+			copy(msg, p.buf[:p.n])
+			cntMsgs.Add(1)
+			l.stats.Add("questions", 1)
+			ctx, cancel := queryContext()
+			go handleDNS(ctx, cancel, msg, p.addr, p.dst, l)
+		}
 	}
 }
 
-// runServerUpstreamDNS listens for upstream answers and relies them to original clients.
-func runServerUpstreamDNS() {
+// cutOffQuery drops the query in p, cut off by its buffer, answering it
+// with FORMERR if its header made it.
+func cutOffQuery(l *listener, p packet) {
+	cntDropped.Add("cut-off", 1)
+	if p.n < headerLen {
+		return
+	}
+	if err := l.send(newReply(p.buf[:p.n], headerLen, rcodeFormErr), p.addr, p.dst); err != nil {
+		logLimited("DNS ERROR (17): %s\n", err)
+		cntErrors.Add(1)
+	}
+}
+
+// relayBatch collects the answers to be relayed through one listener.
+type relayBatch struct {
+	b       *batch
+	queries []*query
+	ids     []int
+}
+
+// runServerUpstreamDNS listens for upstream answers on the connection in src
+// and relies them to original clients.
+func runServerUpstreamDNS(src *atomic.Pointer[net.UDPConn]) error {
 	log.Println("DNS: Started upstream server")
 
-	buf := make([]byte, 512)
+	var delay time.Duration
+	in := newBatch(batchSize(), answerBufSize)
+	out := make(map[*listener]*relayBatch, len(listeners))
+	conn := src.Load()
 	for {
-		n, _, err := upstream.ReadFromUDP(buf)
+		count, err := readBatch(conn, in)
 		if err != nil {
-			log.Println("DNS ERROR (2):", err)
+			if !readBackoff(err, &delay) {
+				if fresh := src.Load(); fresh != conn {
+					conn = fresh // replaced by the watchdog
+					continue
+				}
+				return err
+			}
+			logLimited("DNS ERROR (2): %s\n", err)
 			cntErrors.Add(1)
 			continue
 		}
+		delay = 0
 
-		id := int(uint16(buf[0])<<8 + uint16(buf[1]))
-		if query, ok := queries[id]; ok {
-			delete(queries, id)
-			_, err := proxy.WriteTo(buf[:n], query.From)
-			if err != nil {
-				log.Printf("DNS ERROR: Query id %d %s %s", id, query, err)
-				cntErrors.Add(1)
+		// Group the answers by listener, so each group can be sent at once.
+		for _, p := range in.pkts[:count] {
+			if p.trunc {
+				cutOffAnswer(p.buf[:p.n])
 				continue
 			}
-			if *flagVerbose {
-				log.Println("DNS: Relayed answer to query", id)
+			query, id := takeAnswer(p.buf[:p.n])
+			if query == nil || query.Via == nil {
+				continue // unknown or prefetched
+			}
+			rb, ok := out[query.Via]
+			if !ok {
+				rb = &relayBatch{b: newBatch(len(in.pkts), 0)}
+				out[query.Via] = rb
+			}
+			rb.b.pkts[len(rb.queries)] = packet{buf: p.buf, n: p.n, addr: query.From, dst: query.Dst}
+			rb.queries = append(rb.queries, query)
+			rb.ids = append(rb.ids, id)
+		}
+
+		for l, rb := range out {
+			if len(rb.queries) == 0 {
+				continue
+			}
+			sent, err := l.sendBatch(rb.b, len(rb.queries))
+			for i, query := range rb.queries {
+				if i >= sent {
+					log.Printf("DNS ERROR: Query id %d %s %s", rb.ids[i], query, err)
+					cntErrors.Add(1)
+					continue
+				}
+				relayedAnswer(query, rb.ids[i])
 			}
-			cntRelayed.Add(1)
+			rb.queries, rb.ids = rb.queries[:0], rb.ids[:0]
 		}
 	}
 }
 
+// takeAnswer ends the query the upstream answer in msg is for, and does
+// what is due for every answer: counting it, recording it, clamping its TTLs,
+// giving it back the client's question and caching it. msg may be modified.
+// It returns the query and its ID, or nil if no query waits for the answer.
+func takeAnswer(msg []byte) (*query, int) {
+	if len(msg) < 2 {
+		return nil, 0
+	}
+	id := int(uint16(msg[0])<<8 + uint16(msg[1]))
+	query, ok := queries.take(id)
+	if !ok {
+		return nil, id
+	}
+	if query.From != nil {
+		msg[0], msg[1] = byte(query.ID>>8), byte(query.ID)
+	}
+	atomic.StoreInt64(&lastUpstream, time.Now().UnixNano())
+	query.Upstream.answered(time.Since(query.Start))
+	if query.Record {
+		recordExchange(query.Msg, msg)
+	}
+	if len(msg) >= headerLen {
+		rcode := int(msg[3] & 0x0f)
+		cntRcodes.Add(rcodeName(rcode), 1)
+		if rcode == 0 && msg[6] == 0 && msg[7] == 0 {
+			cntNodata.Add(1)
+		}
+		if query.Trace != nil {
+			query.Trace.step(query.From.IP, query.Host, query.Type, "upstream answered %s with %d records in %s",
+				rcodeName(rcode), int(msg[6])<<8|int(msg[7]), time.Since(query.Start).Round(time.Microsecond))
+		}
+	}
+	// Answers to DNSSEC validating clients are relayed untouched.
+	if _, do := queryEDNS(query.Msg); !do && (*flagMinTTL > 0 || *flagMaxTTL > 0) {
+		min, max := uint32(flagMinTTL.Seconds()), uint32(flagMaxTTL.Seconds())
+		if _, err := clampTTLs(msg, min, max); err != nil {
+			log.Printf("DNS WARN: Query id %d %s not clamped: %s\n", id, query, err)
+		}
+	}
+	if restoreQuestion(msg, query.Msg) {
+		cntCaseFix.Add(1)
+	}
+	if cache != nil && query.Key != "" {
+		cache.store(query.Key, msg, query.Msg)
+	}
+	return query, id
+}
+
+// cutOffAnswer handles an upstream answer that didn't fit the buffer, of
+// which msg is the start. It isn't cached, and the client only gets the
+// records that came in full and fit its UDP limit.
+func cutOffAnswer(msg []byte) {
+	cntCutOff.Add(1)
+	if len(msg) < headerLen {
+		return
+	}
+	id := int(uint16(msg[0])<<8 + uint16(msg[1]))
+	query, ok := queries.take(id)
+	if !ok {
+		return
+	}
+	logLimited("DNS WARN: Query id %d %s: answer too large, cut off\n", id, query)
+	query.Upstream.answered(time.Since(query.Start))
+	if query.Via == nil {
+		return // prefetched
+	}
+	_, _, end, err := parseQuestion(query.Msg)
+	if err != nil {
+		return
+	}
+	reply := newReply(query.Msg, end, int(msg[3]&0x0f))
+	// The records follow a question as long as the client's, so their
+	// compression pointers still hold after it.
+	if off, err := skipName(msg, headerLen); err == nil && off+4 == end && end <= len(msg) &&
+		msg[4] == 0 && msg[5] == 1 {
+		reply = append(reply, msg[end:]...)
+		copy(reply[countAnswer:headerLen], msg[countAnswer:headerLen])
+		reply = trimReply(reply, len(reply))
+	}
+	if err := query.Via.send(finishReply(reply, query.Msg), query.From, query.Dst); err != nil {
+		logLimited("DNS ERROR: Query id %d %s %s\n", id, query, err)
+		cntErrors.Add(1)
+		return
+	}
+	relayedAnswer(query, id)
+}
+
+// relayedAnswer counts the answer to query as relayed to its client.
+func relayedAnswer(query *query, id int) {
+	if *flagVerbose {
+		log.Println("DNS: Relayed answer to query", id)
+	}
+	cntRelayed.Add(1)
+	query.Via.stats.Add("relayed", 1)
+	publish(query.From, query.Host, query.Type, "relayed", "", query.Start)
+}
+
+// batchSize returns the number of packets to handle per syscall.
+func batchSize() int {
+	if *flagBatch < 1 || !batchSupported {
+		return 1
+	}
+	return *flagBatch
+}
+
 // handleDNS peeks the query and either relies it to the upstream DNS server or returns
-// a static answer with the 'fake' IP.
-func handleDNS(msg []byte, from *net.UDPAddr) {
-	var domain bytes.Buffer
+// a static answer with the 'fake' IP. That is the address the query was sent
+// to if dst is known, otherwise the listener's.
+func handleDNS(ctx context.Context, cancel context.CancelFunc, msg []byte, from *net.UDPAddr, dst net.IP, l *listener) {
 	var block bool
+	start := time.Now()
+
+	// The query ends when handleDNS returns, unless it was relayed, then
+	// the query table ends it.
+	relayed := false
+	defer func() {
+		if !relayed {
+			cancel()
+		}
+	}()
 
+	atomic.AddInt64(&handlers, 1)
+	defer atomic.AddInt64(&handlers, -1)
+
+	if len(msg) < headerLen {
+		logLimited("DNS WARN: Short query from %s\n", clientAddr(from))
+		cntDropped.Add("malformed", 1)
+		return
+	}
 	id := int(uint16(msg[0])<<8 + uint16(msg[1]))
 	if *flagVerbose {
-		log.Printf("DNS: Query id %d from %s\n", id, from)
+		log.Printf("DNS: Query id %d from %s\n", id, clientAddr(from))
 	}
 
-	count := uint8(msg[5]) // question counter
-	offset := 12           // point to first domain name
+	count := int(msg[4])<<8 | int(msg[5]) // question counter
 
 	if count != 1 {
-		log.Printf("DNS WARN: Query id %d from %s has %d questions\n", id, from, count)
+		logLimited("DNS WARN: Query id %d from %s has %d questions\n", id, clientAddr(from), count)
+		cntFormErr.Add(1)
+		if err := l.send(finishReply(newReply(msg, headerLen, rcodeFormErr), msg), from, dst); err != nil {
+			logLimited("DNS ERROR (9): %s\n", err)
+			cntErrors.Add(1)
+		}
 		return
 	}
 
-	for {
-		length := int8(msg[offset])
-		if length == 0 {
-			break
-		}
-		offset++
-		domain.WriteString(string(msg[offset : offset+int(length)]))
-		domain.WriteString(".")
-		offset += int(length)
-	}
-	host := domain.String()
-	testHost := host
-	parts := strings.Split(testHost, ".")
-	try := 1
-	for {
-		if _, ok := blocked[testHost]; ok {
-			block = true
-			break
+	host, qtype, end, err := parseQuestion(msg)
+	if err != nil {
+		logLimited("DNS WARN: Query id %d from %s: %s\n", id, clientAddr(from), err)
+		cntDropped.Add("malformed", 1)
+		return
+	}
+	if host == watchdogName {
+		// Probes of the watchdog are answered right away, not counted,
+		// logged or held up by the tarpit like blocked names.
+		sinkhole := l.sinkhole
+		if dst != nil {
+			sinkhole = dst
 		}
-		parts = parts[1:]
-		if len(parts) < 3 {
-			break
+		if err := l.send(blockedReply(msg, end, qtype, sinkhole, nil), from, dst); err != nil {
+			logLimited("DNS ERROR (16): %s\n", err)
+			cntErrors.Add(1)
 		}
-		testHost = strings.Join(parts, ".")
-		try++
+		return
 	}
+	cntQtypes.Add(typeName(qtype), 1)
+	clientSeen(from.IP)
+	countClient(from.IP)
+	tr := tracing(from.IP, host)
+	tr.step(from.IP, host, qtype, "received as id %d on %s", id, l)
 
-	if blocking.Value() && block {
+	if blockedQT[qtype] {
 		if *flagVerbose {
-			log.Printf("DNS: Blocking (%d) %s\n", try, host)
+			log.Printf("DNS: Refusing type %s for %s\n", typeName(qtype), escapeName(host))
 		}
-		cntBlocked.Add(1)
+		cntQTBlock.Add(1)
+		publish(from, host, qtype, "refused", "", start)
+		if err := l.send(finishReply(newReply(msg, end, rcodeNotImp), msg), from, dst); err != nil {
+			logLimited("DNS ERROR (5): %s\n", err)
+			cntErrors.Add(1)
+		}
+		return
+	}
 
-		msg[2] = uint8(129) // flags upper byte
-		msg[3] = uint8(128) // flags lower byte
-		msg[7] = uint8(1)   // answer counter
+	if name := lowerName(host); isIdent(questionClass(msg, end), name) {
+		if *flagVerbose {
+			log.Printf("DNS: Answering CHAOS %s\n", escapeName(host))
+		}
+		if err := l.send(identReply(msg, end, qtype, name), from, dst); err != nil {
+			logLimited("DNS ERROR (15): %s\n", err)
+			cntErrors.Add(1)
+			return
+		}
+		if *flagNoIdent {
+			publish(from, host, qtype, "refused", "", start)
+			return
+		}
+		cntLocal.Add(1)
+		publish(from, host, qtype, "local", "", start)
+		return
+	}
 
-		msg = append(msg, msg[12:12+1+len(host)]...) // domain
-		msg = append(msg, answer...)                 // payload
-		_, err := proxy.WriteTo(msg, from)
-		if err != nil {
-			log.Println("DNS ERROR (3):", err)
+	if tunnelCheck(from.IP, host) {
+		if *flagVerbose {
+			log.Printf("DNS: Refusing %s to %s\n", escapeName(host), clientAddr(from))
+		}
+		cntDropped.Add("tunnel", 1)
+		publish(from, host, qtype, "refused", "", start)
+		if err := l.send(finishReply(newReply(msg, end, rcodeRefused), msg), from, dst); err != nil {
+			logLimited("DNS ERROR (6): %s\n", err)
 			cntErrors.Add(1)
+		}
+		return
+	}
+
+	testHost := lowerName(host)
+	if testHost == statsName {
+		if *flagVerbose {
+			log.Printf("DNS: Answering %s with statistics\n", escapeName(host))
+		}
+		reply := statsReply(msg, end, qtype, from.IP)
+		if err := l.send(reply, from, dst); err != nil {
+			logLimited("DNS ERROR (14): %s\n", err)
+			cntErrors.Add(1)
+			return
+		}
+		if !statsAllowed(from.IP) {
+			publish(from, host, qtype, "refused", "", start)
 			return
 		}
+		cntLocal.Add(1)
+		publish(from, host, qtype, "local", "", start)
+		return
+	}
+
+	rs := currentRules()
+	var lr *localRule
+	if testHost == selfName {
+		// The dashboard is at the sinkholes, by default the address the
+		// query was sent to, all of which the HTTP server listens on.
+		sh := currentSinkholes()
+		lr = &localRule{addrs: []net.IP{l.sinkhole}}
+		if sh.v4 != nil {
+			lr.addrs[0] = sh.v4
+		} else if dst != nil {
+			lr.addrs[0] = dst
+		}
+		if sh.v6 != nil {
+			lr.addrs = append(lr.addrs, sh.v6)
+		}
+	} else if *flagPAC && isWPAD(testHost) {
+		// The PAC file is served at the proxy address.
+		lr = &localRule{addrs: []net.IP{l.sinkhole}}
+		if dst != nil {
+			lr.addrs[0] = dst
+		}
+	} else if len(rs.local) > 0 {
+		zone := findZone(testHost, func(name string) bool { return rs.local[name] != nil })
+		lr = rs.local[zone]
+	}
+	if lr != nil {
 		if *flagVerbose {
-			log.Println("DNS: Sent fake answer")
+			log.Printf("DNS: Answering %s locally\n", escapeName(host))
+		}
+		cntLocal.Add(1)
+		if err := l.send(localReply(msg, end, qtype, lr), from, dst); err != nil {
+			logLimited("DNS ERROR (12): %s\n", err)
+			cntErrors.Add(1)
+			return
+		}
+		publish(from, host, qtype, "local", "", start)
+		return
+	}
+
+	zone, src, block := rs.matchCached(testHost)
+
+	if block && allowed.contains(host) {
+		if *flagVerbose {
+			log.Printf("DNS: Allowing whitelisted %s\n", escapeName(host))
+		}
+		cntWhitelisted.Add(1)
+		block = false
+		tr.step(from.IP, host, qtype, "allowed by the whitelist")
+	} else if tr != nil {
+		if block {
+			tr.step(from.IP, host, qtype, "matches %s", rs.describe(zone, src))
+		} else {
+			tr.step(from.IP, host, qtype, "matches no rule")
+		}
+	}
+
+	if blocking.Value() && block {
+		rule := rs.describe(zone, src)
+		list := ""
+		if src != flagSource {
+			list = rs.names[src.list()]
+			cntListHits.Add(list, 1)
+			rs.markUsed(zone, src)
+		}
+		if isTLDZone(zone) {
+			cntTLDBlock.Add(1)
+		}
+		if *flagWebhook != "" {
+			alertMatch(from.IP, host, zone, list, rule)
 		}
-	} else {
 		if *flagVerbose {
-			log.Println("DNS: Asking upstream")
+			log.Printf("DNS: Blocking %s, matched %s\n", escapeName(host), rule)
 		}
-		queries[id] = &query{From: from, Host: host}
-		_, err := upstream.Write(msg)
+		cntBlocked.Add(1)
+		l.stats.Add("blocked", 1)
+
+		sinkhole, sh := l.sinkhole, currentSinkholes()
+		if sh.v4 != nil {
+			sinkhole = sh.v4
+		} else if dst != nil {
+			sinkhole = dst
+		}
+		reply := blockedReply(msg, end, qtype, sinkhole, sh.v6)
+		tarpit(func() {
+			if err := l.send(reply, from, dst); err != nil {
+				logLimited("DNS ERROR (3): %s\n", err)
+				cntErrors.Add(1)
+				return
+			}
+			if *flagVerbose {
+				log.Println("DNS: Sent fake answer")
+			}
+			publish(from, host, qtype, "blocked", rule, start)
+		})
+		rememberBlock(from.IP, host, rule)
+	} else {
+		var key string
+		if cache != nil {
+			key = cacheKey(host, msg, end)
+			if reply := cache.get(key, msg, end); reply != nil {
+				cntCacheHits.Add(1)
+				if err := l.send(reply, from, dst); err != nil {
+					logLimited("DNS ERROR (8): %s\n", err)
+					cntErrors.Add(1)
+					return
+				}
+				if *flagVerbose {
+					log.Println("DNS: Sent cached answer")
+				}
+				publish(from, host, qtype, "cached", "", start)
+				return
+			}
+			cntCacheMisses.Add(1)
+		}
+		conn, stats, err := upstreamFor(ctx, host)
 		if err != nil {
-			log.Println("DNS ERROR (4):", err)
+			logLimited("DNS ERROR (13): %s\n", err)
 			cntErrors.Add(1)
-			delete(queries, id)
+			l.send(finishReply(newReply(msg, end, rcodeServFail), msg), from, dst)
+			publish(from, host, qtype, "servfail", "", start)
+			return
+		}
+		if *flagVerbose {
+			log.Println("DNS: Asking upstream", conn.RemoteAddr())
+		}
+		q := &query{ID: id, From: from, Dst: dst, Host: host, Type: qtype, Upstream: stats, Via: l, Start: start, Ctx: ctx, Cancel: cancel, Key: key, Msg: msg, Trace: tr}
+		q.Record = recordSampled()
+		if queries.attach(q) {
+			if *flagVerbose {
+				log.Printf("DNS: Query id %d %s waits for a prefetch\n", id, q)
+			}
+			cntPrefetchJoined.Add(1)
+			relayed = true
+			return
+		}
+		if queries.looped(id, q) {
+			log.Printf("DNS ERROR: Query id %d %s came back, the upstream forwards to us\n", id, q)
+			cntLoop.Add(1)
+			if err := l.send(finishReply(newReply(msg, end, rcodeServFail), msg), from, dst); err != nil {
+				logLimited("DNS ERROR (10): %s\n", err)
+				cntErrors.Add(1)
+			}
+			publish(from, host, qtype, "servfail", "", start)
 			return
 		}
-		go func(queryID int) {
-			time.Sleep(*flagTimeout)
-			if query, ok := queries[queryID]; ok {
-				fmt.Printf("DNS WARN: Query id %d %s timed out\n", queryID, query)
-				cntTimedout.Add(1)
-				delete(queries, queryID)
+		upID, added, err := queries.add(q)
+		if err != nil {
+			// Most likely the upstream is down, or a client is flooding
+			// it, don't pile up more.
+			if *flagVerbose {
+				log.Printf("DNS: Query id %d %s not relayed: %s\n", id, q, err)
+			}
+			if err == errClientFull {
+				cntClFull.Add(clientIP(from.IP), 1)
+				cntDropped.Add("client-inflight-cap", 1)
+			} else {
+				cntFull.Add(1)
+				cntDropped.Add("inflight-cap", 1)
 			}
+			if err := l.send(finishReply(newReply(msg, end, rcodeServFail), msg), from, dst); err != nil {
+				logLimited("DNS ERROR (11): %s\n", err)
+				cntErrors.Add(1)
+			}
+			publish(from, host, qtype, "servfail", "", start)
+			return
+		}
+		relayed = true
+		if !added {
+			if *flagVerbose {
+				log.Printf("DNS: Query id %d %s is a retransmission\n", id, q)
+			}
+			cntRetrans.Add(1)
+			return
+		}
+		tr.step(from.IP, host, qtype, "sending to upstream %s", conn.RemoteAddr())
+		out := append([]byte(nil), msg...)
+		out[0], out[1] = byte(upID>>8), byte(upID)
+		if upPool != nil && stats == upStats {
+			err = upPool.send(out)
+		} else {
+			_, err = conn.Write(out)
+		}
+		if err != nil {
+			logLimited("DNS ERROR (4): %s\n", err)
+			cntErrors.Add(1)
+			queries.remove(upID, q)
 			return
-		}(id)
+		}
+		q.Upstream.sent()
+		queries.timeout(upID, q)
 	}
 	return
 }
 
+// blockedReply makes the answer to a query for a blocked name: the sinkhole
+// address ip4 for A (and ANY) queries, the IPv6 sinkhole ip6 for AAAA queries
+// if there is one, and no records (NODATA) otherwise, so that e.g. clients
+// preferring IPv6 fall back to the IPv4 sinkhole quickly.
+func blockedReply(msg []byte, end int, qtype uint16, ip4, ip6 net.IP) []byte {
+	var reply []byte
+	switch _, do := queryEDNS(msg); {
+	case do && *flagDNSSECNX && qtype == typeSOA:
+		// Strict clients follow a missing name up with SOA and NS
+		// queries, which are answered as if the name were the apex of
+		// an empty zone served here, rather than told it's missing.
+		reply = appendZoneSOA(newReply(msg, end, 0), countAnswer, blockedSOAName, blockedSOATTL)
+	case do && *flagDNSSECNX && qtype == typeNS:
+		reply = appendZoneSOA(newReply(msg, end, 0), countAuthority, blockedSOAName, blockedSOATTL)
+	case do && *flagDNSSECNX:
+		// A made up address can't validate, a missing name at least
+		// fails fast.
+		reply = appendZoneSOA(newReply(msg, end, rcodeNXDomain), countAuthority, blockedSOAName, blockedSOATTL)
+	case qtype == typeA || qtype == typeANY:
+		reply = appendA(newReply(msg, end, 0), ip4, sinkholeTTL)
+	case qtype == typeAAAA && ip6 != nil:
+		reply = appendAAAA(newReply(msg, end, 0), ip6, sinkholeTTL)
+	default:
+		reply = appendSOA(newReply(msg, end, 0), sinkholeSOATTL)
+	}
+	setFlag(reply, flagAA, *flagSinkAA)
+	return finishReply(reply, msg)
+}
+
+// localReply makes the answer to a query for a name with a local rule:
+// NXDOMAIN if the rule says so, or its IPv4 addresses for A queries, the IPv6
+// ones for AAAA queries, both for ANY, and no records (NODATA) otherwise.
+func localReply(msg []byte, end int, qtype uint16, lr *localRule) []byte {
+	if lr.nxdomain {
+		reply := appendSOA(newReply(msg, end, rcodeNXDomain), localTTL)
+		setFlag(reply, flagAA, true)
+		return finishReply(reply, msg)
+	}
+	reply := newReply(msg, end, 0)
+	answered := false
+	for _, ip := range lr.addrs {
+		ip4 := ip.To4()
+		switch {
+		case ip4 != nil && (qtype == typeA || qtype == typeANY):
+			reply = appendA(reply, ip4, localTTL)
+		case ip4 == nil && (qtype == typeAAAA || qtype == typeANY):
+			reply = appendAAAA(reply, ip, localTTL)
+		default:
+			continue
+		}
+		answered = true
+	}
+	if !answered {
+		reply = appendSOA(reply, localTTL)
+	}
+	setFlag(reply, flagAA, true)
+	return finishReply(reply, msg)
+}
+
 // authHTTP checks if user supplied proper key.
 func authHTTP(req *http.Request) bool {
 	if val := req.FormValue("key"); val == key {
 		return true
 	}
-	log.Printf("HTTP: Unauthorized access to %s from %s\n", req.RequestURI, req.RemoteAddr)
+	log.Printf("HTTP: Unauthorized access to %s from %s\n", req.RequestURI, clientHTTP(req.RemoteAddr))
 	return false
 }
 
-// handleHTTP returns an 'empty' 1x1 GIF image for any URL.
+// handleHTTP returns an 'empty' 1x1 GIF image for any URL. HEAD gets just
+// the headers, POST beacons no content, OPTIONS preflights are allowed and
+// other methods refused.
 func handleHTTP(w http.ResponseWriter, req *http.Request) {
+	start := time.Now()
 	if *flagVerbose {
 		log.Printf("HTTP: Request %s %s %s\n", req.Method, req.Host, req.RequestURI)
 	}
 	cntServed.Add(1)
-	w.Header()["Content-type"] = []string{"image/gif"}
-	io.WriteString(w, pixel)
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPost:
+		cntMethods.Add(req.Method, 1)
+	default:
+		cntMethods.Add("other", 1)
+	}
+	if *flagServer {
+		w.Header().Set("Server", "adhole/"+version)
+	}
+	corsHeaders(w.Header(), req)
+	limitBody(w, req)
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodPost:
+	case http.MethodOptions:
+		w.Header().Set("Allow", pixelMethods)
+		if *flagCORS != "" {
+			// Preflights are let through, whatever they ask for.
+			w.Header().Set("Access-Control-Allow-Methods", pixelMethods)
+			if h := req.Header.Get("Access-Control-Request-Headers"); h != "" {
+				w.Header().Set("Access-Control-Allow-Headers", h)
+			}
+			w.Header().Set("Access-Control-Max-Age", "86400")
+		}
+		w.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		w.Header().Set("Allow", pixelMethods)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if ipHostRequest(w, req) {
+		return
+	}
+	tarpitWait(req.Context())
+	if *flagSelfServ && wantsPage(req) {
+		name, _, _ := strings.Cut(req.Host, ":")
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		blockPage.Execute(w, name)
+		return
+	}
+	pixelHit(req, start)
+	if req.Method == http.MethodPost {
+		// Beacons don't look at what they get back.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	w.Header().Set("Content-Type", "image/gif")
+	w.Header().Set("Content-Length", strconv.Itoa(len(pixel)))
+	if req.Method != http.MethodHead {
+		io.WriteString(w, pixel)
+	}
 	return
 }
 
+// pixelMethods are the methods the pixel server answers.
+const pixelMethods = "GET, HEAD, POST, OPTIONS"
+
+// corsHeaders lets pages of the -cors-origin origins read sinkhole responses
+// from scripts, so that blocked fetches complete quietly rather than fail
+// and get retried. With "*" any origin may, without credentials. Otherwise
+// the request's origin is echoed if listed, and may send credentials.
+func corsHeaders(h http.Header, req *http.Request) {
+	if *flagCORS == "" {
+		return
+	}
+	h.Set("Cross-Origin-Resource-Policy", "cross-origin")
+	origin := *flagCORS
+	if origin != "*" {
+		h.Add("Vary", "Origin")
+		origin = req.Header.Get("Origin")
+		if !corsListed(origin) {
+			return
+		}
+		h.Set("Access-Control-Allow-Credentials", "true")
+	}
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Set("Timing-Allow-Origin", origin)
+}
+
+// corsListed reports whether origin is one of the comma separated
+// -cors-origin origins.
+func corsListed(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	for _, o := range strings.Split(*flagCORS, ",") {
+		if strings.EqualFold(strings.TrimSpace(o), origin) {
+			return true
+		}
+	}
+	return false
+}
+
 // handleReload reloads the rules and redirects to the debug page.
 func handleReload(w http.ResponseWriter, req *http.Request) {
 	if authHTTP(req) {
-		parseList(list)
-		log.Println("Rules reloaded:", cntRules)
+		reload()
 	}
 	http.Redirect(w, req, "/debug/vars", http.StatusSeeOther)
 	return
 }
 
+// handleAPIReload reloads the rules and reports the result as JSON. A reload
+// already in progress makes it fail with 409 Conflict.
+func handleAPIReload(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		json.NewEncoder(w).Encode(map[string]string{"error": "use POST"})
+		return
+	}
+	if !authHTTP(req) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad key"})
+		return
+	}
+	res, ok := tryReload()
+	if !ok {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{"error": "reload in progress"})
+		return
+	}
+	if !res.Swapped {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
+// handleAPITest tells how a name would be answered, and which rule applies.
+func handleAPITest(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !authHTTP(req) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad key"})
+		return
+	}
+	name := strings.ToLower(strings.TrimSuffix(req.FormValue("name"), ".")) + "."
+	if name == "." {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "no name"})
+		return
+	}
+	rs := currentRules()
+	res := map[string]interface{}{"name": strings.TrimSuffix(name, ".")}
+	if zone, src, ok := rs.matchBlocked(name); ok {
+		res["blocked"] = blocking.Value() && !allowed.contains(name)
+		res["rule"] = rs.describe(zone, src)
+		res["whitelisted"] = allowed.contains(name)
+	}
+	if zone := findZone(name, func(z string) bool { return rs.local[z] != nil }); zone != "" {
+		res["local"] = strings.TrimSuffix(zone, ".")
+	}
+	if zone := findZone(name, func(z string) bool { return rs.forward[z] != nil }); zone != "" {
+		res["forward"] = rs.forward[zone].String()
+	}
+	json.NewEncoder(w).Encode(res)
+}
+
 // handleToggle toggles blocking and redirects to the debug page.
 func handleToggle(w http.ResponseWriter, req *http.Request) {
 	if authHTTP(req) {
@@ -385,15 +1562,57 @@ func handleToggle(w http.ResponseWriter, req *http.Request) {
 	return
 }
 
-// runServerHTTP starts the HTTP server.
-func runServerHTTP(host string) {
-	addr := fmt.Sprintf("%s:%d", host, *flagHTTPPort)
+// httpRoutes registers the handlers on the default mux, which takes each
+// pattern only once.
+var httpRoutes sync.Once
+
+// setupHTTP sets up the connection limit and the handlers of the HTTP
+// server.
+func setupHTTP() {
+	if *flagHTTPConn > 0 {
+		httpConns = newConnLimiter(*flagHTTPConn)
+	}
+	httpRoutes.Do(registerHTTP)
+}
+
+// registerHTTP registers the HTTP handlers.
+func registerHTTP() {
 	http.HandleFunc("/", handleHTTP)
 	http.HandleFunc("/debug/reload", handleReload)
 	http.HandleFunc("/debug/toggle", handleToggle)
-	log.Println("HTTP: Started at", addr)
-	log.Fatalln(http.ListenAndServe(addr, nil))
-	panic("not reachable")
+	http.HandleFunc("/api/reload", handleAPIReload)
+	http.HandleFunc("/api/whitelist", handleAPIWhitelist)
+	http.HandleFunc("/api/export", handleAPIExport)
+	http.HandleFunc("/api/import", handleAPIImport)
+	http.HandleFunc("/api/stream", handleStream)
+	http.HandleFunc("/api/test", handleAPITest)
+	http.HandleFunc("/api/lists", handleAPILists)
+	http.HandleFunc("/api/lists/", handleAPILists)
+	http.HandleFunc("/api/rules/unused", handleAPIUnused)
+	http.HandleFunc("/api/config", handleAPIConfig)
+	http.HandleFunc("/api/sinkhole", handleAPISinkhole)
+	http.HandleFunc("/api/trace", handleAPITrace)
+	http.HandleFunc("/api/trace/results", handleAPITraceResults)
+	if *flagPAC {
+		http.HandleFunc("/proxy.pac", handlePAC)
+		http.HandleFunc("/wpad.dat", handlePAC)
+	}
+	http.HandleFunc("/healthz", handleHealth)
+	http.HandleFunc("/readyz", handleReady)
+}
+
+// runServerHTTP runs the HTTP server on an already bound listener.
+func runServerHTTP(ln net.Listener) error {
+	log.Println("HTTP: Started at", ln.Addr())
+	srv := &http.Server{
+		Handler:           proxyHosts(http.DefaultServeMux),
+		ReadHeaderTimeout: 10 * time.Second,
+		IdleTimeout:       time.Minute,
+	}
+	if httpConns != nil {
+		srv.ConnState = httpConns.connState
+	}
+	return srv.Serve(ln)
 }
 
 // vim: ts=4 sw=4 sts=4
@@ -0,0 +1,407 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestReadBackoff(t *testing.T) {
+	closed := &net.OpError{Op: "read", Net: "udp", Err: net.ErrClosed}
+	for _, tc := range []struct {
+		err   error
+		delay time.Duration // before
+		cont  bool
+		want  time.Duration // after
+	}{
+		{closed, 0, false, 0},
+		{fmt.Errorf("wrapped: %w", net.ErrClosed), 10 * time.Millisecond, false, 10 * time.Millisecond},
+		{syscall.EMSGSIZE, 0, true, 5 * time.Millisecond},
+		{syscall.EMSGSIZE, 5 * time.Millisecond, true, 10 * time.Millisecond},
+		{&net.OpError{Op: "read", Net: "udp", Err: syscall.ECONNREFUSED}, 20 * time.Millisecond, true, 40 * time.Millisecond},
+	} {
+		delay := tc.delay
+		if cont := readBackoff(tc.err, &delay); cont != tc.cont || delay != tc.want {
+			t.Errorf("%v after %s: continue %v, delay %s, want %v, %s", tc.err, tc.delay, cont, delay, tc.cont, tc.want)
+		}
+	}
+}
+
+// The server loops must end when their socket is closed under load, rather
+// than spin on the error.
+func TestServerLoopsEndOnClose(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		run  func(conn *net.UDPConn) error
+	}{
+		{"local", func(conn *net.UDPConn) error {
+			return runServerLocalDNS(newListener(conn, net.IPv4(127, 0, 0, 1).To4()))
+		}},
+		{"upstream", func(conn *net.UDPConn) error {
+			var src atomic.Pointer[net.UDPConn]
+			src.Store(conn)
+			return runServerUpstreamDNS(&src)
+		}},
+	} {
+		conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan error, 1)
+		go func() { done <- tc.run(conn) }()
+
+		// Short queries and answers to no query, dropped right away.
+		client, err := net.DialUDP("udp4", nil, conn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		stop := make(chan struct{})
+		go func() {
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+					client.Write(make([]byte, 4))
+				}
+			}
+		}()
+		time.Sleep(50 * time.Millisecond)
+		errs := cntErrors.Value()
+		conn.Close()
+		select {
+		case err := <-done:
+			if !errors.Is(err, net.ErrClosed) {
+				t.Errorf("%s: ended with %v", tc.name, err)
+			}
+		case <-time.After(2 * time.Second):
+			t.Errorf("%s: still running after the socket was closed", tc.name)
+		}
+		close(stop)
+		client.Close()
+		if n := cntErrors.Value() - errs; n > 0 {
+			t.Errorf("%s: %d errors counted after closing", tc.name, n)
+		}
+	}
+}
+
+// ednsQuery returns a query for name of qtype with an OPT record
+// advertising size, and DO set as given.
+func ednsQuery(name string, qtype uint16, size int, do bool) []byte {
+	msg := testQuery(name, qtype)
+	msg[11] = 1
+	var flags byte
+	if do {
+		flags = 0x80
+	}
+	return append(msg, 0, 0, typeOPT, byte(size>>8), byte(size), 0, 0, flags, 0, 0, 0)
+}
+
+// bigAnswer returns an answer to the TXT query in msg of at least size
+// bytes.
+func bigAnswer(msg []byte, size int) []byte {
+	_, _, end, _ := parseQuestion(msg)
+	answer := newReply(msg, end, 0)
+	for len(answer) < size {
+		answer = appendTXT(answer, classIN, 300, strings.Repeat("k", 250))
+	}
+	return appendOPT(answer, false, -1)
+}
+
+// TestRelayAnswers sends answers of all sizes through the upstream server
+// loop, and checks that the client gets them byte for byte.
+func TestRelayAnswers(t *testing.T) {
+	up, fake := udpPair(t)
+	var src atomic.Pointer[net.UDPConn]
+	src.Store(up)
+	go runServerUpstreamDNS(&src)
+	l := startListener(t, true)
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	client.SetReadBuffer(1 << 20)
+
+	txt := ednsQuery("example.com.", typeTXT, 65535, false)
+	tests := []struct {
+		name   string
+		query  []byte
+		answer []byte
+	}{
+		{"signed", ednsQuery("example.com.", typeA, 1232, true), answerVector(t, "dnssec")},
+		{"CNAME chain", ednsQuery("www.microsoft.com.", typeA, 1232, false), answerVector(t, "cname-chain")},
+		{"over 512 bytes", txt, bigAnswer(txt, 1400)},
+		{"over 4 KiB", txt, bigAnswer(txt, 5000)},
+		{"near 64 KiB", txt, bigAnswer(txt, 60000)},
+	}
+	buf := make([]byte, answerBufSize)
+	for i, tt := range tests {
+		id := 0xa000 + i
+		answer := append([]byte(nil), tt.answer...)
+		answer[0], answer[1] = byte(id>>8), byte(id)
+		host, _, _, _ := parseQuestion(tt.query)
+		ctx, cancel := queryContext()
+		q := &query{ID: id, Host: host, From: client.LocalAddr().(*net.UDPAddr), Via: l, Start: time.Now(), Ctx: ctx, Cancel: cancel, Msg: tt.query}
+		if !queries.addNew(id, q) {
+			t.Fatalf("%s: id %d taken", tt.name, id)
+		}
+		if _, err := fake.Write(answer); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if !bytes.Equal(buf[:n], answer) {
+			t.Errorf("%s: relayed %d bytes differ from the %d bytes answered", tt.name, n, len(answer))
+		}
+	}
+}
+
+// TestCutOffAnswer checks that an answer cut off on reading isn't cached,
+// and the client only gets the records that came in full.
+func TestCutOffAnswer(t *testing.T) {
+	withFlag(t, &cache, testCache(10, 0, 0))
+	l := startListener(t, true)
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	msg := ednsQuery("example.com.", typeTXT, 4096, false)
+	_, _, end, _ := parseQuestion(msg)
+	const id = 0x1234
+	ctx, cancel := queryContext()
+	q := &query{ID: id, Host: "example.com.", From: client.LocalAddr().(*net.UDPAddr), Via: l, Start: time.Now(),
+		Ctx: ctx, Cancel: cancel, Msg: msg, Key: cacheKey("example.com.", msg, end)}
+	queries.addNew(id, q)
+	cut := cntCutOff.Value()
+
+	cutOffAnswer(bigAnswer(msg, 5000)[:512])
+
+	buf := make([]byte, 512)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := wire(t, "1234 8180 0001 0001 0000 0001 07 6578616d706c65 03 636f6d 00 0010 0001"+
+		" c00c 0010 0001 0000012c 00fb fa "+strings.Repeat("6b", 250)+
+		" 00 0029 0200 00000000 0000")
+	if !bytes.Equal(buf[:n], want) {
+		t.Errorf("got % x\nwant % x", buf[:n], want)
+	}
+	if len(cache.entries) != 0 {
+		t.Error("cut off answer cached")
+	}
+	if _, ok := queries.take(id); ok {
+		t.Error("query still outstanding")
+	}
+	if cntCutOff.Value() != cut+1 {
+		t.Error("cut off answer not counted")
+	}
+}
+
+// Queries of any size must be read whole and answered; ones cut off
+// anyway get FORMERR.
+func TestLocalQuerySizes(t *testing.T) {
+	withBlocked(t, "ads.example.com.")
+	l := startListener(t, false)
+	for _, size := range []int{0, 600, 4000} {
+		msg := ednsQuery("ads.example.com.", typeA, 4096, false)
+		if size > 0 {
+			// An EDNS padding option filling the query up to size.
+			pad := size - len(msg) - 4
+			binary.BigEndian.PutUint16(msg[len(msg)-2:], uint16(pad+4))
+			msg = append(msg, 0, 12, byte(pad>>8), byte(pad))
+			msg = append(msg, make([]byte, pad)...)
+		}
+		reply := ask(t, l, msg)
+		if len(reply) < headerLen || reply[3]&0x0f != 0 || reply[7] != 1 {
+			t.Errorf("%d bytes: answered % x", len(msg), reply)
+		}
+	}
+
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	msg := testQuery("ads.example.com.", typeA)
+	dropped := func() int64 {
+		n, _ := cntDropped.Get("cut-off").(*expvar.Int)
+		if n == nil {
+			return 0
+		}
+		return n.Value()
+	}
+	before := dropped()
+	cutOffQuery(l, packet{buf: msg, n: 20, addr: client.LocalAddr().(*net.UDPAddr), trunc: true})
+	buf := make([]byte, 512)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	n, err := client.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := newReply(msg, headerLen, rcodeFormErr); !bytes.Equal(buf[:n], want) {
+		t.Errorf("cut off query answered % x, want % x", buf[:n], want)
+	}
+	if dropped() != before+1 {
+		t.Error("cut off query not counted")
+	}
+}
+
+// Any origin may read sinkhole responses with "*", but only listed ones
+// with credentials.
+func TestCORSHeaders(t *testing.T) {
+	tests := []struct {
+		flag, origin string
+		allow, creds string
+	}{
+		{"*", "https://example.com", "*", ""},
+		{"*", "", "*", ""},
+		{"https://example.com", "https://example.com", "https://example.com", "true"},
+		{"https://a.example, https://example.com", "https://example.com", "https://example.com", "true"},
+		{"https://example.com", "https://evil.example", "", ""},
+		{"https://example.com", "", "", ""},
+		{"", "https://example.com", "", ""},
+	}
+	for _, tt := range tests {
+		withFlag(t, flagCORS, tt.flag)
+		req := httptest.NewRequest(http.MethodGet, "/ad.gif", nil)
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		h := make(http.Header)
+		corsHeaders(h, req)
+		if got := h.Get("Access-Control-Allow-Origin"); got != tt.allow {
+			t.Errorf("%q from %q: origin %q allowed, want %q", tt.flag, tt.origin, got, tt.allow)
+		}
+		if got := h.Get("Access-Control-Allow-Credentials"); got != tt.creds {
+			t.Errorf("%q from %q: credentials %q, want %q", tt.flag, tt.origin, got, tt.creds)
+		}
+		if vary := h.Get("Vary") == "Origin"; vary != (tt.flag != "" && tt.flag != "*") {
+			t.Errorf("%q from %q: Vary %q", tt.flag, tt.origin, h.Get("Vary"))
+		}
+	}
+}
+
+// The pixel is served to GET, HEAD gets its headers, POST beacons and
+// preflights no content and any other method a 405, each counted.
+func TestPixelMethods(t *testing.T) {
+	withFlag(t, flagCORS, "*")
+	tests := []struct {
+		method, counted string
+		code            int
+		body            string
+		length          string
+	}{
+		{http.MethodGet, "GET", http.StatusOK, pixel, fmt.Sprint(len(pixel))},
+		{http.MethodHead, "HEAD", http.StatusOK, "", fmt.Sprint(len(pixel))},
+		{http.MethodPost, "POST", http.StatusNoContent, "", ""},
+		{http.MethodOptions, "OPTIONS", http.StatusNoContent, "", ""},
+		{http.MethodPut, "other", http.StatusMethodNotAllowed, "", ""},
+		{http.MethodDelete, "other", http.StatusMethodNotAllowed, "", ""},
+	}
+	for _, tt := range tests {
+		before := methodCount(tt.counted)
+		req := httptest.NewRequest(tt.method, "http://ads.example/ad.gif", strings.NewReader("x=1"))
+		req.Header.Set("Origin", "https://example.com")
+		req.Header.Set("Access-Control-Request-Headers", "X-Beacon")
+		rec := httptest.NewRecorder()
+		handleHTTP(rec, req)
+		res := rec.Result()
+		if res.StatusCode != tt.code {
+			t.Errorf("%s: status %d, want %d", tt.method, res.StatusCode, tt.code)
+		}
+		if got := rec.Body.String(); got != tt.body {
+			t.Errorf("%s: body %q, want %q", tt.method, got, tt.body)
+		}
+		if got := res.Header.Get("Content-Length"); got != tt.length {
+			t.Errorf("%s: Content-Length %q, want %q", tt.method, got, tt.length)
+		}
+		if got := res.Header.Get("Access-Control-Allow-Origin"); got != "*" {
+			t.Errorf("%s: origin %q allowed", tt.method, got)
+		}
+		if d := methodCount(tt.counted) - before; d != 1 {
+			t.Errorf("%s: counted %d times as %s", tt.method, d, tt.counted)
+		}
+		switch tt.code {
+		case http.StatusOK:
+			if got := res.Header.Get("Content-Type"); got != "image/gif" {
+				t.Errorf("%s: Content-Type %q", tt.method, got)
+			}
+		case http.StatusMethodNotAllowed:
+			if got := res.Header.Get("Allow"); got != pixelMethods {
+				t.Errorf("%s: Allow %q", tt.method, got)
+			}
+		}
+		if tt.method != http.MethodOptions {
+			continue
+		}
+		for h, want := range map[string]string{
+			"Allow":                        pixelMethods,
+			"Access-Control-Allow-Methods": pixelMethods,
+			"Access-Control-Allow-Headers": "X-Beacon",
+			"Access-Control-Max-Age":       "86400",
+		} {
+			if got := res.Header.Get(h); got != want {
+				t.Errorf("OPTIONS: %s %q, want %q", h, got, want)
+			}
+		}
+	}
+}
+
+// methodCount returns the HTTP requests counted for method.
+func methodCount(method string) int64 {
+	if n, ok := cntMethods.Get(method).(*expvar.Int); ok {
+		return n.Value()
+	}
+	return 0
+}
+
+// TTLs are clamped unless the client asked with DO, whatever the answer
+// says.
+func TestClampUnlessDO(t *testing.T) {
+	withFlag(t, flagMinTTL, time.Minute)
+	tests := []struct {
+		queryDO, answerDO bool
+		want              uint32
+	}{
+		{false, false, 60},
+		{false, true, 60},
+		{true, false, 10},
+		{true, true, 10},
+	}
+	for _, tt := range tests {
+		msg := ednsQuery("example.com.", typeA, 1232, tt.queryDO)
+		_, _, end, _ := parseQuestion(msg)
+		answer := appendOPT(appendA(newReply(msg, end, 0), net.IPv4(192, 0, 2, 1), 10), tt.answerDO, -1)
+		answer[11] = 1
+		const id = 0x4321
+		ctx, cancel := queryContext()
+		queries.addNew(id, &query{Host: "example.com.", Start: time.Now(), Ctx: ctx, Cancel: cancel, Msg: msg})
+		answer[0], answer[1] = id>>8, id&0xff
+		if q, _ := takeAnswer(answer); q == nil {
+			t.Fatal("query not found")
+		}
+		if ttl := binary.BigEndian.Uint32(answer[end+6:]); ttl != tt.want {
+			t.Errorf("DO %v in the query, %v in the answer: TTL %d, want %d", tt.queryDO, tt.answerDO, ttl, tt.want)
+		}
+	}
+}
@@ -0,0 +1,167 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var cntPAC = expvar.NewInt("statsPACServed")
+
+// pacFile is the blocked names part of the proxy auto-config file, built
+// from a rule set with some lists disabled.
+type pacFile struct {
+	rs       *ruleSet
+	disabled [len(disabledBits)]uint64
+	names    []byte // the JavaScript object of the blocked names
+	count    int    // names in it
+	omitted  int    // names left out for -pac-max-size
+}
+
+// pac is the last built pacFile, guarded by pacMu, which is also held while
+// building one.
+var (
+	pac   *pacFile
+	pacMu sync.Mutex
+)
+
+func init() {
+	expvar.Publish("pac", expvar.Func(func() interface{} {
+		pacMu.Lock()
+		defer pacMu.Unlock()
+		if pac == nil {
+			return nil
+		}
+		return map[string]int{"names": pac.count, "omitted": pac.omitted, "bytes": len(pac.names)}
+	}))
+}
+
+// currentPAC returns the pacFile of the current rules, building it again if
+// the rules were reloaded or lists disabled or enabled since the last one.
+func currentPAC() *pacFile {
+	rs := currentRules()
+	var bits [len(disabledBits)]uint64
+	for i := range disabledBits {
+		bits[i] = disabledBits[i].Load()
+	}
+	pacMu.Lock()
+	defer pacMu.Unlock()
+	if pac == nil || pac.rs != rs || pac.disabled != bits {
+		start := time.Now()
+		pac = buildPAC(rs, *flagPACSize)
+		pac.disabled = bits
+		log.Printf("HTTP: Built proxy.pac with %d names (%d left out) in %s\n",
+			pac.count, pac.omitted, time.Since(start).Round(time.Millisecond))
+	}
+	return pac
+}
+
+// buildPAC collects the blocked names and top level domains of rs, leaving
+// out names already covered by a blocked parent domain. If they don't fit in
+// max bytes the names with the fewest labels are kept, as they cover the
+// most. Substring rules can't be expressed and are left out.
+func buildPAC(rs *ruleSet, max int) *pacFile {
+	has := func(name string) bool {
+		if src, ok := rs.blocked[name]; ok {
+			_, ok = rs.activeSource("", name, src)
+			return ok
+		}
+		src, ok := rs.tlds[name]
+		if ok {
+			_, ok = rs.activeSource("*.", name, src)
+		}
+		return ok
+	}
+	covered := func(name string) bool {
+		i := strings.IndexByte(name, '.')
+		return i < len(name)-1 && findZone(name[i+1:], has) != ""
+	}
+	var names []string
+	for name, src := range rs.blocked {
+		if _, ok := rs.activeSource("", name, src); ok && !covered(name) {
+			names = append(names, strings.TrimSuffix(name, "."))
+		}
+	}
+	for name, src := range rs.tlds {
+		if _, ok := rs.activeSource("*.", name, src); ok {
+			names = append(names, strings.TrimSuffix(name, "."))
+		}
+	}
+	sort.Slice(names, func(i, j int) bool {
+		a, b := strings.Count(names[i], "."), strings.Count(names[j], ".")
+		if a != b {
+			return a < b
+		}
+		return names[i] < names[j]
+	})
+
+	p := &pacFile{rs: rs}
+	var buf bytes.Buffer
+	buf.WriteString("var blocked = {")
+	for i, name := range names {
+		if buf.Len()+len(name)+8 > max {
+			p.omitted = len(names) - i
+			break
+		}
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		if i%8 == 0 {
+			buf.WriteByte('\n')
+		}
+		fmt.Fprintf(&buf, "%q:1", name)
+		p.count++
+	}
+	buf.WriteString("\n};\n")
+	p.names = buf.Bytes()
+	return p
+}
+
+// pacFunc is FindProxyForURL, which walks up the domains of the host the way
+// the DNS server does.
+const pacFunc = `
+function FindProxyForURL(url, host) {
+	host = host.toLowerCase();
+	for (;;) {
+		if (blocked.hasOwnProperty(host)) {
+			return "PROXY %s";
+		}
+		var i = host.indexOf(".");
+		if (i < 0) {
+			return "DIRECT";
+		}
+		host = host.substring(i + 1);
+	}
+}
+`
+
+// handlePAC serves the proxy auto-config file, at /proxy.pac and for WPAD
+// at /wpad.dat. Blocked hosts are sent to the pixel server as their proxy,
+// at the address the PAC file was fetched from, where HTTPS fails quickly.
+func handlePAC(w http.ResponseWriter, req *http.Request) {
+	proxy := req.Host
+	if addr, ok := req.Context().Value(http.LocalAddrContextKey).(net.Addr); ok {
+		proxy = addr.String()
+	}
+	p := currentPAC()
+	cntPAC.Add(1)
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	fmt.Fprintf(w, "// Generated by adhole from the block lists, %d names left out.\n", p.omitted)
+	w.Write(p.names)
+	fmt.Fprintf(w, pacFunc, proxy)
+}
+
+// isWPAD reports whether name, in lower case with a trailing dot, is one
+// clients look up to find the WPAD proxy configuration, e.g. wpad.home.
+func isWPAD(name string) bool {
+	return strings.HasPrefix(name, "wpad.")
+}
@@ -0,0 +1,49 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// checkPidFile refuses to start if the PID file at path belongs to a running
+// adhole. Stale files are left to be overwritten by writePidFile.
+func checkPidFile(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil || pid <= 0 || pid == os.Getpid() {
+		return nil
+	}
+	if !processAlive(pid) {
+		return nil
+	}
+	// Where the command name is available make sure the PID wasn't reused by
+	// something else, otherwise play safe.
+	if comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid)); err == nil &&
+		!strings.Contains(string(comm), "adhole") {
+		return nil
+	}
+	return fmt.Errorf("already running with PID %d (see %s)", pid, path)
+}
+
+// writePidFile writes the PID of this process to path.
+func writePidFile(path string) error {
+	return os.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+}
+
+// removePidFile removes the PID file at path if it is still ours.
+func removePidFile(path string) {
+	data, err := os.ReadFile(path)
+	if err == nil && strings.TrimSpace(string(data)) == strconv.Itoa(os.Getpid()) {
+		os.Remove(path)
+	}
+}
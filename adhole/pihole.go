@@ -0,0 +1,359 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Pi-hole keeps its lists in gravity.db, an SQLite database, and its local
+// DNS records in custom.list. It used to keep the lists in the other files,
+// which are read if there is no database.
+const (
+	piholeGravity    = "gravity.db"
+	piholeAdlists    = "adlists.list"         // list URLs
+	piholeBlack      = "blacklist.txt"        // exact names to block
+	piholeWhite      = "whitelist.txt"        // exact names to allow
+	piholeRegex      = "regex.list"           // regular expressions to block
+	piholeWhiteRegex = "whitelist-regex.list" // regular expressions to allow
+	piholeLocal      = "custom.list"          // local DNS records: "ip name"
+)
+
+// Pi-hole's domainlist types.
+const (
+	piholeExactAllow = 0
+	piholeExactDeny  = 1
+	piholeRegexAllow = 2
+	piholeRegexDeny  = 3
+)
+
+// piholeImport is what was found in a Pi-hole directory.
+type piholeImport struct {
+	urls    []string
+	block   []string // list lines
+	local   []string // list lines
+	allow   []string // override names
+	skipped []string // what couldn't be imported, and why
+}
+
+// runImportPihole runs the import-pihole subcommand: it turns the lists of
+// a Pi-hole into AdHole list and overrides files, and prints the command
+// line using them. It returns the exit code.
+func runImportPihole(args []string) int {
+	fs := flag.NewFlagSet("import-pihole", flag.ContinueOnError)
+	out := fs.String("out", ".", "directory to write pihole-block.txt, pihole-local.txt and pihole-overrides.txt to")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s import-pihole [options] /etc/pihole\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 1
+	}
+	dir := fs.Arg(0)
+
+	imp, found, err := readPihole(dir, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return 2
+	}
+	if !found {
+		fmt.Fprintf(os.Stderr, "ERROR: No Pi-hole lists in %s\n", dir)
+		return 2
+	}
+	for _, s := range imp.skipped {
+		fmt.Fprintf(os.Stderr, "WARN: %s\n", s)
+	}
+
+	cmd := []string{os.Args[0]}
+	var lists []string
+	for _, f := range []struct {
+		name  string
+		lines []string
+	}{
+		{"pihole-block.txt", imp.block},
+		{"pihole-local.txt", imp.local},
+		{"pihole-overrides.txt", imp.allow},
+	} {
+		if len(f.lines) == 0 {
+			continue
+		}
+		path := filepath.Join(*out, f.name)
+		header := "# Imported from the Pi-hole in " + dir + "\n"
+		if err := os.WriteFile(path, []byte(header+strings.Join(f.lines, "\n")+"\n"), 0644); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			return 2
+		}
+		fmt.Fprintf(os.Stderr, "%s: %d lines\n", path, len(f.lines))
+		if f.name == "pihole-overrides.txt" {
+			cmd = append(cmd, "-overrides", path)
+		} else {
+			lists = append(lists, path)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "%d list URLs, %d lines skipped. Run AdHole with:\n\n", len(imp.urls), len(imp.skipped))
+	cmd = append(cmd, "KEY", "UPSTREAM", "PROXY")
+	cmd = append(cmd, imp.urls...)
+	fmt.Println(strings.Join(append(cmd, lists...), " "))
+	return 0
+}
+
+// readPihole reads the Pi-hole lists in dir: from the database at db, or
+// gravity.db if db is "", else from the older files if there is no
+// database, and the local DNS records. found is false if there are none of
+// them.
+func readPihole(dir, db string) (imp *piholeImport, found bool, err error) {
+	imp = new(piholeImport)
+	read := func(name string, fn func(line string) error) error {
+		f, err := os.Open(filepath.Join(dir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		defer f.Close()
+		found = true
+		scanner := bufio.NewScanner(f)
+		for n := 1; scanner.Scan(); n++ {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || line[0] == '#' {
+				continue
+			}
+			if err := fn(line); err != nil {
+				imp.skip(fmt.Sprintf("%s line %d", name, n), err, line)
+			}
+		}
+		return scanner.Err()
+	}
+
+	if db == "" {
+		db = filepath.Join(dir, piholeGravity)
+	}
+	if fileExists(db) {
+		found = true
+		err = imp.readGravity(db)
+	} else {
+		err = errors.Join(
+			read(piholeAdlists, func(line string) error { return imp.addURL(strings.Fields(line)[0]) }),
+			read(piholeBlack, imp.addBlock),
+			read(piholeWhite, imp.addAllow),
+			read(piholeRegex, func(line string) error { return imp.addRegex(line, true) }),
+			read(piholeWhiteRegex, func(line string) error { return imp.addRegex(line, false) }),
+		)
+	}
+	err = errors.Join(err, read(piholeLocal, func(line string) error {
+		fields := strings.Fields(line)
+		if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+			return errors.New("not 'ip name'")
+		}
+		for _, name := range fields[1:] {
+			if !validName(name) {
+				return errors.New("bad name")
+			}
+			imp.local = append(imp.local, "address=/"+name+"/"+fields[0])
+		}
+		return nil
+	}))
+	if fileExists(filepath.Join(dir, "..", "dnsmasq.d", "05-pihole-custom-cname.conf")) {
+		imp.skipped = append(imp.skipped, "local CNAME records in dnsmasq.d/05-pihole-custom-cname.conf are not supported")
+	}
+	return imp, found, err
+}
+
+// readGravity reads the enabled adlists and domainlist entries of the
+// gravity.db at path, whichever groups they are in.
+func (imp *piholeImport) readGravity(path string) error {
+	db, err := openSQLite(path)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	if fi, err := os.Stat(path + "-wal"); err == nil && fi.Size() > 0 {
+		imp.skipped = append(imp.skipped, filepath.Base(path)+"-wal: changes not yet written to the database are not read")
+	}
+	name := filepath.Base(path)
+	err = db.rows("adlist", func(row map[string]any) error {
+		if address, _ := row["address"].(string); row["enabled"] != int64(0) {
+			if err := imp.addURL(address); err != nil {
+				imp.skip(fmt.Sprintf("%s adlist id %v", name, row["id"]), err, address)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	err = db.rows("domainlist", func(row map[string]any) error {
+		domain, _ := row["domain"].(string)
+		if row["enabled"] == int64(0) {
+			return nil
+		}
+		var err error
+		switch kind, _ := row["type"].(int64); kind {
+		case piholeExactAllow:
+			err = imp.addAllow(domain)
+		case piholeExactDeny:
+			err = imp.addBlock(domain)
+		case piholeRegexAllow:
+			err = imp.addRegex(domain, false)
+		case piholeRegexDeny:
+			err = imp.addRegex(domain, true)
+		default:
+			err = fmt.Errorf("unknown type %d", kind)
+		}
+		if err != nil {
+			imp.skip(fmt.Sprintf("%s domainlist id %v", name, row["id"]), err, domain)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+	return nil
+}
+
+// skip notes that line, found where, couldn't be imported because of err.
+func (imp *piholeImport) skip(where string, err error, line string) {
+	imp.skipped = append(imp.skipped, fmt.Sprintf("%s: %s '%s'", where, err, line))
+}
+
+// addURL adds an adlist URL.
+func (imp *piholeImport) addURL(url string) error {
+	if !isRemote(url) {
+		return errors.New("not a URL")
+	}
+	imp.urls = append(imp.urls, url)
+	return nil
+}
+
+// addBlock adds a blacklisted name.
+func (imp *piholeImport) addBlock(name string) error {
+	if !validName(name) {
+		return errors.New("bad name")
+	}
+	imp.block = append(imp.block, name)
+	return nil
+}
+
+// addAllow adds a whitelisted name.
+func (imp *piholeImport) addAllow(name string) error {
+	if !validName(name) {
+		return errors.New("bad name")
+	}
+	imp.allow = append(imp.allow, name)
+	return nil
+}
+
+// addRegex adds the rule for a regular expression blocking or allowing
+// names.
+func (imp *piholeImport) addRegex(re string, block bool) error {
+	rule, err := piholeRegexRule(re, block)
+	if err != nil {
+		return err
+	}
+	if block {
+		imp.block = append(imp.block, rule)
+	} else {
+		imp.allow = append(imp.allow, rule)
+	}
+	return nil
+}
+
+// loadPihole reads the Pi-hole database at path for -pihole-db, with the
+// local DNS records next to it, and adds its adlists and itself to the
+// lists.
+func loadPihole(path string) (*piholeImport, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	imp, _, err := readPihole(filepath.Dir(path), path)
+	if err != nil {
+		return nil, err
+	}
+	lists = append(lists, imp.urls...)
+	lists = append(lists, path)
+	return imp, nil
+}
+
+// piholeList writes the blacklist, the regular expressions and the local
+// DNS records of the Pi-hole database at path to a temporary list file,
+// and returns its name.
+func piholeList(path string) (string, error) {
+	imp, _, err := readPihole(filepath.Dir(path), path)
+	if err != nil {
+		return "", err
+	}
+	file, err := os.CreateTemp("", "adhole-pihole-")
+	if err != nil {
+		return "", err
+	}
+	w := bufio.NewWriter(file)
+	for _, line := range append(imp.block, imp.local...) {
+		w.WriteString(line)
+		w.WriteByte('\n')
+	}
+	err = w.Flush()
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// piholeRegexRule turns a Pi-hole regular expression into a list line, if
+// it is one of the few that mean a rule AdHole has: a name and its
+// subdomains, (^|\.)example\.com$, also for ^example\.com$ as AdHole can't
+// leave the subdomains out, a top level domain, \.zip$, or a substring,
+// adserver. Only names and their subdomains can be allowed.
+func piholeRegexRule(re string, block bool) (string, error) {
+	unsupported := errors.New("unsupported regular expression")
+	for _, prefix := range []string{`(^|\.)`, `(\.|^)`, `^`} {
+		if rest, ok := strings.CutPrefix(re, prefix); ok {
+			name, ok := regexLiteral(strings.TrimSuffix(rest, "$"))
+			if !ok || !strings.HasSuffix(rest, "$") || !validName(name) {
+				return "", unsupported
+			}
+			return name, nil
+		}
+	}
+	if !block {
+		return "", unsupported
+	}
+	if rest, ok := strings.CutPrefix(re, `\.`); ok && strings.HasSuffix(rest, "$") {
+		if tld, ok := regexLiteral(strings.TrimSuffix(rest, "$")); ok && validTLD(tld) {
+			return "tld:" + tld, nil
+		}
+	}
+	if substr, ok := regexLiteral(re); ok && validName("x"+substr) {
+		return "contains:" + substr, nil
+	}
+	return "", unsupported
+}
+
+// regexLiteral returns the string a regular expression without special
+// characters other than escaped dots matches.
+func regexLiteral(re string) (string, bool) {
+	if strings.ContainsAny(strings.ReplaceAll(re, `\.`, ""), `\.^$*+?()[]{}|`) {
+		return "", false
+	}
+	return strings.ReplaceAll(re, `\.`, "."), re != ""
+}
+
+// fileExists reports whether there is a file at path.
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
@@ -0,0 +1,281 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// gravityDB is a gzipped gravity.db with 512 byte pages, made by sqlite3
+// with Pi-hole's schema, of these adlists:
+//
+//	1 https://example.com/hosts.txt
+//	2 https://example.org/ads.txt
+//	3 https://example.net/off.txt, disabled
+//	4 /etc/hosts.local
+//
+// and domainlist entries, the last of them with a 1500 byte comment of x's
+// that spills over to overflow pages:
+//
+//	1 deny  ads.example.com
+//	2 allow cdn.example.com
+//	3 deny  off.example.com, disabled
+//	4 deny  (^|\.)tracker\.example$
+//	5 deny  \.zip$
+//	6 deny  doubleclick
+//	7 deny  ^ad[0-9]+\.
+//	8 allow (^|\.)good\.example$
+//	9 deny  long.example.com
+//	10-69 deny ad0.example.net to ad59.example.net
+//
+// It also has a gravity table of 20 names, which isn't read.
+const gravityDB = "" +
+	"1f8b0800000000000203ed5a5b6c235719fe7f8f93d8b93b9775b3379f34c9c6" +
+	"5e3bcecdce65b3ed6e2eb3abd034bb9b4d104b9706d776120b5fd278b2cd9682" +
+	"0408905a5124784042a252fbb4aa5025a48a5608f1c2434581bec00b3c94070a" +
+	"0f5c248ab80878e19c993999f3674fc2aa456ab5f52f793cf39d6fce9cfffbff" +
+	"39e7d7b1af5f5b2a5879b651d929652c360e3e40848b8c01401dff1c03cffcee" +
+	"471ac2ffb63a48665174e4c37f88eb20fec739a9d9076cf576387d2de2888b80" +
+	"6fe10b58e627357b6fd6e76f82a1a09fab1a080486f3567678ab52b5aac96225" +
+	"9b29e6afbf0be293349a603ee092b62c6bbb7a6e7838bf97296d17f3c972de1a" +
+	"ae6c6c24ad3d6b9fefe3fce021fccacee670265755f923d804970fe3672b2577" +
+	"4cca1d8d76fc9f05fc23be892ff3939a7d401631e6f18810fb74ed4aca18ccb8" +
+	"1c3c32e45dc6101e4c4cbf78ff7dd00a30230e715f7df8420f42a19ccbef559f" +
+	"2cf2a5613db36b55ecebf54cae58a85aeba3ceb7f1a5396c08f7f4e057d6adcc" +
+	"13c5bc833a47dffc8a39bb6ab2d5d9b9259339188b16726c7179d5bc6caeb0ab" +
+	"2b8b8fceaedc608f9837d8ecdaea95c5657ec7a3e6f26a82b3733bf96a95ad9a" +
+	"9f58656bcb8bd7d64cb67c65952daf2d2d2558be2c9e95637357ae2c99b3cbfb" +
+	"2d6cc1bc34bbb6b4ca46132c9711c3cee5f2def3eea245b399aa15ad5a3b1b56" +
+	"a1948f0e0e5407136cb05c796a30c6325556285bb198db53a9922b6c14de7f67" +
+	"3c18a57cd9b21d73bbdedd165ffb3d275879b7f4447ee7f0278d24786fb732c5" +
+	"426e3d5729650ae5ea915c1e0f6bf7284acc8e3fbe03f8377ea8d97d69ad3ea3" +
+	"179d74112fa2d988460f3a2fa5fbfe4f00be0213b8800bf7d6e31777fd0de1de" +
+	"5efc72da7ef5bdbebdb306320578f8bd4e03d6ededfc91b9ed74e94c13f7e1fc" +
+	"e0cc7c51c74b478e58ecaa511f8ec7f186adba3b3f57f34feee6cbd983977544" +
+	"ff038dd172a6944ff0ab589dbdfeff4904b543d4e6f8ae7351b3fbd24253fcd0" +
+	"7e961fda4e8a99a1d5c78f06be2ada8ee1eff167ce69cd3ee4d6dde98f0783a2" +
+	"34544a3d8e7775fb87827c6e4fa5924a8d38c15b3add9631d2f2a0b3fe5f05fc" +
+	"293fd4ec7ddbedfa86f08913f885457b8adedcc9dc2a58b7ddaf463225bb208b" +
+	"ea1732b7d82e68969515f392b9622ecf9bd795d23a161bafab0f5fee3dac78f7" +
+	"56e0f551ef3c20e2df054f03fe197f8d6fe0abf8223e8f9fc52d5cc3394ce271" +
+	"ac87bfc2dbf0267c1f5e82e739f1ff661d5d463cb8393aad667047a78d4d11ac" +
+	"c3c6260916b2b10982b5db589a606d36962258ab8d8d13acc5c6c608d66c63a3" +
+	"046bb2b111150b351ab1e0267123141410f1221410107122d42020e243a85e40" +
+	"c485509d80880721bf80880321434064fc219f80c8f04328a091037346f35ecd" +
+	"3eb2c6e3df5253e1231d7fa8a970bf47f87013eb7f2bf403fe067f84dfc12a7e" +
+	"12cfe369f827fc04eec05761034ce88fb406201817dbcabcb054ab47b9891c69" +
+	"f108e35a42b34718d3129a3cc2a896d0e811467484e73e170c4250ecc07fcb2c" +
+	"56ca9bea222739fb82340d04028069d19d2ffaf8333793b1cd4a257753ded32f" +
+	"6f38d9c0697d82663c9ec93d363234fda93867c9d6fafdd65c6597977bd96221" +
+	"fb19d91aaee3ad3d76ebcde4d385edfd4ea37ede30633738cfb67632fcb69dbb" +
+	"1f1f3184d3e2f702b1c9ab7128e20b40c056259b2b6b09e8c956d5119cf8c764" +
+	"fc9fc1c7701ac3f077f8057c0fbe0e257884370a6327038ebc224253ba08b013" +
+	"0a6352cb38ae3026b48c1e8591d6321e5018da6c646185a14d47764c6168f391" +
+	"752b0c6d42b22e85a1cdc848a7a7fdb496d0e111b48a46421e412b68a4dd2368" +
+	"f58cb47904ad9cfbefffdbf843fc36eee1c731851df017780bbe0bcfc2165c82" +
+	"7e76d673755c2f574c61e8e58a2a0cad5c6cd0638c69f5626714863e05071486" +
+	"3e05fb15863e05fb14863e051f5418fa14ec5518fa14640a43af694461e8353d" +
+	"ad30f49a9e529274fa3dc77fcaeb25a5d76c5261e8359b50187acdd20a43af59" +
+	"4a61e8351b57187acdc614865eb3512553f57938a230f47938ac30f479985418" +
+	"7a4d8714865ed384c2d06b1a5718e387c5bf8507f988f8df8331d37b4e5aafd9" +
+	"82c2d06b36af30f49acd290cbd66b30a43afd94585a1d7ec82c2d0e7e1c30a43" +
+	"9f870f290c7d1e9e5718fa3c9c513255afe93985a1d7745a61683515bfff7743" +
+	"1af077f806fe00efe037f1f3b8852bbc0a3c83edf06f788767c2ebf0127c0d9e" +
+	"820caf06d2e206772b91a8d32b51a208932851212251e2f9e92e7fdc4655b0d9" +
+	"a5d2e9eb944489db27254a5c3d21519232c7254ad2a447a224351e902871382c" +
+	"5132de6312250e774b9438dce53a4ca84d2e48988d217f1fa252831a0dcdfe1e" +
+	"44a7b234ea4ef967100fa9260dff717f5ab6d23ad71770e29f02fc25afffeee0" +
+	"377805b889d7700607b00dfe05bf859fc36bf0223c07b7e0d3f03148e11ff6c3" +
+	"4fa7e094448933e31225de8cb92e12915b5d2a9d7347254a023d225112e86189" +
+	"924027254a023d24513286844449a0e312250e9f952871382651e270d4759874" +
+	"db225f02e2f0a04489c367244a1c1e902871b85fa2c4e13e1909328674230f68" +
+	"174cfaee21fe19588249117fb165ecf84346dee98264e01d2e48c61d724132ec" +
+	"76778074fd30254a7a5d9028e9765ea2a4df3989123966254ae27f51a244a40b" +
+	"1225f17f58a224fe0f4994c4ffbceb3019429b8c08717846a2c4e17312250e4f" +
+	"4b94383c2551f2b4497ba3ff2e73fefff58af8ffd7aff0c7fca4661f62b3d3e8" +
+	"c05e806187fbe09647d05e30946d09a39edf1cc003fb04beff02e30b83fa002c" +
+	"0000"
+
+// writeGravity writes gravityDB to a Pi-hole directory, and returns the
+// directory.
+func writeGravity(tb testing.TB) string {
+	tb.Helper()
+	data, err := hex.DecodeString(gravityDB)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	db, err := io.ReadAll(zr)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	dir := tb.TempDir()
+	if err := os.WriteFile(filepath.Join(dir, piholeGravity), db, 0644); err != nil {
+		tb.Fatal(err)
+	}
+	return dir
+}
+
+// The rows of a table come in rowid order, with the INTEGER PRIMARY KEY
+// column holding the rowid, and values spilled to overflow pages whole.
+func TestSQLiteRows(t *testing.T) {
+	db, err := openSQLite(filepath.Join(writeGravity(t), piholeGravity))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	var ids []int64
+	var domains []string
+	err = db.rows("domainlist", func(row map[string]any) error {
+		id, _ := row["id"].(int64)
+		ids = append(ids, id)
+		domain, _ := row["domain"].(string)
+		domains = append(domains, domain)
+		if comment, _ := row["comment"].(string); id == 9 && comment != strings.Repeat("x", 1500) {
+			t.Errorf("comment of %d bytes", len(comment))
+		} else if id != 9 && row["comment"] != nil {
+			t.Errorf("id %d: comment %v", id, row["comment"])
+		}
+		if row["date_added"] != int64(1700000000) {
+			t.Errorf("id %d: date_added %v", id, row["date_added"])
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 69 {
+		t.Fatalf("%d rows, want 69", len(ids))
+	}
+	for i, id := range ids {
+		if id != int64(i+1) {
+			t.Fatalf("row %d has id %d", i, id)
+		}
+	}
+	if domains[0] != "ads.example.com" || domains[68] != "ad59.example.net" {
+		t.Errorf("domains %q ... %q", domains[0], domains[68])
+	}
+	if err := db.rows("group", func(map[string]any) error { return nil }); err == nil {
+		t.Error("missing table read")
+	}
+}
+
+// A corrupt database is an error, never a panic or a hang.
+func TestSQLiteCorrupt(t *testing.T) {
+	path := filepath.Join(writeGravity(t), piholeGravity)
+	good, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for off := 0; off < len(good); off += 17 {
+		for _, data := range [][]byte{good[:off], append(append(append([]byte(nil), good[:off]...), good[off]^0xff), good[off+1:]...)} {
+			if err := os.WriteFile(path, data, 0644); err != nil {
+				t.Fatal(err)
+			}
+			db, err := openSQLite(path)
+			if err != nil {
+				continue
+			}
+			for _, table := range []string{"adlist", "domainlist"} {
+				db.rows(table, func(map[string]any) error { return nil })
+			}
+			db.Close()
+		}
+	}
+}
+
+// The enabled entries of gravity.db are imported, and what AdHole has no
+// rule for is reported, along with the local DNS records of custom.list.
+func TestReadGravity(t *testing.T) {
+	dir := writeGravity(t)
+	if err := os.WriteFile(filepath.Join(dir, piholeLocal), []byte("192.168.1.10 nas.lan\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	// Ignored next to the database.
+	if err := os.WriteFile(filepath.Join(dir, piholeBlack), []byte("old.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	imp, found, err := readPihole(dir, "")
+	if err != nil || !found {
+		t.Fatal(found, err)
+	}
+	block := []string{"ads.example.com", "tracker.example", "tld:zip", "contains:doubleclick", "long.example.com"}
+	for i := 0; i < 60; i++ {
+		block = append(block, fmt.Sprintf("ad%d.example.net", i))
+	}
+	for _, tt := range []struct {
+		what      string
+		got, want []string
+	}{
+		{"urls", imp.urls, []string{"https://example.com/hosts.txt", "https://example.org/ads.txt"}},
+		{"block", imp.block, block},
+		{"allow", imp.allow, []string{"cdn.example.com", "good.example"}},
+		{"local", imp.local, []string{"address=/nas.lan/192.168.1.10"}},
+		{"skipped", imp.skipped, []string{
+			"gravity.db adlist id 4: not a URL '/etc/hosts.local'",
+			"gravity.db domainlist id 7: unsupported regular expression '^ad[0-9]+\\.'",
+		}},
+	} {
+		if !reflect.DeepEqual(tt.got, tt.want) {
+			t.Errorf("%s:\n got %q\nwant %q", tt.what, tt.got, tt.want)
+		}
+	}
+}
+
+// With -pihole-db the database is a list of its own, its adlists are
+// added, and its whitelist allows names.
+func TestPiholeDB(t *testing.T) {
+	path := filepath.Join(writeGravity(t), piholeGravity)
+	withFlag(t, flagPiholeDB, path)
+	withLogBuffer(t, 0)
+	withFlag(t, &lists, nil)
+	withFlag(t, &allowed, &whitelist{entries: make(map[string]time.Time)})
+	imp, err := loadPihole(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(imp.urls, path); !reflect.DeepEqual(lists, want) {
+		t.Errorf("lists %q, want %q", lists, want)
+	}
+	rs, files, err := loadLists([]string{path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 || files[0].Name != "gravity" || files[0].FromCache {
+		t.Errorf("list files %+v", files)
+	}
+	for _, tt := range []struct {
+		name  string
+		block bool
+	}{
+		{"ads.example.com.", true},
+		{"x.tracker.example.", true},
+		{"archive.zip.", true},
+		{"ad42.example.net.", true},
+		{"cdn.example.com.", false},
+		{"off.example.com.", false},
+	} {
+		if _, _, block := rs.matchCached(tt.name); block != tt.block {
+			t.Errorf("%s blocked: %v, want %v", tt.name, block, tt.block)
+		}
+	}
+	allowed.allowFixed(imp.allow)
+	for _, name := range []string{"cdn.example.com.", "www.good.example."} {
+		if !allowed.contains(name) {
+			t.Errorf("%s not allowed", name)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+// See LICENSE.txt for licensing information.
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"unsafe"
+)
+
+// pktinfoSupported tells if the destination address of queries is known,
+// so that wildcard listeners can answer with the address they were asked at.
+const pktinfoSupported = batchSupported
+
+// pktinfoSpace is the size of the control buffer for an IP_PKTINFO message.
+var pktinfoSpace = syscall.CmsgSpace(syscall.SizeofInet4Pktinfo)
+
+// enablePktinfo asks the kernel to report the destination address of each
+// packet read from conn.
+func enablePktinfo(conn *net.UDPConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var serr error
+	err = raw.Control(func(fd uintptr) {
+		serr = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_PKTINFO, 1)
+	})
+	if err != nil {
+		return err
+	}
+	return serr
+}
+
+// parsePktinfo returns the destination address from the control messages
+// in oob, or nil if there is none.
+func parsePktinfo(oob []byte) net.IP {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil
+	}
+	for _, m := range msgs {
+		if m.Header.Level != syscall.IPPROTO_IP || m.Header.Type != syscall.IP_PKTINFO ||
+			len(m.Data) < syscall.SizeofInet4Pktinfo {
+			continue
+		}
+		info := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&m.Data[0]))
+		// The header destination is what the client asked, unless it was
+		// a broadcast, then the interface's address will do.
+		ip := net.IPv4(info.Addr[0], info.Addr[1], info.Addr[2], info.Addr[3]).To4()
+		if !ip.IsGlobalUnicast() && !ip.IsLoopback() {
+			ip = net.IPv4(info.Spec_dst[0], info.Spec_dst[1], info.Spec_dst[2], info.Spec_dst[3]).To4()
+		}
+		return ip
+	}
+	return nil
+}
+
+// pktinfoSource returns a control message making a packet go out from src.
+func pktinfoSource(src net.IP) []byte {
+	oob := make([]byte, pktinfoSpace)
+	h := (*syscall.Cmsghdr)(unsafe.Pointer(&oob[0]))
+	h.Level = syscall.IPPROTO_IP
+	h.Type = syscall.IP_PKTINFO
+	h.SetLen(syscall.CmsgLen(syscall.SizeofInet4Pktinfo))
+	info := (*syscall.Inet4Pktinfo)(unsafe.Pointer(&oob[syscall.CmsgLen(0)]))
+	copy(info.Spec_dst[:], src.To4())
+	return oob
+}
@@ -0,0 +1,24 @@
+// See LICENSE.txt for licensing information.
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// pktinfoSupported tells if the destination address of queries is known,
+// so that wildcard listeners can answer with the address they were asked at.
+const pktinfoSupported = false
+
+// enablePktinfo is not supported on this platform.
+func enablePktinfo(conn *net.UDPConn) error {
+	return errors.New("IP_PKTINFO is not supported on this platform")
+}
+
+// pktinfoSource is not supported on this platform.
+func pktinfoSource(src net.IP) []byte {
+	return nil
+}
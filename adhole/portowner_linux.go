@@ -0,0 +1,65 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// portOwner returns the name and PID of the process with a proto ("udp" or
+// "tcp") socket bound to port, or "" if it can't be found out, e.g. when the
+// process belongs to another user.
+func portOwner(proto string, port int) string {
+	inodes := make(map[string]bool)
+	for _, file := range []string{"/proc/net/" + proto, "/proc/net/" + proto + "6"} {
+		socketInodes(file, proto == "tcp", port, inodes)
+	}
+	if len(inodes) == 0 {
+		return ""
+	}
+	fds, _ := filepath.Glob("/proc/[0-9]*/fd/*")
+	for _, fd := range fds {
+		link, err := os.Readlink(fd)
+		if err != nil || !strings.HasPrefix(link, "socket:[") {
+			continue
+		}
+		if !inodes[strings.TrimSuffix(strings.TrimPrefix(link, "socket:["), "]")] {
+			continue
+		}
+		dir := filepath.Dir(filepath.Dir(fd))
+		comm, _ := os.ReadFile(filepath.Join(dir, "comm"))
+		return fmt.Sprintf("%s (pid %s)", strings.TrimSpace(string(comm)), filepath.Base(dir))
+	}
+	return ""
+}
+
+// socketInodes adds the inodes of the sockets bound to port listed in a
+// /proc/net file to inodes. With listen only listening TCP sockets count.
+func socketInodes(file string, listen bool, port int, inodes map[string]bool) {
+	f, err := os.Open(file)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	s.Scan() // header
+	for s.Scan() {
+		// sl local_address rem_address st tx_queue:rx_queue tr:tm->when
+		// retrnsmt uid timeout inode ...
+		fields := strings.Fields(s.Text())
+		if len(fields) < 10 {
+			continue
+		}
+		i := strings.LastIndexByte(fields[1], ':')
+		p, err := strconv.ParseUint(fields[1][i+1:], 16, 16)
+		if err != nil || int(p) != port || listen && fields[3] != "0A" {
+			continue
+		}
+		inodes[fields[9]] = true
+	}
+}
@@ -0,0 +1,63 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestSocketInodes(t *testing.T) {
+	const udp = `  sl  local_address rem_address   st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode ref pointer drops
+  1: 0100007F:0035 00000000:0000 07 00000000:00000000 00:00000000 00000000     0        0 1001 2 0000000000000000 0
+  2: 00000000:14E9 00000000:0000 07 00000000:00000000 00:00000000 00000000   101        0 1002 2 0000000000000000 0
+`
+	const tcp = `  sl  local_address rem_address   st tx_queue rx_queue  tr tm->when retrnsmt   uid  timeout inode
+   0: 0100007F:0050 00000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 2001 1 0000000000000000 100 0 0 10 0
+   1: 0100007F:0050 0100007F:C350 01 00000000:00000000 00:00000000 00000000     0        0 2002 1 0000000000000000 20 4 30 10 -1
+`
+	const tcp6 = `  sl  local_address                         remote_address                        st tx_queue rx_queue tr tm->when retrnsmt   uid  timeout inode
+   0: 00000000000000000000000000000000:0050 00000000000000000000000000000000:0000 0A 00000000:00000000 00:00000000 00000000     0        0 3001 1 0000000000000000 100 0 0 10 0
+`
+	tests := []struct {
+		name   string
+		file   string
+		listen bool
+		port   int
+		want   string
+	}{
+		{"udp", udp, false, 53, "1001"},
+		{"udp other port", udp, false, 5353, "1002"},
+		{"udp free port", udp, false, 54, ""},
+		{"tcp listening only", tcp, true, 80, "2001"},
+		{"tcp any state", tcp, false, 80, "2001 2002"},
+		{"tcp6", tcp6, true, 80, "3001"},
+		{"garbled", "header\nnot a socket line\n", false, 53, ""},
+	}
+	for _, tt := range tests {
+		inodes := make(map[string]bool)
+		socketInodes(writeTemp(t, "net", tt.file), tt.listen, tt.port, inodes)
+		var got []string
+		for inode := range inodes {
+			got = append(got, inode)
+		}
+		sort.Strings(got)
+		if strings.Join(got, " ") != tt.want {
+			t.Errorf("%s: inodes %v, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// The process holding a port is found for sockets of this process.
+func TestPortOwner(t *testing.T) {
+	for _, proto := range []string{"udp", "tcp"} {
+		port, _ := occupy(t, proto)
+		if got, want := portOwner(proto, port), thisProcess(); got != want {
+			t.Errorf("%s port %d owned by %q, want %q", proto, port, got, want)
+		}
+	}
+	if got := portOwner("udp", 1); got != "" {
+		t.Errorf("free port owned by %q", got)
+	}
+}
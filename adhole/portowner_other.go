@@ -0,0 +1,10 @@
+// See LICENSE.txt for licensing information.
+//go:build !linux
+// +build !linux
+
+package main
+
+// portOwner is only implemented on Linux.
+func portOwner(proto string, port int) string {
+	return ""
+}
@@ -0,0 +1,121 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+)
+
+// preset is a well-known block list that can be given by name with -preset
+// rather than by its URL.
+type preset struct {
+	URL    string
+	Format string // what the list is in, for the presets subcommand only
+	About  string
+}
+
+// presets are the lists known by name, the built-in ones and those of
+// -presets-file, which replace built-in ones of the same name.
+var presets = map[string]preset{
+	"stevenblack": {"https://raw.githubusercontent.com/StevenBlack/hosts/master/hosts", "hosts", "StevenBlack's unified hosts: ads and malware"},
+	"oisd-small":  {"https://small.oisd.nl/", "adblock", "oisd small: the most used ad and tracking domains"},
+	"oisd-big":    {"https://big.oisd.nl/", "adblock", "oisd big: ads, tracking, malware and more, few false positives"},
+	"adaway":      {"https://adaway.org/hosts.txt", "hosts", "AdAway: mobile ads"},
+	"peterlowe":   {"https://pgl.yoyo.org/adservers/serverlist.php?hostformat=hosts&showintro=0&mimetype=plaintext", "hosts", "Peter Lowe's ad and tracking servers"},
+	"urlhaus":     {"https://urlhaus.abuse.ch/downloads/hostfile/", "hosts", "URLhaus: hosts spreading malware"},
+}
+
+// presetNames are the preset URLs given with -preset, to the preset names
+// their lists are called by instead of the URL's file name.
+var presetNames = make(map[string]string)
+
+// loadPresets adds the presets in the file at path to the built-in ones. A
+// line has a name, a URL and optionally the list format and a description;
+// empty lines and those starting with # are skipped.
+func loadPresets(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	scn := bufio.NewScanner(file)
+	for n := 1; scn.Scan(); n++ {
+		line := strings.TrimSpace(scn.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) < 2 || !isRemote(fields[1]) {
+			return fmt.Errorf("%s:%d: want a name and an http or https URL", path, n)
+		}
+		p := preset{URL: fields[1]}
+		if len(fields) > 2 {
+			p.Format = fields[2]
+		}
+		if len(fields) > 3 {
+			p.About = strings.Join(fields[3:], " ")
+		}
+		presets[fields[0]] = p
+	}
+	return scn.Err()
+}
+
+// resolvePresets returns the URLs of the comma separated preset names and
+// records what to call their lists.
+func resolvePresets(names string) ([]string, error) {
+	var urls []string
+	for _, name := range strings.Split(names, ",") {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		p, ok := presets[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown preset '%s', see '%s presets'", name, os.Args[0])
+		}
+		urls = append(urls, p.URL)
+		presetNames[p.URL] = name
+	}
+	return urls, nil
+}
+
+// runPresets runs the presets subcommand, which lists the presets and where
+// their lists come from. It returns the exit code.
+func runPresets(args []string) int {
+	fs := flag.NewFlagSet("presets", flag.ContinueOnError)
+	file := fs.String("presets-file", "", "file with more presets, as given to the server")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s presets [options]\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if *file == "" {
+		*file = os.Getenv(envName("presets-file"))
+	}
+	if *file != "" {
+		if err := loadPresets(*file); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+			return 2
+		}
+	}
+	names := make([]string, 0, len(presets))
+	for name := range presets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tw := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "NAME\tFORMAT\tDESCRIPTION\tURL")
+	for _, name := range names {
+		p := presets[name]
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", name, p.Format, p.About, p.URL)
+	}
+	tw.Flush()
+	return 0
+}
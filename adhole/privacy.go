@@ -0,0 +1,80 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"net"
+)
+
+// privacyKey is the per-run HMAC key used to pseudonymize client addresses,
+// so clients can be correlated within one run but not across runs.
+var privacyKey = make([]byte, 32)
+
+// setupPrivacy checks the -privacy mode and prepares the HMAC key.
+func setupPrivacy(mode string) error {
+	switch mode {
+	case "", "truncate":
+		return nil
+	case "hmac":
+		_, err := rand.Read(privacyKey)
+		return err
+	}
+	return fmt.Errorf("unknown privacy mode '%s'", mode)
+}
+
+// clientIP returns how a client address is shown in logs and statistics.
+func clientIP(ip net.IP) string {
+	switch *flagPrivacy {
+	case "hmac":
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		mac := hmac.New(sha256.New, privacyKey)
+		mac.Write(ip)
+		return "client-" + hex.EncodeToString(mac.Sum(nil)[:6])
+	case "truncate":
+		if ip4 := ip.To4(); ip4 != nil {
+			return ip4.Mask(net.CIDRMask(24, 32)).String() + "/24"
+		}
+		return ip.Mask(net.CIDRMask(48, 128)).String() + "/48"
+	}
+	return ip.String()
+}
+
+// clientAddr is clientIP for a UDP address, including the port when
+// privacy is off.
+func clientAddr(addr *net.UDPAddr) string {
+	if *flagPrivacy == "" {
+		return addr.String()
+	}
+	return clientIP(addr.IP)
+}
+
+// clientHTTP is clientIP for an HTTP request's RemoteAddr.
+func clientHTTP(remote string) string {
+	if *flagPrivacy == "" {
+		return remote
+	}
+	host, _, err := net.SplitHostPort(remote)
+	if err != nil {
+		host = remote
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return clientIP(ip)
+	}
+	return "-"
+}
+
+// logHost returns how a queried name is shown in logs. In privacy mode only
+// blocked (or otherwise refused) names are shown.
+func logHost(host string, blocked bool) string {
+	if *flagPrivacy != "" && !blocked {
+		return "-"
+	}
+	return escapeName(host)
+}
@@ -0,0 +1,105 @@
+// See LICENSE.txt for licensing information.
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestDropPrivilegesLookupErrors(t *testing.T) {
+	for _, tc := range []struct {
+		user, group string
+	}{
+		{"no-such-user-adhole", ""},
+		{"nobody", "no-such-group-adhole"},
+	} {
+		if err := dropPrivileges(tc.user, tc.group); err == nil {
+			t.Errorf("%s:%s: no error", tc.user, tc.group)
+		}
+	}
+}
+
+// dropEnv tells the test binary run by TestDropPrivileges to drop
+// privileges, with the path of a file only root can read.
+const dropEnv = "ADHOLE_TEST_DROP"
+
+// TestDropPrivileges drops privileges in a child process, as they can't be
+// regained, in the order the server does: sockets bound and files opened
+// first, then the drop. The child checks that what was opened before stays
+// usable and nothing can be opened as root after.
+func TestDropPrivileges(t *testing.T) {
+	if os.Getuid() != 0 {
+		t.Skip("needs root")
+	}
+	secret := filepath.Join(t.TempDir(), "secret.txt")
+	if err := os.WriteFile(secret, []byte("list\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(os.Args[0], "-test.run=^TestDropPrivilegesChild$", "-test.v")
+	cmd.Env = append(os.Environ(), dropEnv+"="+secret)
+	out, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("child failed: %s\n%s", err, out)
+	}
+}
+
+func TestDropPrivilegesChild(t *testing.T) {
+	secret := os.Getenv(dropEnv)
+	if secret == "" {
+		t.Skip("run by TestDropPrivileges")
+	}
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	list, err := os.Open(secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer list.Close()
+
+	if err := dropPrivileges("nobody", ""); err != nil {
+		t.Fatal(err)
+	}
+	if os.Getuid() == 0 || os.Geteuid() == 0 || os.Getgid() == 0 {
+		t.Fatalf("still root: uid %d euid %d gid %d", os.Getuid(), os.Geteuid(), os.Getgid())
+	}
+	if err := syscall.Setuid(0); err == nil {
+		t.Error("regained root")
+	}
+	if groups, _ := os.Getgroups(); len(groups) != 1 || groups[0] != os.Getgid() {
+		t.Errorf("supplementary groups %v", groups)
+	}
+	// Opened before the drop: still usable.
+	if data, err := io.ReadAll(list); err != nil || string(data) != "list\n" {
+		t.Errorf("reading the list opened before: %q, %v", data, err)
+	}
+	go func() {
+		if c, err := net.Dial("tcp4", ln.Addr().String()); err == nil {
+			c.Close()
+		}
+	}()
+	if c, err := ln.Accept(); err != nil {
+		t.Errorf("accepting on the socket bound before: %s", err)
+	} else {
+		c.Close()
+	}
+	// After the drop: root's files and low ports are out of reach.
+	if f, err := os.Open(secret); err == nil {
+		f.Close()
+		t.Error("opened the list as nobody")
+	}
+	if ln, err := net.Listen("tcp4", "127.0.0.1:1"); err == nil {
+		ln.Close()
+		t.Error("bound a low port as nobody")
+	}
+}
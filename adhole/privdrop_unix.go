@@ -0,0 +1,64 @@
+// See LICENSE.txt for licensing information.
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// dropPrivileges switches the process to the given user and group. It must be
+// called after all listeners have been bound and the list has been read.
+// An empty group means the user's primary group.
+func dropPrivileges(name, group string) error {
+	usr, err := user.Lookup(name)
+	if err != nil {
+		return err
+	}
+	uid, err := strconv.Atoi(usr.Uid)
+	if err != nil {
+		return err
+	}
+	gid, err := strconv.Atoi(usr.Gid)
+	if err != nil {
+		return err
+	}
+	if group != "" {
+		grp, err := user.LookupGroup(group)
+		if err != nil {
+			return err
+		}
+		if gid, err = strconv.Atoi(grp.Gid); err != nil {
+			return err
+		}
+	}
+
+	// Order matters: supplementary groups and gid can only be changed while
+	// we are still root.
+	if err := syscall.Setgroups([]int{gid}); err != nil {
+		return fmt.Errorf("setgroups: %s", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("setgid: %s", err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("setuid: %s", err)
+	}
+
+	// Verify the drop actually happened and can't be undone.
+	if os.Getuid() != uid || os.Geteuid() != uid || os.Getgid() != gid {
+		return errors.New("ids did not change")
+	}
+	if uid != 0 && syscall.Setuid(0) == nil {
+		return errors.New("still able to regain root")
+	}
+	log.Printf("Dropped privileges to %s (uid %d, gid %d)\n", name, uid, gid)
+	return nil
+}
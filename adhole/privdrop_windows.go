@@ -0,0 +1,14 @@
+// See LICENSE.txt for licensing information.
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"errors"
+)
+
+// dropPrivileges is not supported on Windows.
+func dropPrivileges(name, group string) error {
+	return errors.New("dropping privileges is not supported on Windows")
+}
@@ -0,0 +1,160 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runPrune runs the prune subcommand: it writes a copy of each list, as
+// list.pruned, without the lines whose blocking rules never matched
+// according to the state file. It returns the exit code.
+func runPrune(args []string) int {
+	fs := flag.NewFlagSet("prune", flag.ContinueOnError)
+	statefile := fs.String("statefile", "", "state file of the server that used the lists")
+	comment := fs.Bool("comment", false, "comment out unused lines instead of removing them")
+	since := fs.String("since", "0d", "only prune lists tracked for at least this long, e.g. 30d")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s prune [options] list.txt...\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	min, err := parseSince(*since)
+	if *statefile == "" || fs.NArg() == 0 || err != nil {
+		fs.Usage()
+		return 1
+	}
+	data, err := os.ReadFile(*statefile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return 2
+	}
+	var st state
+	if err := json.Unmarshal(data, &st); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s: %s\n", *statefile, err)
+		return 2
+	}
+
+	code := 0
+	for _, path := range fs.Args() {
+		usage, err := findUsage(st.RuleUsage, path)
+		if err == nil && time.Since(usage.since) < min {
+			err = fmt.Errorf("only tracked since %s", usage.since.Format(time.RFC3339))
+		}
+		if err == nil {
+			var kept, pruned int
+			kept, pruned, err = pruneList(path, usage, *comment)
+			if err == nil {
+				fmt.Fprintf(os.Stderr, "%s: %d lines pruned, %d kept, written to %s.pruned\n", path, pruned, kept, path)
+				continue
+			}
+		}
+		fmt.Fprintf(os.Stderr, "ERROR: %s: %s\n", path, err)
+		code = 2
+	}
+	return code
+}
+
+// findUsage returns the saved usage of the list at path, if its contents
+// are still the ones it was tracked for.
+func findUsage(m map[string]usageState, path string) (*listUsage, error) {
+	if isRemote(path) {
+		return nil, errors.New("remote lists can't be pruned")
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return nil, err
+	}
+	for _, st := range m {
+		if p, err := filepath.Abs(st.Path); err != nil || p != abs {
+			continue
+		}
+		hash, err := hashFile(path)
+		if err != nil {
+			return nil, err
+		}
+		if hash != st.Hash {
+			return nil, errors.New("changed since it was tracked")
+		}
+		u := newListUsage(st.Hash, len(st.Bits)*8)
+		u.restore(st)
+		return u, nil
+	}
+	return nil, errors.New("not in the state file")
+}
+
+// pruneList writes the pruned copy of the list at path. Lines with blocking
+// rules are dropped, or commented out, if none of them matched. All other
+// lines are kept as they are.
+func pruneList(path string, usage *listUsage, comment bool) (kept, pruned int, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	r, err := decompress(path, file)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer r.Close()
+	out, err := os.Create(path + ".pruned")
+	if err != nil {
+		return 0, 0, err
+	}
+	defer out.Close()
+	w := bufio.NewWriter(out)
+
+	var st listState
+	rd := bufio.NewReader(r)
+	for line := 1; ; line++ {
+		text, err := rd.ReadString('\n')
+		if text == "" && err == io.EOF {
+			break
+		}
+		if err != nil && err != io.EOF {
+			return 0, 0, err
+		}
+		if blockingLine(&st, strings.TrimSpace(text)) && !usage.used(line) {
+			pruned++
+			if !comment {
+				continue
+			}
+			text = "# unused: " + text
+		} else {
+			kept++
+		}
+		w.WriteString(text)
+	}
+	if err := w.Flush(); err != nil {
+		return 0, 0, err
+	}
+	return kept, pruned, out.Close()
+}
+
+// blockingLine reports whether text is a list line with only blocking rules.
+func blockingLine(st *listState, text string) bool {
+	if text == "" || strings.HasPrefix(text, "#") || strings.HasPrefix(text, "@include ") {
+		return false
+	}
+	rules, _, err := parseListLine(st, text)
+	if err != nil || len(rules) == 0 {
+		return false
+	}
+	for _, rule := range rules {
+		if rule.Server != nil || rule.Addrs != nil || rule.NXDomain || rule.NoData {
+			return false
+		}
+	}
+	return true
+}
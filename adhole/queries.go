@@ -0,0 +1,263 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// queryTable holds the queries relayed upstream and not yet answered,
+// keyed by the id they were sent upstream with. Clients' queries are sent
+// with fresh random ids rather than their own: two clients may well pick
+// the same id, and the answer has nothing else to tell whose it is. Unlike
+// the maps of per client state elsewhere, it needs no expiringMap: queries
+// leave all its maps when answered or timed out, and a client leaves
+// perClient with its last query, so none outgrows the ids.
+type queryTable struct {
+	mu        sync.Mutex
+	m         map[int]*query
+	sent      map[clientQuery]int // client queries to their ids in m
+	prefetch  map[string]int      // cache keys of prefetches to their ids in m
+	max       int                 // limit on len(m), 0 - none
+	peak      int                 // highest len(m) seen
+	perClient map[string]int      // client IPs to their queries in m
+	maxClient int                 // limit on the queries of one client, 0 - none
+}
+
+// clientQuery identifies a query by the address of its client and the id
+// the client sent it with.
+type clientQuery struct {
+	addr netip.AddrPort
+	id   int
+}
+
+var (
+	// errQueriesFull is returned by add when the table is at its limit.
+	errQueriesFull = errors.New("too many outstanding queries")
+	// errClientFull is returned by add when the client has as many
+	// queries in the table as it may.
+	errClientFull = errors.New("too many outstanding queries from the client")
+)
+
+// newQueryTable returns an empty table.
+func newQueryTable() *queryTable {
+	return &queryTable{
+		m:         make(map[int]*query, 4096),
+		sent:      make(map[clientQuery]int, 4096),
+		prefetch:  make(map[string]int),
+		perClient: make(map[string]int),
+	}
+}
+
+// clientQueryOf returns the key of q in sent.
+func clientQueryOf(q *query) clientQuery {
+	return clientQuery{q.From.AddrPort(), q.ID}
+}
+
+// clientKey returns the key of the client of q in perClient, "" for
+// prefetch queries.
+func clientKey(q *query) string {
+	if q.From == nil {
+		return ""
+	}
+	return string(q.From.IP.To16())
+}
+
+// add records an outstanding query from a client under a fresh id, which it
+// returns for the query to be sent upstream with. If the same client already
+// has an outstanding query with the same id and name it is a
+// retransmission: the existing entry takes the context of q, with its later
+// deadline, and add returns its id and false. A new query isn't added if
+// the table is full.
+func (t *queryTable) add(q *query) (int, bool, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if id, ok := t.sent[clientQueryOf(q)]; ok {
+		if old := t.m[id]; old.Host == q.Host {
+			// The old context ends on its own at its deadline.
+			old.Ctx, old.Cancel = q.Ctx, q.Cancel
+			return id, false, nil
+		}
+	}
+	if t.max > 0 && len(t.m) >= t.max || len(t.m) >= 1<<16 {
+		return 0, false, errQueriesFull
+	}
+	if key := clientKey(q); t.maxClient > 0 && t.perClient[key] >= t.maxClient {
+		return 0, false, errClientFull
+	}
+	id := rand.Intn(1 << 16)
+	for t.m[id] != nil {
+		id = rand.Intn(1 << 16)
+	}
+	t.put(id, q)
+	return id, true, nil
+}
+
+// put stores q, replacing any query with the same id, and tracks the peak
+// size, the queries per client and the prefetches. It must be called with
+// t.mu held.
+func (t *queryTable) put(id int, q *query) {
+	if old, ok := t.m[id]; ok {
+		t.del(id, old)
+	}
+	t.m[id] = q
+	if len(t.m) > t.peak {
+		t.peak = len(t.m)
+	}
+	if q.From == nil {
+		if q.Key != "" {
+			t.prefetch[q.Key] = id
+		}
+		return
+	}
+	t.sent[clientQueryOf(q)] = id
+	t.perClient[clientKey(q)]++
+}
+
+// del removes q, the entry for id. It must be called with t.mu held.
+func (t *queryTable) del(id int, q *query) {
+	delete(t.m, id)
+	if q.From == nil {
+		if t.prefetch[q.Key] == id {
+			delete(t.prefetch, q.Key)
+		}
+		return
+	}
+	if cq := clientQueryOf(q); t.sent[cq] == id {
+		delete(t.sent, cq)
+	}
+	key := clientKey(q)
+	if t.perClient[key]--; t.perClient[key] <= 0 {
+		delete(t.perClient, key)
+	}
+}
+
+// attach hands an outstanding prefetch of the same question as q over to
+// the client of q, which then gets the prefetched answer, and tells if it
+// did. A client with as many queries outstanding as it may gets none,
+// like from add.
+func (t *queryTable) attach(q *query) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	id, ok := t.prefetch[q.Key]
+	if !ok || q.Key == "" || t.m[id].Host != q.Host {
+		return false
+	}
+	if t.maxClient > 0 && t.perClient[clientKey(q)] >= t.maxClient {
+		return false
+	}
+	old := t.m[id]
+	delete(t.prefetch, q.Key)
+	old.From, old.Dst, old.Via, old.Type, old.ID = q.From, q.Dst, q.Via, q.Type, q.ID
+	old.Msg, old.Trace = q.Msg, q.Trace
+	// The old context ends on its own at its deadline.
+	old.Ctx, old.Cancel = q.Ctx, q.Cancel
+	t.sent[clientQueryOf(old)] = id
+	t.perClient[clientKey(old)]++
+	return true
+}
+
+// addNew records an outstanding query sent upstream with id, only if there
+// is none with the same id yet, and the table isn't full.
+func (t *queryTable) addNew(id int, q *query) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if _, ok := t.m[id]; ok || t.max > 0 && len(t.m) >= t.max {
+		return false
+	}
+	t.put(id, q)
+	return true
+}
+
+// take removes and returns the query with the given id, which is answered
+// and so ends.
+func (t *queryTable) take(id int) (*query, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	q, ok := t.m[id]
+	if ok {
+		t.del(id, q)
+		q.Cancel()
+	}
+	return q, ok
+}
+
+// remove removes q if it's still the entry for id, and ends it.
+func (t *queryTable) remove(id int, q *query) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.m[id] == q {
+		t.del(id, q)
+		q.Cancel()
+	}
+}
+
+// Len returns the number of outstanding queries.
+func (t *queryTable) Len() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.m)
+}
+
+// Peak returns the highest number of outstanding queries seen.
+func (t *queryTable) Peak() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.peak
+}
+
+// Oldest returns the time the oldest outstanding query was received at.
+func (t *queryTable) Oldest() (time.Time, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var oldest time.Time
+	for _, q := range t.m {
+		if oldest.IsZero() || q.Start.Before(oldest) {
+			oldest = q.Start
+		}
+	}
+	return oldest, !oldest.IsZero()
+}
+
+// queryContext returns the context of a query received now, which ends at
+// the -t timeout.
+func queryContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), *flagTimeout)
+}
+
+// timeout arranges for q to be dropped when its context ends, if it's still
+// unanswered by then. Retransmissions may replace the context with one with
+// a later deadline.
+func (t *queryTable) timeout(id int, q *query) {
+	t.mu.Lock()
+	ctx := q.Ctx
+	t.mu.Unlock()
+	context.AfterFunc(ctx, func() { t.expire(id, q) })
+}
+
+// expire drops q if its context ended, or waits for the new one to end.
+func (t *queryTable) expire(id int, q *query) {
+	t.mu.Lock()
+	if t.m[id] != q {
+		t.mu.Unlock()
+		return
+	}
+	if ctx := q.Ctx; ctx.Err() == nil {
+		t.mu.Unlock()
+		context.AfterFunc(ctx, func() { t.expire(id, q) })
+		return
+	}
+	t.del(id, q)
+	t.mu.Unlock()
+	logLimited("DNS WARN: Query id %d %s timed out\n", id, q)
+	cntTimedout.Add(1)
+	q.Upstream.timedOut()
+	if q.Via != nil {
+		publish(q.From, q.Host, q.Type, "timeout", "", q.Start)
+	}
+}
@@ -0,0 +1,390 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// newTestQuery returns a query for host from the client at from, nil for a
+// prefetch, that ends with the test.
+func newTestQuery(tb testing.TB, host, from string) *query {
+	tb.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	tb.Cleanup(cancel)
+	q := &query{ID: 7, Host: host, Key: host + "/1/1", Start: time.Now(), Ctx: ctx, Cancel: cancel, Msg: testQuery(host+".", typeA)}
+	if from != "" {
+		addr, err := net.ResolveUDPAddr("udp", from)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		q.From = addr
+	}
+	return q
+}
+
+// TestQueryCollisions covers a new query arriving with the id an outstanding
+// one was sent upstream with, from a client or sent by us to prefetch.
+func TestQueryCollisions(t *testing.T) {
+	const (
+		client = "192.0.2.1:5000"
+		other  = "192.0.2.2:5000"
+	)
+	tests := []struct {
+		name       string
+		old        string // client of the outstanding query, "" - prefetch
+		oldHost    string
+		from       string
+		host       string
+		attached   bool
+		looped     bool
+		added      bool
+		retransmit bool
+	}{
+		{"retransmission", client, "example.com", client, "example.com", false, false, false, true},
+		{"other port", client, "example.com", "192.0.2.1:5001", "example.com", false, true, false, false},
+		{"other client", client, "example.com", other, "example.com", false, true, false, false},
+		{"other name", client, "example.com", other, "example.org", false, false, true, false},
+		{"prefetch", "", "example.com", client, "example.com", true, false, false, false},
+		{"prefetch of other name", "", "example.com", client, "example.org", false, false, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tab := newQueryTable()
+			old := newTestQuery(t, tt.oldHost, tt.old)
+			if !tab.addNew(7, old) {
+				t.Fatal("addNew failed on an empty table")
+			}
+			q := newTestQuery(t, tt.host, tt.from)
+
+			if got := tab.attach(q); got != tt.attached {
+				t.Errorf("attach = %v, want %v", got, tt.attached)
+			}
+			if tt.attached {
+				if old.From != q.From || old.Ctx != q.Ctx {
+					t.Error("the prefetch wasn't handed over to the client")
+				}
+				if n := tab.perClient[clientKey(q)]; n != 1 {
+					t.Errorf("client has %d queries, want 1", n)
+				}
+				if got, _ := tab.take(7); got != old {
+					t.Error("the prefetch isn't the outstanding query any more")
+				}
+				if len(tab.perClient) != 0 {
+					t.Errorf("clients left after take: %v", tab.perClient)
+				}
+				return
+			}
+			if got := tab.looped(7, q); got != tt.looped {
+				t.Errorf("looped = %v, want %v", got, tt.looped)
+			}
+			if tt.looped {
+				return
+			}
+			id, added, err := tab.add(q)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if added != tt.added {
+				t.Errorf("added = %v, want %v", added, tt.added)
+			}
+			if tt.retransmit && (old.Ctx != q.Ctx || id != 7) {
+				t.Error("the retransmission didn't extend the deadline")
+			}
+			if tt.added {
+				if got, _ := tab.take(id); id == 7 || got != q {
+					t.Errorf("new query outstanding as %d", id)
+				}
+			}
+			if got, _ := tab.take(7); got != old {
+				t.Error("the old query isn't outstanding any more")
+			}
+		})
+	}
+}
+
+func TestQueryLimits(t *testing.T) {
+	tab := newQueryTable()
+	tab.max, tab.maxClient = 3, 2
+	for _, from := range []string{"192.0.2.1:1", "192.0.2.1:2"} {
+		if _, _, err := tab.add(newTestQuery(t, "example.com", from)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, _, err := tab.add(newTestQuery(t, "example.com", "192.0.2.1:3")); err != errClientFull {
+		t.Errorf("third query of a client: %v, want %v", err, errClientFull)
+	}
+	// Prefetches don't count against any client, nor are they handed over
+	// to one at its limit.
+	if !tab.addNew(-1, newTestQuery(t, "example.com", "")) {
+		t.Error("prefetch refused")
+	}
+	if tab.attach(newTestQuery(t, "example.com", "192.0.2.1:3")) {
+		t.Error("prefetch handed over to a client at its limit")
+	}
+	if n := tab.perClient[clientKey(newTestQuery(t, "example.com", "192.0.2.1:3"))]; n != 2 {
+		t.Errorf("client has %d queries, want 2", n)
+	}
+	if _, _, err := tab.add(newTestQuery(t, "example.com", "192.0.2.2:1")); err != errQueriesFull {
+		t.Errorf("query over the limit: %v, want %v", err, errQueriesFull)
+	}
+	if tab.Peak() != 3 {
+		t.Errorf("peak %d, want 3", tab.Peak())
+	}
+}
+
+// resetQueries empties the outstanding queries and sets their limits, then
+// adds queries from the clients at from, prefetches for "", for the rest of
+// the test. The listeners use the table as it is, so it's changed locked.
+func resetQueries(tb testing.TB, max, maxClient int, from ...string) {
+	queries.mu.Lock()
+	defer queries.mu.Unlock()
+	for id, q := range queries.m {
+		queries.del(id, q)
+	}
+	queries.max, queries.maxClient, queries.peak = max, maxClient, 0
+	for id, addr := range from {
+		queries.put(id, newTestQuery(tb, "example.org", addr))
+	}
+	tb.Cleanup(func() {
+		queries.mu.Lock()
+		defer queries.mu.Unlock()
+		for id, q := range queries.m {
+			queries.del(id, q)
+		}
+		queries.max, queries.maxClient = 0, 0
+	})
+}
+
+// askRelayed sends msg to l and returns the query relayed to up, or the
+// answer if none was.
+func askRelayed(tb testing.TB, l *listener, up *net.UDPConn, msg []byte) (relayedMsg, reply []byte) {
+	tb.Helper()
+	client, err := net.DialUDP("udp4", nil, l.conn.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer client.Close()
+	client.Write(msg)
+	if relayedMsg = relayed(up); relayedMsg != nil {
+		return relayedMsg, nil
+	}
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	buf := make([]byte, answerBufSize)
+	n, err := client.Read(buf)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return nil, buf[:n]
+}
+
+// Queries over -max-outstanding get SERVFAIL rather than be relayed, and
+// the peak counts those that were.
+func TestMaxOutstanding(t *testing.T) {
+	up := withUpstream(t)
+	l := startListener(t, false)
+	tests := []struct {
+		name    string
+		max     int
+		waiting int // outstanding queries of other clients
+		relay   bool
+	}{
+		{"no limit", 0, 5, true},
+		{"under the limit", 3, 2, true},
+		{"at the limit", 3, 3, false},
+		{"over the limit", 3, 4, false},
+	}
+	tab := queries
+	for _, tt := range tests {
+		var from []string
+		for i := 0; i < tt.waiting; i++ {
+			from = append(from, fmt.Sprintf("192.0.2.%d:53", i+1))
+		}
+		resetQueries(t, tt.max, 0, from...)
+		full := cntFull.Value()
+
+		got, reply := askRelayed(t, l, up, testQuery("example.com.", typeA))
+		if (got != nil) != tt.relay {
+			t.Errorf("%s: relayed %v, want %v", tt.name, got != nil, tt.relay)
+			continue
+		}
+		if tt.relay {
+			if tab.Peak() != tt.waiting+1 {
+				t.Errorf("%s: peak %d, want %d", tt.name, tab.Peak(), tt.waiting+1)
+			}
+			continue
+		}
+		if rcode := reply[3] & 0x0f; rcode != rcodeServFail {
+			t.Errorf("%s: rcode %d, want SERVFAIL", tt.name, rcode)
+		}
+		if cntFull.Value() != full+1 {
+			t.Errorf("%s: not counted as over the limit", tt.name)
+		}
+		if tab.Len() != tt.waiting {
+			t.Errorf("%s: %d outstanding, want %d", tt.name, tab.Len(), tt.waiting)
+		}
+	}
+}
+
+// Unanswered queries are dropped once their deadline passes, the latest one
+// if retransmitted.
+func TestQueryTimeout(t *testing.T) {
+	const deadline = 50 * time.Millisecond
+	tests := []struct {
+		name    string
+		answer  bool          // right away
+		resent  time.Duration // deadline of a retransmission, if any
+		expired bool          // after 3 deadlines
+	}{
+		{"unanswered", false, 0, true},
+		{"answered", true, 0, false},
+		{"retransmitted", false, 6 * deadline, false},
+	}
+	for _, tt := range tests {
+		tab := newQueryTable()
+		q := newTestQuery(t, "example.com", "192.0.2.1:53")
+		q.Ctx, q.Cancel = context.WithTimeout(context.Background(), deadline)
+		id, _, _ := tab.add(q)
+		tab.timeout(id, q)
+		if tt.resent > 0 {
+			again := newTestQuery(t, "example.com", "192.0.2.1:53")
+			again.Ctx, again.Cancel = context.WithTimeout(context.Background(), tt.resent)
+			t.Cleanup(again.Cancel)
+			if _, added, _ := tab.add(again); added {
+				t.Fatalf("%s: retransmission added", tt.name)
+			}
+		}
+		if tt.answer {
+			tab.take(id)
+		}
+		timedOut := cntTimedout.Value()
+		time.Sleep(3 * deadline)
+		if expired := cntTimedout.Value() > timedOut; expired != tt.expired {
+			t.Errorf("%s: timed out %v, want %v", tt.name, expired, tt.expired)
+		}
+		if ok := tab.Len() == 1; ok != (!tt.answer && !tt.expired) {
+			t.Errorf("%s: outstanding %v", tt.name, ok)
+		}
+		if tt.resent > 0 {
+			time.Sleep(tt.resent)
+			if _, ok := tab.take(id); ok {
+				t.Errorf("%s: still outstanding after the retransmission's deadline", tt.name)
+			}
+		}
+	}
+}
+
+// clFull returns the count of queries from client turned away by its cap.
+func clFull(client string) int64 {
+	n, ok := cntClFull.m.Get(client)
+	if !ok {
+		return 0
+	}
+	return n.Load()
+}
+
+// A client with -max-outstanding-client queries outstanding gets SERVFAIL
+// for more, while other clients are relayed.
+func TestMaxOutstandingClient(t *testing.T) {
+	up := withUpstream(t)
+	l := startListener(t, false)
+	const us = "127.0.0.1"
+	tests := []struct {
+		name    string
+		max     int
+		waiting []string // clients of the outstanding queries
+		relay   bool
+	}{
+		{"no cap", 0, []string{us + ":1", us + ":2", us + ":3"}, true},
+		{"under the cap", 2, []string{us + ":1"}, true},
+		{"at the cap", 2, []string{us + ":1", us + ":2"}, false},
+		{"other client at the cap", 2, []string{"192.0.2.1:1", "192.0.2.1:2"}, true},
+		{"prefetches", 1, []string{"", ""}, true},
+	}
+	for _, tt := range tests {
+		resetQueries(t, 0, tt.max, tt.waiting...)
+		capped := clFull(us)
+		got, reply := askRelayed(t, l, up, testQuery("example.com.", typeA))
+		if (got != nil) != tt.relay {
+			t.Errorf("%s: relayed %v, want %v", tt.name, got != nil, tt.relay)
+			continue
+		}
+		if tt.relay {
+			continue
+		}
+		if rcode := reply[3] & 0x0f; rcode != rcodeServFail {
+			t.Errorf("%s: rcode %d, want SERVFAIL", tt.name, rcode)
+		}
+		if clFull(us) != capped+1 {
+			t.Errorf("%s: not counted for the client", tt.name)
+		}
+	}
+}
+
+// Clients asking with the same id each get their own answer: their queries
+// go upstream with ids of their own, and the answers come back with theirs.
+func TestSameIDClients(t *testing.T) {
+	withBlocked(t)
+	resetQueries(t, 0, 0)
+	up := withUpstream(t)
+	var src atomic.Pointer[net.UDPConn]
+	src.Store(upstream.Load())
+	go runServerUpstreamDNS(&src)
+	l := startListener(t, false)
+
+	hosts := []string{"a.example.com.", "b.example.com."}
+	clients := make([]*net.UDPConn, len(hosts))
+	for i, host := range hosts {
+		c, err := net.DialUDP("udp4", nil, l.conn.LocalAddr().(*net.UDPAddr))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer c.Close()
+		clients[i] = c
+		c.Write(testQuery(host, typeA)) // both with id 0x1234
+	}
+
+	ids := make(map[int]bool)
+	buf := make([]byte, answerBufSize)
+	for range hosts {
+		up.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, from, err := up.ReadFromUDP(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg := buf[:n]
+		ids[int(msg[0])<<8|int(msg[1])] = true
+		host, _, end, err := parseQuestion(msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ip := net.IPv4(192, 0, 2, host[0])
+		up.WriteToUDP(appendA(newReply(msg, end, 0), ip, 60), from)
+	}
+	if len(ids) != len(hosts) {
+		t.Errorf("sent upstream with ids %v, want one each", ids)
+	}
+
+	for i, c := range clients {
+		c.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := c.Read(buf)
+		if err != nil {
+			t.Fatalf("%s: %v", hosts[i], err)
+		}
+		host, _, _, err := parseQuestion(buf[:n])
+		if err != nil || host != hosts[i] {
+			t.Errorf("asked about %s, answered about %s %v", hosts[i], host, err)
+		}
+		if id := int(buf[0])<<8 | int(buf[1]); id != 0x1234 {
+			t.Errorf("%s: answered with id %04x", hosts[i], id)
+		}
+		if addrs := answerAddrs(buf[:n]); len(addrs) != 1 || addrs[0] != fmt.Sprintf("192.0.2.%d", hosts[i][0]) {
+			t.Errorf("%s: answered %v", hosts[i], addrs)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"math/rand"
+)
+
+// queryLog is the -querylog file, nil if queries aren't logged.
+var queryLog *logFile
+
+var (
+	cntQLogged  = expvar.NewInt("statsQueryLogged")
+	cntQSkipped = expvar.NewInt("statsQuerySampledOut")
+)
+
+// sampledActions are the actions of the queries of which only a sample is
+// logged with -querylog-sample. Blocked queries and failures always are.
+var sampledActions = map[string]bool{
+	"relayed": true,
+	"cached":  true,
+	"local":   true,
+}
+
+// queryRecord is a line of the query log: the same as a stream event, plus
+// the sample rate for sampled queries.
+type queryRecord struct {
+	*streamEvent
+	Sampled bool    `json:"sampled,omitempty"`
+	Rate    float64 `json:"rate,omitempty"` // to scale counts back up
+}
+
+func init() {
+	expvar.Publish("queryLog", expvar.Func(func() interface{} {
+		if queryLog == nil {
+			return nil
+		}
+		return map[string]interface{}{
+			"file":       queryLog.path,
+			"sampleRate": *flagQLSample,
+			"logged":     cntQLogged.Value(),
+			"sampledOut": cntQSkipped.Value(),
+		}
+	}))
+}
+
+// logQuery writes ev to the query log, unless it isn't in the sample.
+func logQuery(ev *streamEvent) {
+	rec := queryRecord{streamEvent: ev}
+	if rate := *flagQLSample; rate < 1 && sampledActions[ev.Action] {
+		if rand.Float64() >= rate {
+			cntQSkipped.Add(1)
+			return
+		}
+		rec.Sampled, rec.Rate = true, rate
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return
+	}
+	queryLog.Write(append(line, '\n'))
+	cntQLogged.Add(1)
+}
@@ -0,0 +1,81 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Limits of the recent blocks: how long a block is remembered after the
+// last pixel request it explained, and for how many client and name pairs.
+const (
+	recentBlockTTL  = 10 * time.Minute
+	recentBlockKeys = 16384
+)
+
+var cntPixelHits = expvar.NewMap("statsPixelHits")
+
+// recentBlock is a blocked query, for the pixel requests that follow it.
+type recentBlock struct {
+	rule string
+	at   time.Time
+}
+
+// recentBlocks are the latest blocked queries by client and name, so that
+// the pixel requests they send to the sinkhole can be told apart from other
+// traffic and tagged with the rule that sent them there.
+var recentBlocks = newExpiringMap[string, recentBlock]("recentBlocks", recentBlockKeys, recentBlockTTL)
+
+// recentBlockKey is the key of a query for name from client, name lowercased
+// with a trailing dot.
+func recentBlockKey(client net.IP, name string) string {
+	return client.String() + " " + name
+}
+
+// rememberBlock notes that a query for name from client was blocked by rule.
+func rememberBlock(client net.IP, name, rule string) {
+	recentBlocks.Put(recentBlockKey(client, lowerName(name)), recentBlock{rule: rule, at: time.Now()})
+}
+
+// pixelHit publishes a pixel request as a query event with action "pixel",
+// so the query log joins it to the DNS block: with the rule and the time of
+// the client's block of the name, or, without a recent one, the rule in the
+// current rules that blocks it, if any. Hits are counted by which it was:
+// "dns", "list" or "none".
+func pixelHit(req *http.Request, start time.Time) {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		return
+	}
+	client := net.ParseIP(host)
+	name, _, _ := strings.Cut(req.Host, ":")
+	if client == nil || name == "" || hostIP(req.Host) != nil {
+		return
+	}
+	name = lowerName(strings.TrimSuffix(name, ".")) + "."
+
+	var blockedAt time.Time
+	rule, how := "", "none"
+	if b, ok := recentBlocks.Get(recentBlockKey(client, name)); ok {
+		rule, blockedAt, how = b.rule, b.at, "dns"
+	} else {
+		rs := currentRules()
+		if zone, src, block := rs.matchCached(name); block {
+			rule, how = rs.describe(zone, src), "list"
+		}
+	}
+	cntPixelHits.Add(how, 1)
+	if *flagVerbose {
+		if how == "dns" {
+			log.Printf("HTTP: Request for %s blocked at %s by %s\n", escapeName(name), blockedAt.Format(time.RFC3339), rule)
+		} else if how == "list" {
+			log.Printf("HTTP: Request for %s without a recent block, listed by %s\n", escapeName(name), rule)
+		}
+	}
+	publishPixel(&net.UDPAddr{IP: client}, name, req.Method, rule, blockedAt, start)
+}
@@ -0,0 +1,160 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"io"
+	"log"
+	"math/rand"
+	"os"
+	"time"
+)
+
+var (
+	cntRecorded = expvar.NewInt("statsRecorded")
+	cntRecDrop  = expvar.NewInt("statsRecordDropped")
+)
+
+// A -record file starts with recordMagic, followed by one record per
+// upstream exchange: the time the answer came in as nanoseconds since the
+// epoch (8 bytes), then the query and the answer, each as its length (2
+// bytes) and its wire bytes. All numbers are big endian.
+const recordMagic = "ADHREC01"
+
+// recordQueue is the number of exchanges that may wait to be written before
+// more are dropped.
+const recordQueue = 1024
+
+// recordings queues the exchanges for the writer, nil if not recording.
+var recordings chan []byte
+
+// openRecording opens the -record file at path, appending to it, and starts
+// writing the recorded exchanges until it holds max bytes.
+func openRecording(path string, max int64) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0640)
+	if err != nil {
+		return err
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	size := fi.Size()
+	if size == 0 {
+		if _, err := io.WriteString(file, recordMagic); err != nil {
+			file.Close()
+			return err
+		}
+		size = int64(len(recordMagic))
+	}
+	recordings = make(chan []byte, recordQueue)
+	go writeRecordings(file, size, max)
+	return nil
+}
+
+// recordSampled reports whether to record the exchange of a query, as
+// -record-sample of them are.
+func recordSampled() bool {
+	return recordings != nil && (*flagRecSampl >= 1 || rand.Float64() < *flagRecSampl)
+}
+
+// recordExchange queues an upstream query and its answer to be recorded. It
+// never blocks: if the writer can't keep up, the exchange is dropped.
+func recordExchange(query, answer []byte) {
+	rec := make([]byte, 0, 12+len(query)+len(answer))
+	rec = binary.BigEndian.AppendUint64(rec, uint64(time.Now().UnixNano()))
+	rec = binary.BigEndian.AppendUint16(rec, uint16(len(query)))
+	rec = append(rec, query...)
+	rec = binary.BigEndian.AppendUint16(rec, uint16(len(answer)))
+	rec = append(rec, answer...)
+	select {
+	case recordings <- rec:
+	default:
+		cntRecDrop.Add(1)
+	}
+}
+
+// writeRecordings writes the queued exchanges to file, which holds size
+// bytes already, flushing whenever the queue is empty. Once the file would
+// grow beyond max bytes the exchanges are dropped.
+func writeRecordings(file *os.File, size, max int64) {
+	w := bufio.NewWriter(file)
+	full := false
+	for rec := range recordings {
+		if full || size+int64(len(rec)) > max {
+			if !full {
+				log.Printf("DNS: Recording stopped, %s has reached -record-size\n", file.Name())
+				full = true
+			}
+			cntRecDrop.Add(1)
+			continue
+		}
+		if _, err := w.Write(rec); err != nil {
+			log.Println("DNS ERROR: Recording stopped:", err)
+			cntErrors.Add(1)
+			full = true
+			continue
+		}
+		size += int64(len(rec))
+		cntRecorded.Add(1)
+		if len(recordings) == 0 {
+			if err := w.Flush(); err != nil {
+				log.Println("DNS ERROR: Recording stopped:", err)
+				cntErrors.Add(1)
+				full = true
+			}
+		}
+	}
+}
+
+// recorded is a recorded upstream exchange.
+type recorded struct {
+	Time   time.Time
+	Query  []byte
+	Answer []byte
+}
+
+// readRecording reads a -record file.
+func readRecording(r io.Reader) ([]recorded, error) {
+	br := bufio.NewReader(r)
+	magic := make([]byte, len(recordMagic))
+	if _, err := io.ReadFull(br, magic); err != nil || string(magic) != recordMagic {
+		return nil, errors.New("not an adhole recording")
+	}
+	var exs []recorded
+	for {
+		var ts [8]byte
+		if _, err := io.ReadFull(br, ts[:]); err == io.EOF {
+			return exs, nil
+		} else if err != nil {
+			return exs, err
+		}
+		ex := recorded{Time: time.Unix(0, int64(binary.BigEndian.Uint64(ts[:])))}
+		var err error
+		if ex.Query, err = readRecordPart(br); err != nil {
+			return exs, err
+		}
+		if ex.Answer, err = readRecordPart(br); err != nil {
+			return exs, err
+		}
+		exs = append(exs, ex)
+	}
+}
+
+// readRecordPart reads a length prefixed message of a record.
+func readRecordPart(r io.Reader) ([]byte, error) {
+	var n [2]byte
+	if _, err := io.ReadFull(r, n[:]); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return msg, nil
+}
@@ -0,0 +1,173 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+var cntVerify = expvar.NewInt("statsVerifyFailed")
+
+// remoteClient fetches remote lists and their digests.
+var remoteClient = &http.Client{Timeout: 2 * time.Minute}
+
+// isRemote reports whether a list is given by an HTTP or HTTPS URL rather
+// than a file name.
+func isRemote(list string) bool {
+	return strings.HasPrefix(list, "http://") || strings.HasPrefix(list, "https://")
+}
+
+// listPath returns the path part of a list URL, or the file name as it is.
+func listPath(list string) string {
+	if !isRemote(list) {
+		return list
+	}
+	if u, err := url.Parse(list); err == nil {
+		return path.Base(u.Path)
+	}
+	return list
+}
+
+// fetchList downloads the remote list at rawURL to a temporary file and
+// returns its name. The download is checked against the digest in a
+// "#sha256=" fragment of the URL or, failing that, the one at the URL with
+// ".sha256" appended, if there is one. With -require-checksums a list
+// without either is refused.
+func fetchList(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	want, err := fragmentDigest(u.Fragment)
+	if err != nil {
+		return "", err
+	}
+	u.Fragment = ""
+	if want == "" {
+		if want, err = fetchDigest(u.String() + ".sha256"); err != nil {
+			return "", err
+		}
+	}
+	if want == "" && *flagReqSums {
+		return "", verifyFailed(u, errors.New("no checksum and -require-checksums is on"))
+	}
+
+	req, err := http.NewRequest(http.MethodGet, u.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept-Encoding", "gzip, zstd")
+	resp, err := remoteClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("fetching %s: %s", u, resp.Status)
+	}
+	body, err := decodeBody(resp)
+	if err != nil {
+		return "", fmt.Errorf("fetching %s: %w", u, err)
+	}
+	file, err := os.CreateTemp("", "adhole-list-")
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(io.MultiWriter(file, hash), body)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && want != "" {
+		if got := hex.EncodeToString(hash.Sum(nil)); got != want {
+			err = verifyFailed(u, fmt.Errorf("sha256 is %s, expected %s", got, want))
+		}
+	}
+	if err != nil {
+		os.Remove(file.Name())
+		return "", err
+	}
+	return file.Name(), nil
+}
+
+// decodeBody returns the body of resp with its Content-Encoding undone, so
+// that the list and its digest are of the file as served without it.
+func decodeBody(resp *http.Response) (io.Reader, error) {
+	switch enc := resp.Header.Get("Content-Encoding"); enc {
+	case "", "identity":
+		return resp.Body, nil
+	case "gzip":
+		return gzip.NewReader(resp.Body)
+	case "zstd":
+		return newZstdReader(resp.Body), nil
+	default:
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", enc)
+	}
+}
+
+// fragmentDigest returns the digest in a "sha256=" URL fragment, or "" if
+// there is none.
+func fragmentDigest(fragment string) (string, error) {
+	if fragment == "" {
+		return "", nil
+	}
+	digest, ok := strings.CutPrefix(fragment, "sha256=")
+	if !ok || !validDigest(digest) {
+		return "", fmt.Errorf("bad list URL fragment %q, expected sha256=<hex digest>", fragment)
+	}
+	return strings.ToLower(digest), nil
+}
+
+// fetchDigest fetches a digest file in the format of sha256sum, of which
+// only the digest on the first line is used. A missing file gives "".
+func fetchDigest(rawURL string) (string, error) {
+	resp, err := remoteClient.Get(rawURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusGone:
+		return "", nil
+	default:
+		return "", fmt.Errorf("fetching %s: %s", rawURL, resp.Status)
+	}
+	line, err := bufio.NewReader(io.LimitReader(resp.Body, 1024)).ReadString('\n')
+	if err != nil && err != io.EOF {
+		return "", err
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 || !validDigest(fields[0]) {
+		return "", fmt.Errorf("no sha256 digest in %s", rawURL)
+	}
+	return strings.ToLower(fields[0]), nil
+}
+
+// validDigest reports whether s is a hex encoded sha256 digest.
+func validDigest(s string) bool {
+	b, err := hex.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
+
+// verifyFailed logs and counts a list that failed verification, and returns
+// the error for it.
+func verifyFailed(u *url.URL, err error) error {
+	cntVerify.Add(1)
+	log.Printf("DNS ERROR: List %s failed verification: %s\n", u, err)
+	return fmt.Errorf("list %s failed verification: %s", u, err)
+}
@@ -0,0 +1,84 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+// Remote lists are checked against the digest in their URL or next to them,
+// and refused if it doesn't match.
+func TestFetchList(t *testing.T) {
+	const list = "ads.example.com\ntracker.net\n"
+	sum := sha256.Sum256([]byte(list))
+	good, bad := hex.EncodeToString(sum[:]), strings.Repeat("0", 64)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/list.txt", "/signed.txt", "/tampered.txt":
+			w.Write([]byte(list))
+		case "/signed.txt.sha256":
+			w.Write([]byte(strings.ToUpper(good) + "  signed.txt\n"))
+		case "/tampered.txt.sha256":
+			w.Write([]byte(bad + "  tampered.txt\n"))
+		case "/garbled.txt.sha256":
+			w.Write([]byte("not a digest\n"))
+		default:
+			http.NotFound(w, req)
+		}
+	}))
+	defer srv.Close()
+
+	tests := []struct {
+		name     string
+		path     string
+		required bool
+		err      string // "" if fetched
+		verify   bool   // failed verification
+	}{
+		{"digest in the URL", "/list.txt#sha256=" + good, false, "", false},
+		{"digest in the URL, upper case", "/list.txt#sha256=" + strings.ToUpper(good), true, "", false},
+		{"wrong digest in the URL", "/list.txt#sha256=" + bad, false, "failed verification", true},
+		{"bad fragment", "/list.txt#md5=abc", false, "fragment", false},
+		{"digest file", "/signed.txt", true, "", false},
+		{"wrong digest file", "/tampered.txt", false, "failed verification", true},
+		{"garbled digest file", "/garbled.txt", false, "no sha256 digest", false},
+		{"no digest", "/list.txt", false, "", false},
+		{"no digest, required", "/list.txt", true, "-require-checksums", true},
+		{"missing list", "/missing.txt", false, "404", false},
+	}
+	for _, tt := range tests {
+		withFlag(t, flagReqSums, tt.required)
+		failed := cntVerify.Value()
+		path, err := fetchList(srv.URL + tt.path)
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+				continue
+			}
+			data, _ := os.ReadFile(path)
+			os.Remove(path)
+			if string(data) != list {
+				t.Errorf("%s: fetched %q", tt.name, data)
+			}
+		} else if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		}
+		if got := cntVerify.Value() > failed; got != tt.verify {
+			t.Errorf("%s: counted as failed verification %v, want %v", tt.name, got, tt.verify)
+		}
+	}
+
+	rs, _, err := loadLists([]string{srv.URL + "/signed.txt"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, block := rs.matchBlocked("www.tracker.net."); !block || rs.names[0] != "signed" {
+		t.Errorf("remote list %q not loaded", rs.names)
+	}
+}
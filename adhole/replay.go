@@ -0,0 +1,211 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// runReplay runs the replay subcommand: it sends the queries of a -record
+// file to a resolver and reports the answers that differ from the recorded
+// ones in their rcode or their answer records. It returns the exit code, 1
+// if any answers differ.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ContinueOnError)
+	server := fs.String("server", "8.8.8.8:53", "resolver to send the recorded queries to")
+	timeout := fs.Duration("t", 2*time.Second, "query timeout")
+	all := fs.Bool("all", false, "show the answers that match too")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s replay [options] recording\n\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		return 1
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 1
+	}
+	file, err := os.Open(fs.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return 2
+	}
+	exs, err := readRecording(file)
+	file.Close()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s: %s\n", fs.Arg(0), err)
+		if len(exs) == 0 {
+			return 2
+		}
+	}
+	addr := *server
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, "53")
+	}
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		return 2
+	}
+	defer conn.Close()
+
+	var same, differ, failed int
+	buf := make([]byte, 65535)
+	for _, ex := range exs {
+		name, qtype, _, err := parseQuestion(ex.Query)
+		if err != nil {
+			continue
+		}
+		q := fmt.Sprintf("%s %s", strings.TrimSuffix(escapeName(name), "."), typeName(qtype))
+		answer, err := replayQuery(conn, ex.Query, buf, *timeout)
+		if err != nil {
+			fmt.Printf("%s: %s\n", q, err)
+			failed++
+			continue
+		}
+		was, now := describeAnswer(ex.Answer), describeAnswer(answer)
+		if was == now {
+			same++
+			if *all {
+				fmt.Printf("%s: same: %s\n", q, now)
+			}
+			continue
+		}
+		differ++
+		fmt.Printf("%s:\n  recorded %s: %s\n  %-8s %s: %s\n", q,
+			ex.Time.Format(time.RFC3339), was, "now", *server, now)
+	}
+	fmt.Printf("%d queries: %d same, %d differ, %d failed\n", same+differ+failed, same, differ, failed)
+	if differ > 0 || failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// replayQuery sends a recorded query, with its ID, and waits for the answer.
+func replayQuery(conn net.Conn, query, buf []byte, timeout time.Duration) ([]byte, error) {
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		if n >= headerLen && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+// describeAnswer returns the rcode of an answer and its answer records,
+// without their TTLs and sorted, so that two answers with the same records
+// in a different order are described the same.
+func describeAnswer(msg []byte) string {
+	if len(msg) < headerLen {
+		return "malformed"
+	}
+	var rrs []string
+	off := headerLen
+	var err error
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[4:])) && err == nil; i++ {
+		if off, err = skipName(msg, off); err == nil {
+			off += 4
+		}
+	}
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[6:])) && err == nil; i++ {
+		var rr string
+		if rr, off, err = describeRecord(msg, off); err == nil {
+			rrs = append(rrs, rr)
+		}
+	}
+	if err != nil || off > len(msg) {
+		return "malformed"
+	}
+	sort.Strings(rrs)
+	desc := rcodeName(int(msg[3] & 0x0f))
+	if msg[2]&0x02 != 0 {
+		desc += " truncated"
+	}
+	if len(rrs) > 0 {
+		desc += " [" + strings.Join(rrs, ", ") + "]"
+	}
+	return desc
+}
+
+// describeRecord returns the record at off as its type and data, and the
+// offset past it. The names in data are spelled out, as the same records
+// may be compressed differently.
+func describeRecord(msg []byte, off int) (string, int, error) {
+	off, err := skipName(msg, off)
+	if err != nil || off+10 > len(msg) {
+		return "", 0, errMalformed
+	}
+	rrtype := binary.BigEndian.Uint16(msg[off:])
+	rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+	off += 10
+	if off+rdlen > len(msg) {
+		return "", 0, errMalformed
+	}
+	data := msg[off : off+rdlen]
+	var desc string
+	switch {
+	case rrtype == typeA && rdlen == 4, rrtype == typeAAAA && rdlen == 16:
+		desc = net.IP(data).String()
+	case rrtype == typeCNAME || rrtype == typeNS || rrtype == typePTR:
+		name, err := readName(msg, off)
+		if err != nil {
+			return "", 0, err
+		}
+		desc = name
+	case rrtype == typeMX && rdlen > 2:
+		name, err := readName(msg, off+2)
+		if err != nil {
+			return "", 0, err
+		}
+		desc = strconv.Itoa(int(binary.BigEndian.Uint16(data))) + " " + name
+	default:
+		desc = hex.EncodeToString(data)
+	}
+	return typeName(rrtype) + " " + desc, off + rdlen, nil
+}
+
+// readName returns the name at off in msg, following compression pointers.
+func readName(msg []byte, off int) (string, error) {
+	var name []byte
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", errMalformed
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			if len(name) == 0 {
+				return ".", nil
+			}
+			return escapeName(lowerName(string(name))), nil
+		case length&0xc0 == 0xc0:
+			if off+2 > len(msg) || jumps > 16 {
+				return "", errMalformed
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+			continue
+		case length&0xc0 != 0 || off+1+length > len(msg):
+			return "", errMalformed
+		}
+		name = appendLabel(name, msg[off+1:off+1+length])
+		off += 1 + length
+	}
+}
@@ -0,0 +1,280 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+)
+
+// Locally generated responses are built from the query's header and
+// question, with records appended after it. All records are about the name
+// in the question, so their owner name is a compression pointer to it.
+//
+// Good sources of information on the DNS protocol can be found at:
+// http://www.firewall.cx/networking-topics/protocols/domain-name-system-dns
+// http://www.iana.org/assignments/dns-parameters/dns-parameters.xhtml
+//
+// Bytes of a record described:
+// 2 - Name        = 0xc00c - pointer to the name in the question
+// 2 - Type        = e.g. 0x0001 - A
+// 2 - Class       = 0x0001 - IN
+// 4 - TTL
+// 2 - Data Length - number of resource bytes, e.g. 4 for an IPv4 address
+// ? - Data
+
+// Header flag bits, in the 16-bit flags field.
+const (
+	flagQR = 0x8000 // response
+	flagAA = 0x0400 // authoritative answer
+	flagTC = 0x0200 // truncated
+	flagRD = 0x0100 // recursion desired
+	flagRA = 0x0080 // recursion available
+	flagAD = 0x0020 // authentic data
+	flagCD = 0x0010 // checking disabled
+)
+
+// sinkholeTTL is the TTL of sinkhole records: if anyone respects it, this
+// should reduce hits.
+const sinkholeTTL = 0xffffffff
+
+// ednsUDPSize is the UDP payload size advertised in OPT records, which is
+// the size of the buffers queries are read into.
+const ednsUDPSize = 512
+
+// sinkholeSOATTL is the TTL and minimum of the SOA record in negative
+// answers for blocked names.
+const sinkholeSOATTL = 3600
+
+// blockedSOATTL is the TTL and minimum of the SOA records of the blocked
+// zone answered with -dnssec-nxdomain, short so that a name unblocked is
+// asked about again soon.
+const blockedSOATTL = 60
+
+// blockedSOAName is the primary server of the blocked zone.
+const blockedSOAName = "blocked.adhole"
+
+// localTTL is the TTL of locally answered records.
+const localTTL = 300
+
+// Offsets of the record counters in the header.
+const (
+	countAnswer     = 6
+	countAuthority  = 8
+	countAdditional = 10
+)
+
+// newReply starts a response to the query in msg, whose question ends at
+// end, with the given rcode. The opcode, RD and CD are copied from the query,
+// and RA is set. AD never is: nothing made up by AdHole has been validated.
+// With end at headerLen the question is left out. The query is not modified.
+func newReply(msg []byte, end int, rcode int) []byte {
+	reply := make([]byte, end, end+64)
+	copy(reply, msg[:end])
+	flags := binary.BigEndian.Uint16(msg[2:])
+	flags = flagQR | flags&(0x7800|flagRD|flagCD) | flagRA | uint16(rcode&0xf)
+	binary.BigEndian.PutUint16(reply[2:], flags)
+	qdcount := uint16(1)
+	if end == headerLen {
+		qdcount = 0
+	}
+	binary.BigEndian.PutUint16(reply[4:], qdcount)
+	for i := countAnswer; i < headerLen; i++ {
+		reply[i] = 0
+	}
+	return reply
+}
+
+// setFlag sets or clears a header flag of a reply.
+func setFlag(reply []byte, flag uint16, on bool) {
+	flags := binary.BigEndian.Uint16(reply[2:])
+	if on {
+		flags |= flag
+	} else {
+		flags &^= flag
+	}
+	binary.BigEndian.PutUint16(reply[2:], flags)
+}
+
+// appendRecord appends an IN record about the question's name to reply, and
+// bumps the counter at count. Records have to be appended in section order.
+func appendRecord(reply []byte, count int, rrtype uint16, ttl uint32, data []byte) []byte {
+	return appendClassRecord(reply, count, rrtype, classIN, ttl, data)
+}
+
+// appendClassRecord is appendRecord for records of any class.
+func appendClassRecord(reply []byte, count int, rrtype, class uint16, ttl uint32, data []byte) []byte {
+	reply = append(reply, 0xc0, headerLen)
+	reply = binary.BigEndian.AppendUint16(reply, rrtype)
+	reply = binary.BigEndian.AppendUint16(reply, class)
+	reply = binary.BigEndian.AppendUint32(reply, ttl)
+	reply = binary.BigEndian.AppendUint16(reply, uint16(len(data)))
+	reply = append(reply, data...)
+	binary.BigEndian.PutUint16(reply[count:], binary.BigEndian.Uint16(reply[count:])+1)
+	return reply
+}
+
+// appendA appends an A record with ip to the answer section.
+func appendA(reply []byte, ip net.IP, ttl uint32) []byte {
+	return appendRecord(reply, countAnswer, typeA, ttl, ip.To4())
+}
+
+// appendAAAA appends an AAAA record with ip to the answer section.
+func appendAAAA(reply []byte, ip net.IP, ttl uint32) []byte {
+	return appendRecord(reply, countAnswer, typeAAAA, ttl, ip.To16())
+}
+
+// appendTXT appends a TXT record of the given class and strings to the
+// answer section. Strings longer than the 255 bytes a character-string holds
+// are split.
+func appendTXT(reply []byte, class uint16, ttl uint32, strs ...string) []byte {
+	var data []byte
+	for _, s := range strs {
+		for {
+			n := min(len(s), 255)
+			data = append(data, byte(n))
+			data = append(data, s[:n]...)
+			if s = s[n:]; s == "" {
+				break
+			}
+		}
+	}
+	return appendClassRecord(reply, countAnswer, typeTXT, class, ttl, data)
+}
+
+// appendSOA appends a SOA record to the authority section, as used in
+// negative answers. The zone is the question's name and its minimum, which
+// tells how long to cache the negative answer, is ttl.
+func appendSOA(reply []byte, ttl uint32) []byte {
+	return appendZoneSOA(reply, countAuthority, "adhole", ttl)
+}
+
+// appendZoneSOA appends a SOA record of the question's name with the given
+// primary server name to the section counted at count.
+func appendZoneSOA(reply []byte, count int, mname string, ttl uint32) []byte {
+	var data []byte
+	for _, label := range strings.Split(mname, ".") {
+		data = append(data, byte(len(label)))
+		data = append(data, label...)
+	}
+	data = append(data, 0)                            // mname
+	data = append(data, 0xc0, headerLen)              // rname
+	data = binary.BigEndian.AppendUint32(data, 1)     // serial
+	data = binary.BigEndian.AppendUint32(data, 3600)  // refresh
+	data = binary.BigEndian.AppendUint32(data, 600)   // retry
+	data = binary.BigEndian.AppendUint32(data, 86400) // expire
+	data = binary.BigEndian.AppendUint32(data, ttl)   // minimum
+	return appendRecord(reply, count, typeSOA, ttl, data)
+}
+
+// appendOPT appends an OPT record to the additional section, with the DO
+// (DNSSEC OK) bit set as given, and a padding option of pad zero bytes unless
+// pad is negative.
+func appendOPT(reply []byte, do bool, pad int) []byte {
+	reply = append(reply, 0) // root
+	reply = binary.BigEndian.AppendUint16(reply, typeOPT)
+	reply = binary.BigEndian.AppendUint16(reply, ednsUDPSize)
+	var ttl uint32 // extended rcode, version and flags
+	if do {
+		ttl |= 0x8000
+	}
+	reply = binary.BigEndian.AppendUint32(reply, ttl)
+	if pad < 0 {
+		reply = binary.BigEndian.AppendUint16(reply, 0) // no options
+	} else {
+		reply = binary.BigEndian.AppendUint16(reply, uint16(4+pad))
+		reply = binary.BigEndian.AppendUint16(reply, optPadding)
+		reply = binary.BigEndian.AppendUint16(reply, uint16(pad))
+		reply = append(reply, make([]byte, pad)...)
+	}
+	binary.BigEndian.PutUint16(reply[countAdditional:], binary.BigEndian.Uint16(reply[countAdditional:])+1)
+	return reply
+}
+
+// optLen is the size of the OPT record appended by appendOPT, without
+// padding.
+const optLen = 11
+
+// EDNS padding (RFC 7830): the option code, and the block size replies are
+// padded to, as recommended by RFC 8467.
+const (
+	optPadding       = 12
+	paddingBlockSize = 468
+)
+
+// finishReply completes a reply to the query in msg: if the query used EDNS
+// the reply gets an OPT record too, with DO copied from the query. A reply
+// that would be larger than the client accepts over UDP is trimmed to the
+// records that fit. With -pad-responses the reply is padded if the query
+// was. It must be called after all the other records have been appended.
+func finishReply(reply, msg []byte) []byte {
+	edns, do := queryEDNS(msg)
+	size := len(reply)
+	if edns {
+		size += optLen
+	}
+	limit := udpLimit(msg)
+	if size > limit {
+		reply = trimReply(reply, limit-(size-len(reply)))
+	}
+	if edns {
+		pad := -1
+		if *flagPadResp && queryPadded(msg) {
+			pad = padding(len(reply)+optLen+4, limit)
+		}
+		reply = appendOPT(reply, do, pad)
+	}
+	return reply
+}
+
+// padding returns how many bytes of padding bring a reply of size bytes,
+// including an empty padding option, to a multiple of the block size, or
+// only up to limit if that's less. It is 0 if there's no room at all.
+func padding(size, limit int) int {
+	padded := (size + paddingBlockSize - 1) / paddingBlockSize * paddingBlockSize
+	if padded > limit {
+		padded = limit
+	}
+	if padded < size {
+		return 0
+	}
+	return padded - size
+}
+
+// udpLimit returns the largest reply the client of msg accepts over UDP:
+// 512 bytes, or more if it advertises a larger EDNS payload size.
+func udpLimit(msg []byte) int {
+	if size := ednsSize(msg); size > 512 {
+		return size
+	}
+	return 512
+}
+
+// trimReply cuts reply down to the records of its answer and authority
+// sections that end within limit bytes, dropping the additional section and
+// any record cut off. TC is not set: AdHole doesn't answer over TCP, so the
+// client is better off with the records that fit than told to ask there.
+func trimReply(reply []byte, limit int) []byte {
+	off := headerLen
+	if binary.BigEndian.Uint16(reply[4:]) == 1 {
+		if end, err := skipName(reply, headerLen); err == nil && end+4 <= len(reply) {
+			off = end + 4
+		}
+	}
+	full := true
+	for _, count := range []int{countAnswer, countAuthority} {
+		kept := 0
+		for n := int(binary.BigEndian.Uint16(reply[count:])); full && kept < n; kept++ {
+			end, err := skipRecord(reply, off)
+			if err != nil || end > limit {
+				full = false
+				break
+			}
+			off = end
+		}
+		binary.BigEndian.PutUint16(reply[count:], uint16(kept))
+	}
+	binary.BigEndian.PutUint16(reply[countAdditional:], 0)
+	return reply[:off]
+}
@@ -0,0 +1,335 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"net"
+	"strings"
+	"testing"
+)
+
+// wire decodes hex written in groups for reading, e.g. "1234 8180".
+func wire(tb testing.TB, s string) []byte {
+	tb.Helper()
+	msg, err := hex.DecodeString(strings.Join(strings.Fields(s), ""))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return msg
+}
+
+// The parts of the replies to testQuery("example.com.", ...).
+const (
+	wireQuestionA    = "07 6578616d706c65 03 636f6d 00 0001 0001"
+	wireQuestionAAAA = "07 6578616d706c65 03 636f6d 00 001c 0001"
+	wireQuestionTXT  = "07 6578616d706c65 03 636f6d 00 0010 0001"
+	// A record about the name in the question with the sinkhole TTL.
+	wireSinkholeA = "c00c 0001 0001 ffffffff 0004 c0000201"
+)
+
+func TestReplyWire(t *testing.T) {
+	a := testQuery("example.com.", typeA)
+	aaaa := testQuery("example.com.", typeAAAA)
+	txt := testQuery("example.com.", typeTXT)
+	end := len(a)
+	long := strings.Repeat("x", 300)
+
+	tests := []struct {
+		name  string
+		query []byte
+		build func(msg []byte) []byte
+		want  string
+	}{
+		{"NXDOMAIN", a, func(msg []byte) []byte { return newReply(msg, end, rcodeNXDomain) },
+			"1234 8183 0001 0000 0000 0000 " + wireQuestionA},
+		{"FORMERR without question", a, func(msg []byte) []byte { return newReply(msg, headerLen, rcodeFormErr) },
+			"1234 8181 0000 0000 0000 0000"},
+		{"A", a, func(msg []byte) []byte {
+			return appendA(newReply(msg, end, 0), net.IPv4(192, 0, 2, 1), sinkholeTTL)
+		}, "1234 8180 0001 0001 0000 0000 " + wireQuestionA + " " + wireSinkholeA},
+		{"two A", a, func(msg []byte) []byte {
+			reply := appendA(newReply(msg, end, 0), net.IPv4(192, 0, 2, 1), localTTL)
+			return appendA(reply, net.IPv4(192, 0, 2, 2), localTTL)
+		}, "1234 8180 0001 0002 0000 0000 " + wireQuestionA +
+			" c00c 0001 0001 0000012c 0004 c0000201" +
+			" c00c 0001 0001 0000012c 0004 c0000202"},
+		{"AAAA", aaaa, func(msg []byte) []byte {
+			return appendAAAA(newReply(msg, end, 0), net.ParseIP("2001:db8::1"), localTTL)
+		}, "1234 8180 0001 0001 0000 0000 " + wireQuestionAAAA +
+			" c00c 001c 0001 0000012c 0010 20010db8000000000000000000000001"},
+		{"SOA", a, func(msg []byte) []byte { return appendSOA(newReply(msg, end, 0), sinkholeSOATTL) },
+			"1234 8180 0001 0000 0001 0000 " + wireQuestionA +
+				" c00c 0006 0001 00000e10 001e" +
+				" 06 6164686f6c65 00 c00c 00000001 00000e10 00000258 00015180 00000e10"},
+		{"TXT split", txt, func(msg []byte) []byte { return appendTXT(newReply(msg, end, 0), classIN, 0, "v=1", long) },
+			"1234 8180 0001 0001 0000 0000 " + wireQuestionTXT +
+				" c00c 0010 0001 00000000 0132 03 763d31 ff " + strings.Repeat("78", 255) +
+				" 2d " + strings.Repeat("78", 45)},
+		{"OPT", a, func(msg []byte) []byte { return appendOPT(newReply(msg, end, 0), true, -1) },
+			"1234 8180 0001 0000 0000 0001 " + wireQuestionA + " 00 0029 0200 00008000 0000"},
+		{"OPT padded", a, func(msg []byte) []byte { return appendOPT(newReply(msg, end, 0), false, 3) },
+			"1234 8180 0001 0000 0000 0001 " + wireQuestionA + " 00 0029 0200 00000000 0007 000c 0003 000000"},
+	}
+	for _, tt := range tests {
+		query := append([]byte(nil), tt.query...)
+		got := tt.build(query)
+		if want := wire(t, tt.want); !bytes.Equal(got, want) {
+			t.Errorf("%s:\n got % x\nwant % x", tt.name, got, want)
+		}
+		if !bytes.Equal(query, tt.query) {
+			t.Errorf("%s: query modified", tt.name)
+		}
+		if err := walkRecords(got, func(uint16, int) {}); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+// TestReplyHeader checks which query header bits a reply keeps.
+func TestReplyHeader(t *testing.T) {
+	tests := []struct {
+		name  string
+		flags uint16
+		rcode int
+		want  uint16
+	}{
+		{"RD", flagRD, 0, 0x8180},
+		{"no RD", 0, 0, 0x8080},
+		{"CD kept", flagRD | flagCD, 0, 0x8190},
+		{"AA, TC and AD dropped", flagAA | flagTC | flagAD, 0, 0x8080},
+		{"opcode kept", 0x2800 | flagRD, rcodeNotImp, 0xa984},
+		{"response bit and rcode replaced", flagQR | flagRD | 5, rcodeServFail, 0x8182},
+	}
+	for _, tt := range tests {
+		msg := testQuery("example.com.", typeA)
+		msg[2], msg[3] = byte(tt.flags>>8), byte(tt.flags)
+		reply := newReply(msg, len(msg), tt.rcode)
+		if got := uint16(reply[2])<<8 | uint16(reply[3]); got != tt.want {
+			t.Errorf("%s: flags %04x, want %04x", tt.name, got, tt.want)
+		}
+	}
+}
+
+// Replies are trimmed to whole records within the limit, without the
+// additional section and without TC.
+func TestTrimReply(t *testing.T) {
+	msg := testQuery("example.com.", typeA)
+	reply := newReply(msg, len(msg), 0)
+	for i := 1; i <= 3; i++ {
+		reply = appendA(reply, net.IPv4(192, 0, 2, byte(i)), 300)
+	}
+	reply = appendSOA(reply, sinkholeSOATTL)
+	reply = appendOPT(reply, false, -1)
+	const (
+		a1  = " c00c 0001 0001 0000012c 0004 c0000201"
+		a2  = " c00c 0001 0001 0000012c 0004 c0000202"
+		a3  = " c00c 0001 0001 0000012c 0004 c0000203"
+		soa = " c00c 0006 0001 00000e10 001e" +
+			" 06 6164686f6c65 00 c00c 00000001 00000e10 00000258 00015180 00000e10"
+	)
+	full := len(reply) - optLen
+	tests := []struct {
+		name  string
+		reply []byte
+		limit int
+		want  string
+	}{
+		{"all fit", reply, len(reply), "0003 0001 0000 " + wireQuestionA + a1 + a2 + a3 + soa},
+		{"authority cut", reply, full - 1, "0003 0000 0000 " + wireQuestionA + a1 + a2 + a3},
+		{"answers cut", reply, len(msg) + 2*16 + 15, "0002 0000 0000 " + wireQuestionA + a1 + a2},
+		{"question only", reply, len(msg), "0000 0000 0000 " + wireQuestionA},
+		{"record cut off", reply[:len(msg)+2*16+3], 4096, "0002 0000 0000 " + wireQuestionA + a1 + a2},
+	}
+	for _, tt := range tests {
+		got := trimReply(append([]byte(nil), tt.reply...), tt.limit)
+		if want := wire(t, "1234 8180 0001 "+tt.want); !bytes.Equal(got, want) {
+			t.Errorf("%s:\n got % x\nwant % x", tt.name, got, want)
+		}
+	}
+}
+
+// A name of 127 labels, the most there can be, still gets as many of its
+// records as fit the client's limit, and never TC.
+func TestLongNameReplies(t *testing.T) {
+	name := strings.Repeat("a.", 127)
+	lr := &localRule{}
+	for i := 0; i < 40; i++ {
+		lr.addrs = append(lr.addrs, net.IPv4(192, 0, 2, byte(i)).To4())
+	}
+	tests := []struct {
+		name    string
+		query   []byte
+		rule    *localRule
+		limit   int
+		answers int
+	}{
+		{"blocked", testQuery(name, typeA), nil, 512, 1},
+		{"blocked, EDNS", ednsQuery(name, typeA, 1232, true), nil, 1232, 1},
+		{"local", testQuery(name, typeA), lr, 512, 15},
+		{"local, EDNS 512", ednsQuery(name, typeA, 512, false), lr, 512, 14},
+		{"local, EDNS 1232", ednsQuery(name, typeA, 1232, false), lr, 1232, 40},
+	}
+	for _, tt := range tests {
+		_, _, end, err := parseQuestion(tt.query)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if end != headerLen+255+4 {
+			t.Fatalf("%s: question of %d bytes", tt.name, end-headerLen)
+		}
+		var reply []byte
+		if tt.rule != nil {
+			reply = localReply(tt.query, end, typeA, tt.rule)
+		} else {
+			reply = blockedReply(tt.query, end, typeA, net.IPv4(0, 0, 0, 0), nil)
+		}
+		if len(reply) > tt.limit {
+			t.Errorf("%s: %d bytes, over %d", tt.name, len(reply), tt.limit)
+		}
+		if reply[2]&0x02 != 0 {
+			t.Errorf("%s: TC set", tt.name)
+		}
+		if n := int(binary.BigEndian.Uint16(reply[countAnswer:])); n != tt.answers {
+			t.Errorf("%s: %d answers, want %d", tt.name, n, tt.answers)
+		}
+		if err := walkRecords(reply, func(uint16, int) {}); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+}
+
+func TestPadding(t *testing.T) {
+	tests := []struct {
+		size, limit, want int
+	}{
+		{100, 4096, 368},
+		{468, 4096, 0},
+		{469, 4096, 467},
+		{100, 400, 300},
+		{600, 512, 0},
+	}
+	for _, tt := range tests {
+		if got := padding(tt.size, tt.limit); got != tt.want {
+			t.Errorf("padding(%d, %d) = %d, want %d", tt.size, tt.limit, got, tt.want)
+		}
+	}
+}
+
+// TestBlockedReplyFlags checks the exact flag bytes of sinkhole answers.
+func TestBlockedReplyFlags(t *testing.T) {
+	tests := []struct {
+		name  string
+		rd    bool
+		aa    bool
+		qtype uint16
+		want  [2]byte
+	}{
+		{"RD", true, false, typeA, [2]byte{0x81, 0x80}},
+		{"no RD", false, false, typeA, [2]byte{0x80, 0x80}},
+		{"RD, AA", true, true, typeA, [2]byte{0x85, 0x80}},
+		{"no RD, AA", false, true, typeA, [2]byte{0x84, 0x80}},
+		{"NODATA, RD", true, false, typeMX, [2]byte{0x81, 0x80}},
+		{"NODATA, no RD, AA", false, true, typeMX, [2]byte{0x84, 0x80}},
+	}
+	for _, tt := range tests {
+		withFlag(t, flagSinkAA, tt.aa)
+		msg := testQuery("example.com.", tt.qtype)
+		setFlag(msg, flagRD, tt.rd)
+		reply := blockedReply(msg, len(msg), tt.qtype, net.IPv4(192, 0, 2, 1), nil)
+		if got := [2]byte{reply[2], reply[3]}; got != tt.want {
+			t.Errorf("%s: flags % x, want % x", tt.name, got, tt.want)
+		}
+	}
+}
+
+// ednsQueries are EDNS queries for ads.example.com as clients send them.
+var ednsQueries = []struct {
+	name  string
+	query string
+	do    bool
+}{
+	// Captured from the Go resolver (net.Resolver with PreferGo).
+	{"Go resolver A", "4e7d 0100 0001 0000 0000 0001 03616473 076578616d706c65 03636f6d 00 0001 0001" +
+		" 00 0029 04d0 00000000 0000", false},
+	{"Go resolver AAAA", "af1d 0100 0001 0000 0000 0001 03616473 076578616d706c65 03636f6d 00 001c 0001" +
+		" 00 0029 04d0 00000000 0000", false},
+	// As sent by dig +edns: AD set, and a client cookie.
+	{"dig +edns", "5c0e 0120 0001 0000 0000 0001 03616473 076578616d706c65 03636f6d 00 0001 0001" +
+		" 00 0029 04d0 00000000 000c 000a 0008 a3f16c0d92e8b157", false},
+	{"dig +dnssec", "7b42 0120 0001 0000 0000 0001 03616473 076578616d706c65 03636f6d 00 0001 0001" +
+		" 00 0029 04d0 00008000 000c 000a 0008 a3f16c0d92e8b157", true},
+}
+
+func TestBlockedReplyOPT(t *testing.T) {
+	sinkhole := net.IPv4(192, 0, 2, 1)
+	for _, tt := range ednsQueries {
+		msg := wire(t, tt.query)
+		_, qtype, end, err := parseQuestion(msg)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		reply := blockedReply(msg, end, qtype, sinkhole, nil)
+		if reply[10] != 0 || reply[11] != 1 {
+			t.Errorf("%s: %d additional records, want 1", tt.name, int(reply[10])<<8|int(reply[11]))
+		}
+		opt := "00 0029 0200 00000000 0000"
+		if tt.do {
+			opt = "00 0029 0200 00008000 0000"
+		}
+		if want := wire(t, opt); !bytes.HasSuffix(reply, want) {
+			t.Errorf("%s: reply ends % x, want % x", tt.name, reply[len(reply)-len(want):], want)
+		}
+		if edns, do := queryEDNS(reply); !edns || do != tt.do {
+			t.Errorf("%s: reply EDNS %v, DO %v", tt.name, edns, do)
+		}
+		if err := walkRecords(reply, func(uint16, int) {}); err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+		}
+	}
+
+	// No OPT for a query without one.
+	msg := testQuery("ads.example.com.", typeA)
+	if reply := blockedReply(msg, len(msg), typeA, sinkhole, nil); reply[10] != 0 || reply[11] != 0 {
+		t.Error("OPT added to a reply to a query without EDNS")
+	}
+}
+
+// TestBlockedTypes asks a listener about a blocked name with the types
+// that get different answers, with and without an IPv6 sinkhole.
+func TestBlockedTypes(t *testing.T) {
+	withBlocked(t, "ads.example.com.")
+	l := startListener(t, false)
+	t.Cleanup(func() { curSinks.Store(nil) })
+	const (
+		sinkA    = "c00c 0001 0001 ffffffff 0004 7f000001"
+		sinkAAAA = "c00c 001c 0001 ffffffff 0010 20010db8000000000000000000000001"
+		nodata   = "c00c 0006 0001 00000e10 001e 06 6164686f6c65 00 c00c 00000001 00000e10 00000258 00015180 00000e10"
+	)
+	tests := []struct {
+		name    string
+		qtype   uint16
+		v6      net.IP
+		counts  string
+		records string
+	}{
+		{"A", typeA, nil, "0001 0000", sinkA},
+		{"AAAA without IPv6 sinkhole", typeAAAA, nil, "0000 0001", nodata},
+		{"A with IPv6 sinkhole", typeA, net.ParseIP("2001:db8::1"), "0001 0000", sinkA},
+		{"AAAA with IPv6 sinkhole", typeAAAA, net.ParseIP("2001:db8::1"), "0001 0000", sinkAAAA},
+		{"MX", typeMX, net.ParseIP("2001:db8::1"), "0000 0001", nodata},
+		{"HTTPS", typeHTTPS, nil, "0000 0001", nodata},
+		{"ANY", typeANY, nil, "0001 0000", sinkA},
+	}
+	for _, tt := range tests {
+		curSinks.Store(&sinkholes{v6: tt.v6})
+		msg := testQuery("ads.example.com.", tt.qtype)
+		question := hex.EncodeToString(msg[headerLen:])
+		want := wire(t, "1234 8180 0001 "+tt.counts+" 0000 "+question+" "+tt.records)
+		if got := ask(t, l, msg); !bytes.Equal(got, want) {
+			t.Errorf("%s:\n got % x\nwant % x", tt.name, got, want)
+		}
+	}
+}
@@ -0,0 +1,28 @@
+// See LICENSE.txt for licensing information.
+//go:build linux && !mips && !mipsle && !mips64 && !mips64le
+// +build linux,!mips,!mipsle,!mips64,!mips64le
+
+package main
+
+import (
+	"syscall"
+)
+
+// soReusePort is SO_REUSEPORT, which the syscall package lacks on some
+// architectures.
+const soReusePort = 0xf
+
+// reusePortSupported tells if several sockets may share an address.
+const reusePortSupported = true
+
+// reusePort sets SO_REUSEPORT on a socket before it is bound.
+func reusePort(network, address string, c syscall.RawConn) error {
+	var err error
+	cerr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soReusePort, 1)
+	})
+	if cerr != nil {
+		return cerr
+	}
+	return err
+}
@@ -0,0 +1,18 @@
+// See LICENSE.txt for licensing information.
+//go:build !linux || mips || mipsle || mips64 || mips64le
+// +build !linux mips mipsle mips64 mips64le
+
+package main
+
+import (
+	"errors"
+	"syscall"
+)
+
+// reusePortSupported tells if several sockets may share an address.
+const reusePortSupported = false
+
+// reusePort is not supported on this platform.
+func reusePort(network, address string, c syscall.RawConn) error {
+	return errors.New("SO_REUSEPORT is not supported on this platform")
+}
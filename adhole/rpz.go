@@ -0,0 +1,107 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"errors"
+	"net"
+	"strings"
+)
+
+// rpzTypes are the record types recognized in RPZ zone files.
+var rpzTypes = map[string]bool{
+	"A": true, "AAAA": true, "CNAME": true, "SOA": true, "NS": true, "TXT": true,
+}
+
+// rpzTriggers are the owner name labels of RPZ triggers other than QNAME,
+// which don't apply to a forwarder that doesn't look into answers.
+var rpzTriggers = []string{"rpz-ip", "rpz-nsip", "rpz-nsdname", "rpz-client-ip"}
+
+// parseRPZLine parses the lines of a Response Policy Zone file, as used for
+// threat intelligence feeds. QNAME policies are supported:
+//
+//	ads.example.com CNAME .   - NXDOMAIN
+//	ads.example.com CNAME *.  - NODATA
+//	ads.example.com A 0.0.0.0 - answer with the address (also AAAA)
+//	*.ads.example.com ...     - the same for subdomains
+//
+// Owner names are relative to the zone, and like all list rules apply to the
+// name and its subdomains. SOA and NS records and $ORIGIN and $TTL directives
+// are understood, other policies and triggers are skipped with an error.
+func parseRPZLine(st *listState, line string) ([]listRule, bool, error) {
+	if i := strings.IndexByte(line, ';'); i >= 0 {
+		line = strings.TrimSpace(line[:i])
+		if line == "" {
+			return nil, true, nil // comment
+		}
+	}
+	if st.paren {
+		st.paren = !strings.Contains(line, ")")
+		return nil, true, nil
+	}
+	fields := strings.Fields(line)
+	switch {
+	case len(fields) == 2 && fields[0] == "$ORIGIN":
+		st.origin = strings.ToLower(fields[1])
+		return nil, true, nil
+	case len(fields) == 2 && fields[0] == "$TTL":
+		return nil, true, nil
+	case len(fields) > 0 && rpzTypes[strings.ToUpper(fields[0])]:
+		// A record without an owner, i.e. the previous one, the apex's NS.
+		st.paren = strings.Contains(line, "(") && !strings.Contains(line, ")")
+		return nil, true, nil
+	}
+
+	// owner [ttl] [class] type rdata
+	typ := 1
+	for typ < len(fields) && typ < 4 && !rpzTypes[strings.ToUpper(fields[typ])] {
+		typ++
+	}
+	if typ >= len(fields)-1 || typ == 4 {
+		return nil, false, nil
+	}
+	owner, rrtype, rdata := strings.ToLower(fields[0]), strings.ToUpper(fields[typ]), fields[typ+1]
+	if strings.Contains(line, "(") && !strings.Contains(line, ")") {
+		st.paren = true
+	}
+	if rrtype == "SOA" {
+		if st.origin == "" && strings.HasSuffix(owner, ".") {
+			st.origin = owner
+		}
+		return nil, true, nil
+	}
+	if rrtype == "NS" || rrtype == "TXT" || owner == "@" {
+		return nil, true, nil
+	}
+
+	name := owner
+	if strings.HasSuffix(name, ".") {
+		name = strings.TrimSuffix(strings.TrimSuffix(name, st.origin), ".")
+	}
+	name = strings.TrimPrefix(name, "*.")
+	for _, trigger := range rpzTriggers {
+		if strings.HasSuffix(name, "."+trigger) {
+			return nil, true, errors.New("RPZ " + trigger + " trigger not supported")
+		}
+	}
+	if !validName(name) {
+		return nil, true, errors.New("bad RPZ owner name")
+	}
+
+	rule := listRule{Name: name}
+	switch {
+	case rrtype == "CNAME" && rdata == ".":
+		rule.NXDomain = true
+	case rrtype == "CNAME" && rdata == "*.":
+		rule.NoData = true
+	case rrtype == "CNAME":
+		return nil, true, errors.New("RPZ CNAME " + rdata + " policy not supported")
+	default: // A or AAAA
+		ip := net.ParseIP(rdata)
+		if ip == nil || (rrtype == "A") != (ip.To4() != nil) {
+			return nil, true, errors.New("bad RPZ " + rrtype + " record")
+		}
+		rule.Addrs = []net.IP{ip}
+	}
+	return []listRule{rule}, true, nil
+}
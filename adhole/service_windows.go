@@ -0,0 +1,203 @@
+// See LICENSE.txt for licensing information.
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"log"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// Service control manager constants, see winsvc.h.
+const (
+	serviceWin32OwnProcess = 0x10
+
+	serviceStopped     = 1
+	serviceStopPending = 3
+	serviceRunning     = 4
+
+	serviceAcceptStop        = 0x1
+	serviceAcceptShutdown    = 0x4
+	serviceAcceptParamChange = 0x8
+
+	serviceControlStop        = 1
+	serviceControlInterrogate = 4
+	serviceControlShutdown    = 5
+	serviceControlParamChange = 6
+
+	errorCallNotImplemented          = 120
+	errorServiceSpecificError        = 1066
+	errorFailedServiceControllerConn = 1063
+)
+
+var (
+	advapi32                         = syscall.NewLazyDLL("advapi32.dll")
+	procStartServiceCtrlDispatcherW  = advapi32.NewProc("StartServiceCtrlDispatcherW")
+	procRegisterServiceCtrlHandlerEx = advapi32.NewProc("RegisterServiceCtrlHandlerExW")
+	procSetServiceStatus             = advapi32.NewProc("SetServiceStatus")
+)
+
+// serviceTableEntry mirrors SERVICE_TABLE_ENTRYW.
+type serviceTableEntry struct {
+	name *uint16
+	proc uintptr
+}
+
+// serviceStatus mirrors SERVICE_STATUS.
+type serviceStatus struct {
+	serviceType             uint32
+	currentState            uint32
+	controlsAccepted        uint32
+	win32ExitCode           uint32
+	serviceSpecificExitCode uint32
+	checkPoint              uint32
+	waitHint                uint32
+}
+
+var (
+	serviceStop   chan struct{}
+	serviceHandle uintptr
+	// serviceStarted is closed once serviceMain runs, and serviceDone
+	// hands it the exit status once run has returned.
+	serviceStarted = make(chan struct{})
+	serviceDone    = make(chan int)
+	// dispatched is closed when the service control dispatcher returns.
+	dispatched chan struct{}
+	// stopOnce closes serviceStop: the service may be asked to stop and
+	// be shut down with the system, or be asked to stop twice.
+	stopOnce sync.Once
+
+	statusMu   sync.Mutex
+	checkPoint uint32 // of the last stop pending state reported
+)
+
+// serviceStopWait is the wait hint given with each stop pending state,
+// reported every second while stopping.
+const serviceStopWait = 10 * time.Second
+
+// setServiceState reports the current state to the service control manager,
+// with the exit status code once stopped.
+func setServiceState(state uint32, code int) {
+	statusMu.Lock()
+	defer statusMu.Unlock()
+	status := serviceStatus{
+		serviceType:  serviceWin32OwnProcess,
+		currentState: state,
+	}
+	switch state {
+	case serviceRunning:
+		status.controlsAccepted = serviceAcceptStop | serviceAcceptShutdown | serviceAcceptParamChange
+	case serviceStopPending:
+		checkPoint++
+		status.checkPoint = checkPoint
+		status.waitHint = uint32(serviceStopWait / time.Millisecond)
+	case serviceStopped:
+		if code != 0 {
+			status.win32ExitCode = errorServiceSpecificError
+			status.serviceSpecificExitCode = uint32(code)
+		}
+	}
+	procSetServiceStatus.Call(serviceHandle, uintptr(unsafe.Pointer(&status)))
+}
+
+// stopService makes sigwait return, if it didn't yet.
+func stopService() {
+	stopOnce.Do(func() { close(serviceStop) })
+}
+
+// serviceHandler maps service control requests onto the same lifecycle
+// actions as the Unix signals: stop and shutdown stop, paramchange reloads.
+func serviceHandler(ctrl, evtype, evdata, context uintptr) uintptr {
+	switch ctrl {
+	case serviceControlStop, serviceControlShutdown:
+		log.Println("Service stop requested, stopping")
+		setServiceState(serviceStopPending, 0)
+		stopService()
+	case serviceControlParamChange:
+		log.Println("Service paramchange requested, reloading")
+		reload()
+	case serviceControlInterrogate:
+	default:
+		return errorCallNotImplemented
+	}
+	return 0
+}
+
+// serviceMain is called by the service control manager on its own thread.
+// It reports the service running until it is stopped, then stopping until
+// run is done, and only then stopped.
+func serviceMain(argc, argv uintptr) uintptr {
+	name, _ := syscall.UTF16PtrFromString("adhole")
+	serviceHandle, _, _ = procRegisterServiceCtrlHandlerEx.Call(
+		uintptr(unsafe.Pointer(name)),
+		syscall.NewCallback(serviceHandler),
+		0,
+	)
+	if serviceHandle == 0 {
+		log.Println("ERROR: Can't register service control handler")
+		return 0
+	}
+	setServiceState(serviceRunning, 0)
+	close(serviceStarted)
+	<-serviceStop
+
+	tick := time.NewTicker(time.Second)
+	defer tick.Stop()
+	for {
+		setServiceState(serviceStopPending, 0)
+		select {
+		case code := <-serviceDone:
+			setServiceState(serviceStopped, code)
+			return 0
+		case <-tick.C:
+		}
+	}
+}
+
+// startService starts the service control dispatcher, which runs until the
+// service is stopped. It returns false if not started as a service, and
+// true once the service runs: stop is closed when it is to stop.
+func startService(stop chan struct{}) bool {
+	serviceStop = stop
+	dispatched = make(chan struct{})
+	failed := make(chan error, 1)
+	go func() {
+		defer close(dispatched)
+		name, _ := syscall.UTF16PtrFromString("adhole")
+		table := []serviceTableEntry{
+			{name: name, proc: syscall.NewCallback(serviceMain)},
+			{},
+		}
+		ok, _, err := procStartServiceCtrlDispatcherW.Call(uintptr(unsafe.Pointer(&table[0])))
+		if ok == 0 {
+			failed <- err
+		}
+	}()
+	select {
+	case <-serviceStarted:
+		return true
+	case err := <-failed:
+		if errno, isErrno := err.(syscall.Errno); !isErrno || errno != errorFailedServiceControllerConn {
+			log.Println("ERROR: Service dispatcher:", err)
+		}
+		return false
+	}
+}
+
+// exitService reports the service stopped with the exit status code,
+// once run has returned, and waits for the dispatcher to end. It does
+// nothing if not run as a service.
+func exitService(code int) {
+	select {
+	case <-serviceStarted:
+	default:
+		return
+	}
+	stopService()
+	serviceDone <- code
+	<-dispatched
+}
@@ -1,4 +1,5 @@
 // See LICENSE.txt for licensing information.
+//go:build !windows
 // +build !windows
 
 package main
@@ -10,13 +11,40 @@ import (
 	"syscall"
 )
 
-// sigwait processes signals such as a CTRL-C hit.
-func sigwait() {
-	sig := make(chan os.Signal)
-	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGKILL)
+// sigwait processes signals such as a CTRL-C hit. SIGHUP reloads the list,
+// SIGUSR1 reopens the log files, SIGINT and SIGTERM make it return, as does a
+// server loop ending. The failure of the server loop is returned, nil if
+// stopped by a signal.
+func sigwait() error {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP, syscall.SIGUSR1)
 
-	<-sig
-	log.Println("Signal received, stopping")
-
-	return
+	for {
+		select {
+		case s := <-sig:
+			if s == syscall.SIGHUP {
+				log.Println("Signal received, reloading")
+				reload()
+				continue
+			}
+			if s == syscall.SIGUSR1 {
+				if logger != nil {
+					logger.Reopen()
+					log.Println("Signal received, reopened log file")
+				}
+				if queryLog != nil {
+					queryLog.Reopen()
+				}
+				continue
+			}
+			log.Println("Signal received, stopping")
+		case err := <-failed:
+			log.Println("Server stopped, stopping:", err)
+			return err
+		}
+		return nil
+	}
 }
+
+// exitService does nothing: there are no Windows services here.
+func exitService(code int) {}
@@ -1,4 +1,5 @@
 // See LICENSE.txt for licensing information.
+//go:build windows
 // +build windows
 
 package main
@@ -9,13 +10,32 @@ import (
 	"os/signal"
 )
 
-// sigwait processes signals such as a CTRL-C hit.
-func sigwait() {
-	sig := make(chan os.Signal)
-	signal.Notify(sig, os.Interrupt, os.Kill)
+// sigwait processes signals such as a CTRL-C hit. When running as a Windows
+// service it waits for the service to be stopped instead, reported stopped
+// by exitService after. The failure of a server loop that made it return is
+// returned, nil if stopped otherwise.
+func sigwait() error {
+	stop := make(chan struct{})
+	if startService(stop) {
+		select {
+		case <-stop:
+			return nil
+		case err := <-failed:
+			log.Println("Server stopped, stopping:", err)
+			stopService()
+			return err
+		}
+	}
 
-	<-sig
-	log.Println("Signal received, stopping")
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt)
 
-	return
+	select {
+	case <-sig:
+		log.Println("Signal received, stopping")
+	case err := <-failed:
+		log.Println("Server stopped, stopping:", err)
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,112 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// sinkholes are the addresses blocked names are answered with. They are
+// replaced as a whole, never changed, so a query sees either the old or the
+// new ones.
+type sinkholes struct {
+	v4 net.IP // nil - the address the query was sent to
+	v6 net.IP // nil - no records
+}
+
+// curSinks are the sinkholes in use, -sinkhole6 and the listeners' own
+// addresses until /api/sinkhole changes them.
+var curSinks atomic.Pointer[sinkholes]
+
+// currentSinkholes returns the sinkholes in use.
+func currentSinkholes() *sinkholes {
+	if sh := curSinks.Load(); sh != nil {
+		return sh
+	}
+	return &sinkholes{v6: sinkhole6}
+}
+
+// sinkholeView is the sinkholes as shown by the API, empty for the default.
+type sinkholeView struct {
+	IPv4 string `json:"ipv4"`
+	IPv6 string `json:"ipv6"`
+}
+
+// view returns sh as shown by the API.
+func (sh *sinkholes) view() sinkholeView {
+	var v sinkholeView
+	if sh.v4 != nil {
+		v.IPv4 = sh.v4.String()
+	}
+	if sh.v6 != nil {
+		v.IPv6 = sh.v6.String()
+	}
+	return v
+}
+
+// handleAPISinkhole shows the sinkholes, and with a POST changes them: ipv4
+// and ipv6 set the addresses blocked A and AAAA queries are answered with,
+// where given, and an empty value goes back to the address the query was sent
+// to, or no records. Addresses that aren't this host's, or that the HTTP
+// server doesn't listen on, are refused unless force is set, as blocked
+// clients wouldn't reach the pixel there. Both need the key.
+func handleAPISinkhole(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	reply := func(status int, msg string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+	}
+	if !authHTTP(req) {
+		reply(http.StatusForbidden, "bad key")
+		return
+	}
+	old := currentSinkholes()
+	if req.Method != http.MethodPost {
+		json.NewEncoder(w).Encode(old.view())
+		return
+	}
+
+	sh := *old
+	force := req.FormValue("force") != ""
+	if arg, ok := req.Form["ipv4"]; ok {
+		sh.v4 = nil
+		if arg[0] != "" {
+			if sh.v4 = net.ParseIP(arg[0]).To4(); sh.v4 == nil || sh.v4.IsUnspecified() {
+				reply(http.StatusBadRequest, "bad ipv4")
+				return
+			}
+		}
+	}
+	if arg, ok := req.Form["ipv6"]; ok {
+		sh.v6 = nil
+		if arg[0] != "" {
+			if sh.v6 = net.ParseIP(arg[0]); sh.v6 == nil || sh.v6.To4() != nil || sh.v6.IsUnspecified() {
+				reply(http.StatusBadRequest, "bad ipv6")
+				return
+			}
+		}
+	}
+	for _, ip := range []net.IP{sh.v4, sh.v6} {
+		if ip == nil || force {
+			continue
+		}
+		if !isLocalIP(ip) {
+			reply(http.StatusBadRequest, ip.String()+" is not an address of this host, set force to use it anyway")
+			return
+		}
+		if len(httpBound) > 0 && !servesHTTP(httpBound, ip, *flagHTTPPort) {
+			addr := net.JoinHostPort(ip.String(), strconv.Itoa(*flagHTTPPort))
+			reply(http.StatusBadRequest, "the HTTP server doesn't listen on "+addr+", set force to use it anyway")
+			return
+		}
+	}
+	curSinks.Store(&sh)
+	v := sh.view()
+	log.Printf("HTTP: Sinkhole set to %q and %q\n", v.IPv4, v.IPv6)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,102 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// Sinkholes must be addresses blocked clients reach the pixel at: of this
+// host and listened on by the HTTP server, unless forced.
+func TestSinkholeSwap(t *testing.T) {
+	withFlag(t, &key, "secret")
+	withFlag(t, flagHTTPPort, 80)
+	on4 := []*net.TCPAddr{{IP: net.IPv4(127, 0, 0, 1), Port: 80}}
+	any := []*net.TCPAddr{{IP: net.IPv4zero, Port: 80}, {IP: net.IPv6unspecified, Port: 80}}
+	tests := []struct {
+		name   string
+		bound  []*net.TCPAddr
+		form   string
+		status int
+		want   sinkholeView
+	}{
+		{"listened on", on4, "ipv4=127.0.0.1", http.StatusOK, sinkholeView{IPv4: "127.0.0.1"}},
+		{"not listened on", on4, "ipv4=127.0.0.2", http.StatusBadRequest, sinkholeView{}},
+		{"other port", []*net.TCPAddr{{IP: net.IPv4(127, 0, 0, 2), Port: 8080}}, "ipv4=127.0.0.2", http.StatusBadRequest, sinkholeView{}},
+		{"forced", on4, "ipv4=127.0.0.2&force=1", http.StatusOK, sinkholeView{IPv4: "127.0.0.2"}},
+		{"wildcard", any, "ipv4=127.0.0.2&ipv6=::1", http.StatusOK, sinkholeView{IPv4: "127.0.0.2", IPv6: "::1"}},
+		{"IPv6 not listened on", on4, "ipv6=::1", http.StatusBadRequest, sinkholeView{}},
+		{"no HTTP server", nil, "ipv4=127.0.0.2", http.StatusOK, sinkholeView{IPv4: "127.0.0.2"}},
+		{"not local", nil, "ipv4=192.0.2.1", http.StatusBadRequest, sinkholeView{}},
+		{"unspecified", any, "ipv4=0.0.0.0", http.StatusBadRequest, sinkholeView{}},
+		{"back to default", on4, "ipv4=", http.StatusOK, sinkholeView{}},
+	}
+	for _, tt := range tests {
+		httpBound = tt.bound
+		curSinks.Store(nil)
+		form, _ := url.ParseQuery(tt.form)
+		form.Set("key", key)
+		req := httptest.NewRequest(http.MethodPost, "/api/sinkhole", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		handleAPISinkhole(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+		if got := currentSinkholes().view(); got != tt.want {
+			t.Errorf("%s: sinkholes %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+	httpBound = nil
+	curSinks.Store(nil)
+}
+
+// The self name must be answered with the sinkholes in use, like blocked
+// names, also after they were swapped.
+func TestSelfNameSinkholes(t *testing.T) {
+	withFlag(t, &selfName, "adhole.home.")
+	withBlocked(t, "ads.example.com.")
+	l := startListener(t, false)
+	t.Cleanup(func() { curSinks.Store(nil) })
+	for _, sh := range []*sinkholes{
+		{},
+		{v4: net.IPv4(127, 0, 0, 2).To4(), v6: net.ParseIP("::1")},
+	} {
+		curSinks.Store(sh)
+		for _, qtype := range []uint16{typeA, typeAAAA} {
+			self := ask(t, l, testQuery("adhole.home.", qtype))
+			blocked := ask(t, l, testQuery("ads.example.com.", qtype))
+			if !equalAddrs(self, blocked) {
+				t.Errorf("%+v type %d: self name answered % x, blocked name % x", sh.view(), qtype, self, blocked)
+			}
+		}
+	}
+}
+
+// equalAddrs reports whether the answers a and b have the same address
+// records, whatever their TTLs and other records.
+func equalAddrs(a, b []byte) bool {
+	_, _, endA, errA := parseQuestion(a)
+	_, _, endB, errB := parseQuestion(b)
+	if errA != nil || errB != nil || string(a[6:8]) != string(b[6:8]) {
+		return false
+	}
+	records := func(msg []byte) string {
+		var rrs []string
+		walkRecords(msg, func(rrtype uint16, off int) {
+			if rrtype != typeA && rrtype != typeAAAA {
+				return
+			}
+			n := int(binary.BigEndian.Uint16(msg[off+8:]))
+			rrs = append(rrs, string(msg[off:off+4])+string(msg[off+10:off+10+n]))
+		})
+		return strings.Join(rrs, "|")
+	}
+	return endA > 0 && endB > 0 && records(a) == records(b)
+}
@@ -0,0 +1,142 @@
+// See LICENSE.txt for licensing information.
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bufio"
+	"expvar"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+var (
+	// cntSocketDrops is the number of packets the kernel dropped on our
+	// sockets, as their receive buffers were full.
+	cntSocketDrops = expvar.NewInt("statsSocketDrops")
+	// sockDrops and sockQueued are, per socket, the packets the kernel
+	// dropped and the bytes waiting in the receive buffer.
+	sockDrops  = expvar.NewMap("socketDrops")
+	sockQueued = expvar.NewMap("socketQueued")
+)
+
+// socketBuffers returns the effective receive and send buffer sizes.
+func socketBuffers(conn *net.UDPConn) (rcv, snd int) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return -1, -1
+	}
+	raw.Control(func(fd uintptr) {
+		var err error
+		if rcv, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF); err != nil {
+			rcv = -1
+		}
+		if snd, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF); err != nil {
+			snd = -1
+		}
+	})
+	return
+}
+
+// socketInode returns the inode of a socket, as seen in /proc/net/udp.
+func socketInode(conn *net.UDPConn) uint64 {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0
+	}
+	var stat syscall.Stat_t
+	raw.Control(func(fd uintptr) {
+		if syscall.Fstat(int(fd), &stat) != nil {
+			stat.Ino = 0
+		}
+	})
+	return uint64(stat.Ino)
+}
+
+// watchSocketDrops periodically reads the kernel counters of the given
+// sockets from /proc/net/udp and /proc/net/udp6, the same ones SO_MEMINFO
+// returns: the drops go to statsSocketDrops and, with the bytes queued, to
+// socketDrops and socketQueued by socket. A connected socket, i.e. the
+// upstream one, is shown by its remote address, the others by their local
+// one.
+func watchSocketDrops(conns []*net.UDPConn, every time.Duration) {
+	names := make(map[uint64]string, len(conns))
+	for _, conn := range conns {
+		if ino := socketInode(conn); ino != 0 {
+			if addr := conn.RemoteAddr(); addr != nil {
+				names[ino] = "upstream " + addr.String()
+			} else {
+				names[ino] = conn.LocalAddr().String()
+			}
+		}
+	}
+	for {
+		stats := make(map[uint64]socketStats, len(names))
+		for _, file := range []string{"/proc/net/udp", "/proc/net/udp6"} {
+			if err := readSocketStats(file, names, stats); err != nil && !os.IsNotExist(err) {
+				log.Println("DNS ERROR: Can't read socket drops:", err)
+				return
+			}
+		}
+		var total int64
+		for ino, st := range stats {
+			total += st.drops
+			setInt(sockDrops, names[ino], st.drops)
+			setInt(sockQueued, names[ino], st.queued)
+		}
+		cntSocketDrops.Set(total)
+		time.Sleep(every)
+	}
+}
+
+// socketStats are the kernel counters of a socket.
+type socketStats struct {
+	drops  int64 // packets dropped
+	queued int64 // bytes waiting to be read
+}
+
+// setInt sets the value of key in m.
+func setInt(m *expvar.Map, key string, value int64) {
+	v, ok := m.Get(key).(*expvar.Int)
+	if !ok {
+		v = new(expvar.Int)
+		m.Set(key, v)
+	}
+	v.Set(value)
+}
+
+// readSocketStats adds the counters of the sockets with the inodes in names
+// listed in file, in the format of /proc/net/udp, to stats.
+func readSocketStats(file string, names map[uint64]string, stats map[uint64]socketStats) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scn := bufio.NewScanner(f)
+	scn.Scan() // header
+	for scn.Scan() {
+		fields := strings.Fields(scn.Text())
+		if len(fields) < 13 {
+			continue
+		}
+		ino, err := strconv.ParseUint(fields[9], 10, 64)
+		if _, ok := names[ino]; err != nil || !ok {
+			continue
+		}
+		var st socketStats
+		st.drops, _ = strconv.ParseInt(fields[12], 10, 64)
+		if _, rx, ok := strings.Cut(fields[4], ":"); ok {
+			st.queued, _ = strconv.ParseInt(rx, 16, 64)
+		}
+		stats[ino] = st
+	}
+	return scn.Err()
+}
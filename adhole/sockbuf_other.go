@@ -0,0 +1,19 @@
+// See LICENSE.txt for licensing information.
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// socketBuffers can't tell the effective buffer sizes on this platform.
+func socketBuffers(conn *net.UDPConn) (rcv, snd int) {
+	return -1, -1
+}
+
+// watchSocketDrops is not supported on this platform.
+func watchSocketDrops(conns []*net.UDPConn, every time.Duration) {
+}
@@ -0,0 +1,335 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"strings"
+)
+
+// sqliteDB reads the rows of tables in an SQLite database file, as much of
+// the file format as it takes to read Pi-hole's gravity.db without a
+// driver. Indexes, WITHOUT ROWID tables and write-ahead logs aren't read.
+type sqliteDB struct {
+	f      *os.File
+	size   int // of a page
+	usable int // bytes of a page, without the reserved ones at the end
+	pages  int
+}
+
+var errSQLiteCorrupt = errors.New("malformed SQLite database")
+
+// sqliteMaxDepth limits how deep table b-trees are followed, so that a
+// corrupt file with a loop in one can't recurse forever.
+const sqliteMaxDepth = 32
+
+// openSQLite opens the SQLite database at path for reading.
+func openSQLite(path string) (*sqliteDB, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	hdr := make([]byte, 100)
+	if _, err := io.ReadFull(f, hdr); err != nil || string(hdr[:16]) != "SQLite format 3\x00" {
+		f.Close()
+		return nil, fmt.Errorf("%s: not an SQLite database", path)
+	}
+	db := &sqliteDB{f: f, size: int(binary.BigEndian.Uint16(hdr[16:]))}
+	if db.size == 1 {
+		db.size = 65536
+	}
+	db.usable = db.size - int(hdr[20])
+	if db.size < 512 || db.size&(db.size-1) != 0 || db.usable < 480 {
+		f.Close()
+		return nil, fmt.Errorf("%s: %w", path, errSQLiteCorrupt)
+	}
+	if enc := binary.BigEndian.Uint32(hdr[56:]); enc > 1 {
+		f.Close()
+		return nil, fmt.Errorf("%s: only UTF-8 databases can be read", path)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	db.pages = int(fi.Size() / int64(db.size))
+	return db, nil
+}
+
+// Close closes the database file.
+func (db *sqliteDB) Close() error {
+	return db.f.Close()
+}
+
+// rows calls fn with the values of each row of table by column name, in
+// rowid order: nil, int64, float64, string or []byte. A column added to the
+// table after a row was written is missing from it.
+func (db *sqliteDB) rows(table string, fn func(row map[string]any) error) error {
+	root, sql := 0, ""
+	err := db.walk(1, 0, func(_ int64, rec []byte) error {
+		vals, err := sqliteRecord(rec)
+		if err != nil {
+			return err
+		}
+		if len(vals) < 5 || vals[0] != "table" {
+			return nil
+		}
+		if name, _ := vals[1].(string); strings.EqualFold(name, table) {
+			page, _ := vals[3].(int64)
+			root, sql = int(page), fmt.Sprint(vals[4])
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if root == 0 {
+		return fmt.Errorf("no table %s", table)
+	}
+	if strings.Contains(strings.ToUpper(sql), "WITHOUT ROWID") {
+		return fmt.Errorf("table %s is WITHOUT ROWID, which can't be read", table)
+	}
+	cols, rowid := sqliteColumns(sql)
+	return db.walk(root, 0, func(id int64, rec []byte) error {
+		vals, err := sqliteRecord(rec)
+		if err != nil {
+			return err
+		}
+		row := make(map[string]any, len(cols))
+		for i, col := range cols {
+			if i < len(vals) {
+				row[col] = vals[i]
+			}
+		}
+		if rowid >= 0 {
+			row[cols[rowid]] = id
+		}
+		return fn(row)
+	})
+}
+
+// page reads page n, counted from 1.
+func (db *sqliteDB) page(n int) ([]byte, error) {
+	if n < 1 || n > db.pages {
+		return nil, errSQLiteCorrupt
+	}
+	p := make([]byte, db.size)
+	if _, err := db.f.ReadAt(p, int64(n-1)*int64(db.size)); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// walk calls fn with the rowid and the record of each row of the table
+// b-tree whose root is page root, at depth in the tree.
+func (db *sqliteDB) walk(root, depth int, fn func(rowid int64, rec []byte) error) error {
+	if depth > sqliteMaxDepth {
+		return errSQLiteCorrupt
+	}
+	p, err := db.page(root)
+	if err != nil {
+		return err
+	}
+	hdr := 0
+	if root == 1 {
+		hdr = 100 // after the database header
+	}
+	kind, cells := p[hdr], int(binary.BigEndian.Uint16(p[hdr+3:]))
+	ptrs := hdr + 8
+	switch kind {
+	case 0x05: // interior
+		ptrs = hdr + 12
+	case 0x0d: // leaf
+	default:
+		return errSQLiteCorrupt
+	}
+	if ptrs+2*cells > len(p) {
+		return errSQLiteCorrupt
+	}
+	for i := 0; i < cells; i++ {
+		off := int(binary.BigEndian.Uint16(p[ptrs+2*i:]))
+		if off+4 > len(p) {
+			return errSQLiteCorrupt
+		}
+		if kind == 0x05 {
+			if err := db.walk(int(binary.BigEndian.Uint32(p[off:])), depth+1, fn); err != nil {
+				return err
+			}
+			continue
+		}
+		size, n := sqliteVarint(p[off:])
+		off += n
+		rowid, m := sqliteVarint(p[min(off, len(p)):])
+		off += m
+		if n == 0 || m == 0 || size > uint64(db.pages*db.size) {
+			return errSQLiteCorrupt
+		}
+		rec, err := db.payload(p, off, int(size))
+		if err != nil {
+			return err
+		}
+		if err := fn(int64(rowid), rec); err != nil {
+			return err
+		}
+	}
+	if kind == 0x05 {
+		return db.walk(int(binary.BigEndian.Uint32(p[hdr+8:])), depth+1, fn)
+	}
+	return nil
+}
+
+// payload returns the size bytes of payload of the leaf cell at off in page
+// p, with what spilled over to overflow pages.
+func (db *sqliteDB) payload(p []byte, off, size int) ([]byte, error) {
+	local, maxLocal := size, db.usable-35
+	if size > maxLocal {
+		minLocal := (db.usable-12)*32/255 - 23
+		if local = minLocal + (size-minLocal)%(db.usable-4); local > maxLocal {
+			local = minLocal
+		}
+	}
+	if off+local > len(p) {
+		return nil, errSQLiteCorrupt
+	}
+	rec := append(make([]byte, 0, size), p[off:off+local]...)
+	if local == size {
+		return rec, nil
+	}
+	if off+local+4 > len(p) {
+		return nil, errSQLiteCorrupt
+	}
+	for next := int(binary.BigEndian.Uint32(p[off+local:])); len(rec) < size; {
+		o, err := db.page(next)
+		if err != nil {
+			return nil, err
+		}
+		next = int(binary.BigEndian.Uint32(o))
+		rec = append(rec, o[4:4+min(size-len(rec), db.usable-4)]...)
+	}
+	return rec, nil
+}
+
+// sqliteVarint decodes the variable length integer at the start of b, and
+// returns it and its length, 0 if b is too short.
+func sqliteVarint(b []byte) (uint64, int) {
+	var v uint64
+	for i := 0; i < len(b) && i < 9; i++ {
+		if i == 8 {
+			return v<<8 | uint64(b[i]), 9
+		}
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i] < 0x80 {
+			return v, i + 1
+		}
+	}
+	return 0, 0
+}
+
+// sqliteRecord decodes the values of a record.
+func sqliteRecord(rec []byte) ([]any, error) {
+	hlen, n := sqliteVarint(rec)
+	if n == 0 || hlen > uint64(len(rec)) {
+		return nil, errSQLiteCorrupt
+	}
+	var vals []any
+	body := int(hlen)
+	for off := n; off < int(hlen); {
+		st, n := sqliteVarint(rec[off:hlen])
+		if n == 0 {
+			return nil, errSQLiteCorrupt
+		}
+		off += n
+		var size int
+		switch {
+		case st <= 4:
+			size = int(st)
+		case st == 5:
+			size = 6
+		case st == 6 || st == 7:
+			size = 8
+		case st == 10 || st == 11:
+			return nil, errSQLiteCorrupt // reserved
+		case st >= 12:
+			size = int((st - 12) / 2)
+		}
+		if size < 0 || body+size > len(rec) {
+			return nil, errSQLiteCorrupt
+		}
+		b := rec[body : body+size]
+		body += size
+		switch {
+		case st == 0:
+			vals = append(vals, nil)
+		case st <= 6:
+			v := int64(int8(b[0]))
+			for _, c := range b[1:] {
+				v = v<<8 | int64(c)
+			}
+			vals = append(vals, v)
+		case st == 7:
+			vals = append(vals, math.Float64frombits(binary.BigEndian.Uint64(b)))
+		case st == 8 || st == 9:
+			vals = append(vals, int64(st-8))
+		case st%2 == 0:
+			vals = append(vals, append([]byte(nil), b...))
+		default:
+			vals = append(vals, string(b))
+		}
+	}
+	return vals, nil
+}
+
+// sqliteColumns returns the column names of a CREATE TABLE statement, and
+// which of them is an alias of the rowid, an INTEGER PRIMARY KEY, or -1.
+func sqliteColumns(sql string) ([]string, int) {
+	start, end := strings.Index(sql, "("), strings.LastIndex(sql, ")")
+	if start < 0 || end < start {
+		return nil, -1
+	}
+	// The column definitions are split at commas outside of parentheses
+	// and quotes, e.g. of DEFAULT (strftime('%s', 'now')).
+	var defs []string
+	depth, quote, from := 0, byte(0), start+1
+	for i := start + 1; i < end; i++ {
+		switch c := sql[i]; {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"' || c == '`':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == ',' && depth == 0:
+			defs = append(defs, sql[from:i])
+			from = i + 1
+		}
+	}
+	defs = append(defs, sql[from:end])
+
+	var cols []string
+	rowid := -1
+	for _, def := range defs {
+		fields := strings.Fields(def)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "CONSTRAINT", "PRIMARY", "UNIQUE", "CHECK", "FOREIGN":
+			continue // table constraints
+		}
+		if len(fields) >= 4 && strings.EqualFold(fields[1], "INTEGER") &&
+			strings.EqualFold(fields[2], "PRIMARY") && strings.EqualFold(fields[3], "KEY") {
+			rowid = len(cols)
+		}
+		cols = append(cols, strings.Trim(fields[0], "\"`[]"))
+	}
+	return cols, rowid
+}
@@ -0,0 +1,68 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// Exit statuses. Once AdHole is serving, nothing makes it exit with any but
+// exitWatchdog and exitFailed: reloads and refreshes that fail keep what was
+// loaded before.
+const (
+	exitConfig   = 1 // bad flags, arguments or environment
+	exitBind     = 2 // a socket can't be bound, or privileges dropped
+	exitWatchdog = 3 // -watchdog-exit gave up on the listeners
+	exitList     = 4 // a list, or another file of names, can't be loaded
+	exitFailed   = 5 // a component failed, with -on-failure exit
+)
+
+// exitError is a startup error with the exit status it calls for. Err may
+// join several problems, which are reported one per line. A nil Err has
+// been reported already, e.g. by the flag package.
+type exitError struct {
+	Code int
+	Err  error
+}
+
+func (e *exitError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("exit status %d", e.Code)
+	}
+	return e.Err.Error()
+}
+
+func (e *exitError) Unwrap() error { return e.Err }
+
+// configError, bindError and listError return err with its exit status.
+func configError(err error) error { return &exitError{exitConfig, err} }
+func bindError(err error) error   { return &exitError{exitBind, err} }
+func listError(err error) error   { return &exitError{exitList, err} }
+
+// failureError returns err, which stopped the server, with its exit status:
+// exitFailed unless it comes with another.
+func failureError(err error) error {
+	var ee *exitError
+	if errors.As(err, &ee) {
+		return err
+	}
+	return &exitError{exitFailed, err}
+}
+
+// reportError writes the problems in a startup error to stderr, one per
+// line, and returns the exit status for it.
+func reportError(err error) int {
+	var ee *exitError
+	if !errors.As(err, &ee) {
+		ee = &exitError{exitConfig, err}
+	}
+	if ee.Err != nil {
+		for _, line := range strings.Split(ee.Err.Error(), "\n") {
+			fmt.Fprintf(os.Stderr, "ERROR: %s\n", line)
+		}
+	}
+	return ee.Code
+}
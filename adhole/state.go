@@ -0,0 +1,166 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// stateVersion is bumped whenever the state file format changes
+// incompatibly. Files with a different version are ignored.
+const stateVersion = 1
+
+// state is the on-disk snapshot of the counters, holding the totals
+// accumulated over all previous runs plus the current one.
+type state struct {
+	Version  int                         `json:"version"`
+	Saved    time.Time                   `json:"saved"`
+	Counters map[string]int64            `json:"counters"`
+	Maps     map[string]map[string]int64 `json:"maps"`
+	History  *historyData                `json:"history,omitempty"`
+	// DisabledLists are the lists disabled at runtime, see disabled.
+	DisabledLists map[string]time.Time `json:"disabledLists,omitempty"`
+	// RuleUsage tells which rules of each list matched, see listUsage.
+	RuleUsage map[string]usageState `json:"ruleUsage,omitempty"`
+}
+
+// persistedCounters are the counters that survive restarts.
+var persistedCounters = map[string]*expvar.Int{
+	"statsQuestions":     cntMsgs,
+	"statsRelayed":       cntRelayed,
+	"statsBlocked":       cntBlocked,
+	"statsTimedout":      cntTimedout,
+	"statsServed":        cntServed,
+	"statsErrors":        cntErrors,
+	"statsRetransmits":   cntRetrans,
+	"statsNodata":        cntNodata,
+	"statsQtypeBlocked":  cntQTBlock,
+	"statsTunnelSuspect": cntTunnel,
+	"statsTLDBlocked":    cntTLDBlock,
+	"statsVerifyFailed":  cntVerify,
+	"statsFormErr":       cntFormErr,
+	"statsCacheHits":     cntCacheHits,
+	"statsCacheMisses":   cntCacheMisses,
+	"statsPrefetched":    cntPrefetched,
+	"statsCacheFloored":  cntCacheFloor,
+	"statsServfailHits":  cntSFHits,
+}
+
+// persistedMaps are the counter maps that survive restarts.
+var persistedMaps = map[string]*expvar.Map{
+	"statsRcodes":      cntRcodes,
+	"statsQtypes":      cntQtypes,
+	"statsListHits":    cntListHits,
+	"statsHTTPMethods": cntMethods,
+	"statsDropped":     cntDropped,
+}
+
+// stateBase holds the totals restored at startup; the current values of
+// the counters are added to it.
+var stateBase = struct {
+	sync.Mutex
+	state
+}{}
+
+func init() {
+	expvar.Publish("statsTotal", expvar.Func(func() interface{} {
+		return currentState()
+	}))
+}
+
+// currentState combines the restored totals with the current counters.
+func currentState() *state {
+	stateBase.Lock()
+	defer stateBase.Unlock()
+
+	st := &state{
+		Version:  stateVersion,
+		Saved:    time.Now(),
+		Counters: make(map[string]int64, len(persistedCounters)),
+		Maps:     make(map[string]map[string]int64, len(persistedMaps)),
+	}
+	for name, cnt := range persistedCounters {
+		st.Counters[name] = stateBase.Counters[name] + cnt.Value()
+	}
+	for name, m := range persistedMaps {
+		values := make(map[string]int64)
+		for k, v := range stateBase.Maps[name] {
+			values[k] = v
+		}
+		m.Do(func(kv expvar.KeyValue) {
+			if v, ok := kv.Value.(*expvar.Int); ok {
+				values[kv.Key] += v.Value()
+			}
+		})
+		st.Maps[name] = values
+	}
+	st.DisabledLists = disabledLists()
+	return st
+}
+
+// loadState restores the totals from path. A missing file is not an error.
+// A corrupt or incompatible file is reported and otherwise ignored.
+func loadState(path string) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	}
+	if err == nil {
+		var st state
+		if err = json.Unmarshal(data, &st); err == nil && st.Version != stateVersion {
+			err = fmt.Errorf("version %d not supported", st.Version)
+		}
+		if err == nil {
+			if st.History != nil && *flagHistory {
+				restoreHistory(st.History)
+			}
+			st.History = nil
+			restoreDisabled(st.DisabledLists)
+			st.DisabledLists = nil
+			restoreUsage(st.RuleUsage)
+			st.RuleUsage = nil
+			stateBase.Lock()
+			stateBase.state = st
+			stateBase.Unlock()
+			log.Printf("Restored counters saved at %s\n", st.Saved.Format(time.RFC3339))
+			return
+		}
+	}
+	log.Printf("WARN: Ignoring state file %s: %s\n", path, err)
+}
+
+// saveState writes the current totals to path.
+func saveState(path string) error {
+	st := currentState()
+	if *flagHistory {
+		st.History = currentHistory()
+	}
+	st.RuleUsage = currentUsage()
+	data, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// runStateSaver periodically saves the state to path.
+func runStateSaver(path string, every time.Duration) {
+	for {
+		time.Sleep(every)
+		if err := saveState(path); err != nil {
+			log.Println("ERROR: Can't save state:", err)
+			cntErrors.Add(1)
+		}
+	}
+}
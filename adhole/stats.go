@@ -0,0 +1,61 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"expvar"
+	"runtime"
+	"sync/atomic"
+	"time"
+)
+
+// handlers is the number of handleDNS goroutines currently running.
+var handlers int64
+
+// Process and configuration information.
+var (
+	startTime = time.Now()
+	infoList  = expvar.NewString("infoListHash")
+	infoUp    = expvar.NewString("infoUpstream")
+)
+
+func init() {
+	expvar.Publish("gauges", expvar.Func(gauges))
+	expvar.NewString("infoStartTime").Set(startTime.Format(time.RFC3339))
+	expvar.Publish("infoUptime", expvar.Func(func() interface{} {
+		return int64(time.Since(startTime).Seconds())
+	}))
+	expvar.Publish("infoListen", expvar.Func(func() interface{} {
+		addrs := make([]string, 0, len(listeners))
+		seen := make(map[string]bool, len(listeners))
+		for _, l := range listeners {
+			if addr := l.String(); !seen[addr] {
+				seen[addr] = true
+				addrs = append(addrs, addr)
+			}
+		}
+		return addrs
+	}))
+}
+
+// gauges returns point-in-time values of the query path and the process.
+func gauges() interface{} {
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+
+	oldest := 0.0
+	if start, ok := queries.Oldest(); ok {
+		oldest = time.Since(start).Seconds()
+	}
+	return map[string]interface{}{
+		"outstandingQueries": queries.Len(),
+		"outstandingPeak":    queries.Peak(),
+		"oldestQueryAge":     oldest,
+		"activeHandlers":     atomic.LoadInt64(&handlers),
+		"tarpitPending":      atomic.LoadInt64(&tarpitPending),
+		"goroutines":         runtime.NumGoroutine(),
+		"heapAlloc":          mem.HeapAlloc,
+		"heapObjects":        mem.HeapObjects,
+		"numGC":              mem.NumGC,
+	}
+}
@@ -0,0 +1,90 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bytes"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// statsdMaxPacket keeps statsd packets below a typical path MTU.
+const statsdMaxPacket = 1400
+
+// statsdAddr parses a statsd URL such as udp://192.168.1.10:8125.
+func statsdAddr(arg string) (string, error) {
+	u, err := url.Parse(arg)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "udp" || u.Host == "" {
+		return "", fmt.Errorf("statsd address must look like udp://host:port, got '%s'", arg)
+	}
+	if u.Port() == "" {
+		return net.JoinHostPort(u.Host, "8125"), nil
+	}
+	return u.Host, nil
+}
+
+// metricName turns a counter name like statsQuestions into questions.
+func metricName(name string) string {
+	name = strings.TrimPrefix(name, "stats")
+	return strings.ToLower(name[:1]) + name[1:]
+}
+
+// runStatsd sends the counters (as increments since the previous flush) and
+// a few gauges to a statsd server every interval. Write errors are ignored,
+// the metrics are simply lost.
+func runStatsd(addr, prefix string, every time.Duration) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		log.Println("ERROR: statsd:", err)
+		return
+	}
+	defer conn.Close()
+	log.Println("Sending metrics to statsd at", addr)
+
+	last := make(map[string]int64)
+	var buf bytes.Buffer
+	send := func(name string, value int64, kind string) {
+		line := fmt.Sprintf("%s%s:%d|%s\n", prefix, name, value, kind)
+		if buf.Len()+len(line) > statsdMaxPacket {
+			conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+			conn.Write(buf.Bytes())
+			buf.Reset()
+		}
+		buf.WriteString(line)
+	}
+	counter := func(name string, value int64) {
+		if delta := value - last[name]; delta != 0 {
+			send(name, delta, "c")
+		}
+		last[name] = value
+	}
+
+	for {
+		time.Sleep(every)
+		for name, cnt := range persistedCounters {
+			counter(metricName(name), cnt.Value())
+		}
+		for name, m := range persistedMaps {
+			m.Do(func(kv expvar.KeyValue) {
+				if v, ok := kv.Value.(*expvar.Int); ok {
+					counter(metricName(name)+"."+kv.Key, v.Value())
+				}
+			})
+		}
+		send("rules", cntRules.Value(), "g")
+		send("outstanding", int64(queries.Len()), "g")
+		if buf.Len() > 0 {
+			conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+			conn.Write(buf.Bytes())
+			buf.Reset()
+		}
+	}
+}
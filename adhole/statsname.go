@@ -0,0 +1,82 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The -stats-name name, lowercased with a trailing dot, and the networks
+// allowed to query it.
+var (
+	statsName string
+	statsNets []*net.IPNet
+)
+
+// setupStatsName validates -stats-name and parses -stats-clients.
+func setupStatsName(name, nets string) error {
+	if name == "" {
+		return nil
+	}
+	if statsName = strings.TrimSuffix(name, "."); !validName(statsName) || strings.Contains(statsName, "..") {
+		return fmt.Errorf("bad -stats-name '%s'", name)
+	}
+	statsName = lowerName(statsName) + "."
+	for _, cidr := range strings.Split(nets, ",") {
+		if cidr = strings.TrimSpace(cidr); cidr == "" {
+			continue
+		}
+		_, ipnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return fmt.Errorf("bad -stats-clients network '%s'", cidr)
+		}
+		statsNets = append(statsNets, ipnet)
+	}
+	return nil
+}
+
+// statsAllowed tells if the client at ip may query -stats-name.
+func statsAllowed(ip net.IP) bool {
+	for _, ipnet := range statsNets {
+		if ipnet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// statsReply answers a query for -stats-name with a TXT record of space
+// separated key=value pairs, REFUSED for clients outside -stats-clients and
+// no records for other types. Nothing should cache it, so its TTL is 0.
+func statsReply(msg []byte, end int, qtype uint16, client net.IP) []byte {
+	if !statsAllowed(client) {
+		return finishReply(newReply(msg, end, rcodeRefused), msg)
+	}
+	reply := newReply(msg, end, 0)
+	if qtype == typeTXT || qtype == typeANY {
+		on := "off"
+		if blocking.Value() {
+			on = "on"
+		}
+		pairs := []string{
+			"queries=" + strconv.FormatInt(cntMsgs.Value(), 10),
+			"blocked=" + strconv.FormatInt(cntBlocked.Value(), 10),
+			"relayed=" + strconv.FormatInt(cntRelayed.Value(), 10),
+			"cached=" + strconv.FormatInt(cntCacheHits.Value(), 10),
+			"outstanding=" + strconv.Itoa(queries.Len()),
+			"rules=" + strconv.FormatInt(cntRules.Value(), 10),
+			"blocking=" + on,
+			"uptime=" + strconv.FormatInt(int64(time.Since(startTime).Seconds()), 10),
+			"version=" + version,
+		}
+		reply = appendTXT(reply, classIN, 0, strings.Join(pairs, " "))
+	} else {
+		reply = appendSOA(reply, 0)
+	}
+	setFlag(reply, flagAA, true)
+	return finishReply(reply, msg)
+}
@@ -0,0 +1,41 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"flag"
+	"net"
+	"testing"
+)
+
+// Only the machine AdHole runs on gets the statistics by default.
+func TestStatsClients(t *testing.T) {
+	withFlag(t, &statsName, "")
+	withFlag(t, &statsNets, nil)
+	if err := setupStatsName("stats.adhole", flag.Lookup("stats-clients").DefValue); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		client string
+		rcode  byte
+	}{
+		{"127.0.0.1", 0},
+		{"127.0.0.53", 0},
+		{"::1", 0},
+		{"192.168.1.10", rcodeRefused},
+		{"10.0.0.2", rcodeRefused},
+		{"fd00::2", rcodeRefused},
+		{"203.0.113.1", rcodeRefused},
+	}
+	for _, tt := range tests {
+		msg := testQuery("stats.adhole.", typeTXT)
+		_, _, end, _ := parseQuestion(msg)
+		reply := statsReply(msg, end, typeTXT, net.ParseIP(tt.client))
+		if reply[3]&0x0f != tt.rcode {
+			t.Errorf("%s: rcode %d, want %d", tt.client, reply[3]&0x0f, tt.rcode)
+		}
+		if answers := reply[7]; (answers == 1) != (tt.rcode == 0) {
+			t.Errorf("%s: %d answers", tt.client, answers)
+		}
+	}
+}
@@ -0,0 +1,176 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"encoding/json"
+	"expvar"
+	"log"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// streamBuffer is the number of events a stream client may lag behind
+// before events are dropped for it.
+const streamBuffer = 256
+
+var cntStreamDrop = expvar.NewInt("statsStreamDropped")
+
+// streamEvent is one query as sent to /api/stream clients.
+type streamEvent struct {
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client"`
+	ClientName string    `json:"clientName,omitempty"` // from -clients or -dhcp-leases
+	Name       string    `json:"qname"`
+	Type       string    `json:"qtype"`
+	Action     string    `json:"action"`
+	Rule       string    `json:"rule,omitempty"` // the blocking rule and its source
+	Latency    float64   `json:"latency"`        // milliseconds
+
+	// BlockedAt is, for a pixel request, when the query that brought the
+	// client to the sinkhole was blocked.
+	BlockedAt *time.Time `json:"blockedAt,omitempty"`
+}
+
+// streams holds the channels of the connected stream clients, which need
+// the key and leave when they disconnect.
+var streams = struct {
+	sync.Mutex
+	subs map[chan *streamEvent]bool
+	n    int64 // len(subs), read without the lock
+}{subs: make(map[chan *streamEvent]bool)}
+
+// publish sends a query event to all stream clients, and the query log,
+// unless the name is in -log-ignore, and adds it to a trace the query is
+// part of. It never blocks: a client that isn't
+// keeping up misses the event.
+func publish(from *net.UDPAddr, host string, qtype uint16, action, rule string, start time.Time) {
+	if t := tracing(from.IP, host); t != nil {
+		outcome := action
+		if rule != "" {
+			outcome += " by " + rule
+		}
+		t.step(from.IP, host, qtype, "%s after %s", outcome, time.Since(start).Round(time.Microsecond))
+	}
+	publishEvent(from, host, typeName(qtype), action, rule, start, nil)
+}
+
+// publishPixel sends a pixel request for host from from to the stream
+// clients and the query log, with the method as its type.
+func publishPixel(from *net.UDPAddr, host, method, rule string, blockedAt time.Time, start time.Time) {
+	var at *time.Time
+	if !blockedAt.IsZero() {
+		at = &blockedAt
+	}
+	publishEvent(from, host, method, "pixel", rule, start, at)
+}
+
+// publishEvent is publish without the trace.
+func publishEvent(from *net.UDPAddr, host, qtype, action, rule string, start time.Time, blockedAt *time.Time) {
+	if atomic.LoadInt64(&streams.n) == 0 && queryLog == nil {
+		return
+	}
+	if ignoredName(host) {
+		cntIgnored.Add(1)
+		return
+	}
+	now := time.Now()
+	ev := &streamEvent{
+		Time:       now,
+		Client:     clientIP(from.IP),
+		ClientName: clientName(from.IP),
+		Name:       logHost(host, action == "blocked" || action == "pixel" && rule != ""),
+		Type:       qtype,
+		Action:     action,
+		Rule:       rule,
+		Latency:    float64(now.Sub(start).Microseconds()) / 1000,
+		BlockedAt:  blockedAt,
+	}
+	if queryLog != nil {
+		logQuery(ev)
+	}
+	streams.Lock()
+	defer streams.Unlock()
+	for ch := range streams.subs {
+		select {
+		case ch <- ev:
+		default:
+			cntStreamDrop.Add(1)
+		}
+	}
+}
+
+// subscribe registers a new stream client.
+func subscribe() chan *streamEvent {
+	ch := make(chan *streamEvent, streamBuffer)
+	streams.Lock()
+	defer streams.Unlock()
+	streams.subs[ch] = true
+	atomic.StoreInt64(&streams.n, int64(len(streams.subs)))
+	return ch
+}
+
+// unsubscribe removes a stream client.
+func unsubscribe(ch chan *streamEvent) {
+	streams.Lock()
+	defer streams.Unlock()
+	delete(streams.subs, ch)
+	atomic.StoreInt64(&streams.n, int64(len(streams.subs)))
+}
+
+// handleStream sends the queries as they happen as Server-Sent Events, one
+// JSON object per query. With filter=blocked only blocked queries are sent.
+func handleStream(w http.ResponseWriter, req *http.Request) {
+	if !authHTTP(req) {
+		http.Error(w, "bad key", http.StatusForbidden)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	filter := req.FormValue("filter")
+	if filter != "" && filter != "blocked" {
+		http.Error(w, "unknown filter", http.StatusBadRequest)
+		return
+	}
+
+	ch := subscribe()
+	defer unsubscribe(ch)
+	log.Printf("HTTP: Stream to %s started\n", clientHTTP(req.RemoteAddr))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	// Comments keep proxies from closing an idle stream.
+	ping := time.NewTicker(30 * time.Second)
+	defer ping.Stop()
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case ev := <-ch:
+			if filter != "" && ev.Action != filter {
+				continue
+			}
+			w.Write([]byte("data: "))
+			enc.Encode(ev) // ends with the newline
+			if _, err := w.Write([]byte("\n")); err != nil {
+				return
+			}
+		case <-ping.C:
+			if _, err := w.Write([]byte(": ping\n\n")); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			log.Printf("HTTP: Stream to %s ended\n", clientHTTP(req.RemoteAddr))
+			return
+		}
+		flusher.Flush()
+	}
+}
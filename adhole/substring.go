@@ -0,0 +1,103 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+// substrings is an Aho-Corasick automaton finding any of a set of patterns
+// in a name in one pass, however many patterns there are.
+type substrings struct {
+	nodes    []acNode
+	patterns []string
+}
+
+// acNode is a state of the automaton: the patterns' prefixes form a trie,
+// and fail leads to the state of the longest proper suffix that is also a
+// prefix, where matching continues when there is no transition.
+type acNode struct {
+	next map[byte]int32
+	fail int32
+	out  int32 // pattern ending here, or -1
+	dict int32 // closest state by fail links with a pattern ending, or -1
+}
+
+// newSubstrings builds the automaton for patterns.
+func newSubstrings(patterns []string) *substrings {
+	ss := &substrings{nodes: []acNode{{fail: 0, out: -1, dict: -1}}, patterns: patterns}
+	for i, pattern := range patterns {
+		state := int32(0)
+		for j := 0; j < len(pattern); j++ {
+			next, ok := ss.nodes[state].next[pattern[j]]
+			if !ok {
+				next = int32(len(ss.nodes))
+				ss.nodes = append(ss.nodes, acNode{out: -1, dict: -1})
+				if ss.nodes[state].next == nil {
+					ss.nodes[state].next = make(map[byte]int32)
+				}
+				ss.nodes[state].next[pattern[j]] = next
+			}
+			state = next
+		}
+		if ss.nodes[state].out < 0 {
+			ss.nodes[state].out = int32(i)
+		}
+	}
+
+	// The fail links of a state depend on shallower states only, so they
+	// are set breadth first.
+	queue := make([]int32, 0, len(ss.nodes))
+	for _, child := range ss.nodes[0].next {
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		state := queue[0]
+		queue = queue[1:]
+		for c, child := range ss.nodes[state].next {
+			fail := ss.nodes[state].fail
+			for fail != 0 && !ss.has(fail, c) {
+				fail = ss.nodes[fail].fail
+			}
+			if next, ok := ss.nodes[fail].next[c]; ok {
+				fail = next
+			}
+			ss.nodes[child].fail = fail
+			if ss.nodes[fail].out >= 0 {
+				ss.nodes[child].dict = fail
+			} else {
+				ss.nodes[child].dict = ss.nodes[fail].dict
+			}
+			queue = append(queue, child)
+		}
+	}
+	return ss
+}
+
+// has reports whether state has a transition on c.
+func (ss *substrings) has(state int32, c byte) bool {
+	_, ok := ss.nodes[state].next[c]
+	return ok
+}
+
+// find returns the index of the first pattern found in name for which use
+// returns true, or -1 if there is none.
+func (ss *substrings) find(name string, use func(pattern int) bool) int {
+	state := int32(0)
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		for state != 0 && !ss.has(state, c) {
+			state = ss.nodes[state].fail
+		}
+		if next, ok := ss.nodes[state].next[c]; ok {
+			state = next
+		}
+		for out := state; out >= 0; out = ss.nodes[out].dict {
+			if p := ss.nodes[out].out; p >= 0 && use(int(p)) {
+				return int(p)
+			}
+		}
+	}
+	return -1
+}
+
+// len returns the number of states.
+func (ss *substrings) len() int {
+	return len(ss.nodes)
+}
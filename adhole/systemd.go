@@ -0,0 +1,113 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd.
+const listenFDsStart = 3
+
+// activatedSockets returns the sockets passed by systemd socket activation,
+// keyed by their FileDescriptorName, "dns" or "http". Sockets without a name
+// are called "dns" and "http", in that order. The map is empty when the
+// process was not socket-activated.
+func activatedSockets() (map[string][]*os.File, error) {
+	if pid, err := strconv.Atoi(os.Getenv("LISTEN_PID")); err != nil || pid != os.Getpid() {
+		return make(map[string][]*os.File), nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count < 1 {
+		return make(map[string][]*os.File), nil
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	return activatedFiles(listenFDsStart, count, names)
+}
+
+// activatedFiles returns count sockets passed from the descriptor first on,
+// with the given names. Sockets of any other name than "dns" and "http" are
+// an error, for which all of them are closed, so that none is left open
+// unused.
+func activatedFiles(first, count int, names []string) (map[string][]*os.File, error) {
+	defaults := []string{"dns", "http"}
+	files := make(map[string][]*os.File)
+	for i := 0; i < count; i++ {
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		if (name == "" || name == "unknown") && i < len(defaults) {
+			name = defaults[i]
+		}
+		file := os.NewFile(uintptr(first+i), name)
+		if name != "dns" && name != "http" {
+			file.Close()
+			for _, fs := range files {
+				closeFiles(fs)
+			}
+			for j := i + 1; j < count; j++ {
+				os.NewFile(uintptr(first+j), "").Close()
+			}
+			return nil, fmt.Errorf("activated socket '%s' is neither dns nor http, set FileDescriptorName= to one of them", name)
+		}
+		files[name] = append(files[name], file)
+	}
+	return files, nil
+}
+
+// closeFiles closes activated sockets that aren't used.
+func closeFiles(files []*os.File) {
+	for _, file := range files {
+		file.Close()
+	}
+}
+
+// activatedUDP converts an activated socket to a UDP connection.
+func activatedUDP(file *os.File) (*net.UDPConn, error) {
+	defer file.Close()
+	pc, err := net.FilePacketConn(file)
+	if err != nil {
+		return nil, err
+	}
+	conn, ok := pc.(*net.UDPConn)
+	if !ok {
+		pc.Close()
+		return nil, errors.New("activated socket is not UDP")
+	}
+	return conn, nil
+}
+
+// activatedListener converts an activated socket to a stream listener.
+func activatedListener(file *os.File) (net.Listener, error) {
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+// sdNotify sends a state string to systemd if NOTIFY_SOCKET is set.
+// It is a no-op otherwise.
+func sdNotify(state string) error {
+	path := os.Getenv("NOTIFY_SOCKET")
+	if path == "" {
+		return nil
+	}
+	if path[0] == '@' {
+		path = "\x00" + path[1:]
+	}
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,110 @@
+// See LICENSE.txt for licensing information.
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// passSockets binds a UDP and a TCP socket and duplicates their descriptors
+// to first and first+1, as systemd would pass them, for activatedFiles.
+func passSockets(t *testing.T, first int) {
+	t.Helper()
+	pc, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer pc.Close()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	for i, c := range []syscall.Conn{pc.(syscall.Conn), ln.(syscall.Conn)} {
+		raw, err := c.SyscallConn()
+		if err != nil {
+			t.Fatal(err)
+		}
+		raw.Control(func(fd uintptr) { err = syscall.Dup3(int(fd), first+i, 0) })
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// fdOpen reports whether fd is an open descriptor.
+func fdOpen(fd int) bool {
+	var st syscall.Stat_t
+	return syscall.Fstat(fd, &st) == nil
+}
+
+func TestActivatedFiles(t *testing.T) {
+	const first = 200
+	for _, tc := range []struct {
+		names []string
+		err   bool
+		dns   int
+		http  int
+	}{
+		{names: nil, dns: 1, http: 1},
+		{names: []string{"dns", "http"}, dns: 1, http: 1},
+		{names: []string{"unknown", ""}, dns: 1, http: 1},
+		{names: []string{"dns", "dns"}, dns: 2},
+		{names: []string{"http", "http"}, http: 2},
+		{names: []string{"dns", "metrics"}, err: true},
+		{names: []string{"admin", "http"}, err: true},
+	} {
+		passSockets(t, first)
+		files, err := activatedFiles(first, 2, tc.names)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%q: no error", tc.names)
+			}
+			for fd := first; fd < first+2; fd++ {
+				if fdOpen(fd) {
+					t.Errorf("%q: descriptor %d left open", tc.names, fd)
+					syscall.Close(fd)
+				}
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %s", tc.names, err)
+			continue
+		}
+		if len(files["dns"]) != tc.dns || len(files["http"]) != tc.http || len(files) > 2 {
+			t.Errorf("%q: got %d dns and %d http sockets of %d names", tc.names, len(files["dns"]), len(files["http"]), len(files))
+		}
+		for _, fs := range files {
+			closeFiles(fs)
+		}
+	}
+}
+
+func TestActivatedSocketsAdopted(t *testing.T) {
+	const first = 210
+	passSockets(t, first)
+	files, err := activatedFiles(first, 2, []string{"dns", "http"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := activatedUDP(files["dns"][0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	ln, err := activatedListener(files["http"][0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln.Close()
+	for fd := first; fd < first+2; fd++ {
+		if fdOpen(fd) {
+			t.Errorf("descriptor %d left open after adopting", fd)
+		}
+	}
+}
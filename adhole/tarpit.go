@@ -0,0 +1,57 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"context"
+	"expvar"
+	"sync/atomic"
+	"time"
+)
+
+var cntTarpit = expvar.NewInt("statsTarpitted")
+
+// tarpitPending is the number of answers currently held back.
+var tarpitPending int64
+
+// tarpitHold reserves a place for a delayed answer, unless the tarpit is off
+// or full, in which case the answer should go out right away.
+func tarpitHold() bool {
+	if *flagTarpit <= 0 {
+		return false
+	}
+	if atomic.AddInt64(&tarpitPending, 1) > int64(*flagTarpitMx) {
+		atomic.AddInt64(&tarpitPending, -1)
+		return false
+	}
+	cntTarpit.Add(1)
+	return true
+}
+
+// tarpit runs send after the -tarpit delay, or right away if the tarpit is
+// off or full.
+func tarpit(send func()) {
+	if !tarpitHold() {
+		send()
+		return
+	}
+	time.AfterFunc(*flagTarpit, func() {
+		atomic.AddInt64(&tarpitPending, -1)
+		send()
+	})
+}
+
+// tarpitWait blocks for the -tarpit delay, if the tarpit isn't off or full,
+// or until ctx is done.
+func tarpitWait(ctx context.Context) {
+	if !tarpitHold() {
+		return
+	}
+	defer atomic.AddInt64(&tarpitPending, -1)
+	t := time.NewTimer(*flagTarpit)
+	defer t.Stop()
+	select {
+	case <-t.C:
+	case <-ctx.Done():
+	}
+}
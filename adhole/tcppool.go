@@ -0,0 +1,370 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"expvar"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+var (
+	cntTCPDials  = expvar.NewInt("statsUpstreamTCPDials")
+	cntTCPErrors = expvar.NewInt("statsUpstreamTCPErrors")
+)
+
+// optKeepalive is the edns-tcp-keepalive option (RFC 7828), whose data is
+// the idle timeout the server allows, in units of 100 milliseconds.
+const optKeepalive = 11
+
+// Reconnect backoff after the upstream can't be dialed: the delay doubles
+// with each failure in a row.
+const (
+	minTCPBackoff = 100 * time.Millisecond
+	maxTCPBackoff = 10 * time.Second
+)
+
+var errPoolBusy = errors.New("all upstream TCP connections are busy")
+
+// upPool is the TCP connection pool to the upstream with -upstream-tcp.
+var upPool *tcpPool
+
+// tcpPool is a pool of persistent TCP connections to one upstream. Queries
+// are pipelined, up to inflight on each connection, and the answers, which
+// may come in any order, are matched to the queries by their IDs like those
+// over UDP.
+type tcpPool struct {
+	addr     string
+	size     int
+	inflight int
+	idle     time.Duration
+	timeout  time.Duration
+
+	mu      sync.Mutex
+	conns   []*tcpConn
+	dialing chan struct{} // closed when the dial in progress is done, if any
+	backoff time.Duration
+	retry   time.Time // no dialing before this after a failure
+}
+
+// tcpConn is a connection of a tcpPool.
+type tcpConn struct {
+	conn net.Conn
+	pool *tcpPool
+	idle time.Duration // as negotiated with the upstream
+
+	mu      sync.Mutex // guards writes, pending and closed
+	pending map[uint16]time.Time
+	closed  bool
+}
+
+// newTCPPool returns a pool of up to size connections to the upstream at
+// addr, each closed after idle without queries, or sooner if the upstream
+// asks for it.
+func newTCPPool(addr string, size, inflight int, idle, timeout time.Duration) *tcpPool {
+	return &tcpPool{addr: addr, size: size, inflight: inflight, idle: idle, timeout: timeout}
+}
+
+// send sends the query in msg over the least busy connection, dialing a new
+// one if all are busy and the pool isn't full.
+func (p *tcpPool) send(msg []byte) error {
+	c, err := p.pick(true)
+	if err != nil {
+		return err
+	}
+	return c.send(msg)
+}
+
+// pick returns the least busy connection, dialing a new one if all are busy
+// and the pool isn't full. Only one dial is in progress at a time, without
+// p.mu held, so that a slow upstream holds up only the queries that have no
+// connection to go over. Those wait for the dial in progress if wait is set.
+func (p *tcpPool) pick(wait bool) (*tcpConn, error) {
+	p.mu.Lock()
+	var best *tcpConn
+	least := p.inflight
+	for _, c := range p.conns {
+		if n := c.load(); n < least {
+			best, least = c, n
+		}
+	}
+	if best != nil && (least == 0 || len(p.conns) >= p.size) {
+		p.mu.Unlock()
+		return best, nil
+	}
+	if done := p.dialing; done != nil {
+		p.mu.Unlock()
+		if best != nil {
+			return best, nil
+		}
+		if !wait {
+			return nil, errPoolBusy
+		}
+		<-done
+		return p.pick(false)
+	}
+	if len(p.conns) >= p.size || time.Now().Before(p.retry) {
+		p.mu.Unlock()
+		if best != nil {
+			return best, nil
+		}
+		return nil, errPoolBusy
+	}
+	done := make(chan struct{})
+	p.dialing = done
+	p.mu.Unlock()
+
+	c, err := p.dial()
+	p.mu.Lock()
+	p.dialing = nil
+	if err == nil {
+		p.backoff = 0
+		p.conns = append(p.conns, c)
+	} else {
+		cntTCPErrors.Add(1)
+		p.backoff = min(max(2*p.backoff, minTCPBackoff), maxTCPBackoff)
+		p.retry = time.Now().Add(p.backoff)
+		log.Printf("DNS ERROR: Can't connect to upstream %s over TCP, retrying in %s: %s\n", p.addr, p.backoff, err)
+	}
+	p.mu.Unlock()
+	close(done)
+	if err != nil {
+		if best != nil {
+			return best, nil
+		}
+		return nil, err
+	}
+	go c.read()
+	return c, nil
+}
+
+// dial opens a new connection and negotiates its idle timeout. It must be
+// called without p.mu held.
+func (p *tcpPool) dial() (*tcpConn, error) {
+	cntTCPDials.Add(1)
+	conn, err := net.DialTimeout("tcp", p.addr, p.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &tcpConn{conn: conn, pool: p, idle: p.idle, pending: make(map[uint16]time.Time)}
+	if err := c.negotiate(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// remove drops c from the pool.
+func (p *tcpPool) remove(c *tcpConn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, pc := range p.conns {
+		if pc == c {
+			p.conns = append(p.conns[:i], p.conns[i+1:]...)
+			return
+		}
+	}
+}
+
+// negotiate asks the upstream, with a query for the root NS records, how
+// long it keeps the connection open, and lowers c.idle to that. Upstreams
+// that don't support edns-tcp-keepalive leave it alone.
+func (c *tcpConn) negotiate() error {
+	msg := make([]byte, headerLen, headerLen+16+optLen)
+	binary.BigEndian.PutUint16(msg, uint16(rand.Intn(0x10000)))
+	binary.BigEndian.PutUint16(msg[4:], 1) // one question
+	msg = append(msg, 0, 0, byte(typeNS), 0, 1)
+	msg = append(msg, 0, 0, byte(typeOPT>>8), byte(typeOPT), ednsUDPSize>>8, ednsUDPSize&0xff, 0, 0, 0, 0, 0, 4, 0, optKeepalive, 0, 0)
+	binary.BigEndian.PutUint16(msg[countAdditional:], 1)
+
+	c.conn.SetDeadline(time.Now().Add(c.pool.timeout))
+	defer c.conn.SetDeadline(time.Time{})
+	if err := writeTCP(c.conn, msg); err != nil {
+		return err
+	}
+	answer, err := readTCP(c.conn)
+	if err != nil {
+		return err
+	}
+	if len(answer) < headerLen || answer[0] != msg[0] || answer[1] != msg[1] {
+		return errMalformed
+	}
+	if timeout, ok := keepaliveTimeout(answer); ok && timeout < c.idle {
+		c.idle = timeout
+	}
+	return nil
+}
+
+// keepaliveTimeout returns the idle timeout in the edns-tcp-keepalive option
+// of an answer, if it has one.
+func keepaliveTimeout(msg []byte) (timeout time.Duration, ok bool) {
+	walkRecords(msg, func(rrtype uint16, off int) {
+		if rrtype != typeOPT {
+			return
+		}
+		opts := msg[off+10 : off+10+int(binary.BigEndian.Uint16(msg[off+8:]))]
+		for len(opts) >= 4 {
+			code := binary.BigEndian.Uint16(opts)
+			n := 4 + int(binary.BigEndian.Uint16(opts[2:]))
+			if n > len(opts) {
+				return
+			}
+			if code == optKeepalive && n == 6 {
+				timeout = time.Duration(binary.BigEndian.Uint16(opts[4:])) * 100 * time.Millisecond
+				ok = true
+			}
+			opts = opts[n:]
+		}
+	})
+	return
+}
+
+// load returns the number of queries c waits for the answers to. Queries
+// older than the upstream timeout are forgotten, their answers won't be
+// relayed anyway.
+func (c *tcpConn) load() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return c.pool.inflight
+	}
+	for id, sent := range c.pending {
+		if time.Since(sent) > c.pool.timeout {
+			delete(c.pending, id)
+		}
+	}
+	return len(c.pending)
+}
+
+// send writes the query in msg to the connection.
+func (c *tcpConn) send(msg []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return net.ErrClosed
+	}
+	c.pending[binary.BigEndian.Uint16(msg)] = time.Now()
+	c.conn.SetWriteDeadline(time.Now().Add(c.pool.timeout))
+	if err := writeTCP(c.conn, msg); err != nil {
+		c.closeLocked()
+		return err
+	}
+	return nil
+}
+
+// read relays the answers coming in on c until it is closed: by the
+// upstream, on an error, or after c.idle without queries.
+func (c *tcpConn) read() {
+	defer c.close()
+	for {
+		c.conn.SetReadDeadline(time.Now().Add(max(c.idle, minTCPBackoff)))
+		msg, err := readTCP(c.conn)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				if c.idleNow() {
+					return
+				}
+				continue
+			}
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Println("DNS ERROR: Upstream TCP connection:", err)
+				cntTCPErrors.Add(1)
+			}
+			return
+		}
+		if len(msg) < headerLen {
+			continue
+		}
+		c.mu.Lock()
+		delete(c.pending, binary.BigEndian.Uint16(msg))
+		c.mu.Unlock()
+		relayTCPAnswer(msg)
+	}
+}
+
+// idleNow closes c if it waits for no answers.
+func (c *tcpConn) idleNow() bool {
+	c.load()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.pending) > 0 {
+		return false
+	}
+	c.closeLocked()
+	return true
+}
+
+// close closes the connection and drops it from the pool.
+func (c *tcpConn) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closeLocked()
+}
+
+// closeLocked is close with c.mu held.
+func (c *tcpConn) closeLocked() {
+	if c.closed {
+		return
+	}
+	c.closed = true
+	c.conn.Close()
+	go c.pool.remove(c)
+}
+
+// relayTCPAnswer relays an answer that came over TCP to the client over
+// UDP, trimmed to the records that fit if it is too large for it.
+func relayTCPAnswer(msg []byte) {
+	query, id := takeAnswer(msg)
+	if query == nil || query.Via == nil {
+		return
+	}
+	if limit := udpLimit(query.Msg); len(msg) > limit {
+		// The upstream's OPT record goes with the additional section.
+		edns, do := queryEDNS(query.Msg)
+		if edns {
+			limit -= optLen
+		}
+		msg = trimReply(msg, limit)
+		if edns {
+			msg = appendOPT(msg, do, -1)
+		}
+	}
+	if err := query.Via.send(msg, query.From, query.Dst); err != nil {
+		log.Printf("DNS ERROR: Query id %d %s %s", id, query, err)
+		cntErrors.Add(1)
+		return
+	}
+	relayedAnswer(query, id)
+}
+
+// writeTCP writes msg with its length in front, as DNS over TCP does.
+func writeTCP(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	_, err := w.Write(append(buf, msg...))
+	return err
+}
+
+// readTCP reads a length prefixed message. An error after part of it was
+// read, a timeout included, is io.ErrUnexpectedEOF, as the stream can't be
+// read on from there.
+func readTCP(r io.Reader) ([]byte, error) {
+	var n [2]byte
+	if read, err := io.ReadFull(r, n[:]); err != nil {
+		if read > 0 {
+			return nil, io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(n[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return msg, nil
+}
@@ -0,0 +1,225 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTCPResolver is an upstream speaking DNS over TCP. It answers the
+// keepalive negotiation of each connection after the delay for it, then
+// reads batch queries at a time and answers them in reverse order.
+type fakeTCPResolver struct {
+	ln    net.Listener
+	batch int
+	delay func(conn int) time.Duration
+
+	mu    sync.Mutex
+	conns []net.Conn
+}
+
+// startTCPResolver starts a fakeTCPResolver on a free loopback port, stopped
+// after the test.
+func startTCPResolver(tb testing.TB, batch int, delay func(conn int) time.Duration) *fakeTCPResolver {
+	tb.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	r := &fakeTCPResolver{ln: ln, batch: batch, delay: delay}
+	go r.serve()
+	tb.Cleanup(func() {
+		ln.Close()
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		for _, conn := range r.conns {
+			conn.Close()
+		}
+	})
+	return r
+}
+
+// answer returns the answer the resolver gives to msg.
+func (r *fakeTCPResolver) answer(msg []byte) []byte {
+	answer := append([]byte(nil), msg...)
+	answer[2] |= 0x80
+	return answer
+}
+
+func (r *fakeTCPResolver) serve() {
+	for n := 0; ; n++ {
+		conn, err := r.ln.Accept()
+		if err != nil {
+			return
+		}
+		r.mu.Lock()
+		r.conns = append(r.conns, conn)
+		r.mu.Unlock()
+		go func(n int) {
+			msg, err := readTCP(conn)
+			if err != nil {
+				return
+			}
+			time.Sleep(r.delay(n))
+			if writeTCP(conn, r.answer(msg)) != nil {
+				return
+			}
+			for {
+				var msgs [][]byte
+				for len(msgs) < r.batch {
+					msg, err := readTCP(conn)
+					if err != nil {
+						return
+					}
+					msgs = append(msgs, msg)
+				}
+				for i := len(msgs) - 1; i >= 0; i-- {
+					writeTCP(conn, r.answer(msgs[i]))
+				}
+			}
+		}(n)
+	}
+}
+
+// poolConns returns the number of connections in p.
+func poolConns(p *tcpPool) int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.conns)
+}
+
+// Answers coming back in any order over one connection must each reach
+// the client that asked.
+func TestTCPPoolOutOfOrder(t *testing.T) {
+	const count = 5
+	r := startTCPResolver(t, count, func(int) time.Duration { return 0 })
+	p := newTCPPool(r.ln.Addr().String(), 1, count, time.Minute, 2*time.Second)
+	l := startListener(t, true)
+	client, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+
+	want := make(map[int][]byte)
+	for i := 0; i < count; i++ {
+		id := 0xb000 + i
+		host := fmt.Sprintf("q%d.example.com.", i)
+		msg := testQuery(host, typeA)
+		msg[0], msg[1] = byte(id>>8), byte(id)
+		ctx, cancel := queryContext()
+		q := &query{ID: id, Host: host, From: client.LocalAddr().(*net.UDPAddr), Via: l, Start: time.Now(), Ctx: ctx, Cancel: cancel, Msg: msg}
+		if !queries.addNew(id, q) {
+			t.Fatalf("id %d taken", id)
+		}
+		want[id] = r.answer(msg)
+		if err := p.send(msg); err != nil {
+			t.Fatalf("query %d: %v", i, err)
+		}
+	}
+	var order []int
+	buf := make([]byte, answerBufSize)
+	for len(order) < count {
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatalf("after %d answers: %v", len(order), err)
+		}
+		id := int(buf[0])<<8 | int(buf[1])
+		if !bytes.Equal(buf[:n], want[id]) {
+			t.Errorf("answer to id %d: % x, want % x", id, buf[:n], want[id])
+		}
+		delete(want, id)
+		order = append(order, id)
+	}
+	if order[0] != 0xb000+count-1 {
+		t.Errorf("answers relayed in order %x, want the resolver's reverse order", order)
+	}
+	if len(want) > 0 {
+		t.Errorf("no answers to %d queries", len(want))
+	}
+	if n := poolConns(p); n != 1 {
+		t.Errorf("%d connections, want 1", n)
+	}
+}
+
+// A slow dial must not hold up queries that can go over the connections
+// already open.
+func TestTCPPoolSlowDial(t *testing.T) {
+	const slow = time.Second
+	r := startTCPResolver(t, 100, func(n int) time.Duration {
+		if n > 0 {
+			return slow
+		}
+		return 0
+	})
+	p := newTCPPool(r.ln.Addr().String(), 2, 10, time.Minute, 2*slow)
+	query := func(id int) []byte {
+		msg := testQuery("example.com.", typeA)
+		msg[0], msg[1] = byte(id>>8), byte(id)
+		return msg
+	}
+	if err := p.send(query(1)); err != nil {
+		t.Fatal(err)
+	}
+
+	// The first connection is busy now, so this dials a second one.
+	dialed := make(chan error, 1)
+	go func() { dialed <- p.send(query(2)) }()
+	for deadline := time.Now().Add(slow / 2); ; {
+		p.mu.Lock()
+		dialing := p.dialing != nil
+		p.mu.Unlock()
+		if dialing {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("no dial started")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	start := time.Now()
+	if err := p.send(query(3)); err != nil {
+		t.Fatal(err)
+	}
+	if d := time.Since(start); d > slow/4 {
+		t.Errorf("query waited %s for the dial of another connection", d)
+	}
+	if err := <-dialed; err != nil {
+		t.Fatal(err)
+	}
+	if n := poolConns(p); n != 2 {
+		t.Errorf("%d connections, want 2", n)
+	}
+}
+
+// Queries with no connection to go over wait for the dial in progress,
+// rather than dial again or fail.
+func TestTCPPoolWaitForDial(t *testing.T) {
+	r := startTCPResolver(t, 100, func(int) time.Duration { return 200 * time.Millisecond })
+	p := newTCPPool(r.ln.Addr().String(), 1, 10, time.Minute, 2*time.Second)
+	dials := cntTCPDials.Value()
+	errs := make(chan error, 3)
+	for id := 1; id <= cap(errs); id++ {
+		msg := testQuery("example.com.", typeA)
+		msg[0], msg[1] = 0, byte(id)
+		go func() { errs <- p.send(msg) }()
+	}
+	for i := 0; i < cap(errs); i++ {
+		if err := <-errs; err != nil {
+			t.Error(err)
+		}
+	}
+	if n := cntTCPDials.Value() - dials; n != 1 {
+		t.Errorf("%d dials, want 1", n)
+	}
+	if n := poolConns(p); n != 1 {
+		t.Errorf("%d connections, want 1", n)
+	}
+}
@@ -0,0 +1,204 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Limits of a trace: how long it may run, by default and at most, and how
+// many of the latest steps it keeps for /api/trace/results.
+const (
+	traceDefault  = 5 * time.Minute
+	traceMaxFor   = time.Hour
+	traceMaxSteps = 1000
+)
+
+// tracer is a trace of the queries for a name and its subdomains, from a
+// client, or both. Every step of a matching query is logged and kept.
+type tracer struct {
+	name   string // lowercased with a trailing dot, "" for any
+	client net.IP // nil for any
+	until  atomic.Int64
+
+	mu      sync.Mutex
+	steps   []traceStep
+	dropped int
+}
+
+// traceStep is a step of a traced query.
+type traceStep struct {
+	Time   time.Time `json:"time"`
+	Client string    `json:"client"`
+	Name   string    `json:"name"`
+	Type   string    `json:"type"`
+	Step   string    `json:"step"`
+}
+
+// curTrace is the last trace started, which may have ended.
+var curTrace atomic.Pointer[tracer]
+
+// tracing returns the trace a query for host from client is part of, or
+// nil. Without a trace running it's a single atomic load.
+func tracing(client net.IP, host string) *tracer {
+	t := curTrace.Load()
+	if t == nil || time.Now().UnixNano() >= t.until.Load() {
+		return nil
+	}
+	if t.client != nil && !t.client.Equal(client) {
+		return nil
+	}
+	if t.name != "" {
+		host = lowerName(host)
+		if host != t.name && !strings.HasSuffix(host, "."+t.name) {
+			return nil
+		}
+	}
+	return t
+}
+
+// step logs a step of a query for host from client and keeps it, unless t
+// is nil.
+func (t *tracer) step(client net.IP, host string, qtype uint16, format string, args ...interface{}) {
+	if t == nil {
+		return
+	}
+	s := traceStep{
+		Time:   time.Now(),
+		Client: clientIP(client),
+		Name:   escapeName(host),
+		Type:   typeName(qtype),
+		Step:   fmt.Sprintf(format, args...),
+	}
+	log.Printf("DNS TRACE: %s %s from %s: %s\n", s.Type, s.Name, s.Client, s.Step)
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.steps) == traceMaxSteps {
+		t.steps = append(t.steps[:0], t.steps[1:]...)
+		t.dropped++
+	}
+	t.steps = append(t.steps, s)
+}
+
+// traceView is a trace as shown by the API.
+type traceView struct {
+	Name    string      `json:"name,omitempty"`
+	Client  string      `json:"client,omitempty"`
+	Until   time.Time   `json:"until"`
+	Active  bool        `json:"active"`
+	Dropped int         `json:"dropped"`
+	Steps   []traceStep `json:"steps,omitempty"`
+}
+
+// view returns t as shown by the API, with the steps if asked for.
+func (t *tracer) view(steps bool) traceView {
+	until := time.Unix(0, t.until.Load())
+	v := traceView{Name: t.name, Until: until, Active: time.Now().Before(until)}
+	if t.client != nil {
+		v.Client = t.client.String()
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	v.Dropped = t.dropped
+	if steps {
+		v.Steps = append([]traceStep(nil), t.steps...)
+	}
+	return v
+}
+
+// handleAPITrace starts a trace with a POST of name, client or both, and
+// optionally for how long, e.g. for=10m. A DELETE ends it early. Both need
+// the key.
+func handleAPITrace(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	reply := func(status int, msg string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+	}
+	if !authHTTP(req) {
+		reply(http.StatusForbidden, "bad key")
+		return
+	}
+	switch req.Method {
+	case http.MethodPost:
+	case http.MethodDelete:
+		t := curTrace.Load()
+		if t == nil {
+			reply(http.StatusNotFound, "no trace")
+			return
+		}
+		if now := time.Now().UnixNano(); t.until.Load() > now {
+			t.until.Store(now)
+			log.Println("HTTP: Trace ended")
+		}
+		json.NewEncoder(w).Encode(t.view(false))
+		return
+	default:
+		w.Header().Set("Allow", "POST, DELETE")
+		reply(http.StatusMethodNotAllowed, "use POST or DELETE")
+		return
+	}
+
+	t := new(tracer)
+	if name := strings.TrimSuffix(req.FormValue("name"), "."); name != "" {
+		if !validName(name) || strings.Contains(name, "..") {
+			reply(http.StatusBadRequest, "bad name")
+			return
+		}
+		t.name = lowerName(name) + "."
+	}
+	if client := req.FormValue("client"); client != "" {
+		if t.client = net.ParseIP(client); t.client == nil {
+			reply(http.StatusBadRequest, "bad client")
+			return
+		}
+	}
+	if t.name == "" && t.client == nil {
+		reply(http.StatusBadRequest, "name or client needed")
+		return
+	}
+	d := traceDefault
+	if arg := req.FormValue("for"); arg != "" {
+		var err error
+		if d, err = time.ParseDuration(arg); err != nil || d <= 0 || d > traceMaxFor {
+			reply(http.StatusBadRequest, fmt.Sprintf("bad duration, at most %s", traceMaxFor))
+			return
+		}
+	}
+	t.until.Store(time.Now().Add(d).UnixNano())
+	curTrace.Store(t)
+	var what []string
+	if t.name != "" {
+		what = append(what, escapeName(t.name))
+	}
+	if t.client != nil {
+		what = append(what, "from "+t.client.String())
+	}
+	log.Printf("HTTP: Tracing queries %s for %s\n", strings.Join(what, " "), d)
+	json.NewEncoder(w).Encode(t.view(false))
+}
+
+// handleAPITraceResults returns the steps of the last trace, running or not.
+func handleAPITraceResults(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if !authHTTP(req) {
+		w.WriteHeader(http.StatusForbidden)
+		json.NewEncoder(w).Encode(map[string]string{"error": "bad key"})
+		return
+	}
+	t := curTrace.Load()
+	if t == nil {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"error": "no trace"})
+		return
+	}
+	json.NewEncoder(w).Encode(t.view(true))
+}
@@ -0,0 +1,144 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"log"
+	"math"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tunnelMinLabel is the label length from which entropy is checked, as short
+// labels don't carry enough characters for a meaningful value.
+const tunnelMinLabel = 24
+
+// tunnelMaxKeys caps the client/domain pairs the detector keeps track of, as
+// a client can make up as many domains as it likes.
+const tunnelMaxKeys = 65536
+
+// tunnelWindow counts the distinct subdomains a client asked about under one
+// parent domain, in the current and the previous window.
+type tunnelWindow struct {
+	start time.Time
+	cur   map[string]bool
+	prev  int
+}
+
+// tunnelState holds the detector's windows and the refused client/domain
+// pairs, keyed by client IP and parent domain. Windows expire two windows
+// after they were last used, and refusals when they run out.
+var tunnelState struct {
+	sync.Mutex
+	windows *expiringMap[string, *tunnelWindow]
+	refused *expiringMap[string, time.Time]
+}
+
+// setupTunnel makes the detector's maps, once the flags are parsed.
+func setupTunnel() {
+	tunnelState.windows = newExpiringMap[string, *tunnelWindow]("tunnelWindows", tunnelMaxKeys, 2**flagTunWin)
+	tunnelState.refused = newExpiringMap[string, time.Time]("tunnelRefused", tunnelMaxKeys, max(*flagTunRef, time.Second))
+}
+
+// parentDomain returns the last two labels of a host with a trailing dot.
+func parentDomain(host string) string {
+	dots := 0
+	for i := len(host) - 2; i >= 0; i-- {
+		if host[i] == '.' {
+			dots++
+			if dots == 2 {
+				return host[i+1:]
+			}
+		}
+	}
+	return host
+}
+
+// labelEntropy returns the Shannon entropy of s in bits per character.
+func labelEntropy(s string) float64 {
+	var counts [256]int
+	for i := 0; i < len(s); i++ {
+		counts[s[i]]++
+	}
+	entropy := 0.0
+	for _, c := range counts {
+		if c > 0 {
+			p := float64(c) / float64(len(s))
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy
+}
+
+// tunnelCheck runs the tunneling heuristics for a query and returns true if
+// the query should be refused.
+func tunnelCheck(client net.IP, host string) bool {
+	if !*flagTunnel {
+		return false
+	}
+	parent := parentDomain(host)
+	if parent == host {
+		return false
+	}
+	sub := host[:len(host)-len(parent)]
+	key := client.String() + " " + parent
+	now := time.Now()
+
+	tunnelState.Lock()
+	defer tunnelState.Unlock()
+
+	if until, ok := tunnelState.refused.Get(key); ok {
+		if now.Before(until) {
+			return true
+		}
+		tunnelState.refused.Delete(key)
+	}
+
+	reason := ""
+	if len(host) >= *flagTunLen {
+		reason = "long name"
+	} else {
+		for _, label := range strings.Split(sub, ".") {
+			if len(label) >= tunnelMinLabel && labelEntropy(label) >= *flagTunEnt {
+				reason = "high entropy label"
+				break
+			}
+		}
+	}
+
+	w := tunnelState.windows.GetOrPut(key, func() *tunnelWindow {
+		return &tunnelWindow{start: now, cur: make(map[string]bool)}
+	})
+	if elapsed := now.Sub(w.start); elapsed >= *flagTunWin {
+		w.prev = len(w.cur)
+		if elapsed >= 2**flagTunWin {
+			w.prev = 0
+		}
+		w.start, w.cur = now, make(map[string]bool)
+	}
+	// There is no need to remember more names than the threshold.
+	if len(w.cur) <= *flagTunUniq {
+		w.cur[sub] = true
+	}
+	// Weigh the previous window by how much of it is still inside the
+	// sliding window.
+	weight := 1 - float64(now.Sub(w.start))/float64(*flagTunWin)
+	if reason == "" && float64(len(w.cur))+weight*float64(w.prev) > float64(*flagTunUniq) {
+		reason = "many distinct subdomains"
+	}
+	if reason == "" {
+		return false
+	}
+
+	cntTunnel.Add(1)
+	log.Printf("DNS WARN: Possible tunneling from %s via %s (%s): %s\n",
+		clientIP(client), escapeName(parent), reason, logHost(host, *flagTunRef > 0))
+	if *flagTunRef > 0 {
+		tunnelState.refused.Put(key, now.Add(*flagTunRef))
+		tunnelState.windows.Delete(key)
+		return true
+	}
+	return false
+}
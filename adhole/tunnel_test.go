@@ -0,0 +1,161 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withTunnel turns the tunneling detector on with the default thresholds,
+// refusing suspicious domains for refuse, with no state from before.
+func withTunnel(tb testing.TB, refuse time.Duration) {
+	withFlag(tb, flagTunnel, true)
+	withFlag(tb, flagTunLen, 120)
+	withFlag(tb, flagTunEnt, 4.0)
+	withFlag(tb, flagTunUniq, 200)
+	withFlag(tb, flagTunWin, time.Minute)
+	withFlag(tb, flagTunRef, refuse)
+	windows, refused := tunnelState.windows, tunnelState.refused
+	setupTunnel()
+	tb.Cleanup(func() { tunnelState.windows, tunnelState.refused = windows, refused })
+}
+
+// subdomains returns n names with distinct short labels under parent.
+func subdomains(n int, parent string) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("s%d.%s", i, parent)
+	}
+	return names
+}
+
+// tunnelWarnings returns the tunneling warnings in lines.
+func tunnelWarnings(lines []string) []string {
+	var warnings []string
+	for _, line := range lines {
+		if strings.Contains(line, "Possible tunneling") {
+			warnings = append(warnings, line)
+		}
+	}
+	return warnings
+}
+
+// Streams of queries like those of DNS tunnels must be warned about once
+// they look like one, and refused from then on with -tunnel-refuse.
+func TestTunnelCheck(t *testing.T) {
+	client := net.IPv4(192, 0, 2, 7)
+	entropic := "x7k2q9vz4m8w1p6r3t5y0b2n8c4h.tun.example."
+	long := strings.Repeat("a", 60) + "." + strings.Repeat("b", 60) + ".tun.example."
+	tests := []struct {
+		name     string
+		names    []string
+		refuse   time.Duration
+		flagged  int    // index of the first query warned about, -1 for none
+		reason   string // in the warning
+		warnings int
+		refused  int // queries refused
+	}{
+		{"ordinary names", []string{"www.example.com.", "mail.example.com.", "www.example.com."}, 0, -1, "", 0, 0},
+		{"long low entropy label", []string{strings.Repeat("a", 40) + ".example.com."}, 0, -1, "", 0, 0},
+		{"high entropy label", []string{"www.tun.example.", entropic}, 0, 1, "high entropy label", 1, 0},
+		{"over-long name", []string{long}, 0, 0, "long name", 1, 0},
+		{"subdomains up to the limit", subdomains(200, "tun.example."), 0, -1, "", 0, 0},
+		{"burst of subdomains", subdomains(210, "tun.example."), 0, 200, "many distinct subdomains", 10, 0},
+		{"burst of repeats", append(subdomains(100, "tun.example."), subdomains(150, "tun.example.")...), 0, -1, "", 0, 0},
+		{"refused after a burst", subdomains(210, "tun.example."), time.Minute, 200, "many distinct subdomains", 1, 10},
+		{"refused after high entropy", []string{entropic, "www.tun.example."}, time.Minute, 0, "high entropy label", 1, 2},
+	}
+	for _, tt := range tests {
+		withTunnel(t, tt.refuse)
+		lb := withLogBuffer(t, 0)
+		count := cntTunnel.Value()
+		flagged, refused := -1, 0
+		for i, name := range tt.names {
+			if tunnelCheck(client, name) {
+				refused++
+			}
+			if flagged < 0 && cntTunnel.Value() > count {
+				flagged = i
+			}
+		}
+		if flagged != tt.flagged {
+			t.Errorf("%s: first flagged query %d, want %d", tt.name, flagged, tt.flagged)
+		}
+		if refused != tt.refused {
+			t.Errorf("%s: %d queries refused, want %d", tt.name, refused, tt.refused)
+		}
+		if n := cntTunnel.Value() - count; n != int64(tt.warnings) {
+			t.Errorf("%s: counted %d suspects, want %d", tt.name, n, tt.warnings)
+		}
+		warnings := tunnelWarnings(lb.lines())
+		if len(warnings) != tt.warnings {
+			t.Errorf("%s: %d warnings, want %d: %q", tt.name, len(warnings), tt.warnings, warnings)
+		}
+		for _, w := range warnings {
+			if !strings.Contains(w, "192.0.2.7") || !strings.Contains(w, "tun.example") || !strings.Contains(w, "("+tt.reason+")") {
+				t.Errorf("%s: warning %q, want one about 192.0.2.7 via tun.example for %s", tt.name, w, tt.reason)
+			}
+		}
+	}
+}
+
+// A refusal holds for the client and the domain warned about only, and
+// only for -tunnel-refuse.
+func TestTunnelRefusal(t *testing.T) {
+	withTunnel(t, time.Minute)
+	withLogBuffer(t, 0)
+	client, other := net.IPv4(192, 0, 2, 7), net.IPv4(192, 0, 2, 8)
+	if !tunnelCheck(client, "x7k2q9vz4m8w1p6r3t5y0b2n8c4h.tun.example.") {
+		t.Fatal("high entropy label not refused")
+	}
+	tests := []struct {
+		name   string
+		client net.IP
+		host   string
+		want   bool
+	}{
+		{"same client and domain", client, "www.tun.example.", true},
+		{"same client, other subdomain", client, "a.b.tun.example.", true},
+		{"same client, other domain", client, "www.example.com.", false},
+		{"other client, same domain", other, "www.tun.example.", false},
+	}
+	for _, tt := range tests {
+		if got := tunnelCheck(tt.client, tt.host); got != tt.want {
+			t.Errorf("%s: refused %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	// Once the refusal runs out the domain is answered again.
+	key := client.String() + " tun.example."
+	tunnelState.refused.Put(key, time.Now().Add(-time.Second))
+	if tunnelCheck(client, "www.tun.example.") {
+		t.Error("still refused after -tunnel-refuse")
+	}
+
+	withFlag(t, flagTunnel, false)
+	if tunnelCheck(client, "x7k2q9vz4m8w1p6r3t5y0b2n8c4h.tun.example.") {
+		t.Error("refused with -tunnel off")
+	}
+}
+
+func TestLabelEntropy(t *testing.T) {
+	tests := []struct {
+		label    string
+		min, max float64
+	}{
+		{"", 0, 0},
+		{"aaaaaaaa", 0, 0},
+		{"abababab", 1, 1},
+		{"abcdefgh", 3, 3},
+		{"x7k2q9vz4m8w1p6r3t5y0b2n8c4h", 4, 5},
+	}
+	for _, tt := range tests {
+		if got := labelEntropy(tt.label); got < tt.min || got > tt.max {
+			t.Errorf("%q: %.2f bits, want %.2f to %.2f", tt.label, got, tt.min, tt.max)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// unixSocket is the datagram Unix domain socket of a listener. Clients are
+// handled as if they were at 127.0.0.1, each with a port of its own, so that
+// the rest of the query path needn't know about them.
+type unixSocket struct {
+	conn  *net.UnixConn
+	path  string
+	mu    sync.Mutex
+	ports map[string]int // client socket paths to their ports
+	names map[int]string // and back
+	next  int            // the next port to give out
+}
+
+// unixListener is the -listen-unix listener, if any. It is kept apart from
+// listeners, which are all UDP sockets.
+var unixListener *listener
+
+// unixClientIP is the address Unix socket clients appear to have.
+var unixClientIP = net.IPv4(127, 0, 0, 1)
+
+// listenUnix binds a datagram Unix domain socket at path with the given
+// file mode, replacing a stale socket left behind there.
+func listenUnix(path string, mode os.FileMode) (*net.UnixConn, error) {
+	if info, err := os.Stat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		conn.Close()
+		os.Remove(path)
+		return nil, err
+	}
+	return conn, nil
+}
+
+// parseMode parses an octal file mode, e.g. "0660".
+func parseMode(s string) (os.FileMode, error) {
+	mode, err := strconv.ParseUint(s, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("bad file mode '%s'", s)
+	}
+	return os.FileMode(mode), nil
+}
+
+// newUnixListener wraps a bound Unix domain socket.
+func newUnixListener(conn *net.UnixConn, sinkhole net.IP) *listener {
+	path := conn.LocalAddr().String()
+	l := &listener{
+		unix:     &unixSocket{conn: conn, path: path, ports: make(map[string]int), names: make(map[int]string), next: 1},
+		sinkhole: sinkhole,
+		stats:    new(expvar.Map).Init(),
+	}
+	statsListeners.Set("unix:"+path, l.stats)
+	return l
+}
+
+// port returns the port standing in for the client socket at name. Ports
+// are reused once all have been given out, the oldest first.
+func (u *unixSocket) port(name string) int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if port, ok := u.ports[name]; ok {
+		return port
+	}
+	port := u.next
+	if u.next++; u.next > 65535 {
+		u.next = 1
+	}
+	delete(u.ports, u.names[port])
+	u.names[port] = name
+	u.ports[name] = port
+	return port
+}
+
+// send writes b to the client with the port standing in for it.
+func (u *unixSocket) send(b []byte, to *net.UDPAddr) error {
+	u.mu.Lock()
+	name := u.names[to.Port]
+	u.mu.Unlock()
+	if name == "" {
+		return errors.New("unknown unix socket client")
+	}
+	_, err := u.conn.WriteToUnix(b, &net.UnixAddr{Name: name, Net: "unixgram"})
+	return err
+}
+
+// close closes the socket and removes it.
+func (u *unixSocket) close() {
+	u.conn.Close()
+	os.Remove(u.path)
+}
+
+// runServerUnixDNS reads DNS queries from a Unix domain socket listener and
+// dispatches them for processing. Clients must bind their sockets, or there
+// is nowhere to send the answers.
+func runServerUnixDNS(l *listener) error {
+	log.Println("DNS: Started local server at", l)
+	atomic.AddInt64(&listening, 1)
+	defer atomic.AddInt64(&listening, -1)
+
+	var delay time.Duration
+	buf := make([]byte, answerBufSize)
+	for {
+		n, addr, err := l.unix.conn.ReadFromUnix(buf)
+		if err != nil {
+			if !readBackoff(err, &delay) {
+				return err
+			}
+			logLimited("DNS ERROR (1): %s\n", err)
+			cntErrors.Add(1)
+			continue
+		}
+		delay = 0
+		if addr == nil || addr.Name == "" {
+			log.Println("DNS WARN: Query from an unbound unix socket, can't answer")
+			continue
+		}
+
+		from := &net.UDPAddr{IP: unixClientIP, Port: l.unix.port(addr.Name)}
+		if n == len(buf) {
+			cutOffQuery(l, packet{buf: buf, n: n, addr: from})
+			continue
+		}
+		msg := make([]byte, n)
+		copy(msg, buf[:n])
+		cntMsgs.Add(1)
+		l.stats.Add("questions", 1)
+		ctx, cancel := queryContext()
+		go handleDNS(ctx, cancel, msg, from, nil, l)
+	}
+}
@@ -0,0 +1,105 @@
+// See LICENSE.txt for licensing information.
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestParseMode(t *testing.T) {
+	tests := []struct {
+		s    string
+		mode os.FileMode
+		err  bool
+	}{
+		{"0660", 0660, false},
+		{"666", 0666, false},
+		{"0777", 0777, false},
+		{"1777", 0, true},
+		{"0689", 0, true},
+		{"rw-rw----", 0, true},
+		{"", 0, true},
+	}
+	for _, tt := range tests {
+		mode, err := parseMode(tt.s)
+		if mode != tt.mode || (err != nil) != tt.err {
+			t.Errorf("%q: %o, %v, want %o, error %v", tt.s, mode, err, tt.mode, tt.err)
+		}
+	}
+}
+
+// Each client socket gets a port of its own, reused once all were given out.
+func TestUnixPorts(t *testing.T) {
+	u := &unixSocket{ports: make(map[string]int), names: make(map[int]string), next: 65534}
+	for _, tt := range []struct {
+		name string
+		port int
+	}{
+		{"/run/a.sock", 65534},
+		{"/run/b.sock", 65535},
+		{"/run/a.sock", 65534},
+		{"/run/c.sock", 1},
+		{"/run/b.sock", 65535},
+	} {
+		if port := u.port(tt.name); port != tt.port {
+			t.Errorf("%s: port %d, want %d", tt.name, port, tt.port)
+		}
+	}
+	u.next = 65534
+	if port := u.port("/run/d.sock"); port != 65534 {
+		t.Fatalf("port %d reused, want 65534", port)
+	}
+	if _, ok := u.ports["/run/a.sock"]; ok || u.names[65534] != "/run/d.sock" {
+		t.Error("the client of a reused port still has it")
+	}
+}
+
+// Queries over the socket are answered to the client's socket, which
+// replaces a stale one left behind.
+func TestUnixListener(t *testing.T) {
+	withBlocked(t, "ads.example.com.")
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dns.sock")
+	stale, err := listenUnix(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.Close()
+	conn, err := listenUnix(path, 0660)
+	if err != nil {
+		t.Fatalf("stale socket not replaced: %v", err)
+	}
+	l := newUnixListener(conn, net.IPv4(127, 0, 0, 1).To4())
+	t.Cleanup(l.unix.close)
+	go runServerUnixDNS(l)
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0660 {
+		t.Errorf("socket mode %v, %v, want 0660", info.Mode().Perm(), err)
+	}
+
+	client, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, "client.sock"), Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	for _, name := range []string{"ads.example.com.", "www.ads.example.com."} {
+		msg := testQuery(name, typeA)
+		if _, err := client.WriteToUnix(msg, &net.UnixAddr{Name: path, Net: "unixgram"}); err != nil {
+			t.Fatal(err)
+		}
+		client.SetReadDeadline(time.Now().Add(2 * time.Second))
+		buf := make([]byte, 512)
+		n, err := client.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if addrs := answerAddrs(buf[:n]); len(addrs) != 1 || addrs[0] != "127.0.0.1" {
+			t.Errorf("%s: answered % x", name, buf[:n])
+		}
+	}
+}
@@ -0,0 +1,122 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"expvar"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencySamples is the number of recent answers latency percentiles are
+// computed from.
+const latencySamples = 1024
+
+// serverStats holds the counters of one upstream server.
+type serverStats struct {
+	mu       sync.Mutex
+	queries  int64
+	answers  int64
+	timeouts int64
+	samples  []time.Duration // ring of the latest answers' latencies
+	next     int
+}
+
+// upstreams holds the statistics of the upstream servers by address. They
+// come from the upstream argument and the lists' server lines only, never
+// from queries, so their number is what's configured.
+var upstreams = struct {
+	sync.Mutex
+	m map[string]*serverStats
+}{m: make(map[string]*serverStats)}
+
+// upStats is the statistics of the upstream server in use.
+var upStats *serverStats
+
+func init() {
+	expvar.Publish("upstreams", expvar.Func(func() interface{} {
+		upstreams.Lock()
+		defer upstreams.Unlock()
+		out := make(map[string]interface{}, len(upstreams.m))
+		for addr, s := range upstreams.m {
+			out[addr] = s.report()
+		}
+		return out
+	}))
+}
+
+// serverStatsFor returns the statistics of the upstream server at addr,
+// creating them if needed.
+func serverStatsFor(addr string) *serverStats {
+	upstreams.Lock()
+	defer upstreams.Unlock()
+	s, ok := upstreams.m[addr]
+	if !ok {
+		s = &serverStats{samples: make([]time.Duration, 0, latencySamples)}
+		upstreams.m[addr] = s
+	}
+	return s
+}
+
+// sent counts a query sent to the server. It is safe on a nil receiver, as
+// are the other counting methods.
+func (s *serverStats) sent() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.queries++
+	s.mu.Unlock()
+}
+
+// answered counts an answer that took latency to arrive.
+func (s *serverStats) answered(latency time.Duration) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.answers++
+	if len(s.samples) < latencySamples {
+		s.samples = append(s.samples, latency)
+		return
+	}
+	s.samples[s.next] = latency
+	s.next = (s.next + 1) % latencySamples
+}
+
+// timedOut counts a query the server didn't answer in time.
+func (s *serverStats) timedOut() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	s.timeouts++
+	s.mu.Unlock()
+}
+
+// report returns the counters and latency percentiles in milliseconds.
+func (s *serverStats) report() map[string]interface{} {
+	s.mu.Lock()
+	sorted := append([]time.Duration(nil), s.samples...)
+	out := map[string]interface{}{
+		"queries":  s.queries,
+		"answers":  s.answers,
+		"timeouts": s.timeouts,
+	}
+	s.mu.Unlock()
+
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	latency := make(map[string]float64, 3)
+	for _, p := range []int{50, 90, 99} {
+		if len(sorted) == 0 {
+			break
+		}
+		d := sorted[(len(sorted)-1)*p/100]
+		latency["p"+strconv.Itoa(p)] = float64(d.Microseconds()) / 1000
+	}
+	out["latency"] = latency
+	return out
+}
@@ -0,0 +1,243 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// listUsage records which lines of a list had a blocking rule match, one
+// bit per line, since the list was first loaded with its current contents.
+type listUsage struct {
+	hash  string
+	since time.Time
+	bits  []atomic.Uint64
+}
+
+// usageState is a listUsage as kept in the state file.
+type usageState struct {
+	Path  string    `json:"path"`
+	Hash  string    `json:"hash"`
+	Since time.Time `json:"since"`
+	Bits  []byte    `json:"bits"` // little endian words
+}
+
+// newListUsage returns the usage of a list with the given hash and number
+// of lines, with no line used.
+func newListUsage(hash string, lines int) *listUsage {
+	return &listUsage{hash: hash, since: time.Now(), bits: make([]atomic.Uint64, lines/64+1)}
+}
+
+// mark records that a rule on line matched.
+func (u *listUsage) mark(line int) {
+	if u == nil || line/64 >= len(u.bits) {
+		return
+	}
+	word, mask := &u.bits[line/64], uint64(1)<<(line%64)
+	if word.Load()&mask == 0 {
+		word.Or(mask)
+	}
+}
+
+// used reports whether a rule on line matched.
+func (u *listUsage) used(line int) bool {
+	return line/64 < len(u.bits) && u.bits[line/64].Load()&(1<<(line%64)) != 0
+}
+
+// state returns the usage as kept in the state file.
+func (u *listUsage) state(path string) usageState {
+	b := make([]byte, 0, len(u.bits)*8)
+	for i := range u.bits {
+		b = binary.LittleEndian.AppendUint64(b, u.bits[i].Load())
+	}
+	return usageState{Path: path, Hash: u.hash, Since: u.since, Bits: b}
+}
+
+// restore adds the lines used according to st, if it is about the same
+// contents, and takes its start time.
+func (u *listUsage) restore(st usageState) {
+	if st.Hash != u.hash {
+		return
+	}
+	for i := 0; i < len(u.bits) && (i+1)*8 <= len(st.Bits); i++ {
+		u.bits[i].Or(binary.LittleEndian.Uint64(st.Bits[i*8:]))
+	}
+	if st.Since.Before(u.since) {
+		u.since = st.Since
+	}
+}
+
+// trackUsage sets up the usage of the lists of rs, which is about to replace
+// the current rules. Lists whose contents didn't change keep their usage.
+func trackUsage(rs *ruleSet, files []listFile) {
+	old := make(map[string]*listUsage)
+	if cur := currentRules(); cur != nil {
+		for i, name := range cur.names {
+			old[name] = cur.usage[i]
+		}
+	}
+	rs.usage = make([]*listUsage, len(rs.names))
+	for _, info := range files {
+		i := indexOf(rs.names, info.Name)
+		if u := old[info.Name]; u != nil && u.hash == info.Hash && info.Hash != "" {
+			rs.usage[i] = u
+		} else {
+			rs.usage[i] = newListUsage(info.Hash, info.lines)
+		}
+	}
+}
+
+// currentUsage returns the usage of the current lists for the state file.
+func currentUsage() map[string]usageState {
+	rs := currentRules()
+	m := make(map[string]usageState, len(rs.names))
+	for i, name := range rs.names {
+		if u := rs.usage[i]; u != nil && !isRemote(rs.paths[i]) && rs.paths[i] != *flagPiholeDB {
+			m[name] = u.state(rs.paths[i])
+		}
+	}
+	return m
+}
+
+// restoreUsage restores the usage saved in the state file.
+func restoreUsage(m map[string]usageState) {
+	rs := currentRules()
+	for i, name := range rs.names {
+		if st, ok := m[name]; ok && rs.usage[i] != nil {
+			rs.usage[i].restore(st)
+		}
+	}
+}
+
+// markUsed records that the blocking rule for zone, as returned by
+// matchBlocked with src, matched. Every list holding the rule is credited,
+// so that none of them has it pruned.
+func (rs *ruleSet) markUsed(zone string, src ruleSource) {
+	rs.markSource(src)
+	for _, src := range rs.also[zone] {
+		rs.markSource(src)
+	}
+}
+
+// markSource records that the rule from src matched.
+func (rs *ruleSet) markSource(src ruleSource) {
+	if src == flagSource || src.list() >= len(rs.usage) {
+		return
+	}
+	rs.usage[src.list()].mark(src.line())
+}
+
+// unusedRule is a list line whose rules never matched.
+type unusedRule struct {
+	Line int    `json:"line"`
+	Rule string `json:"rule"` // the first of the line's rules
+}
+
+// unusedList reports the unused rules of a list.
+type unusedList struct {
+	Name    string       `json:"name"`
+	Path    string       `json:"path"`
+	Since   time.Time    `json:"trackedSince"`
+	Unused  []unusedRule `json:"unused"`
+	Tracked int          `json:"tracked"` // lines with blocking rules
+}
+
+// unused reports the lines with blocking rules that never matched, for the
+// lists tracked for at least the given time.
+func (rs *ruleSet) unused(since time.Duration) []unusedList {
+	lines := make([]map[int]string, len(rs.names))
+	add := func(rule string, src ruleSource) {
+		i := src.list()
+		if src == flagSource || rs.usage[i] == nil {
+			return
+		}
+		if lines[i] == nil {
+			lines[i] = make(map[int]string)
+		}
+		if _, ok := lines[i][src.line()]; !ok {
+			lines[i][src.line()] = rule
+		}
+	}
+	collect := func(prefix string, m map[string]ruleSource) {
+		for name, src := range m {
+			rule := prefix + strings.TrimSuffix(name, ".")
+			add(rule, src)
+			for _, src := range rs.also[prefix+name] {
+				add(rule, src)
+			}
+		}
+	}
+	collect("", rs.blocked)
+	collect("*.", rs.tlds)
+	collect("contains:", rs.substrs)
+
+	lists := []unusedList{}
+	for i, name := range rs.names {
+		u := rs.usage[i]
+		if u == nil || time.Since(u.since) < since {
+			continue
+		}
+		ul := unusedList{Name: name, Path: rs.paths[i], Since: u.since, Unused: []unusedRule{}, Tracked: len(lines[i])}
+		for line, rule := range lines[i] {
+			if !u.used(line) {
+				ul.Unused = append(ul.Unused, unusedRule{Line: line, Rule: rule})
+			}
+		}
+		sort.Slice(ul.Unused, func(a, b int) bool { return ul.Unused[a].Line < ul.Unused[b].Line })
+		lists = append(lists, ul)
+	}
+	return lists
+}
+
+// parseSince parses a duration that may also be given in days, e.g. "30d".
+func parseSince(s string) (time.Duration, error) {
+	if days, ok := strings.CutSuffix(s, "d"); ok {
+		n, err := strconv.Atoi(days)
+		if err != nil || n < 0 {
+			return 0, fmt.Errorf("bad number of days %q", s)
+		}
+		return time.Duration(n) * 24 * time.Hour, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// handleAPIUnused reports the rules that never matched, for the lists
+// tracked for at least since, if given.
+func handleAPIUnused(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	reply := func(status int, msg string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+	}
+	if !authHTTP(req) {
+		reply(http.StatusForbidden, "bad key")
+		return
+	}
+	var since time.Duration
+	if s := req.FormValue("since"); s != "" {
+		var err error
+		if since, err = parseSince(s); err != nil {
+			reply(http.StatusBadRequest, err.Error())
+			return
+		}
+	}
+	json.NewEncoder(w).Encode(currentRules().unused(since))
+}
+
+// indexOf returns the index of name in names, or -1.
+func indexOf(names []string, name string) int {
+	for i, n := range names {
+		if n == name {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,61 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Build information, set at build time with e.g.:
+// go build -ldflags "-X main.version=1.0.0 -X main.commit=abc123 -X main.buildDate=2014-08-01"
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+func init() {
+	// Fill in the blanks from the information embedded by the Go toolchain.
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				if commit == "" {
+					commit = setting.Value
+				}
+			case "vcs.time":
+				if buildDate == "" {
+					buildDate = setting.Value
+				}
+			}
+		}
+	}
+	if commit == "" {
+		commit = "unknown"
+	}
+	if buildDate == "" {
+		buildDate = "unknown"
+	}
+
+	info := new(expvar.Map).Init()
+	for k, v := range map[string]string{
+		"version":   version,
+		"commit":    commit,
+		"buildDate": buildDate,
+		"goVersion": runtime.Version(),
+	} {
+		s := new(expvar.String)
+		s.Set(v)
+		info.Set(k, s)
+	}
+	expvar.Publish("buildInfo", info)
+}
+
+// versionString returns a one-line description of the build.
+func versionString() string {
+	return fmt.Sprintf("adhole %s (commit %s, built %s, %s %s/%s)",
+		version, commit, buildDate, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
@@ -0,0 +1,111 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var cntWarmup = expvar.NewInt("statsWarmupQueries")
+
+// warmedUp is set once the -warmup queries are answered, or right away
+// without -warmup.
+var warmedUp int32
+
+// loadWarmup reads the names to warm the cache up with from the file at
+// path, one per line. Empty lines and lines starting with # are skipped.
+func loadWarmup(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var names []string
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		name := strings.TrimSpace(scanner.Text())
+		if name == "" || name[0] == '#' {
+			continue
+		}
+		name = strings.TrimSuffix(name, ".")
+		if !validName(name) || strings.Contains(name, "..") {
+			return nil, fmt.Errorf("%s line %d: bad name '%s'", path, line, name)
+		}
+		names = append(names, name)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return names, nil
+}
+
+// warmupQuery returns a query for name of qtype, with an OPT record without
+// the DO bit if edns is set.
+func warmupQuery(name string, qtype uint16, edns bool) []byte {
+	msg := []byte{0, 0, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(name, ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, byte(qtype>>8), byte(qtype), 0, 1)
+	if edns {
+		msg = append(msg, 0, byte(typeOPT>>8), byte(typeOPT), ednsUDPSize>>8, ednsUDPSize&0xff, 0, 0, 0, 0, 0, 0)
+		binary.BigEndian.PutUint16(msg[countAdditional:], 1)
+	}
+	return msg
+}
+
+// runWarmup asks the upstream about names, at most rate queries a second,
+// so their answers are cached before clients ask. Clients ask with and
+// without EDNS, which are cached apart, so it asks both ways for A and AAAA.
+// Answers cached already, e.g. from -cache-persist, are not asked for again.
+func runWarmup(names []string, rate int) {
+	defer atomic.StoreInt32(&warmedUp, 1)
+	start := time.Now()
+	interval := time.Second / time.Duration(rate)
+	log.Printf("DNS: Warming up the cache with %d names\n", len(names))
+
+	var keys []string
+	for i, name := range names {
+		for _, qtype := range []uint16{typeA, typeAAAA} {
+			for _, edns := range []bool{false, true} {
+				msg := warmupQuery(name, qtype, edns)
+				host, _, end, err := parseQuestion(msg)
+				if err != nil {
+					continue
+				}
+				key := cacheKey(host, msg, end)
+				if cache.has(key) {
+					continue
+				}
+				if cacheQuery(msg) {
+					cntWarmup.Add(1)
+					keys = append(keys, key)
+					time.Sleep(interval)
+				}
+			}
+		}
+		if done := i + 1; done%100 == 0 && done < len(names) {
+			log.Printf("DNS: Warming up the cache: %d of %d names\n", done, len(names))
+		}
+	}
+	// Give the last queries time to be answered.
+	time.Sleep(*flagTimeout)
+	cached := 0
+	for _, key := range keys {
+		if cache.has(key) {
+			cached++
+		}
+	}
+	log.Printf("DNS: Warmed up the cache in %s: %d of %d answers cached\n",
+		time.Since(start).Round(time.Second), cached, len(keys))
+}
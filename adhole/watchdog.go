@@ -0,0 +1,104 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// watchdogName is always answered with the sinkhole, so the watchdog can
+// check the listeners without depending on the list or the upstream.
+const watchdogName = "adhole-watchdog.invalid."
+
+var cntWatchdog = expvar.NewInt("statsWatchdogFailures")
+
+// watchdogInterval returns how often to run the watchdog: every, or half of
+// what systemd expects if its watchdog is enabled.
+func watchdogInterval(every time.Duration) time.Duration {
+	if every > 0 {
+		return every
+	}
+	usec, err := strconv.ParseInt(os.Getenv("WATCHDOG_USEC"), 10, 64)
+	if err != nil || usec <= 0 {
+		return 0
+	}
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+	return time.Duration(usec) * time.Microsecond / 2
+}
+
+// watchdogCheck queries every listener for watchdogName, and checks that
+// the upstream answered something within every if queries timed out.
+func watchdogCheck(timeout, every time.Duration, timedOut bool) error {
+	for _, l := range listeners {
+		reply, err := exchange(l, watchdogName, typeA, timeout)
+		if err != nil {
+			return fmt.Errorf("listener %s: %s", l, err)
+		}
+		if reply[7] != 1 {
+			return fmt.Errorf("listener %s: no sinkhole answer", l)
+		}
+	}
+	last := time.Unix(0, atomic.LoadInt64(&lastUpstream))
+	if timedOut && time.Since(last) > every {
+		return errors.New("upstream: queries time out with no answers")
+	}
+	return nil
+}
+
+// redialUpstream replaces the upstream socket with a fresh one.
+func redialUpstream() error {
+	old := upstream.Load()
+	conn, err := net.DialUDP("udp4", nil, old.RemoteAddr().(*net.UDPAddr))
+	if err != nil {
+		return err
+	}
+	upstream.Store(conn)
+	old.Close()
+	return nil
+}
+
+// runWatchdog checks the servers every interval. After fails checks in a row
+// failed it stops AdHole with exit status 3 if exit is set, otherwise it
+// tries to fix the upstream socket. It also keeps the systemd watchdog happy
+// for as long as the checks pass.
+func runWatchdog(every time.Duration, fails int, exit bool) {
+	failures := 0
+	timeouts := cntTimedout.Value()
+	for range time.Tick(every) {
+		now := cntTimedout.Value()
+		err := watchdogCheck(*flagTimeout, every, now > timeouts)
+		timeouts = now
+		if err == nil {
+			failures = 0
+			sdNotify("WATCHDOG=1")
+			continue
+		}
+		failures++
+		cntWatchdog.Add(1)
+		log.Printf("DNS ERROR: Watchdog check failed (%d of %d): %s\n", failures, fails, err)
+		if failures < fails {
+			continue
+		}
+
+		if exit {
+			log.Println("DNS ERROR: Watchdog giving up, stopping")
+			fail(&exitError{exitWatchdog, err})
+			return
+		}
+		log.Println("DNS ERROR: Watchdog reopening the upstream socket")
+		if err := redialUpstream(); err != nil {
+			log.Println("DNS ERROR: Watchdog can't reopen the upstream socket:", err)
+		}
+		failures = 0
+	}
+}
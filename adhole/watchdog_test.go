@@ -0,0 +1,126 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWatchdogInterval(t *testing.T) {
+	pid := strconv.Itoa(os.Getpid())
+	tests := []struct {
+		name  string
+		every time.Duration
+		usec  string
+		pid   string
+		want  time.Duration
+	}{
+		{"off", 0, "", "", 0},
+		{"flag", 10 * time.Second, "", "", 10 * time.Second},
+		{"flag over systemd", 10 * time.Second, "30000000", "", 10 * time.Second},
+		{"systemd", 0, "30000000", "", 15 * time.Second},
+		{"systemd for us", 0, "30000000", pid, 15 * time.Second},
+		{"systemd for another process", 0, "30000000", "1", 0},
+		{"systemd garbage", 0, "soon", "", 0},
+	}
+	for _, tt := range tests {
+		t.Setenv("WATCHDOG_USEC", tt.usec)
+		t.Setenv("WATCHDOG_PID", tt.pid)
+		if got := watchdogInterval(tt.every); got != tt.want {
+			t.Errorf("%s: %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+// startListener starts a DNS listener on a free loopback port, serving
+// queries unless wedged, and stops it after the test.
+func startListener(tb testing.TB, wedged bool) *listener {
+	tb.Helper()
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	l := newListener(conn, net.IPv4(127, 0, 0, 1).To4())
+	tb.Cleanup(func() { conn.Close() })
+	if !wedged {
+		go runServerLocalDNS(l)
+	}
+	return l
+}
+
+func TestWatchdogCheck(t *testing.T) {
+	recent, stale := time.Now(), time.Now().Add(-time.Minute)
+	tests := []struct {
+		name     string
+		wedged   bool
+		timedOut bool
+		answered time.Time // last upstream answer
+		err      string
+	}{
+		{"healthy", false, false, stale, ""},
+		{"timeouts with answers", false, true, recent, ""},
+		{"timeouts only", false, true, stale, "upstream"},
+		{"wedged listener", true, false, recent, "listener"},
+	}
+	for _, tt := range tests {
+		withFlag(t, &listeners, []*listener{startListener(t, false), startListener(t, tt.wedged)})
+		atomic.StoreInt64(&lastUpstream, tt.answered.UnixNano())
+		err := watchdogCheck(200*time.Millisecond, 10*time.Second, tt.timedOut)
+		if tt.err == "" && err != nil || tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s: %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+// Probes must be answered at once and not count as blocked queries, also
+// with the tarpit on and blocking off.
+func TestWatchdogProbe(t *testing.T) {
+	withFlag(t, flagTarpit, time.Second)
+	withFlag(t, &listeners, []*listener{startListener(t, false)})
+	t.Cleanup(func() { blocking.Set(true) })
+	for _, on := range []bool{true, false} {
+		blocking.Set(on)
+		blocked := cntBlocked.Value()
+		if err := watchdogCheck(200*time.Millisecond, 10*time.Second, false); err != nil {
+			t.Errorf("blocking %v: %v", on, err)
+		}
+		if n := cntBlocked.Value() - blocked; n != 0 {
+			t.Errorf("blocking %v: probe counted as %d blocked", on, n)
+		}
+	}
+}
+
+func TestRedialUpstream(t *testing.T) {
+	up, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer up.Close()
+	old, err := net.DialUDP("udp4", nil, up.LocalAddr().(*net.UDPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := upstream.Swap(old)
+	defer upstream.Store(saved)
+
+	if err := redialUpstream(); err != nil {
+		t.Fatal(err)
+	}
+	conn := upstream.Load()
+	defer conn.Close()
+	if conn == old || conn.RemoteAddr().String() != up.LocalAddr().String() {
+		t.Errorf("upstream socket %s to %s, want a new one to %s", conn.LocalAddr(), conn.RemoteAddr(), up.LocalAddr())
+	}
+	if _, err := old.Write([]byte{0}); err == nil {
+		t.Error("old upstream socket still open")
+	}
+	if _, err := conn.Write([]byte{0}); err != nil {
+		t.Error(err)
+	}
+}
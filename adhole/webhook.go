@@ -0,0 +1,142 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+var (
+	cntHookSent = expvar.NewInt("statsWebhookSent")
+	cntHookDrop = expvar.NewInt("statsWebhookDropped")
+	cntHookFail = expvar.NewInt("statsWebhookFailed")
+)
+
+// Webhook delivery: alerts waiting to be sent beyond webhookQueue are
+// dropped, and a failed POST is tried webhookTries times in all, waiting
+// twice as long before each retry.
+const (
+	webhookQueue   = 64
+	webhookTries   = 4
+	webhookBackoff = 2 * time.Second
+)
+
+// alert is the JSON object posted to the -webhook for a query blocked by an
+// alert rule. Text is for Slack and the like, which show only that.
+type alert struct {
+	Time       time.Time `json:"time"`
+	Client     string    `json:"client"`
+	ClientName string    `json:"clientName,omitempty"`
+	Name       string    `json:"qname"`
+	Rule       string    `json:"rule"`
+	Text       string    `json:"text"`
+}
+
+var (
+	// alerts queues the alerts for the webhook sender.
+	alerts = make(chan *alert, webhookQueue)
+	// alertLists and alertRules are the list names and the blocked names,
+	// with a trailing dot, whose matches alert.
+	alertLists map[string]bool
+	alertRules map[string]bool
+	// webhookClient posts the alerts.
+	webhookClient = &http.Client{Timeout: 10 * time.Second}
+)
+
+// setupAlerts checks the -webhook URL and sets which rules alert.
+func setupAlerts(url, lists, rules string) error {
+	if !isRemote(url) {
+		return fmt.Errorf("bad -webhook '%s', want an http or https URL", url)
+	}
+	alertLists = make(map[string]bool)
+	for _, name := range strings.Split(lists, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			alertLists[name] = true
+		}
+	}
+	alertRules = make(map[string]bool)
+	for _, name := range strings.Split(rules, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			alertRules[strings.ToLower(strings.TrimSuffix(name, "."))+"."] = true
+		}
+	}
+	if len(alertLists) == 0 && len(alertRules) == 0 {
+		return errors.New("-webhook needs -alert-lists or -alert-rules")
+	}
+	return nil
+}
+
+// alertMatch queues an alert if blocking the query of the client at ip for
+// host, by the rule for zone from the list named list, should alert. It
+// never blocks.
+func alertMatch(ip net.IP, host, zone, list, rule string) {
+	if !alertLists[list] && !alertRules[zone] {
+		return
+	}
+	a := &alert{
+		Time:       time.Now(),
+		Client:     clientIP(ip),
+		ClientName: clientName(ip),
+		Name:       escapeName(host),
+		Rule:       rule,
+	}
+	who := a.Client
+	if a.ClientName != "" {
+		who += " (" + a.ClientName + ")"
+	}
+	a.Text = fmt.Sprintf("adhole: %s queried %s, blocked by %s", who, strings.TrimSuffix(a.Name, "."), rule)
+	select {
+	case alerts <- a:
+	default:
+		cntHookDrop.Add(1)
+	}
+}
+
+// runWebhook posts the queued alerts to url, at most rate a minute. Alerts
+// coming in faster pile up in the queue, and then are dropped.
+func runWebhook(url string, rate int) {
+	interval := time.Minute / time.Duration(rate)
+	for a := range alerts {
+		body, err := json.Marshal(a)
+		if err != nil {
+			continue
+		}
+		delay := webhookBackoff
+		for try := 1; ; try++ {
+			if err = postAlert(url, body); err == nil {
+				cntHookSent.Add(1)
+				break
+			}
+			if try == webhookTries {
+				log.Printf("ERROR: webhook: giving up on the alert for %s: %s\n", a.Name, err)
+				cntHookFail.Add(1)
+				break
+			}
+			time.Sleep(delay)
+			delay *= 2
+		}
+		time.Sleep(interval)
+	}
+}
+
+// postAlert posts one alert.
+func postAlert(url string, body []byte) error {
+	resp, err := webhookClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"html/template"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Self-service whitelisting limits: how many names a client may allow
+// within selfServeWindow, and for how long at most.
+const (
+	selfServeLimit  = 5
+	selfServeWindow = time.Hour
+	selfServeMaxFor = time.Hour
+)
+
+var cntWhitelisted = expvar.NewInt("statsWhitelisted")
+
+// whitelist holds names that are not blocked even if the list says so,
+// with their expiry time, zero for permanent entries. It is independent of
+// the list, so entries survive reloads.
+type whitelist struct {
+	mu      sync.Mutex
+	entries map[string]time.Time
+	fixed   map[string]bool                   // permanent entries not saved, from -pihole-db
+	clients *expiringMap[string, []time.Time] // recent self-service requests per client
+	swept   time.Time                         // when expired entries were last dropped
+}
+
+// allowed is the whitelist in use.
+var allowed = &whitelist{
+	entries: make(map[string]time.Time),
+	clients: newExpiringMap[string, []time.Time]("selfServiceClients", 10000, selfServeWindow),
+}
+
+// load reads permanent entries from the overrides file at path, one name per
+// line. A missing file is not an error.
+func (wl *whitelist) load(path string) error {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	scn := bufio.NewScanner(file)
+	for scn.Scan() {
+		if name := strings.TrimSpace(scn.Text()); name != "" && !strings.HasPrefix(name, "#") {
+			wl.entries[strings.ToLower(name)+"."] = time.Time{}
+		}
+	}
+	return scn.Err()
+}
+
+// allowFixed permanently allows names, which aren't saved to the overrides
+// file.
+func (wl *whitelist) allowFixed(names []string) {
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	if wl.fixed == nil {
+		wl.fixed = make(map[string]bool, len(names))
+	}
+	for _, name := range names {
+		wl.fixed[strings.ToLower(name)+"."] = true
+	}
+}
+
+// save writes the permanent entries to the overrides file at path. It must
+// be called with wl locked.
+func (wl *whitelist) save(path string) error {
+	return saveOverrides(path, wl.entries)
+}
+
+// saveOverrides writes the permanent ones of entries to the overrides file
+// at path, replacing it as a whole.
+func saveOverrides(path string, entries map[string]time.Time) error {
+	var b strings.Builder
+	for name, expires := range entries {
+		if expires.IsZero() {
+			b.WriteString(strings.TrimSuffix(name, "."))
+			b.WriteByte('\n')
+		}
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(b.String()), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// add allows name for the given duration, or permanently if it is 0.
+func (wl *whitelist) add(name string, d time.Duration) error {
+	name = strings.ToLower(strings.TrimSuffix(name, ".")) + "."
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	if d == 0 {
+		wl.entries[name] = time.Time{}
+		if *flagOverride != "" {
+			return wl.save(*flagOverride)
+		}
+		return nil
+	}
+	// Temporary entries nobody asks for again would never be dropped by
+	// contains, so they are dropped here once in a while.
+	now := time.Now()
+	if now.Sub(wl.swept) >= selfServeWindow {
+		wl.swept = now
+		for name, expires := range wl.entries {
+			if !expires.IsZero() && now.After(expires) {
+				delete(wl.entries, name)
+			}
+		}
+	}
+	// Never shorten a permanent or longer entry.
+	expires := now.Add(d)
+	if old, ok := wl.entries[name]; !ok || (!old.IsZero() && old.Before(expires)) {
+		wl.entries[name] = expires
+	}
+	return nil
+}
+
+// contains tells if host or any of its parent domains is whitelisted.
+// Expired entries are dropped as they are found.
+func (wl *whitelist) contains(host string) bool {
+	host = strings.ToLower(host)
+	now := time.Now()
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	if len(wl.entries) == 0 && len(wl.fixed) == 0 {
+		return false
+	}
+	for name := host; name != "" && name != "."; {
+		if wl.fixed[name] {
+			return true
+		}
+		if expires, ok := wl.entries[name]; ok {
+			if expires.IsZero() || now.Before(expires) {
+				return true
+			}
+			delete(wl.entries, name)
+		}
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+	}
+	return false
+}
+
+// limit records a self-service request by client and tells if it is within
+// the rate limit.
+func (wl *whitelist) limit(client string) bool {
+	now := time.Now()
+	wl.mu.Lock()
+	defer wl.mu.Unlock()
+	times, _ := wl.clients.Get(client)
+	recent := times[:0]
+	for _, t := range times {
+		if now.Sub(t) < selfServeWindow {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) >= selfServeLimit {
+		wl.clients.Put(client, recent)
+		return false
+	}
+	wl.clients.Put(client, append(recent, now))
+	return true
+}
+
+// sameOrigin tells if a browser sent req from a page of the host it is sent
+// to, as the block page does, going by the Origin header or, lacking that,
+// the Referer. Requests with neither don't come from a web page at all.
+func sameOrigin(req *http.Request) bool {
+	from := req.Header.Get("Origin")
+	if from == "" {
+		if from = req.Header.Get("Referer"); from == "" {
+			return true
+		}
+	}
+	u, err := url.Parse(from)
+	return err == nil && u.Host != "" && strings.EqualFold(u.Host, req.Host)
+}
+
+// handleAPIWhitelist allows the name given as name (default: the Host of the
+// request) for the duration given as for, e.g. 1h, or permanently if that
+// is empty. With the key anything goes; with -allow-self-service anyone may
+// allow names for up to an hour, a few times per hour, but web pages only
+// from the blocked name itself, so that other sites can't do it for them.
+func handleAPIWhitelist(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	reply := func(status int, msg string) {
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(map[string]string{"error": msg})
+	}
+	if req.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		reply(http.StatusMethodNotAllowed, "use POST")
+		return
+	}
+
+	name := req.FormValue("name")
+	if name == "" {
+		name, _, _ = strings.Cut(req.Host, ":")
+	}
+	if name == "" || strings.ContainsAny(name, " /") {
+		reply(http.StatusBadRequest, "bad name")
+		return
+	}
+	var d time.Duration
+	if arg := req.FormValue("for"); arg != "" {
+		var err error
+		if d, err = time.ParseDuration(arg); err != nil || d <= 0 {
+			reply(http.StatusBadRequest, "bad duration")
+			return
+		}
+	}
+
+	if req.FormValue("key") != key {
+		client, _, _ := net.SplitHostPort(req.RemoteAddr)
+		switch {
+		case !*flagSelfServ:
+			authHTTP(req) // logs the attempt
+			reply(http.StatusForbidden, "bad key")
+			return
+		case d == 0 || d > selfServeMaxFor:
+			reply(http.StatusForbidden, fmt.Sprintf("allowing for longer than %s needs the key", selfServeMaxFor))
+			return
+		case !sameOrigin(req):
+			log.Printf("HTTP: Cross-site whitelisting of %s from %s refused\n", name, clientHTTP(req.RemoteAddr))
+			reply(http.StatusForbidden, "cross-site request")
+			return
+		case !allowed.limit(client):
+			reply(http.StatusTooManyRequests, "too many requests")
+			return
+		}
+	}
+
+	if err := allowed.add(name, d); err != nil {
+		log.Println("HTTP ERROR: Can't save overrides:", err)
+		reply(http.StatusInternalServerError, err.Error())
+		return
+	}
+	if d == 0 {
+		log.Printf("HTTP: %s allowed %s permanently\n", clientHTTP(req.RemoteAddr), name)
+	} else {
+		log.Printf("HTTP: %s allowed %s for %s\n", clientHTTP(req.RemoteAddr), name, d)
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{"name": name, "for": d.String(), "permanent": d == 0})
+}
+
+// blockPage is shown to browsers visiting a blocked name when self-service
+// whitelisting is enabled. It is served over plain HTTP under the blocked
+// name, so it never asks for the key.
+var blockPage = template.Must(template.New("block").Parse(`<!DOCTYPE html>
+<html><head><title>Blocked: {{.}}</title></head>
+<body>
+<h1>{{.}} is blocked</h1>
+<form method="post" action="/api/whitelist">
+<input type="hidden" name="name" value="{{.}}">
+<input type="hidden" name="for" value="1h">
+<button type="submit">Allow for 1 hour</button>
+</form>
+<p>It can take a few minutes until your device forgets the old answer.</p>
+</body></html>
+`))
+
+// wantsPage tells if a request comes from a browser loading a page, rather
+// than an image or a script.
+func wantsPage(req *http.Request) bool {
+	return req.Method == http.MethodGet && strings.Contains(req.Header.Get("Accept"), "text/html")
+}
@@ -0,0 +1,144 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+// withWhitelist gives the test an empty whitelist of its own.
+func withWhitelist(tb testing.TB) *whitelist {
+	wl := &whitelist{
+		entries: make(map[string]time.Time),
+		clients: newExpiringMap[string, []time.Time]("selfServiceClients", 10000, selfServeWindow),
+	}
+	withFlag(tb, &allowed, wl)
+	return wl
+}
+
+func TestWhitelistSelfService(t *testing.T) {
+	withFlag(t, &key, "secret")
+	withFlag(t, flagSelfServ, true)
+	withFlag(t, flagOverride, "")
+	tests := []struct {
+		name    string
+		host    string
+		form    url.Values
+		origin  string
+		referer string
+		status  int
+	}{
+		{"from the block page", "ads.example.com", url.Values{"for": {"1h"}}, "http://ads.example.com", "", http.StatusOK},
+		{"from the block page, with port", "ads.example.com:80", url.Values{"for": {"1h"}}, "http://ads.example.com:80", "", http.StatusOK},
+		{"referer only", "ads.example.com", url.Values{"for": {"30m"}}, "", "http://ads.example.com/banner?x=1", http.StatusOK},
+		{"not from a page", "ads.example.com", url.Values{"for": {"1h"}}, "", "", http.StatusOK},
+		{"other site", "ads.example.com", url.Values{"for": {"1h"}}, "http://evil.example", "", http.StatusForbidden},
+		{"other site by referer", "ads.example.com", url.Values{"for": {"1h"}}, "", "http://evil.example/page", http.StatusForbidden},
+		{"opaque origin", "ads.example.com", url.Values{"for": {"1h"}}, "null", "", http.StatusForbidden},
+		{"subdomain", "ads.example.com", url.Values{"for": {"1h"}}, "http://x.ads.example.com", "", http.StatusForbidden},
+		{"too long", "ads.example.com", url.Values{"for": {"2h"}}, "http://ads.example.com", "", http.StatusForbidden},
+		{"permanently", "ads.example.com", url.Values{}, "http://ads.example.com", "", http.StatusForbidden},
+		{"other site with the key", "ads.example.com", url.Values{"key": {"secret"}}, "http://evil.example", "", http.StatusOK},
+		{"wrong key", "ads.example.com", url.Values{"key": {"guess"}}, "", "", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		wl := withWhitelist(t)
+		req := httptest.NewRequest(http.MethodPost, "/api/whitelist", strings.NewReader(tt.form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Host = tt.host
+		req.RemoteAddr = "192.0.2.1:1234"
+		if tt.origin != "" {
+			req.Header.Set("Origin", tt.origin)
+		}
+		if tt.referer != "" {
+			req.Header.Set("Referer", tt.referer)
+		}
+		w := httptest.NewRecorder()
+		handleAPIWhitelist(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+		}
+		if got, want := wl.contains("ads.example.com."), tt.status == http.StatusOK; got != want {
+			t.Errorf("%s: whitelisted %v, want %v", tt.name, got, want)
+		}
+	}
+}
+
+func TestWhitelistSelfServiceLimit(t *testing.T) {
+	withFlag(t, &key, "secret")
+	withFlag(t, flagSelfServ, true)
+	withWhitelist(t)
+	for i := 0; i <= selfServeLimit; i++ {
+		req := httptest.NewRequest(http.MethodPost, "/api/whitelist?for=1h", nil)
+		req.Host = "ads.example.com"
+		w := httptest.NewRecorder()
+		handleAPIWhitelist(w, req)
+		want := http.StatusOK
+		if i == selfServeLimit {
+			want = http.StatusTooManyRequests
+		}
+		if w.Code != want {
+			t.Errorf("request %d: status %d, want %d", i+1, w.Code, want)
+		}
+	}
+}
+
+// TestBlockPage checks that the block page, served over plain HTTP under
+// the blocked name, offers self-service only and never asks for the key.
+func TestBlockPage(t *testing.T) {
+	withFlag(t, flagSelfServ, true)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Host = "ads.example.com"
+	req.Header.Set("Accept", "text/html,application/xhtml+xml")
+	w := httptest.NewRecorder()
+	handleHTTP(w, req)
+	page := w.Body.String()
+	if !strings.Contains(page, `action="/api/whitelist"`) || !strings.Contains(page, `value="ads.example.com"`) {
+		t.Errorf("no self-service form:\n%s", page)
+	}
+	if strings.Contains(page, `name="key"`) {
+		t.Errorf("the page asks for the key:\n%s", page)
+	}
+}
+
+// Entries allow their names and all names under them, of any number of
+// labels.
+func TestWhitelistContains(t *testing.T) {
+	wl := withWhitelist(t)
+	withFlag(t, flagOverride, "")
+	for _, name := range []string{"shop.example.com", "lan", "Printer", "gone.example.net"} {
+		wl.add(name, 0)
+	}
+	wl.entries["gone.example.net."] = time.Now().Add(-time.Minute)
+	tests := []struct {
+		host string
+		want bool
+	}{
+		{"shop.example.com.", true},
+		{"WWW.Shop.Example.com.", true},
+		{"example.com.", false},
+		{"myshop.example.com.", false},
+		{"lan.", true},
+		{"nas.lan.", true},
+		{"a.b.lan.", true},
+		{"printer.", true},
+		{"printer.example.", false},
+		{"plan.", false},
+		{"gone.example.net.", false},
+		{".", false},
+		{"", false},
+	}
+	for _, tt := range tests {
+		if got := wl.contains(tt.host); got != tt.want {
+			t.Errorf("%q: whitelisted %v, want %v", tt.host, got, tt.want)
+		}
+	}
+	if _, ok := wl.entries["gone.example.net."]; ok {
+		t.Error("expired entry not dropped")
+	}
+}
@@ -0,0 +1,202 @@
+// See LICENSE.txt for licensing information.
+
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	flagWorkers = flag.Int("c", 16, "number of concurrent clients")
+	flagTime    = flag.Duration("d", 10*time.Second, "how long to run")
+	flagCount   = flag.Int("n", 0, "stop after this many queries (0 - no limit)")
+	flagTimeout = flag.Duration("t", 2*time.Second, "query timeout")
+	flagNames   = flag.String("names", "", "file with the names to ask about, one per line (default: made up ones)")
+)
+
+// result is what a client found out.
+type result struct {
+	latencies []time.Duration
+	timeouts  int
+	errors    int
+	rcodes    map[int]int
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [options] address\n\n"+
+			"address - DNS server to load, e.g. 127.0.0.1:53\n\n",
+			os.Args[0])
+		flag.PrintDefaults()
+		return
+	}
+	flag.Parse()
+	if len(flag.Args()) != 1 || *flagWorkers < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+	addr, err := net.ResolveUDPAddr("udp", flag.Arg(0))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		os.Exit(1)
+	}
+	names, err := loadNames(*flagNames)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		os.Exit(1)
+	}
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		total   result
+		counter int
+	)
+	total.rcodes = make(map[int]int)
+	// take reserves a query, unless -n of them were sent.
+	take := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		if *flagCount > 0 && counter >= *flagCount {
+			return false
+		}
+		counter++
+		return true
+	}
+	start := time.Now()
+	stop := start.Add(*flagTime)
+	for i := 0; i < *flagWorkers; i++ {
+		wg.Add(1)
+		go func(seed int64) {
+			defer wg.Done()
+			res := run(addr, names, rand.New(rand.NewSource(seed)), stop, take)
+			mu.Lock()
+			total.latencies = append(total.latencies, res.latencies...)
+			total.timeouts += res.timeouts
+			total.errors += res.errors
+			for rcode, n := range res.rcodes {
+				total.rcodes[rcode] += n
+			}
+			mu.Unlock()
+		}(int64(i))
+	}
+	wg.Wait()
+	report(&total, time.Since(start))
+}
+
+// run sends queries one after the other until stop, or take says no more.
+func run(addr *net.UDPAddr, names []string, rnd *rand.Rand, stop time.Time, take func() bool) *result {
+	res := &result{rcodes: make(map[int]int)}
+	conn, err := net.DialUDP("udp", nil, addr)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %s\n", err)
+		res.errors++
+		return res
+	}
+	defer conn.Close()
+	buf := make([]byte, 4096)
+	for time.Now().Before(stop) && take() {
+		id := uint16(rnd.Intn(1 << 16))
+		msg := query(id, names[rnd.Intn(len(names))])
+		sent := time.Now()
+		if _, err := conn.Write(msg); err != nil {
+			res.errors++
+			continue
+		}
+		conn.SetReadDeadline(sent.Add(*flagTimeout))
+		for {
+			n, err := conn.Read(buf)
+			if err != nil {
+				if ne, ok := err.(net.Error); ok && ne.Timeout() {
+					res.timeouts++
+				} else {
+					res.errors++
+				}
+				break
+			}
+			if n < 12 || binary.BigEndian.Uint16(buf) != id {
+				continue // a late answer to an earlier query
+			}
+			res.latencies = append(res.latencies, time.Since(sent))
+			res.rcodes[int(buf[3]&0x0f)]++
+			break
+		}
+	}
+	return res
+}
+
+// report prints the rate and the latency percentiles.
+func report(res *result, took time.Duration) {
+	lat := res.latencies
+	sort.Slice(lat, func(i, j int) bool { return lat[i] < lat[j] })
+	fmt.Printf("%d answered, %d timed out, %d errors in %s\n", len(lat), res.timeouts, res.errors, took.Round(time.Millisecond))
+	fmt.Printf("%.0f queries per second\n", float64(len(lat))/took.Seconds())
+	if len(lat) == 0 {
+		return
+	}
+	pct := func(p float64) time.Duration {
+		return lat[int(p/100*float64(len(lat)-1))]
+	}
+	fmt.Printf("latency p50 %s, p90 %s, p99 %s, p99.9 %s, max %s\n",
+		pct(50), pct(90), pct(99), pct(99.9), lat[len(lat)-1])
+	var rcodes []string
+	for rcode, n := range res.rcodes {
+		rcodes = append(rcodes, fmt.Sprintf("%d: %d", rcode, n))
+	}
+	sort.Strings(rcodes)
+	fmt.Printf("rcodes %s\n", strings.Join(rcodes, ", "))
+}
+
+// loadNames reads the names from path, or makes up some if it's empty: a
+// few popular sites and random ones, so that caches don't answer them all.
+func loadNames(path string) ([]string, error) {
+	if path == "" {
+		names := []string{"example.com", "www.google.com", "doubleclick.net", "ads.example.com"}
+		for i := 0; i < 1000; i++ {
+			names = append(names, fmt.Sprintf("host%d.example.org", i))
+		}
+		return names, nil
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var names []string
+	scn := bufio.NewScanner(file)
+	for scn.Scan() {
+		if name := strings.TrimSpace(scn.Text()); name != "" && !strings.HasPrefix(name, "#") {
+			names = append(names, name)
+		}
+	}
+	if err := scn.Err(); err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no names in %s", path)
+	}
+	return names, nil
+}
+
+// query returns an A query for name with the given id.
+func query(id uint16, name string) []byte {
+	msg := []byte{0, 0, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0}
+	binary.BigEndian.PutUint16(msg, id)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if label != "" && len(label) < 64 {
+			msg = append(msg, byte(len(label)))
+			msg = append(msg, label...)
+		}
+	}
+	return append(msg, 0, 0, 1, 0, 1)
+}
@@ -4,10 +4,13 @@ package main
 
 import (
 	"bufio"
+	"compress/gzip"
 	"flag"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
 )
 
@@ -36,7 +39,19 @@ func (s *Source) Process() {
 		return
 	}
 	defer resp.Body.Close()
-	scanner := bufio.NewScanner(resp.Body)
+	var body io.Reader = resp.Body
+	// Go undoes a gzip Content-Encoding by itself, but not for compressed
+	// files served as they are.
+	if strings.HasSuffix(s.URL, ".gz") || resp.Header.Get("Content-Encoding") == "gzip" {
+		zr, err := gzip.NewReader(resp.Body)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error: (%s) %s\n", s.Name, err)
+			return
+		}
+		defer zr.Close()
+		body = zr
+	}
+	scanner := bufio.NewScanner(body)
 	for scanner.Scan() {
 		domain := s.Extractor(scanner.Text())
 		if domain != nil {